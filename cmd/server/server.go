@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/cors"
+	"github.com/carlosroman/payments-api/internal/app/idempotency"
+	"github.com/carlosroman/payments-api/internal/app/migration"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
 	"github.com/carlosroman/payments-api/internal/app/payment"
-	"github.com/gorilla/handlers"
+	"github.com/carlosroman/payments-api/internal/app/ratelimit"
+	"github.com/carlosroman/payments-api/internal/app/webhook"
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 )
 
@@ -33,7 +46,7 @@ func main() {
 		{Name: "run",
 			Aliases: []string{"r"},
 			Usage:   "run server",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.IntFlag{
 					Name:   "port, p",
 					Value:  8080,
@@ -41,43 +54,159 @@ func main() {
 					EnvVar: "SERVER_PORT",
 				},
 				cli.StringFlag{
-					Name:   "db-user",
-					Usage:  "Database username",
-					EnvVar: "DB_USER",
+					Name:   "store",
+					Value:  "postgres",
+					Usage:  "Where payments are kept, one of postgres, file or memory",
+					EnvVar: "STORE",
 				},
 				cli.StringFlag{
-					Name:   "db-password",
-					Usage:  "Database password",
-					EnvVar: "DB_PASSWORD",
+					Name:   "data-dir",
+					Value:  "data",
+					Usage:  "The directory the file store keeps its log and snapshot in",
+					EnvVar: "DATA_DIR",
+				},
+				cli.IntFlag{
+					Name:   "snapshot-every",
+					Value:  1000,
+					Usage:  "The number of changes the file store logs before taking a snapshot",
+					EnvVar: "SNAPSHOT_EVERY",
+				},
+				cli.DurationFlag{
+					Name:   "idempotency-ttl",
+					Value:  24 * time.Hour,
+					Usage:  "How long the response to a request with an Idempotency-Key is kept for retries",
+					EnvVar: "IDEMPOTENCY_TTL",
+				},
+				cli.BoolFlag{
+					Name:   "migrate-on-start",
+					Usage:  "Apply any pending database migrations before starting, postgres store only",
+					EnvVar: "MIGRATE_ON_START",
 				},
 				cli.StringFlag{
-					Name:   "db-name",
-					Usage:  "Database name",
-					EnvVar: "DB_NAME",
+					Name:   "outbox-webhook",
+					Usage:  "A URL every payment event is posted to",
+					EnvVar: "OUTBOX_WEBHOOK",
 				},
 				cli.StringFlag{
-					Name:   "db-host",
-					Value:  "localhost",
-					Usage:  "Database host",
-					EnvVar: "DB_HOST",
+					Name:   "outbox-file",
+					Usage:  "A file every payment event is appended to as a line of JSON",
+					EnvVar: "OUTBOX_FILE",
+				},
+				cli.DurationFlag{
+					Name:   "outbox-interval",
+					Value:  time.Second,
+					Usage:  "How often new payment events are looked for",
+					EnvVar: "OUTBOX_INTERVAL",
 				},
 				cli.IntFlag{
-					Name:   "db-port",
-					Value:  5432,
-					Usage:  "The database port",
-					EnvVar: "DB_PORT",
+					Name:   "webhook-disable-after",
+					Value:  20,
+					Usage:  "The number of failed attempts in a row after which a webhook subscription is disabled",
+					EnvVar: "WEBHOOK_DISABLE_AFTER",
 				},
-			},
+				cli.BoolFlag{
+					Name:   "webhook-allow-internal",
+					Usage:  "Let webhook subscriptions point at loopback, private and link-local addresses, only for trying webhooks out locally",
+					EnvVar: "WEBHOOK_ALLOW_INTERNAL",
+				},
+				cli.StringFlag{
+					Name:   "auth",
+					Value:  "apikey",
+					Usage:  "How callers are authenticated, apikey, jwt or both separated by a comma, or none",
+					EnvVar: "AUTH",
+				},
+				apiKeysFileFlag,
+				cli.StringFlag{
+					Name:   "jwt-secret",
+					Usage:  "The shared secret HS256 tokens are signed with",
+					EnvVar: "JWT_SECRET",
+				},
+				cli.StringFlag{
+					Name:   "jwt-jwks-file",
+					Usage:  "A JSON Web Key Set file with the keys RS256 and ES256 tokens are signed with",
+					EnvVar: "JWT_JWKS_FILE",
+				},
+				cli.StringFlag{
+					Name:   "jwt-audience",
+					Usage:  "The audience tokens have to be meant for",
+					EnvVar: "JWT_AUDIENCE",
+				},
+				cli.StringFlag{
+					Name:   "approval-thresholds",
+					Usage:  "A JSON file with the amounts by organisation and currency above which payments have to be approved",
+					EnvVar: "APPROVAL_THRESHOLDS",
+				},
+				cli.BoolFlag{
+					Name:   "unauthenticated-approvals",
+					Usage:  "Let payments be approved by the X-Actor of requests that are not authenticated, only for trying approvals out with --auth=none",
+					EnvVar: "UNAUTHENTICATED_APPROVALS",
+				},
+				cli.StringFlag{
+					Name:   "rate-limits",
+					Usage:  "A JSON file with the rate limits of reads and writes, reloaded on SIGHUP",
+					EnvVar: "RATE_LIMITS",
+				},
+				cli.StringFlag{
+					Name:   "mode",
+					Value:  "production",
+					Usage:  "production or development, in development any origin can make cross-origin requests unless told otherwise",
+					EnvVar: "MODE",
+				},
+				cli.StringFlag{
+					Name:   "cors-file",
+					Usage:  "A JSON file with the CORS policy, the cors flags override it",
+					EnvVar: "CORS_FILE",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-origins",
+					Usage:  "An origin allowed to make cross-origin requests, * for any or https://*.example.com for its subdomains",
+					EnvVar: "CORS_ALLOWED_ORIGINS",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-methods",
+					Usage:  "A method cross-origin requests may use",
+					EnvVar: "CORS_ALLOWED_METHODS",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-allowed-headers",
+					Usage:  "A header cross-origin requests may send",
+					EnvVar: "CORS_ALLOWED_HEADERS",
+				},
+				cli.StringSliceFlag{
+					Name:   "cors-exposed-headers",
+					Usage:  "A response header cross-origin requests may read",
+					EnvVar: "CORS_EXPOSED_HEADERS",
+				},
+				cli.BoolFlag{
+					Name:   "cors-allow-credentials",
+					Usage:  "Let cross-origin requests send cookies and authorization",
+					EnvVar: "CORS_ALLOW_CREDENTIALS",
+				},
+				cli.DurationFlag{
+					Name:   "cors-max-age",
+					Usage:  "How long browsers may keep the answer to a preflight, up to 10m",
+					EnvVar: "CORS_MAX_AGE",
+				},
+			}, dbFlags...),
 			Action: func(c *cli.Context) error {
-				db, err := initDb(
-					c.String("db-host"),
-					c.Int("db-port"),
-					c.String("db-user"),
-					c.String("db-password"),
-					c.String("db-name"))
+				stores, err := openStores(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				go purgeEvery(stores.keys, time.Minute)
+
+				sinks, err := openSinks(c)
 				if err != nil {
 					return cli.NewExitError(err, 1)
 				}
+				targets := webhook.Targets{AllowInternal: c.Bool("webhook-allow-internal")}
+				if targets.AllowInternal {
+					log.Warn("Webhook subscriptions can point at internal addresses")
+				}
+				dispatcher := webhook.NewDispatcher(stores.webhooks, targets.Client(10*time.Second), c.Int("webhook-disable-after"))
+				sinks = append(sinks, dispatcher)
+				go outbox.NewRelay(stores.events, sinks, c.Duration("outbox-interval")).Run(context.Background())
+				go dispatcher.Run(context.Background(), c.Duration("outbox-interval"))
 
 				dir, err := os.Getwd()
 				if err != nil {
@@ -85,21 +214,69 @@ func main() {
 				}
 				log.Infof("current dir: %s", dir)
 
-				s := payment.NewService(db)
-				h := payment.GetHandlers(s)
+				opts := []payment.HandlerOption{
+					payment.WithIdempotency(stores.keys, c.Duration("idempotency-ttl")),
+					payment.WithStreamInterval(c.Duration("outbox-interval")),
+				}
+				var limiter *ratelimit.Limiter
+				if name := c.String("rate-limits"); name != "" {
+					config, err := ratelimit.ReadConfig(name)
+					if err != nil {
+						return cli.NewExitError(err, 1)
+					}
+					limiter = ratelimit.NewLimiter(config)
+					go reloadOnHangup(limiter, name)
+					go purgeLimiterEvery(limiter, time.Minute)
+				}
+				authenticator, err := openAuthenticator(c, stores.apiKeys)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+				if authenticator == nil {
+					log.Warn("Authentication is off, anyone can act for any organisation")
+				} else {
+					authenticate := auth.Middleware(authenticator)
+					if limiter != nil {
+						authenticate = ratelimit.FailedAuthentication(limiter, authenticate)
+					}
+					opts = append(opts, payment.WithAuthentication(authenticate))
+				}
+
+				var serviceOpts []payment.ServiceOption
+				if name := c.String("approval-thresholds"); name != "" {
+					thresholds, err := payment.ReadThresholds(name)
+					if err != nil {
+						return cli.NewExitError(err, 1)
+					}
+					serviceOpts = append(serviceOpts, payment.WithApprovalThresholds(thresholds))
+				}
+				if c.Bool("unauthenticated-approvals") {
+					log.Warn("Payments can be approved by whoever X-Actor names when authentication is off")
+					serviceOpts = append(serviceOpts, payment.WithUnauthenticatedApprovals())
+				}
+
+				s := payment.NewAuthorizedService(payment.NewService(stores.payments, serviceOpts...))
+				if limiter != nil {
+					opts = append(opts, payment.WithRateLimit(ratelimit.Middleware(limiter, payment.Owner(s))))
+				}
+				h := payment.GetHandlers(s, opts...)
+				webhook.AddHandlers(h, stores.webhooks, targets, payment.EventCreated, payment.EventUpdated, payment.EventStatusChanged)
 
-				h.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+				h.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static")))).
+					Name(payment.PublicRoute)
+				policy, err := openCORS(c)
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
 				addr := fmt.Sprintf("0.0.0.0:%v", c.Int("port"))
-				headersOk := handlers.AllowedHeaders([]string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"})
-				originsOk := handlers.AllowedOrigins([]string{"*"})
-				methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
 				srv := &http.Server{
 					Addr: addr,
 					// Good practice to set timeouts to avoid Slowloris attacks.
-					WriteTimeout: time.Second * 15,
-					ReadTimeout:  time.Second * 15,
-					IdleTimeout:  time.Second * 60,
-					Handler:      handlers.CORS(headersOk, originsOk, methodsOk)(h), // Pass our instance of gorilla/mux in.
+					// There is no write timeout so the payment stream can stay
+					// open, every other route times out on its own instead.
+					ReadTimeout: time.Second * 15,
+					IdleTimeout: time.Second * 60,
+					Handler:     cors.Middleware(policy)(withTimeout(h, time.Second*15)), // Pass our instance of gorilla/mux in.
 				}
 
 				log.Infof("Starting server at %s", addr)
@@ -109,6 +286,145 @@ func main() {
 				return nil
 			},
 		},
+		{Name: "migrate",
+			Aliases: []string{"m"},
+			Usage:   "migrate the database schema",
+			Subcommands: []cli.Command{
+				{Name: "up",
+					Usage:  "apply every pending migration",
+					Flags:  dbFlags,
+					Action: migrate(func(ctx context.Context, m *migration.Migrator, c *cli.Context) error { return m.Up(ctx) }),
+				},
+				{Name: "down",
+					Usage:  "undo the last migration applied",
+					Flags:  dbFlags,
+					Action: migrate(func(ctx context.Context, m *migration.Migrator, c *cli.Context) error { return m.Down(ctx) }),
+				},
+				{Name: "to",
+					Usage:     "apply or undo migrations until the schema is at the version",
+					ArgsUsage: "<version>",
+					Flags:     dbFlags,
+					Action: migrate(func(ctx context.Context, m *migration.Migrator, c *cli.Context) error {
+						version, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							return fmt.Errorf("version must be a number, got '%s'", c.Args().First())
+						}
+						return m.To(ctx, version)
+					}),
+				},
+				{Name: "status",
+					Usage: "list the migrations and when they were applied",
+					Flags: dbFlags,
+					Action: migrate(func(ctx context.Context, m *migration.Migrator, c *cli.Context) error {
+						statuses, err := m.Status(ctx)
+						if err != nil {
+							return err
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						fmt.Fprintln(w, "VERSION\tAPPLIED\tNAME")
+						for _, s := range statuses {
+							applied := "pending"
+							if s.AppliedAt != nil {
+								applied = s.AppliedAt.Format(time.RFC3339)
+							}
+							fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, applied, s.Name)
+						}
+						return w.Flush()
+					}),
+				},
+			},
+		},
+		{Name: "apikey",
+			Aliases: []string{"k"},
+			Usage:   "manage the API keys callers authenticate with",
+			Subcommands: []cli.Command{
+				{Name: "create",
+					Usage: "create a key for organisations, it is only ever shown once",
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "name",
+							Usage: "What the key is for",
+						},
+						cli.StringSliceFlag{
+							Name:  "organisation-id",
+							Usage: "An organisation the key acts for, repeat for more than one",
+						},
+						cli.StringSliceFlag{
+							Name:  "role",
+							Usage: "A role the key has, one of viewer, submitter, approver or admin, repeat for more than one",
+						},
+					}, keyFlags...),
+					Action: withKeys(func(ctx context.Context, store auth.Store, c *cli.Context) error {
+						organisationIds := c.StringSlice("organisation-id")
+						if len(organisationIds) == 0 {
+							return fmt.Errorf("a key must act for at least one organisation, set --organisation-id")
+						}
+						var roles []auth.Role
+						for _, r := range c.StringSlice("role") {
+							if !auth.Role(r).Known() {
+								return fmt.Errorf("unknown role '%s', must be viewer, submitter, approver or admin", r)
+							}
+							roles = append(roles, auth.Role(r))
+						}
+						if len(roles) == 0 {
+							return fmt.Errorf("a key must have at least one role, set --role")
+						}
+						key, secret, err := auth.NewKey(c.String("name"), organisationIds, roles, time.Now().UTC())
+						if err != nil {
+							return err
+						}
+						if err = store.Create(ctx, key); err != nil {
+							return err
+						}
+						fmt.Printf("Created key %s, keep it somewhere safe as it cannot be shown again:\n%s\n", key.Id, secret)
+						return nil
+					}),
+				},
+				{Name: "list",
+					Usage: "list the keys without their secrets",
+					Flags: keyFlags,
+					Action: withKeys(func(ctx context.Context, store auth.Store, c *cli.Context) error {
+						keys, err := store.List(ctx)
+						if err != nil {
+							return err
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						fmt.Fprintln(w, "ID\tPREFIX\tNAME\tORGANISATIONS\tROLES\tCREATED\tREVOKED")
+						for _, k := range keys {
+							revoked := "-"
+							if k.RevokedAt != nil {
+								revoked = k.RevokedAt.Format(time.RFC3339)
+							}
+							roles := make([]string, len(k.Roles))
+							for i, r := range k.Roles {
+								roles[i] = string(r)
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+								k.Id, k.Prefix, k.Name, strings.Join(k.OrganisationIds, ","), strings.Join(roles, ","), k.CreatedAt.Format(time.RFC3339), revoked)
+						}
+						return w.Flush()
+					}),
+				},
+				{Name: "revoke",
+					Usage:     "stop a key from being used",
+					ArgsUsage: "<id>",
+					Flags:     keyFlags,
+					Action: withKeys(func(ctx context.Context, store auth.Store, c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							return fmt.Errorf("the id of the key to revoke is required")
+						}
+						if err := store.Revoke(ctx, id, time.Now().UTC()); err == auth.ErrNotFound {
+							return fmt.Errorf("no key with id '%s'", id)
+						} else if err != nil {
+							return err
+						}
+						fmt.Printf("Revoked key %s\n", id)
+						return nil
+					}),
+				},
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -117,6 +433,333 @@ func main() {
 	}
 }
 
+var dbFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "db-user",
+		Usage:  "Database username",
+		EnvVar: "DB_USER",
+	},
+	cli.StringFlag{
+		Name:   "db-password",
+		Usage:  "Database password",
+		EnvVar: "DB_PASSWORD",
+	},
+	cli.StringFlag{
+		Name:   "db-name",
+		Usage:  "Database name",
+		EnvVar: "DB_NAME",
+	},
+	cli.StringFlag{
+		Name:   "db-host",
+		Value:  "localhost",
+		Usage:  "Database host",
+		EnvVar: "DB_HOST",
+	},
+	cli.IntFlag{
+		Name:   "db-port",
+		Value:  5432,
+		Usage:  "The database port",
+		EnvVar: "DB_PORT",
+	},
+}
+
+var apiKeysFileFlag = cli.StringFlag{
+	Name:   "api-keys-file",
+	Value:  "api-keys.json",
+	Usage:  "The file API keys are kept in when the store is not postgres",
+	EnvVar: "API_KEYS_FILE",
+}
+
+// keyFlags are what the commands managing API keys need to find them, the
+// same as the server they are for.
+var keyFlags = append([]cli.Flag{
+	cli.StringFlag{
+		Name:   "store",
+		Value:  "postgres",
+		Usage:  "Where the server keeps payments, the keys are in the database for postgres and the keys file otherwise",
+		EnvVar: "STORE",
+	},
+	apiKeysFileFlag,
+}, dbFlags...)
+
+func openDb(c *cli.Context) (*sql.DB, error) {
+	return initDb(
+		c.String("db-host"),
+		c.Int("db-port"),
+		c.String("db-user"),
+		c.String("db-password"),
+		c.String("db-name"))
+}
+
+type stores struct {
+	payments payment.Repository
+	keys     idempotency.Store
+	events   outbox.Store
+	webhooks webhook.Store
+	apiKeys  auth.Store
+}
+
+// openStores opens the store chosen by the store flag with the idempotency
+// keys, payment events and webhooks to go with it. Only the postgres store
+// needs a database and keeps everything there, the file store keeps payments
+// and events in the data directory and the memory store loses everything when
+// the server stops. The file store keeps the idempotency keys and webhooks in
+// the data directory too, the memory store in memory. Both of them keep the
+// API keys in the keys file.
+func openStores(c *cli.Context) (s stores, err error) {
+	switch c.String("store") {
+	case "memory":
+		log.Warn("Using the memory store, payments will be lost when the server stops")
+		s = inMemory(payment.NewMemoryRepository())
+		s.apiKeys = auth.NewFileStore(c.String("api-keys-file"))
+		return s, nil
+	case "file":
+		repo, err := payment.NewFileRepository(c.String("data-dir"), c.Int("snapshot-every"))
+		if err != nil {
+			return s, err
+		}
+		s = inMemory(repo)
+		if s.keys, err = idempotency.NewFileStore(filepath.Join(c.String("data-dir"), "idempotency.log")); err != nil {
+			return s, err
+		}
+		if s.webhooks, err = webhook.NewFileStore(filepath.Join(c.String("data-dir"), "webhooks.log")); err != nil {
+			return s, err
+		}
+		s.apiKeys = auth.NewFileStore(c.String("api-keys-file"))
+		return s, nil
+	case "postgres":
+		db, err := openDb(c)
+		if err != nil {
+			return s, err
+		}
+		if c.Bool("migrate-on-start") {
+			if err = migration.New(db).Up(context.Background()); err != nil {
+				return s, err
+			}
+		}
+		return stores{
+			payments: payment.NewPostgresRepository(db),
+			keys:     idempotency.NewPostgresStore(db),
+			events:   outbox.NewPostgresStore(db),
+			webhooks: webhook.NewPostgresStore(db),
+			apiKeys:  auth.NewPostgresStore(db),
+		}, nil
+	default:
+		return s, fmt.Errorf("unknown store '%s', must be postgres, file or memory", c.String("store"))
+	}
+}
+
+// openAuthenticator makes what callers are authenticated with from the auth
+// flag, there is none when it is off.
+func openAuthenticator(c *cli.Context, keys auth.Store) (auth.Authenticator, error) {
+	if c.String("auth") == "none" {
+		return nil, nil
+	}
+	var authenticators []auth.Authenticator
+	modes := strings.Split(c.String("auth"), ",")
+	for _, mode := range modes {
+		switch strings.TrimSpace(mode) {
+		case "apikey":
+			// With nothing else to authenticate with every request would be
+			// refused.
+			if len(modes) == 1 {
+				usable, err := hasUsableKey(keys)
+				if err != nil {
+					return nil, err
+				}
+				if !usable {
+					return nil, fmt.Errorf("apikey auth has no keys, create one with 'apikey create' or run with --auth=none")
+				}
+			}
+			authenticators = append(authenticators, auth.NewKeyAuthenticator(keys))
+		case "jwt":
+			config := auth.JWTConfig{Secret: []byte(c.String("jwt-secret")), Audience: c.String("jwt-audience")}
+			if name := c.String("jwt-jwks-file"); name != "" {
+				var err error
+				if config.Keys, err = auth.ReadJWKS(name); err != nil {
+					return nil, err
+				}
+			}
+			if len(config.Secret) == 0 && len(config.Keys) == 0 {
+				return nil, fmt.Errorf("jwt auth needs --jwt-secret or --jwt-jwks-file")
+			}
+			if config.Audience == "" {
+				return nil, fmt.Errorf("jwt auth needs --jwt-audience")
+			}
+			authenticators = append(authenticators, auth.NewJWTAuthenticator(config))
+		default:
+			return nil, fmt.Errorf("unknown auth '%s', must be apikey, jwt or none", mode)
+		}
+	}
+	return auth.AnyOf(authenticators...), nil
+}
+
+func hasUsableKey(keys auth.Store) (bool, error) {
+	list, err := keys.List(context.Background())
+	if err != nil {
+		return false, err
+	}
+	for _, key := range list {
+		if key.RevokedAt == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// openSinks opens where payment events are published to, with none of them
+// set the events are dropped once written.
+func openSinks(c *cli.Context) (sinks []outbox.Sink, err error) {
+	if url := c.String("outbox-webhook"); url != "" {
+		sinks = append(sinks, outbox.NewWebhookSink(url, &http.Client{Timeout: 10 * time.Second}))
+	}
+	if name := c.String("outbox-file"); name != "" {
+		f, err := outbox.NewFileSink(name)
+		if err != nil {
+			return sinks, err
+		}
+		sinks = append(sinks, f)
+	}
+	return sinks, nil
+}
+
+// inMemory goes with a store that keeps its own events, the keys and webhooks
+// are kept in memory.
+func inMemory(repo payment.Repository) stores {
+	return stores{
+		payments: repo,
+		keys:     idempotency.NewMemoryStore(),
+		events:   repo.(outbox.Store),
+		webhooks: webhook.NewMemoryStore(),
+	}
+}
+
+// withTimeout gives every request but those streaming payments the timeout to
+// respond in, a request that takes longer is sent 503 Service Unavailable.
+func withTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	timed := http.TimeoutHandler(h, timeout, "request timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == payment.StreamPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
+
+// purgeEvery drops expired idempotency keys for as long as the server runs.
+func purgeEvery(keys idempotency.Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := keys.Purge(context.Background(), time.Now().UTC()); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// openCORS is the CORS policy of the mode, overridden by the file and then by
+// each cors flag that is set.
+func openCORS(c *cli.Context) (policy cors.Config, err error) {
+	switch c.String("mode") {
+	case "production":
+		policy = cors.Production()
+	case "development":
+		policy = cors.Development()
+	default:
+		return policy, fmt.Errorf("unknown mode '%s', it must be production or development", c.String("mode"))
+	}
+	if name := c.String("cors-file"); name != "" {
+		if policy, err = cors.ReadConfig(name, policy); err != nil {
+			return policy, err
+		}
+	}
+	if c.IsSet("cors-allowed-origins") {
+		policy.AllowedOrigins = c.StringSlice("cors-allowed-origins")
+	}
+	if c.IsSet("cors-allowed-methods") {
+		policy.AllowedMethods = c.StringSlice("cors-allowed-methods")
+	}
+	if c.IsSet("cors-allowed-headers") {
+		policy.AllowedHeaders = c.StringSlice("cors-allowed-headers")
+	}
+	if c.IsSet("cors-exposed-headers") {
+		policy.ExposedHeaders = c.StringSlice("cors-exposed-headers")
+	}
+	if c.IsSet("cors-allow-credentials") {
+		policy.AllowCredentials = c.Bool("cors-allow-credentials")
+	}
+	if c.IsSet("cors-max-age") {
+		policy.MaxAge = cors.Duration(c.Duration("cors-max-age"))
+	}
+	if err = policy.Validate(); err != nil {
+		return policy, err
+	}
+	if len(policy.AllowedOrigins) == 0 {
+		log.Info("No origin can make cross-origin requests")
+	} else {
+		log.Infof("Origins that can make cross-origin requests: %s", strings.Join(policy.AllowedOrigins, ", "))
+	}
+	return policy, nil
+}
+
+// reloadOnHangup reads the rate limits again every time the server gets a
+// SIGHUP, limits that cannot be read leave the ones in use alone.
+func reloadOnHangup(limiter *ratelimit.Limiter, name string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		config, err := ratelimit.ReadConfig(name)
+		if err != nil {
+			log.Errorf("Keeping the rate limits in use: %v", err)
+			continue
+		}
+		limiter.Reload(config)
+		log.Infof("Reloaded the rate limits from %s", name)
+	}
+}
+
+func purgeLimiterEvery(limiter *ratelimit.Limiter, interval time.Duration) {
+	for range time.Tick(interval) {
+		limiter.Purge(time.Now())
+	}
+}
+
+// migrate turns a migration step into a command action.
+func migrate(step func(ctx context.Context, m *migration.Migrator, c *cli.Context) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		db, err := openDb(c)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		defer db.Close()
+
+		if err = step(context.Background(), migration.New(db), c); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		return nil
+	}
+}
+
+// withKeys turns something done to the API keys into a command action, the
+// keys are found the same way the server finds them.
+func withKeys(do func(ctx context.Context, store auth.Store, c *cli.Context) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		store := auth.NewFileStore(c.String("api-keys-file"))
+		if c.String("store") == "postgres" {
+			db, err := openDb(c)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			defer db.Close()
+			store = auth.NewPostgresStore(db)
+		}
+
+		if err := do(context.Background(), store, c); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		return nil
+	}
+}
+
 //func corsHandler(h http.Handler) http.Handler {
 //	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 //		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NewFileStore keeps keys as JSON in the file, for servers without a
+// database. The file is read again whenever it has changed so keys created or
+// revoked by the CLI are seen by a running server.
+func NewFileStore(name string) Store {
+	return &fileStore{name: name}
+}
+
+type fileStore struct {
+	mu   sync.Mutex
+	name string
+	keys []Key
+	// modTime and size are of the file when it was last read.
+	modTime time.Time
+	size    int64
+}
+
+// load reads the file when it has changed since it was last read, there are
+// no keys until it is written. The lock must be held.
+func (s *fileStore) load() error {
+	info, err := os.Stat(s.name)
+	if os.IsNotExist(err) {
+		s.keys = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size && s.keys != nil {
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(s.name)
+	if err != nil {
+		return err
+	}
+	keys := make([]Key, 0)
+	if err = json.Unmarshal(bs, &keys); err != nil {
+		return err
+	}
+	for i := range keys {
+		// Keys made before there were roles could do everything.
+		if keys[i].Roles == nil {
+			keys[i].Roles = []Role{RoleAdmin}
+		}
+	}
+	s.keys, s.modTime, s.size = keys, info.ModTime(), info.Size()
+	return nil
+}
+
+// save writes the keys to a new file renamed into place, so a crash leaves
+// the old keys or the new. The lock must be held.
+func (s *fileStore) save(keys []Key) error {
+	bs, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.name + ".tmp"
+	if err = ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.name); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.keys = nil
+	return s.load()
+}
+
+func (s *fileStore) Create(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.save(append(append([]Key(nil), s.keys...), key))
+}
+
+func (s *fileStore) Find(ctx context.Context, hash string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return Key{}, err
+	}
+	for _, k := range s.keys {
+		if k.Hash == hash {
+			return k, nil
+		}
+	}
+	return Key{}, ErrNotFound
+}
+
+func (s *fileStore) List(ctx context.Context) ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return append(make([]Key, 0, len(s.keys)), s.keys...), nil
+}
+
+func (s *fileStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	keys := append([]Key(nil), s.keys...)
+	for i, k := range keys {
+		if k.Id != id {
+			continue
+		}
+		if k.RevokedAt != nil {
+			return nil
+		}
+		keys[i].RevokedAt = &at
+		return s.save(keys)
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,44 @@
+package auth
+
+import "context"
+
+// Identity is who made a request, the organisations they act for and the
+// roles they have.
+type Identity struct {
+	// Subject is who made the request, it is the actor of the changes they
+	// make.
+	Subject         string
+	OrganisationIds []string
+	Roles           []Role
+}
+
+// ActsFor is true when the identity may see and change the payments of the
+// organisation.
+func (id Identity) ActsFor(organisationId string) bool {
+	for _, o := range id.OrganisationIds {
+		if o == organisationId {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns who made the request, ok is false when it was not
+// authenticated.
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+// Allowed is true when the request may act for the organisation. Requests are
+// only left unauthenticated when authentication is off, they may act for any.
+func Allowed(ctx context.Context, organisationId string) bool {
+	id, ok := FromContext(ctx)
+	return !ok || id.ActsFor(organisationId)
+}
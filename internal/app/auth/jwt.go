@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far out the clock of whoever issued a token may be.
+const clockSkew = 30 * time.Second
+
+// JWTConfig is what bearer tokens are checked against.
+type JWTConfig struct {
+	// Secret checks HS256 tokens, they are refused without one.
+	Secret []byte
+	// Keys check RS256 and ES256 tokens, they are refused without any.
+	Keys KeySet
+	// Audience has to be one of the audiences of every token.
+	Audience string
+}
+
+// KeySet is the public keys of a JSON Web Key Set by their kid.
+type KeySet map[string]crypto.PublicKey
+
+// ReadJWKS reads the RSA and P-256 keys of the JSON Web Key Set in the file,
+// keys only meant for encryption are left out.
+func ReadJWKS(name string) (KeySet, error) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err = json.Unmarshal(bs, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(KeySet, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("auth: key '%s' has a bad n, %s", k.Kid, err)
+			}
+			e, err := decodeInt(k.E)
+			if err != nil || !e.IsInt64() || e.Int64() < 3 {
+				return nil, fmt.Errorf("auth: key '%s' has a bad e", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("auth: key '%s' is on curve '%s', only P-256 is supported", k.Kid, k.Crv)
+			}
+			x, errX := decodeInt(k.X)
+			y, errY := decodeInt(k.Y)
+			if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("auth: key '%s' is not a point on P-256", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(bs), nil
+}
+
+// NewJWTAuthenticator takes the bearer token of a request to be a JWT, the
+// request is made by its subject for the organisations of its org_ids claim
+// with the roles of its roles claim when it is signed by one of the keys, has
+// not expired and is meant for the audience.
+func NewJWTAuthenticator(config JWTConfig) Authenticator {
+	return &jwtAuthenticator{config: config, now: time.Now}
+}
+
+type jwtAuthenticator struct {
+	config JWTConfig
+	now    func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	// OrganisationIds are the organisations the subject acts for.
+	OrganisationIds []string `json:"org_ids"`
+	Roles           []Role   `json:"roles"`
+}
+
+// audience is a single audience or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(bs []byte) error {
+	var one string
+	if err := json.Unmarshal(bs, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(bs, &many); err != nil {
+		return errors.New("aud must be a string or a list of them")
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) has(want string) bool {
+	for _, aud := range a {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	id, err := a.verify(bearer(r))
+	if err != nil {
+		log.Debugf("Refused bearer token: %s", err)
+		return Identity{}, ErrUnauthenticated
+	}
+	return id, nil
+}
+
+func (a *jwtAuthenticator) verify(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("not a JWT")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("bad header, %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("bad signature, %s", err)
+	}
+	if err = a.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return Identity{}, err
+	}
+
+	var claims jwtClaims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("bad claims, %s", err)
+	}
+	now := a.now()
+	switch {
+	case claims.ExpiresAt == nil:
+		return Identity{}, errors.New("no exp")
+	case now.Add(-clockSkew).After(numericDate(*claims.ExpiresAt)):
+		return Identity{}, errors.New("expired")
+	case claims.NotBefore != nil && now.Add(clockSkew).Before(numericDate(*claims.NotBefore)):
+		return Identity{}, errors.New("not valid yet")
+	case !claims.Audience.has(a.config.Audience):
+		return Identity{}, fmt.Errorf("not meant for '%s'", a.config.Audience)
+	case claims.Subject == "":
+		return Identity{}, errors.New("no sub")
+	}
+	return Identity{Subject: claims.Subject, OrganisationIds: claims.OrganisationIds, Roles: claims.Roles}, nil
+}
+
+// verifySignature checks the token was signed with the algorithm it says by
+// a key it is meant to be, the algorithm never picks the key.
+func (a *jwtAuthenticator) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch header.Alg {
+	case "HS256":
+		if len(a.config.Secret) == 0 {
+			return errors.New("HS256 is not accepted without a secret")
+		}
+		mac := hmac.New(sha256.New, a.config.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "RS256":
+		key, ok := a.key(header.Kid).(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no RSA key '%s'", header.Kid)
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "ES256":
+		key, ok := a.key(header.Kid).(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("no EC key '%s'", header.Kid)
+		}
+		if len(sig) != 64 {
+			return errors.New("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("alg '%s' is not accepted", header.Alg)
+	}
+}
+
+// key is the key with the kid, a token without one can only be checked when
+// there is a single key.
+func (a *jwtAuthenticator) key(kid string) crypto.PublicKey {
+	if kid == "" && len(a.config.Keys) == 1 {
+		for _, k := range a.config.Keys {
+			return k
+		}
+	}
+	return a.config.Keys[kid]
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func numericDate(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// AnyOf authenticates a request with the first of the authenticators to know
+// who made it.
+func AnyOf(authenticators ...Authenticator) Authenticator {
+	return anyOf(authenticators)
+}
+
+type anyOf []Authenticator
+
+func (as anyOf) Authenticate(r *http.Request) (Identity, error) {
+	for _, a := range as {
+		id, err := a.Authenticate(r)
+		if err != ErrUnauthenticated {
+			return id, err
+		}
+	}
+	return Identity{}, ErrUnauthenticated
+}
@@ -0,0 +1,214 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("JWT", func() {
+	var (
+		secret  = []byte("a shared secret")
+		rsaKey  *rsa.PrivateKey
+		ecKey   *ecdsa.PrivateKey
+		jwks    auth.KeySet
+		a       auth.Authenticator
+		claims  map[string]interface{}
+		encoded = base64.RawURLEncoding.EncodeToString
+	)
+
+	BeforeEach(func() {
+		var err error
+		if rsaKey == nil {
+			rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ShouldNot(HaveOccurred())
+			ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ShouldNot(HaveOccurred())
+		}
+
+		dir, err := ioutil.TempDir("", "jwks")
+		Expect(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		name := filepath.Join(dir, "jwks.json")
+		Expect(ioutil.WriteFile(name, []byte(`{"keys":[
+			{"kty":"RSA","kid":"rsa-1","use":"sig","n":"`+encoded(rsaKey.N.Bytes())+`","e":"`+encoded(big.NewInt(int64(rsaKey.E)).Bytes())+`"},
+			{"kty":"EC","kid":"ec-1","crv":"P-256","x":"`+encoded(ecKey.X.Bytes())+`","y":"`+encoded(ecKey.Y.Bytes())+`"},
+			{"kty":"RSA","kid":"enc-1","use":"enc","n":"AQAB","e":"AQAB"}
+		]}`), 0600)).To(Succeed())
+		jwks, err = auth.ReadJWKS(name)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		a = auth.NewJWTAuthenticator(auth.JWTConfig{Secret: secret, Keys: jwks, Audience: "payments-api"})
+		claims = map[string]interface{}{
+			"sub":     "alice@example.com",
+			"aud":     "payments-api",
+			"exp":     time.Now().Add(time.Minute).Unix(),
+			"org_ids": []string{"org-1", "org-2"},
+			"roles":   []string{"approver"},
+		}
+	})
+
+	sign := func(alg string, kid string, claims map[string]interface{}) string {
+		header := map[string]string{"alg": alg, "typ": "JWT"}
+		if kid != "" {
+			header["kid"] = kid
+		}
+		h, err := json.Marshal(header)
+		Expect(err).ShouldNot(HaveOccurred())
+		c, err := json.Marshal(claims)
+		Expect(err).ShouldNot(HaveOccurred())
+		signed := encoded(h) + "." + encoded(c)
+		digest := sha256.Sum256([]byte(signed))
+
+		var sig []byte
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(signed))
+			sig = mac.Sum(nil)
+		case "RS256":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+			Expect(err).ShouldNot(HaveOccurred())
+		case "ES256":
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			Expect(err).ShouldNot(HaveOccurred())
+			rb, sb := r.Bytes(), s.Bytes()
+			sig = make([]byte, 64)
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+		}
+		return signed + "." + encoded(sig)
+	}
+
+	authenticate := func(token string) (auth.Identity, error) {
+		req := httptest.NewRequest("GET", "/payment/search", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return a.Authenticate(req)
+	}
+
+	thenAlice := func(token string) {
+		id, err := authenticate(token)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(id).To(Equal(auth.Identity{Subject: "alice@example.com", OrganisationIds: []string{"org-1", "org-2"}, Roles: []auth.Role{auth.RoleApprover}}))
+	}
+
+	thenRefused := func(token string) {
+		_, err := authenticate(token)
+		Expect(err).To(Equal(auth.ErrUnauthenticated))
+	}
+
+	It("should only read the signing keys of the set", func() {
+		Expect(jwks).To(HaveLen(2))
+		Expect(jwks).To(HaveKey("rsa-1"))
+		Expect(jwks).To(HaveKey("ec-1"))
+	})
+
+	It("should accept a token signed with the shared secret", func() {
+		thenAlice(sign("HS256", "", claims))
+	})
+
+	It("should accept tokens signed with a key of the set", func() {
+		thenAlice(sign("RS256", "rsa-1", claims))
+		thenAlice(sign("ES256", "ec-1", claims))
+	})
+
+	It("should accept a token for more than one audience", func() {
+		claims["aud"] = []string{"dashboard", "payments-api"}
+		thenAlice(sign("HS256", "", claims))
+	})
+
+	It("should refuse a token that has expired", func() {
+		claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		thenRefused(sign("HS256", "", claims))
+	})
+
+	It("should refuse a token that never expires", func() {
+		delete(claims, "exp")
+		thenRefused(sign("HS256", "", claims))
+	})
+
+	It("should refuse a token that is not valid yet", func() {
+		claims["nbf"] = time.Now().Add(time.Minute).Unix()
+		thenRefused(sign("HS256", "", claims))
+	})
+
+	It("should refuse a token meant for another audience", func() {
+		claims["aud"] = "dashboard"
+		thenRefused(sign("HS256", "", claims))
+		delete(claims, "aud")
+		thenRefused(sign("HS256", "", claims))
+	})
+
+	It("should refuse a token that has been changed", func() {
+		token := strings.Split(sign("RS256", "rsa-1", claims), ".")
+		claims["org_ids"] = []string{"org-3"}
+		changed := strings.Split(sign("RS256", "rsa-1", claims), ".")
+		thenRefused(strings.Join([]string{token[0], changed[1], token[2]}, "."))
+	})
+
+	It("should refuse a token signed with a key it does not say", func() {
+		thenRefused(sign("RS256", "ec-1", claims))
+		thenRefused(sign("ES256", "rsa-1", claims))
+		thenRefused(sign("RS256", "", claims))
+	})
+
+	It("should refuse a token that is not signed", func() {
+		thenRefused(sign("none", "", claims))
+	})
+
+	It("should refuse HS256 without a secret", func() {
+		a = auth.NewJWTAuthenticator(auth.JWTConfig{Keys: jwks, Audience: "payments-api"})
+		thenRefused(sign("HS256", "", claims))
+	})
+
+	It("should refuse something that is not a JWT", func() {
+		thenRefused("pk_0123")
+		thenRefused("")
+	})
+
+	Describe("With API keys", func() {
+		It("should authenticate with whichever the caller has", func() {
+			dir, err := ioutil.TempDir("", "keys")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			store := auth.NewFileStore(filepath.Join(dir, "api-keys.json"))
+			key, apiKey, err := auth.NewKey("dashboard", []string{"org-1"}, []auth.Role{auth.RoleViewer}, time.Now().UTC())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(store.Create(context.Background(), key)).To(Succeed())
+
+			a = auth.AnyOf(auth.NewKeyAuthenticator(store), a)
+			thenAlice(sign("ES256", "ec-1", claims))
+			id, err := authenticate(apiKey)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(id.Subject).To(Equal(key.Subject()))
+			thenRefused("pk_0123")
+		})
+	})
+
+	It("should read the token from the Authorization header", func() {
+		req := httptest.NewRequest("GET", "/payment/search", nil)
+		_, err := a.Authenticate(req)
+		Expect(err).To(Equal(auth.ErrUnauthenticated))
+		req.Header = http.Header{"Authorization": {"bearer " + sign("HS256", "", claims)}}
+		_, err = a.Authenticate(req)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+var ErrNotFound = errors.New("auth: key not found")
+
+// keyPrefix starts every API key so they are easy to spot, in logs or
+// committed by mistake.
+const keyPrefix = "pk_"
+
+// Key is an API key bound to the organisations it acts for with the roles it
+// has. Only the hash of the key is kept, the key itself is shown once when it
+// is created.
+type Key struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the key, enough to tell keys apart.
+	Prefix          string     `json:"prefix"`
+	Hash            string     `json:"hash"`
+	OrganisationIds []string   `json:"organisation_ids"`
+	Roles           []Role     `json:"roles"`
+	CreatedAt       time.Time  `json:"created_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Subject is the actor of the changes made with the key.
+func (k Key) Subject() string {
+	return "apikey:" + k.Id
+}
+
+type Store interface {
+	Create(ctx context.Context, key Key) error
+	// Find returns the key with the hash, revoked or not, or ErrNotFound.
+	Find(ctx context.Context, hash string) (Key, error)
+	// List returns every key oldest first.
+	List(ctx context.Context) ([]Key, error)
+	// Revoke stops the key being used from the time given, a key revoked
+	// already keeps the time it was first revoked.
+	Revoke(ctx context.Context, id string, at time.Time) error
+}
+
+// NewKey makes a key for the organisations with the roles, the secret is the
+// key to give to the caller and is not kept.
+func NewKey(name string, organisationIds []string, roles []Role, now time.Time) (key Key, secret string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return key, secret, err
+	}
+	secret = keyPrefix + hex.EncodeToString(b)
+	return Key{
+		Id:              uuid.NewV4().String(),
+		Name:            name,
+		Prefix:          secret[:len(keyPrefix)+8],
+		Hash:            Hash(secret),
+		OrganisationIds: organisationIds,
+		Roles:           roles,
+		CreatedAt:       now,
+	}, secret, nil
+}
+
+// Hash is what a key is found by. The keys are random enough that a plain
+// SHA-256 cannot be reversed, a slow hash would only slow every request down.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
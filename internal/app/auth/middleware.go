@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrUnauthenticated = errors.New("auth: unauthenticated")
+
+// Authenticator finds who made a request. It returns ErrUnauthenticated when
+// the request does not say or cannot be believed, any other error is a
+// failure to find out.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// Middleware only lets through requests the authenticator knows who made,
+// with who made them in their context.
+func Middleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := a.Authenticate(r)
+			switch {
+			case err == ErrUnauthenticated:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="payments"`)
+				problem.New(http.StatusUnauthorized, "unauthenticated", "a valid bearer token is required").Write(w, r)
+			case err != nil:
+				log.Error(err)
+				problem.New(http.StatusInternalServerError, "internal_error", "something went wrong").Write(w, r)
+			default:
+				next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+			}
+		})
+	}
+}
+
+// bearer is the token sent in the Authorization header, or empty.
+func bearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// NewKeyAuthenticator takes the bearer token of a request to be an API key,
+// the request is made by the key when it is in the store and not revoked.
+func NewKeyAuthenticator(store Store) Authenticator {
+	return &keyAuthenticator{store: store, now: time.Now}
+}
+
+type keyAuthenticator struct {
+	store Store
+	now   func() time.Time
+}
+
+func (a *keyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	secret := bearer(r)
+	if !strings.HasPrefix(secret, keyPrefix) {
+		return Identity{}, ErrUnauthenticated
+	}
+	key, err := a.store.Find(r.Context(), Hash(secret))
+	if err == ErrNotFound {
+		return Identity{}, ErrUnauthenticated
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	if key.RevokedAt != nil && !key.RevokedAt.After(a.now()) {
+		log.Warnf("Refused revoked API key '%s'", key.Id)
+		return Identity{}, ErrUnauthenticated
+	}
+	return Identity{Subject: key.Subject(), OrganisationIds: key.OrganisationIds, Roles: key.Roles}, nil
+}
@@ -0,0 +1,151 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Middleware", func() {
+	var (
+		dir    string
+		store  auth.Store
+		ctx    context.Context
+		called *auth.Identity
+		h      http.Handler
+	)
+
+	BeforeEach(func() {
+		d, err := ioutil.TempDir("", "keys")
+		Expect(err).ShouldNot(HaveOccurred())
+		dir = d
+		store = auth.NewFileStore(filepath.Join(dir, "api-keys.json"))
+		ctx = context.Background()
+		called = nil
+		h = auth.Middleware(auth.NewKeyAuthenticator(store))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := auth.FromContext(r.Context())
+			Expect(ok).To(BeTrue())
+			called = &id
+		}))
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	givenKey := func() (auth.Key, string) {
+		key, secret, err := auth.NewKey("dashboard", []string{"org-1"}, []auth.Role{auth.RoleViewer}, time.Now().UTC())
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(store.Create(ctx, key)).To(Succeed())
+		return key, secret
+	}
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/payment/search", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	thenUnauthenticated := func(w *httptest.ResponseRecorder) {
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(w.Header().Get("WWW-Authenticate")).To(Equal(`Bearer realm="payments"`))
+		Expect(w.Header().Get("Content-Type")).To(Equal(problem.ContentType))
+		var p problem.Problem
+		Expect(json.Unmarshal(w.Body.Bytes(), &p)).To(Succeed())
+		Expect(p.Code).To(Equal("unauthenticated"))
+		Expect(called).To(BeNil())
+	}
+
+	It("should let through a request made with a key", func() {
+		key, secret := givenKey()
+		w := serve("Bearer " + secret)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(called).To(Equal(&auth.Identity{Subject: "apikey:" + key.Id, OrganisationIds: []string{"org-1"}, Roles: []auth.Role{auth.RoleViewer}}))
+	})
+
+	It("should refuse a request without a key", func() {
+		givenKey()
+		thenUnauthenticated(serve(""))
+	})
+
+	It("should refuse a key it does not know", func() {
+		givenKey()
+		thenUnauthenticated(serve("Bearer pk_0000"))
+	})
+
+	It("should refuse a key that is not a bearer token", func() {
+		_, secret := givenKey()
+		thenUnauthenticated(serve("Basic " + secret))
+	})
+
+	It("should refuse a key once it is revoked", func() {
+		key, secret := givenKey()
+		Expect(store.Revoke(ctx, key.Id, time.Now().UTC())).To(Succeed())
+		thenUnauthenticated(serve("Bearer " + secret))
+	})
+})
+
+var _ = Describe("Identity", func() {
+	It("should allow any organisation when the request was not authenticated", func() {
+		Expect(auth.Allowed(context.Background(), "org-1")).To(BeTrue())
+	})
+
+	It("should only allow the organisations of the identity", func() {
+		ctx := auth.NewContext(context.Background(), auth.Identity{Subject: "someone", OrganisationIds: []string{"org-1", "org-2"}})
+		Expect(auth.Allowed(ctx, "org-2")).To(BeTrue())
+		Expect(auth.Allowed(ctx, "org-3")).To(BeFalse())
+	})
+
+	It("should have every permission when the request was not authenticated", func() {
+		Expect(auth.Check(context.Background(), auth.PermissionDelete)).To(Succeed())
+	})
+
+	It("should only have the permissions its roles grant", func() {
+		ctx := auth.NewContext(context.Background(), auth.Identity{Subject: "someone", Roles: []auth.Role{auth.RoleViewer, auth.RoleApprover}})
+		Expect(auth.Check(ctx, auth.PermissionRead)).To(Succeed())
+		Expect(auth.Check(ctx, auth.PermissionTransition)).To(Succeed())
+		Expect(auth.Check(ctx, auth.PermissionCreate)).To(Equal(&auth.ForbiddenError{Permission: auth.PermissionCreate}))
+		Expect(auth.Check(ctx, auth.PermissionDelete)).To(Equal(&auth.ForbiddenError{Permission: auth.PermissionDelete}))
+	})
+
+	DescribeTable("roles",
+		func(role auth.Role, permissions ...auth.Permission) {
+			id := auth.Identity{Roles: []auth.Role{role}}
+			for _, p := range []auth.Permission{auth.PermissionRead, auth.PermissionCreate, auth.PermissionUpdate, auth.PermissionTransition, auth.PermissionApprove, auth.PermissionDelete, auth.PermissionManageWebhooks} {
+				Expect(id.Can(p)).To(Equal(has(permissions, p)), string(p))
+			}
+		},
+		Entry("viewer", auth.RoleViewer, auth.PermissionRead),
+		Entry("submitter", auth.RoleSubmitter, auth.PermissionRead, auth.PermissionCreate, auth.PermissionUpdate),
+		Entry("approver", auth.RoleApprover, auth.PermissionRead, auth.PermissionTransition, auth.PermissionApprove),
+		Entry("admin", auth.RoleAdmin, auth.PermissionRead, auth.PermissionCreate, auth.PermissionUpdate, auth.PermissionTransition, auth.PermissionApprove, auth.PermissionDelete, auth.PermissionManageWebhooks),
+	)
+
+	It("should have no permissions without a role", func() {
+		Expect(auth.Identity{Subject: "someone"}.Can(auth.PermissionRead)).To(BeFalse())
+		Expect(auth.Role("owner").Known()).To(BeFalse())
+	})
+})
+
+func has(permissions []auth.Permission, p auth.Permission) bool {
+	for _, granted := range permissions {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
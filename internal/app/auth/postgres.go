@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"time"
+)
+
+type Database interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewPostgresStore keeps keys in the api_keys table so that every server
+// sharing the database sees them.
+func NewPostgresStore(db Database) Store {
+	return &postgresStore{db: db}
+}
+
+type postgresStore struct {
+	db Database
+}
+
+const keyColumns = "id, name, prefix, hash, organisation_ids, roles, created_at, revoked_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(row scanner) (key Key, err error) {
+	var (
+		roles     []string
+		revokedAt pq.NullTime
+	)
+	err = row.Scan(&key.Id, &key.Name, &key.Prefix, &key.Hash, pq.Array(&key.OrganisationIds), pq.Array(&roles), &key.CreatedAt, &revokedAt)
+	for _, r := range roles {
+		key.Roles = append(key.Roles, Role(r))
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, err
+}
+
+func (s *postgresStore) Create(ctx context.Context, key Key) error {
+	roles := make([]string, len(key.Roles))
+	for i, r := range key.Roles {
+		roles[i] = string(r)
+	}
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO api_keys(id, name, prefix, hash, organisation_ids, roles, created_at) VALUES($1, $2, $3, $4, $5, $6, $7);",
+		key.Id, key.Name, key.Prefix, key.Hash, pq.Array(key.OrganisationIds), pq.Array(roles), key.CreatedAt)
+	return err
+}
+
+func (s *postgresStore) Find(ctx context.Context, hash string) (Key, error) {
+	key, err := scanKey(s.db.QueryRowContext(ctx,
+		"SELECT "+keyColumns+" FROM api_keys WHERE hash = $1;",
+		hash))
+	if err == sql.ErrNoRows {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+func (s *postgresStore) List(ctx context.Context) ([]Key, error) {
+	keys := make([]Key, 0)
+	rows, err := s.db.QueryContext(ctx, "SELECT "+keyColumns+" FROM api_keys ORDER BY created_at, id;")
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1;",
+		id, at)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+)
+
+// Permission is something a caller may be allowed to do to payments or their
+// webhook subscriptions.
+type Permission string
+
+const (
+	PermissionRead       Permission = "payments:read"
+	PermissionCreate     Permission = "payments:create"
+	PermissionUpdate     Permission = "payments:update"
+	PermissionTransition Permission = "payments:transition"
+	PermissionApprove    Permission = "payments:approve"
+	PermissionDelete     Permission = "payments:delete"
+	// PermissionManageWebhooks is creating, enabling and deleting webhook
+	// subscriptions, reading them only needs PermissionRead.
+	PermissionManageWebhooks Permission = "webhooks:manage"
+)
+
+// Role is a set of permissions given to API keys and tokens.
+type Role string
+
+const (
+	RoleViewer    Role = "viewer"
+	RoleSubmitter Role = "submitter"
+	RoleApprover  Role = "approver"
+	RoleAdmin     Role = "admin"
+)
+
+// Roles are every role there is.
+var Roles = []Role{RoleViewer, RoleSubmitter, RoleApprover, RoleAdmin}
+
+var grants = map[Role][]Permission{
+	RoleViewer:    {PermissionRead},
+	RoleSubmitter: {PermissionRead, PermissionCreate, PermissionUpdate},
+	RoleApprover:  {PermissionRead, PermissionTransition, PermissionApprove},
+	RoleAdmin:     {PermissionRead, PermissionCreate, PermissionUpdate, PermissionTransition, PermissionApprove, PermissionDelete, PermissionManageWebhooks},
+}
+
+// Known is true for the roles there are.
+func (r Role) Known() bool {
+	_, ok := grants[r]
+	return ok
+}
+
+// Can is true when one of the roles of the identity grants the permission.
+func (id Identity) Can(p Permission) bool {
+	for _, r := range id.Roles {
+		for _, granted := range grants[r] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ForbiddenError is returned when the caller is missing the permission
+// needed.
+type ForbiddenError struct {
+	Permission Permission
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("auth: missing permission %s", e.Permission)
+}
+
+// Check returns a ForbiddenError unless the request has the permission,
+// requests are only left unauthenticated when authentication is off and then
+// have every permission.
+func Check(ctx context.Context, p Permission) error {
+	if id, ok := FromContext(ctx); ok && !id.Can(p) {
+		return &ForbiddenError{Permission: p}
+	}
+	return nil
+}
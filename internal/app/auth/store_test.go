@@ -0,0 +1,198 @@
+package auth_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Keys", func() {
+	var now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	It("should only keep the hash of the key", func() {
+		key, secret, err := auth.NewKey("dashboard", []string{"org-1"}, []auth.Role{auth.RoleViewer}, now)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(secret).To(HavePrefix("pk_"))
+		Expect(secret).To(HavePrefix(key.Prefix))
+		Expect(key.Hash).To(Equal(auth.Hash(secret)))
+		Expect(key.Hash).ToNot(ContainSubstring(strings.TrimPrefix(secret, key.Prefix)))
+		Expect(key.OrganisationIds).To(Equal([]string{"org-1"}))
+		Expect(key.Roles).To(Equal([]auth.Role{auth.RoleViewer}))
+		Expect(key.CreatedAt).To(Equal(now))
+	})
+
+	It("should never make the same key twice", func() {
+		_, first, err := auth.NewKey("a", nil, nil, now)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, second, err := auth.NewKey("b", nil, nil, now)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(first).ToNot(Equal(second))
+	})
+
+	Describe("File store", func() {
+		var (
+			dir   string
+			store auth.Store
+			ctx   context.Context
+		)
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "keys")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+			store = auth.NewFileStore(filepath.Join(dir, "api-keys.json"))
+			ctx = context.Background()
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		givenKey := func(name string) auth.Key {
+			key, _, err := auth.NewKey(name, []string{"org-1", "org-2"}, []auth.Role{auth.RoleSubmitter, auth.RoleApprover}, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(store.Create(ctx, key)).To(Succeed())
+			return key
+		}
+
+		It("should have no keys before any are created", func() {
+			Expect(store.List(ctx)).To(BeEmpty())
+			_, err := store.Find(ctx, "unknown")
+			Expect(err).To(Equal(auth.ErrNotFound))
+		})
+
+		It("should find a key by its hash", func() {
+			key := givenKey("dashboard")
+			Expect(store.Find(ctx, key.Hash)).To(Equal(key))
+		})
+
+		It("should list the keys oldest first", func() {
+			first, second := givenKey("first"), givenKey("second")
+			Expect(store.List(ctx)).To(Equal([]auth.Key{first, second}))
+		})
+
+		It("should keep the time a key was first revoked", func() {
+			key := givenKey("dashboard")
+			Expect(store.Revoke(ctx, key.Id, now.Add(time.Hour))).To(Succeed())
+			Expect(store.Revoke(ctx, key.Id, now.Add(2*time.Hour))).To(Succeed())
+
+			actual, err := store.Find(ctx, key.Hash)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(*actual.RevokedAt).To(BeTemporally("==", now.Add(time.Hour)))
+		})
+
+		It("should not revoke an unknown key", func() {
+			Expect(store.Revoke(ctx, "unknown", now)).To(Equal(auth.ErrNotFound))
+		})
+
+		It("should let keys made before there were roles do everything", func() {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "api-keys.json"), []byte(`[{"id":"old","hash":"some hash","organisation_ids":["org-1"]}]`), 0600)).To(Succeed())
+			actual, err := store.Find(ctx, "some hash")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.Roles).To(Equal([]auth.Role{auth.RoleAdmin}))
+		})
+
+		It("should see keys written by another store", func() {
+			Expect(store.List(ctx)).To(BeEmpty())
+			other := auth.NewFileStore(filepath.Join(dir, "api-keys.json"))
+			key, _, err := auth.NewKey("dashboard", []string{"org-1"}, []auth.Role{auth.RoleViewer}, now)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(other.Create(ctx, key)).To(Succeed())
+
+			Expect(store.Find(ctx, key.Hash)).To(Equal(key))
+			Expect(other.Revoke(ctx, key.Id, now)).To(Succeed())
+			actual, err := store.Find(ctx, key.Hash)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.RevokedAt).ShouldNot(BeNil())
+		})
+	})
+
+	Describe("Postgres store", func() {
+		var (
+			store  auth.Store
+			dbMock sqlmock.Sqlmock
+			ctx    context.Context
+		)
+
+		BeforeEach(func() {
+			db, mock, err := sqlmock.New()
+			Expect(err).ShouldNot(HaveOccurred())
+			store = auth.NewPostgresStore(db)
+			dbMock = mock
+			ctx = context.Background()
+		})
+
+		AfterEach(func() {
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		columns := []string{"id", "name", "prefix", "hash", "organisation_ids", "roles", "created_at", "revoked_at"}
+
+		It("should insert the key", func() {
+			dbMock.ExpectExec("INSERT INTO api_keys\\(id, name, prefix, hash, organisation_ids, roles, created_at\\) VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7\\);").
+				WithArgs("some id", "dashboard", "pk_0123abcd", "some hash", "{\"org-1\",\"org-2\"}", "{\"viewer\"}", now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			Expect(store.Create(ctx, auth.Key{
+				Id: "some id", Name: "dashboard", Prefix: "pk_0123abcd", Hash: "some hash",
+				OrganisationIds: []string{"org-1", "org-2"}, Roles: []auth.Role{auth.RoleViewer}, CreatedAt: now,
+			})).To(Succeed())
+		})
+
+		It("should find the key by its hash", func() {
+			dbMock.ExpectQuery("SELECT id, name, prefix, hash, organisation_ids, roles, created_at, revoked_at FROM api_keys WHERE hash = \\$1;").
+				WithArgs("some hash").
+				WillReturnRows(sqlmock.NewRows(columns).AddRow("some id", "dashboard", "pk_0123abcd", "some hash", "{org-1,org-2}", "{viewer,approver}", now, now))
+
+			actual, err := store.Find(ctx, "some hash")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.OrganisationIds).To(Equal([]string{"org-1", "org-2"}))
+			Expect(actual.Roles).To(Equal([]auth.Role{auth.RoleViewer, auth.RoleApprover}))
+			Expect(*actual.RevokedAt).To(Equal(now))
+		})
+
+		It("should not find an unknown hash", func() {
+			dbMock.ExpectQuery("SELECT id").
+				WillReturnError(sql.ErrNoRows)
+
+			_, err := store.Find(ctx, "some hash")
+			Expect(err).To(Equal(auth.ErrNotFound))
+		})
+
+		It("should list the keys oldest first", func() {
+			dbMock.ExpectQuery("SELECT id, name, prefix, hash, organisation_ids, roles, created_at, revoked_at FROM api_keys ORDER BY created_at, id;").
+				WillReturnRows(sqlmock.NewRows(columns).
+					AddRow("first", "a", "pk_0", "hash 0", "{org-1}", "{admin}", now, nil).
+					AddRow("second", "b", "pk_1", "hash 1", "{org-2}", "{viewer}", now, nil))
+
+			actual, err := store.List(ctx)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(HaveLen(2))
+			Expect(actual[1].Id).To(Equal("second"))
+			Expect(actual[1].RevokedAt).To(BeNil())
+		})
+
+		It("should keep the time a key was first revoked", func() {
+			dbMock.ExpectExec("UPDATE api_keys SET revoked_at = COALESCE\\(revoked_at, \\$2\\) WHERE id = \\$1;").
+				WithArgs("some id", now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			Expect(store.Revoke(ctx, "some id", now)).To(Succeed())
+		})
+
+		It("should not revoke an unknown key", func() {
+			dbMock.ExpectExec("UPDATE api_keys").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			Expect(store.Revoke(ctx, "some id", now)).To(Equal(auth.ErrNotFound))
+		})
+	})
+})
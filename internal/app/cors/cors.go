@@ -0,0 +1,143 @@
+package cors
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/handlers"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "10m" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// Config is which cross-origin requests browsers are let make. An origin is
+// either "*" for any, an exact origin such as "https://app.example.com", or
+// one with a wildcard subdomain such as "https://*.example.com" which
+// matches any subdomain of example.com but not example.com itself.
+type Config struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long browsers may keep the answer to a preflight, no
+	// more than ten minutes.
+	MaxAge Duration `json:"max_age"`
+}
+
+// Development is the config of a server run locally, any origin may call it.
+// A server in production lets no origin call it unless told.
+func Development() Config {
+	c := Production()
+	c.AllowedOrigins = []string{"*"}
+	return c
+}
+
+// Production is the config of a server in production, every method and
+// header the API takes is allowed but no origin is.
+func Production() Config {
+	return Config{
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Accept", "Accept-Encoding", "Authorization", "Content-Type", "Content-Length", "Idempotency-Key", "Last-Event-ID", "X-Actor", "X-CSRF-Token", "X-Request-Id"},
+		ExposedHeaders: []string{"Location", "X-Request-Id", "Idempotent-Replayed", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+	}
+}
+
+// ReadConfig reads the config from a JSON file over the one given, anything
+// left out of the file is kept.
+func ReadConfig(name string, c Config) (Config, error) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(bs, &c); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// Validate checks every origin is one that can be matched. Credentials cannot
+// be allowed for any origin, that would let every site act as the user.
+func (c Config) Validate() error {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("cors: credentials cannot be allowed for any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("cors: origin '%s' must be a scheme and host such as https://app.example.com", o)
+		}
+		if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+			return fmt.Errorf("cors: origin '%s' can only have a wildcard as its first label", o)
+		}
+	}
+	if c.MaxAge < 0 || time.Duration(c.MaxAge) > 10*time.Minute {
+		return fmt.Errorf("cors: max age must be between 0 and 10m")
+	}
+	return nil
+}
+
+// Allowed is true when the origin matches one of the allowed origins.
+func (c Config) Allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.AllowedOrigins {
+		o = strings.TrimSuffix(strings.ToLower(o), "/")
+		switch {
+		case o == "*", o == origin:
+			return true
+		case strings.Contains(o, "://*."):
+			i := strings.Index(o, "*")
+			prefix, suffix := o[:i], o[i+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				label := origin[len(prefix) : len(origin)-len(suffix)]
+				if label != "" && !strings.ContainsAny(label, "/:@") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Middleware answers preflights and adds the CORS headers to the responses of
+// the origins the config allows. Requests from any other origin get no CORS
+// headers so browsers refuse them.
+func Middleware(c Config) func(http.Handler) http.Handler {
+	opts := []handlers.CORSOption{
+		handlers.AllowedOriginValidator(c.Allowed),
+		handlers.AllowedMethods(c.AllowedMethods),
+		handlers.AllowedHeaders(c.AllowedHeaders),
+		handlers.ExposedHeaders(c.ExposedHeaders),
+		handlers.MaxAge(int(time.Duration(c.MaxAge).Seconds())),
+	}
+	if c.AllowCredentials {
+		opts = append(opts, handlers.AllowCredentials())
+	}
+	cors := handlers.CORS(opts...)
+	return func(next http.Handler) http.Handler {
+		h := cors(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The allowed origin is sent back as it was asked for, so caches
+			// have to keep a response for each origin.
+			w.Header().Add("Vary", "Origin")
+			h.ServeHTTP(w, r)
+		})
+	}
+}
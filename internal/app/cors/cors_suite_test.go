@@ -0,0 +1,13 @@
+package cors_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCORS(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CORS Suite")
+}
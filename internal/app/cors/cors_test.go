@@ -0,0 +1,157 @@
+package cors_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/cors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("CORS", func() {
+
+	DescribeTable("matching origins",
+		func(allowed string, origin string, matches bool) {
+			c := cors.Config{AllowedOrigins: []string{allowed}}
+			Expect(c.Allowed(origin)).To(Equal(matches))
+		},
+		Entry("any", "*", "https://anything.com", true),
+		Entry("exact", "https://app.example.com", "https://app.example.com", true),
+		Entry("exact ignoring case", "https://App.Example.com", "https://app.example.com", true),
+		Entry("another host", "https://app.example.com", "https://evil.com", false),
+		Entry("another scheme", "https://app.example.com", "http://app.example.com", false),
+		Entry("a subdomain", "https://*.example.com", "https://app.example.com", true),
+		Entry("a deeper subdomain", "https://*.example.com", "https://eu.app.example.com", true),
+		Entry("not the domain itself", "https://*.example.com", "https://example.com", false),
+		Entry("not a lookalike", "https://*.example.com", "https://app.notexample.com", false),
+		Entry("not another port", "https://*.example.com", "https://app.example.com:8443", false),
+		Entry("not another scheme", "https://*.example.com", "http://app.example.com", false),
+		Entry("nothing", "https://*.example.com", "", false),
+	)
+
+	It("should allow no origin in production", func() {
+		Expect(cors.Production().Allowed("https://app.example.com")).To(BeFalse())
+		Expect(cors.Development().Allowed("https://app.example.com")).To(BeTrue())
+	})
+
+	Describe("Validating the config", func() {
+		It("should take origins with a scheme and host", func() {
+			Expect(cors.Config{AllowedOrigins: []string{"*", "https://app.example.com", "http://*.example.com:8080"}}.Validate()).To(Succeed())
+		})
+
+		It("should refuse origins it cannot match", func() {
+			for _, o := range []string{"app.example.com", "https://app.example.com/path", "ftp://example.com", "https://app.*.com", "https://**.example.com"} {
+				Expect(cors.Config{AllowedOrigins: []string{o}}.Validate()).ShouldNot(Succeed(), o)
+			}
+		})
+
+		It("should refuse credentials for any origin", func() {
+			Expect(cors.Config{AllowedOrigins: []string{"*"}, AllowCredentials: true}.Validate()).ShouldNot(Succeed())
+		})
+
+		It("should refuse a max age over ten minutes", func() {
+			Expect(cors.Config{MaxAge: cors.Duration(time.Hour)}.Validate()).ShouldNot(Succeed())
+		})
+	})
+
+	Describe("Reading the config", func() {
+		var dir string
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "cors")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		It("should keep what the file leaves out", func() {
+			name := filepath.Join(dir, "cors.json")
+			Expect(ioutil.WriteFile(name, []byte(`{"allowed_origins": ["https://*.example.com"], "allow_credentials": true, "max_age": "5m"}`), 0600)).To(Succeed())
+			c, err := cors.ReadConfig(name, cors.Production())
+			Expect(err).ShouldNot(HaveOccurred())
+			expected := cors.Production()
+			expected.AllowedOrigins = []string{"https://*.example.com"}
+			expected.AllowCredentials = true
+			expected.MaxAge = cors.Duration(5 * time.Minute)
+			Expect(c).To(Equal(expected))
+		})
+	})
+
+	Describe("Middleware", func() {
+		var h http.Handler
+
+		BeforeEach(func() {
+			c := cors.Production()
+			c.AllowedOrigins = []string{"https://*.example.com"}
+			c.AllowCredentials = true
+			c.MaxAge = cors.Duration(5 * time.Minute)
+			h = cors.Middleware(c)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", "/payment/1")
+				w.WriteHeader(http.StatusCreated)
+			}))
+		})
+
+		send := func(method string, origin string, headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/payment", nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		It("should answer a preflight from an allowed origin", func() {
+			w := send("OPTIONS", "https://app.example.com", map[string]string{
+				"Access-Control-Request-Method":  "DELETE",
+				"Access-Control-Request-Headers": "Authorization, Idempotency-Key",
+			})
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+			Expect(w.Header().Get("Access-Control-Allow-Methods")).To(Equal("DELETE"))
+			Expect(w.Header().Get("Access-Control-Allow-Headers")).To(Equal("Authorization,Idempotency-Key"))
+			Expect(w.Header().Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+			Expect(w.Header().Get("Access-Control-Max-Age")).To(Equal("300"))
+		})
+
+		It("should allow PATCH", func() {
+			w := send("OPTIONS", "https://app.example.com", map[string]string{"Access-Control-Request-Method": "PATCH"})
+			Expect(w.Header().Get("Access-Control-Allow-Methods")).To(Equal("PATCH"))
+		})
+
+		It("should expose the headers of a response to an allowed origin", func() {
+			w := send("POST", "https://app.example.com", nil)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get("Access-Control-Allow-Origin")).To(Equal("https://app.example.com"))
+			Expect(w.Header().Get("Access-Control-Expose-Headers")).To(ContainSubstring("Location"))
+			Expect(w.Header().Get("Vary")).To(Equal("Origin"))
+		})
+
+		It("should not add CORS headers for any other origin", func() {
+			w := send("POST", "https://evil.com", nil)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+
+			w = send("OPTIONS", "https://evil.com", map[string]string{"Access-Control-Request-Method": "DELETE"})
+			Expect(w.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			Expect(w.Header().Get("Access-Control-Allow-Methods")).To(BeEmpty())
+		})
+
+		It("should leave same-origin requests alone", func() {
+			w := send("POST", "", nil)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get("Access-Control-Allow-Origin")).To(BeEmpty())
+		})
+	})
+})
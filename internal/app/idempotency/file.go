@@ -0,0 +1,254 @@
+package idempotency
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NewFileStore keeps keys in memory and makes every change durable in an
+// append-only log first, so keys outlive a restart of a server without a
+// database. On opening the log is replayed, a line left half written by a
+// crash is dropped. A key reserved by a request a crash cut short stays held
+// until it expires, like with the postgres store, the payment may have been
+// saved. Purging rewrites the log once most of it is of keys gone.
+func NewFileStore(name string) (Store, error) {
+	s := &fileStore{memoryStore: &memoryStore{records: make(map[Key]Record)}, name: name}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	return s, nil
+}
+
+type fileStore struct {
+	*memoryStore
+	// mu keeps the log in the order the changes are made in memory.
+	mu   sync.Mutex
+	name string
+	log  *os.File
+	// entries is how many lines the log has.
+	entries int
+	// broken is why the log cannot be written to any more, a write failed
+	// and what it left could not be cut off.
+	broken error
+}
+
+// entry is a line of the log, a key reserved, completed or released.
+type entry struct {
+	Op          string    `json:"op"`
+	Scope       string    `json:"scope"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_hash,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	Response    *Response `json:"response,omitempty"`
+}
+
+// minCompact is how many lines the log has before it is worth compacting.
+const minCompact = 1000
+
+const (
+	opReserve  = "reserve"
+	opComplete = "complete"
+	opRelease  = "release"
+)
+
+func (s *fileStore) replay() error {
+	f, err := os.OpenFile(s.name, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		reader = bufio.NewReader(f)
+		offset int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var e entry
+		if line[len(line)-1] != '\n' || json.Unmarshal(line, &e) != nil {
+			log.Warnf("Dropping the torn end of '%s' from offset %d", s.name, offset)
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		s.apply(e)
+		offset += int64(len(line))
+		s.entries++
+	}
+}
+
+func (s *fileStore) apply(e entry) {
+	key := Key{Scope: e.Scope, Key: e.Key}
+	switch e.Op {
+	case opReserve:
+		s.records[key] = Record{RequestHash: e.RequestHash, ExpiresAt: e.ExpiresAt}
+	case opComplete:
+		if held, ok := s.records[key]; ok {
+			held.Response = e.Response
+			s.records[key] = held
+		}
+	case opRelease:
+		delete(s.records, key)
+	}
+}
+
+// append writes the entries to the log and syncs it, the lock must be held.
+// A write that fails is cut off the log, the replay stops at the first bad
+// line so one left there would lose every line written after it. When it
+// cannot be cut off the log takes no more writes.
+func (s *fileStore) append(entries ...entry) error {
+	if s.broken != nil {
+		return s.broken
+	}
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.log.Write(buf)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		if cutErr := s.log.Truncate(info.Size()); cutErr != nil {
+			s.broken = fmt.Errorf("idempotency: '%s' takes no more writes, a failed write could not be cut off: %s", s.name, cutErr)
+			log.Error(s.broken)
+		}
+		return err
+	}
+	s.entries += len(entries)
+	return nil
+}
+
+func (s *fileStore) Reserve(ctx context.Context, key Key, requestHash string, now time.Time, expiresAt time.Time) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held, err := s.memoryStore.Reserve(ctx, key, requestHash, now, expiresAt)
+	if err != nil || held != nil {
+		return held, err
+	}
+	if err = s.append(entry{Op: opReserve, Scope: key.Scope, Key: key.Key, RequestHash: requestHash, ExpiresAt: expiresAt}); err != nil {
+		s.memoryStore.Release(ctx, key)
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *fileStore) Complete(ctx context.Context, key Key, response Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(entry{Op: opComplete, Scope: key.Scope, Key: key.Key, Response: &response}); err != nil {
+		return err
+	}
+	return s.memoryStore.Complete(ctx, key, response)
+}
+
+func (s *fileStore) Release(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(entry{Op: opRelease, Scope: key.Scope, Key: key.Key}); err != nil {
+		return err
+	}
+	return s.memoryStore.Release(ctx, key)
+}
+
+// Purge drops the expired keys. Once the log has more than four lines for
+// every key still held it is written again with only those, an expired key
+// left in the log is only ever replayed as expired.
+func (s *fileStore) Purge(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.memoryStore.Purge(ctx, now); err != nil {
+		return err
+	}
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if s.entries <= minCompact || s.entries <= 4*len(s.records) {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes the keys held to a new log renamed into place, so a crash
+// leaves the old log or the new. Both locks must be held.
+func (s *fileStore) compact() error {
+	tmp := s.name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w, entries := bufio.NewWriter(f), 0
+	for key, held := range s.records {
+		lines := []entry{{Op: opReserve, Scope: key.Scope, Key: key.Key, RequestHash: held.RequestHash, ExpiresAt: held.ExpiresAt}}
+		if held.Response != nil {
+			lines = append(lines, entry{Op: opComplete, Scope: key.Scope, Key: key.Key, Response: held.Response})
+		}
+		for _, e := range lines {
+			line, err := json.Marshal(e)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(append(line, '\n'))
+			entries++
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.name)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(s.name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	// The new log is written to from where it ends, it is the log from now.
+	s.log.Close()
+	s.log, s.entries = f, entries
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
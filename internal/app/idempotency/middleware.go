@@ -0,0 +1,150 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set on responses that are a copy of an earlier one.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+// ScopeFunc picks the scope of the key from the request and its body.
+type ScopeFunc func(r *http.Request, body []byte) string
+
+// Middleware makes requests carrying an Idempotency-Key safe to retry. The
+// first response for a key within its scope is kept for ttl and sent back for
+// every retry with the same body. Retries with a different body, or made while
+// the first request is still running, get a problem instead. Requests without
+// the header are passed straight through.
+func Middleware(store Store, ttl time.Duration, scope ScopeFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(Header)
+			if value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(value) > maxKeyLength {
+				problem.New(http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be at most 255 characters").Write(w, r)
+				return
+			}
+
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				problem.New(http.StatusBadRequest, "malformed_body", err.Error()).Write(w, r)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			sum := sha256.Sum256(body)
+			hash := hex.EncodeToString(sum[:])
+			key := Key{Scope: scope(r, body), Key: value}
+			now := time.Now().UTC()
+			held, err := store.Reserve(r.Context(), key, hash, now, now.Add(ttl))
+			if err != nil {
+				log.Error(err)
+				problem.New(http.StatusInternalServerError, "internal_error", "something went wrong").Write(w, r)
+				return
+			}
+
+			switch {
+			case held == nil:
+				serve(store, key, next, w, r)
+			case held.RequestHash != hash:
+				problem.New(http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used with a different request").Write(w, r)
+			case held.Response == nil:
+				w.Header().Set("Retry-After", "1")
+				problem.New(http.StatusConflict, "idempotency_key_in_use", "a request with this Idempotency-Key is still being processed").Write(w, r)
+			default:
+				replay(w, *held.Response)
+			}
+		})
+	}
+}
+
+// serve handles the request that reserved the key and keeps its response,
+// unless retrying could go differently in which case the key is let go.
+func serve(store Store, key Key, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if p := recover(); p != nil {
+			if err := store.Release(r.Context(), key); err != nil {
+				log.Error(err)
+			}
+			panic(p)
+		}
+	}()
+
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	var err error
+	if !final(rec.status) {
+		err = store.Release(r.Context(), key)
+	} else {
+		err = store.Complete(r.Context(), key, Response{
+			Status:      rec.status,
+			Location:    w.Header().Get("Location"),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// final is true for a response a retry should get again. A server error, or
+// being unauthenticated, forbidden, not found or rate limited, says nothing of
+// the request itself and can change once keys, roles or limits do. The scope
+// is shared by everyone acting for an organisation so one caller's refusal
+// must not be replayed to another either.
+func final(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+func replay(w http.ResponseWriter, resp Response) {
+	if resp.Location != "" {
+		w.Header().Set("Location", resp.Location)
+	}
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	if _, err := w.Write(resp.Body); err != nil {
+		log.Error(err)
+	}
+}
+
+// recorder passes the response on while keeping a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,159 @@
+package idempotency_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/idempotency"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Middleware", func() {
+
+	var (
+		calls   int32
+		status  int
+		release chan struct{}
+		h       http.Handler
+	)
+
+	BeforeEach(func() {
+		calls, status, release = 0, http.StatusCreated, nil
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := atomic.AddInt32(&calls, 1)
+			if release != nil {
+				<-release
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Location", fmt.Sprintf("/thing/%d", call))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"call":%d,"body":%q}`, call, body)
+		})
+		scope := func(r *http.Request, body []byte) string {
+			return r.URL.Query().Get("scope")
+		}
+		h = idempotency.Middleware(idempotency.NewMemoryStore(), time.Hour, scope)(next)
+	})
+
+	sendTo := func(url string, key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(idempotency.Header, key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	send := func(key string, body string) *httptest.ResponseRecorder {
+		return sendTo("/thing", key, body)
+	}
+
+	thenProblemCode := func(w *httptest.ResponseRecorder, status int, code string) {
+		Expect(w.Code).To(Equal(status))
+		var p problem.Problem
+		Expect(json.Unmarshal(w.Body.Bytes(), &p)).To(Succeed())
+		Expect(p.Code).To(Equal(code))
+	}
+
+	It("should pass requests without a key straight through", func() {
+		send("", "a")
+		send("", "a")
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(2)))
+	})
+
+	It("should give the body to the handler", func() {
+		w := send("key-1", "a")
+		Expect(w.Body.String()).To(Equal(`{"call":1,"body":"a"}`))
+	})
+
+	It("should replay the first response for a retry", func() {
+		first := send("key-1", "a")
+		retry := send("key-1", "a")
+
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+		Expect(retry.Code).To(Equal(http.StatusCreated))
+		Expect(retry.Header().Get("Location")).To(Equal("/thing/1"))
+		Expect(retry.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(retry.Header().Get(idempotency.ReplayedHeader)).To(Equal("true"))
+		Expect(retry.Body.String()).To(Equal(first.Body.String()))
+		Expect(first.Header().Get(idempotency.ReplayedHeader)).To(BeEmpty())
+	})
+
+	It("should replay client errors too", func() {
+		status = http.StatusUnprocessableEntity
+		send("key-1", "a")
+		retry := send("key-1", "a")
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+		Expect(retry.Code).To(Equal(http.StatusUnprocessableEntity))
+	})
+
+	It("should reject the key being used with a different body", func() {
+		send("key-1", "a")
+		thenProblemCode(send("key-1", "b"), http.StatusUnprocessableEntity, "idempotency_key_reused")
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+	})
+
+	It("should keep keys of different scopes apart", func() {
+		sendTo("/thing?scope=one", "key-1", "a")
+		w := sendTo("/thing?scope=two", "key-1", "b")
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(2)))
+	})
+
+	It("should let a request be tried again after a server error", func() {
+		status = http.StatusInternalServerError
+		send("key-1", "a")
+		status = http.StatusCreated
+		w := send("key-1", "a")
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(atomic.LoadInt32(&calls)).To(Equal(int32(2)))
+	})
+
+	DescribeTable("should let a request be tried again when it was refused by who sent it",
+		func(refused int) {
+			status = refused
+			send("key-1", "a")
+			status = http.StatusCreated
+			w := send("key-1", "a")
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Header().Get(idempotency.ReplayedHeader)).To(BeEmpty())
+			Expect(atomic.LoadInt32(&calls)).To(Equal(int32(2)))
+		},
+		Entry("unauthenticated", http.StatusUnauthorized),
+		Entry("forbidden", http.StatusForbidden),
+		Entry("not found", http.StatusNotFound),
+		Entry("rate limited", http.StatusTooManyRequests),
+	)
+
+	It("should reject a retry while the first request is still running", func() {
+		release = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			send("key-1", "a")
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(Equal(int32(1)))
+
+		w := send("key-1", "a")
+		close(release)
+		<-done
+		thenProblemCode(w, http.StatusConflict, "idempotency_key_in_use")
+		Expect(w.Header().Get("Retry-After")).To(Equal("1"))
+	})
+
+	It("should reject a key that is too long", func() {
+		thenProblemCode(send(strings.Repeat("k", 256), "a"), http.StatusBadRequest, "invalid_idempotency_key")
+		Expect(atomic.LoadInt32(&calls)).To(BeZero())
+	})
+})
@@ -0,0 +1,86 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type Database interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// NewPostgresStore keeps keys in the idempotency_keys table so that every
+// server sharing the database sees them.
+func NewPostgresStore(db Database) Store {
+	return &postgresStore{db: db}
+}
+
+type postgresStore struct {
+	db Database
+}
+
+// Reserve takes over an expired key in the same statement that inserts a new
+// one, when neither happens the key is held and the holder is read back.
+func (s *postgresStore) Reserve(ctx context.Context, key Key, requestHash string, now time.Time, expiresAt time.Time) (*Record, error) {
+	var reserved string
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO idempotency_keys (scope, key, request_hash, expires_at) VALUES ($1, $2, $3, $5)
+ ON CONFLICT (scope, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status = NULL, location = NULL, content_type = NULL, body = NULL, expires_at = EXCLUDED.expires_at
+ WHERE idempotency_keys.expires_at <= $4 returning key;`,
+		key.Scope, key.Key, requestHash, now, expiresAt).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var (
+		held        Record
+		status      sql.NullInt64
+		location    sql.NullString
+		contentType sql.NullString
+		body        []byte
+	)
+	err = s.db.QueryRowContext(ctx,
+		"SELECT request_hash, status, location, content_type, body, expires_at FROM idempotency_keys WHERE scope = $1 AND key = $2;",
+		key.Scope, key.Key).Scan(&held.RequestHash, &status, &location, &contentType, &body, &held.ExpiresAt)
+	if err == sql.ErrNoRows {
+		// The holder let the key go in between, it is still in use as far
+		// as this request is concerned and can be tried again.
+		return &Record{RequestHash: requestHash, ExpiresAt: expiresAt}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status.Valid {
+		held.Response = &Response{
+			Status:      int(status.Int64),
+			Location:    location.String,
+			ContentType: contentType.String,
+			Body:        body,
+		}
+	}
+	return &held, nil
+}
+
+func (s *postgresStore) Complete(ctx context.Context, key Key, response Response) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status = $3, location = $4, content_type = $5, body = $6 WHERE scope = $1 AND key = $2;",
+		key.Scope, key.Key, response.Status, response.Location, response.ContentType, response.Body)
+	return err
+}
+
+func (s *postgresStore) Release(ctx context.Context, key Key) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2;",
+		key.Scope, key.Key)
+	return err
+}
+
+func (s *postgresStore) Purge(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1;", now)
+	return err
+}
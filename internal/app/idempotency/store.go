@@ -0,0 +1,91 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Key is an idempotency key as sent by a client, keys are only unique within
+// their scope so two organisations can use the same one.
+type Key struct {
+	Scope string
+	Key   string
+}
+
+// Response is what was sent back for the first request made with a key.
+type Response struct {
+	Status      int
+	Location    string
+	ContentType string
+	Body        []byte
+}
+
+// Record is a key that is held, Response is nil while the first request made
+// with it is still being handled.
+type Record struct {
+	RequestHash string
+	Response    *Response
+	ExpiresAt   time.Time
+}
+
+type Store interface {
+	// Reserve holds the key for a request until it expires. When the key is
+	// already held, and has not expired by now, nothing changes and the
+	// record holding it is returned instead.
+	Reserve(ctx context.Context, key Key, requestHash string, now time.Time, expiresAt time.Time) (held *Record, err error)
+	// Complete records the response for a key that was reserved.
+	Complete(ctx context.Context, key Key, response Response) error
+	// Release lets the key go so the request can be tried again.
+	Release(ctx context.Context, key Key) error
+	// Purge drops every key that has expired by now.
+	Purge(ctx context.Context, now time.Time) error
+}
+
+// NewMemoryStore keeps keys in memory, they are lost when the server stops.
+func NewMemoryStore() Store {
+	return &memoryStore{records: make(map[Key]Record)}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[Key]Record
+}
+
+func (s *memoryStore) Reserve(ctx context.Context, key Key, requestHash string, now time.Time, expiresAt time.Time) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held, ok := s.records[key]; ok && held.ExpiresAt.After(now) {
+		return &held, nil
+	}
+	s.records[key] = Record{RequestHash: requestHash, ExpiresAt: expiresAt}
+	return nil, nil
+}
+
+func (s *memoryStore) Complete(ctx context.Context, key Key, response Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held, ok := s.records[key]; ok {
+		held.Response = &response
+		s.records[key] = held
+	}
+	return nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, held := range s.records {
+		if !held.ExpiresAt.After(now) {
+			delete(s.records, key)
+		}
+	}
+	return nil
+}
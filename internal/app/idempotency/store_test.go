@@ -0,0 +1,236 @@
+package idempotency_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/idempotency"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Stores", func() {
+
+	var (
+		ctx   context.Context
+		key   idempotency.Key
+		now   time.Time
+		later time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		key = idempotency.Key{Scope: "org", Key: "key-1"}
+		now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+		later = now.Add(time.Hour)
+	})
+
+	// behavesLikeAStore runs the cases every store that keeps keys itself
+	// has to pass.
+	behavesLikeAStore := func(newStore func() idempotency.Store) {
+		var s idempotency.Store
+
+		BeforeEach(func() {
+			s = newStore()
+		})
+
+		It("should reserve a new key", func() {
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+		})
+
+		It("should return the holder of a key that is held", func() {
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+			Expect(s.Reserve(ctx, key, "other", now, later)).To(Equal(&idempotency.Record{RequestHash: "hash", ExpiresAt: later}))
+
+			resp := idempotency.Response{Status: 201, Location: "/payment/1", Body: []byte("{}")}
+			Expect(s.Complete(ctx, key, resp)).To(Succeed())
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(Equal(&idempotency.Record{RequestHash: "hash", Response: &resp, ExpiresAt: later}))
+		})
+
+		It("should let a key be reserved again once released or expired", func() {
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+			Expect(s.Release(ctx, key)).To(Succeed())
+			Expect(s.Reserve(ctx, key, "other", now, later)).To(BeNil())
+			Expect(s.Reserve(ctx, key, "hash", later, later.Add(time.Hour))).To(BeNil())
+		})
+
+		It("should purge expired keys", func() {
+			other := idempotency.Key{Scope: "org", Key: "key-2"}
+			Expect(s.Reserve(ctx, key, "hash", now, now.Add(time.Minute))).To(BeNil())
+			Expect(s.Reserve(ctx, other, "hash", now, later)).To(BeNil())
+
+			Expect(s.Purge(ctx, now.Add(time.Minute))).To(Succeed())
+			Expect(s.Reserve(ctx, key, "other", now, later)).To(BeNil())
+			Expect(s.Reserve(ctx, other, "hash", now, later)).ToNot(BeNil())
+		})
+	}
+
+	Describe("Memory store", func() {
+		behavesLikeAStore(idempotency.NewMemoryStore)
+	})
+
+	Describe("File store", func() {
+		var (
+			dir  string
+			name string
+		)
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "idempotency")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+			name = filepath.Join(dir, "idempotency.log")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		open := func() idempotency.Store {
+			s, err := idempotency.NewFileStore(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			return s
+		}
+
+		behavesLikeAStore(open)
+
+		reopen := func(s idempotency.Store) idempotency.Store {
+			Expect(s.(io.Closer).Close()).To(Succeed())
+			return open()
+		}
+
+		It("should keep the keys and their responses once reopened", func() {
+			s := open()
+			resp := idempotency.Response{Status: 201, Location: "/payment/1", ContentType: "application/json", Body: []byte(`{"id":"1"}`)}
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+			Expect(s.Complete(ctx, key, resp)).To(Succeed())
+			released := idempotency.Key{Scope: "org", Key: "key-2"}
+			Expect(s.Reserve(ctx, released, "hash", now, later)).To(BeNil())
+			Expect(s.Release(ctx, released)).To(Succeed())
+			pending := idempotency.Key{Scope: "org", Key: "key-3"}
+			Expect(s.Reserve(ctx, pending, "hash", now, later)).To(BeNil())
+
+			s = reopen(s)
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(Equal(&idempotency.Record{RequestHash: "hash", Response: &resp, ExpiresAt: later}))
+			Expect(s.Reserve(ctx, released, "other", now, later)).To(BeNil())
+			Expect(s.Reserve(ctx, pending, "hash", now, later)).To(Equal(&idempotency.Record{RequestHash: "hash", ExpiresAt: later}))
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+
+		It("should drop a line torn by a crash and keep the ones before it", func() {
+			s := open()
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+			Expect(s.(io.Closer).Close()).To(Succeed())
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = f.WriteString(`{"op":"rese`)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			s = open()
+			other := idempotency.Key{Scope: "org", Key: "key-2"}
+			Expect(s.Reserve(ctx, other, "hash", now, later)).To(BeNil())
+			s = reopen(s)
+			Expect(s.Reserve(ctx, key, "other", now, later)).ToNot(BeNil())
+			Expect(s.Reserve(ctx, other, "other", now, later)).ToNot(BeNil())
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+
+		It("should write the log again with only the keys held once purged", func() {
+			s := open()
+			for i := 0; i < 1200; i++ {
+				k := idempotency.Key{Scope: "org", Key: fmt.Sprintf("purged-%d", i)}
+				Expect(s.Reserve(ctx, k, "hash", now, now.Add(time.Minute))).To(BeNil())
+			}
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+			before, err := os.Stat(name)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(s.Purge(ctx, now.Add(time.Minute))).To(Succeed())
+			after, err := os.Stat(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(after.Size()).To(BeNumerically("<", before.Size()/100))
+
+			other := idempotency.Key{Scope: "org", Key: "key-other"}
+			Expect(s.Reserve(ctx, other, "hash", now, later)).To(BeNil())
+			s = reopen(s)
+			Expect(s.Reserve(ctx, key, "other", now, later)).ToNot(BeNil())
+			Expect(s.Reserve(ctx, other, "other", now, later)).ToNot(BeNil())
+			Expect(s.Reserve(ctx, idempotency.Key{Scope: "org", Key: "purged-1"}, "other", now.Add(time.Minute), later)).To(BeNil())
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+	})
+
+	Describe("Postgres store", func() {
+		var (
+			s      idempotency.Store
+			dbMock sqlmock.Sqlmock
+		)
+
+		BeforeEach(func() {
+			db, mock, err := sqlmock.New()
+			Expect(err).ShouldNot(HaveOccurred())
+			s = idempotency.NewPostgresStore(db)
+			dbMock = mock
+		})
+
+		AfterEach(func() {
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should reserve a new or expired key in one statement", func() {
+			dbMock.ExpectQuery("INSERT INTO idempotency_keys \\(scope, key, request_hash, expires_at\\) VALUES \\(\\$1, \\$2, \\$3, \\$5\\) ON CONFLICT \\(scope, key\\) DO UPDATE .* WHERE idempotency_keys.expires_at <= \\$4 returning key;").
+				WithArgs("org", "key-1", "hash", now, later).
+				WillReturnRows(sqlmock.NewRows([]string{"key"}).AddRow("key-1"))
+
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(BeNil())
+		})
+
+		It("should read back the holder of a key that is held", func() {
+			dbMock.ExpectQuery("INSERT INTO idempotency_keys").
+				WillReturnError(sql.ErrNoRows)
+			dbMock.ExpectQuery("SELECT request_hash, status, location, content_type, body, expires_at FROM idempotency_keys WHERE scope = \\$1 AND key = \\$2;").
+				WithArgs("org", "key-1").
+				WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "location", "content_type", "body", "expires_at"}).
+					AddRow("hash", 201, "/payment/1", "application/json", []byte("{}"), later))
+
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(Equal(&idempotency.Record{
+				RequestHash: "hash",
+				Response:    &idempotency.Response{Status: 201, Location: "/payment/1", ContentType: "application/json", Body: []byte("{}")},
+				ExpiresAt:   later,
+			}))
+		})
+
+		It("should have no response for a key still in use", func() {
+			dbMock.ExpectQuery("INSERT INTO idempotency_keys").
+				WillReturnError(sql.ErrNoRows)
+			dbMock.ExpectQuery("SELECT request_hash").
+				WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status", "location", "content_type", "body", "expires_at"}).
+					AddRow("hash", nil, nil, nil, nil, later))
+
+			Expect(s.Reserve(ctx, key, "hash", now, later)).To(Equal(&idempotency.Record{RequestHash: "hash", ExpiresAt: later}))
+		})
+
+		It("should complete, release and purge keys", func() {
+			dbMock.ExpectExec("UPDATE idempotency_keys SET status = \\$3, location = \\$4, content_type = \\$5, body = \\$6 WHERE scope = \\$1 AND key = \\$2;").
+				WithArgs("org", "key-1", 201, "/payment/1", "", []byte("{}")).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			dbMock.ExpectExec("DELETE FROM idempotency_keys WHERE scope = \\$1 AND key = \\$2;").
+				WithArgs("org", "key-1").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			dbMock.ExpectExec("DELETE FROM idempotency_keys WHERE expires_at <= \\$1;").
+				WithArgs(now).
+				WillReturnResult(sqlmock.NewResult(0, 3))
+
+			Expect(s.Complete(ctx, key, idempotency.Response{Status: 201, Location: "/payment/1", Body: []byte("{}")})).To(Succeed())
+			Expect(s.Release(ctx, key)).To(Succeed())
+			Expect(s.Purge(ctx, now)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,252 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// Migration is one versioned change to the schema, Down undoes Up.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil when it
+// is still pending.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// UnknownVersionError is returned when asked to migrate to, or down from, a
+// version that this build has no migration for.
+type UnknownVersionError struct {
+	Version int
+}
+
+func (e *UnknownVersionError) Error() string {
+	return fmt.Sprintf("migration: version %d is not known", e.Version)
+}
+
+type Database interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+type Migrator struct {
+	db         Database
+	migrations []Migration
+}
+
+func New(db Database) *Migrator {
+	return NewWithMigrations(db, All)
+}
+
+func NewWithMigrations(db Database, migrations []Migration) *Migrator {
+	ms := make([]Migration, len(migrations))
+	copy(ms, migrations)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return &Migrator{db: db, migrations: ms}
+}
+
+// Latest is the version of the newest migration.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down undoes the last migration applied, if there is one.
+func (m *Migrator) Down(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	versions := sortedVersions(applied)
+	switch len(versions) {
+	case 0:
+		log.Info("No migrations to undo")
+		return nil
+	case 1:
+		return m.to(ctx, 0, applied)
+	default:
+		return m.to(ctx, versions[len(versions)-2], applied)
+	}
+}
+
+// To applies or undoes migrations until the schema is at the version given,
+// version 0 undoes them all.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version != 0 && m.find(version) == nil {
+		return &UnknownVersionError{Version: version}
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return m.to(ctx, version, applied)
+}
+
+func (m *Migrator) to(ctx context.Context, version int, applied map[int]time.Time) (err error) {
+	versions := sortedVersions(applied)
+	for i := len(versions) - 1; i >= 0 && versions[i] > version; i-- {
+		mig := m.find(versions[i])
+		if mig == nil {
+			return &UnknownVersionError{Version: versions[i]}
+		}
+		if err = m.apply(ctx, *mig, false); err != nil {
+			return err
+		}
+	}
+
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok || mig.Version > version {
+			continue
+		}
+		if err = m.apply(ctx, mig, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status lists every migration known to this build and any applied to the
+// database that it does not know about, ordered by version.
+func (m *Migrator) Status(ctx context.Context) (statuses []Status, err error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return statuses, err
+	}
+
+	for _, mig := range m.migrations {
+		s := Status{Migration: mig}
+		if at, ok := applied[mig.Version]; ok {
+			s.AppliedAt = &at
+			delete(applied, mig.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	for _, v := range sortedVersions(applied) {
+		at := applied[v]
+		statuses = append(statuses, Status{Migration: Migration{Version: v, Name: "unknown"}, AppliedAt: &at})
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i]
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (applied map[int]time.Time, err error) {
+	_, err = m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+ version integer PRIMARY KEY,
+ name text NOT NULL,
+ applied_at timestamptz NOT NULL DEFAULT now()
+);`)
+	if err != nil {
+		return applied, err
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return applied, err
+	}
+	defer rows.Close()
+
+	applied = make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			at      time.Time
+		)
+		if err = rows.Scan(&version, &at); err != nil {
+			return applied, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// apply runs one migration in its own transaction. The tracking table is
+// locked first so that servers migrating on start at the same time wait for
+// each other, and the migration is skipped if another got there first.
+func (m *Migrator) apply(ctx context.Context, mig Migration, up bool) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Error(rbErr)
+			}
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, "LOCK TABLE schema_migrations IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+		return err
+	}
+
+	var done bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1);", mig.Version).Scan(&done)
+	if err != nil {
+		return err
+	}
+	if done == up {
+		return tx.Commit()
+	}
+
+	if up {
+		if _, err = tx.ExecContext(ctx, mig.Up); err != nil {
+			return fmt.Errorf("migration: %d %s failed, %s", mig.Version, mig.Name, err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations(version, name) VALUES($1, $2);", mig.Version, mig.Name)
+	} else {
+		if _, err = tx.ExecContext(ctx, mig.Down); err != nil {
+			return fmt.Errorf("migration: undoing %d %s failed, %s", mig.Version, mig.Name, err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1;", mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if up {
+		log.Infof("Applied migration %d %s", mig.Version, mig.Name)
+	} else {
+		log.Infof("Undid migration %d %s", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+func sortedVersions(applied map[int]time.Time) []int {
+	versions := make([]int, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
@@ -0,0 +1,213 @@
+package migration_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/migration"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Migration", func() {
+
+	var (
+		m      *migration.Migrator
+		db     *sql.DB
+		dbMock sqlmock.Sqlmock
+		ctx    context.Context
+		now    time.Time
+	)
+
+	migrations := []migration.Migration{
+		{Version: 2, Name: "second", Up: "CREATE TABLE b", Down: "DROP TABLE b"},
+		{Version: 1, Name: "first", Up: "CREATE TABLE a", Down: "DROP TABLE a"},
+		{Version: 3, Name: "third", Up: "CREATE TABLE c", Down: "DROP TABLE c"},
+	}
+
+	givenApplied := func(versions ...int) {
+		dbMock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		rows := sqlmock.NewRows([]string{"version", "applied_at"})
+		for _, v := range versions {
+			rows.AddRow(v, now)
+		}
+		dbMock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+			WillReturnRows(rows)
+	}
+
+	expectApply := func(version int, statement string, tracking string) {
+		undo := strings.HasPrefix(tracking, "DELETE")
+		dbMock.ExpectBegin()
+		dbMock.ExpectExec("LOCK TABLE schema_migrations").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		dbMock.ExpectQuery("SELECT EXISTS").
+			WithArgs(version).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(undo))
+		dbMock.ExpectExec(statement).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		dbMock.ExpectExec(tracking).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		dbMock.ExpectCommit()
+	}
+
+	BeforeEach(func() {
+		d, mock, err := sqlmock.New()
+		Expect(err).ShouldNot(HaveOccurred())
+		db = d
+		dbMock = mock
+		m = migration.NewWithMigrations(db, migrations)
+		ctx = context.Background()
+		now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	Describe("The payments migrations", func() {
+		It("should have unique increasing versions that can be undone", func() {
+			for i, mig := range migration.All {
+				Expect(mig.Version).Should(Equal(i + 1))
+				Expect(mig.Name).ShouldNot(BeEmpty())
+				Expect(mig.Up).ShouldNot(BeEmpty())
+				Expect(mig.Down).ShouldNot(BeEmpty())
+			}
+		})
+	})
+
+	Describe("Migrating up", func() {
+		Context("when nothing has been applied", func() {
+			It("should apply every migration in order", func() {
+				givenApplied()
+				expectApply(1, "CREATE TABLE a", "INSERT INTO schema_migrations")
+				expectApply(2, "CREATE TABLE b", "INSERT INTO schema_migrations")
+				expectApply(3, "CREATE TABLE c", "INSERT INTO schema_migrations")
+
+				Expect(m.Up(ctx)).ShouldNot(HaveOccurred())
+				Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when some have been applied", func() {
+			It("should only apply the pending ones", func() {
+				givenApplied(1, 2)
+				expectApply(3, "CREATE TABLE c", "INSERT INTO schema_migrations")
+
+				Expect(m.Up(ctx)).ShouldNot(HaveOccurred())
+				Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when another server applied it first", func() {
+			It("should skip it", func() {
+				givenApplied(1, 2)
+				dbMock.ExpectBegin()
+				dbMock.ExpectExec("LOCK TABLE schema_migrations").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				dbMock.ExpectQuery("SELECT EXISTS").
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				dbMock.ExpectCommit()
+
+				Expect(m.Up(ctx)).ShouldNot(HaveOccurred())
+				Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when a migration fails", func() {
+			It("should roll it back and stop", func() {
+				givenApplied(1)
+				dbMock.ExpectBegin()
+				dbMock.ExpectExec("LOCK TABLE schema_migrations").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				dbMock.ExpectQuery("SELECT EXISTS").
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				dbMock.ExpectExec("CREATE TABLE b").
+					WillReturnError(errors.New("syntax error"))
+				dbMock.ExpectRollback()
+
+				err := m.Up(ctx)
+				Expect(err).Should(MatchError("migration: 2 second failed, syntax error"))
+				Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Migrating down", func() {
+		It("should undo the last migration", func() {
+			givenApplied(1, 2, 3)
+			expectApply(3, "DROP TABLE c", "DELETE FROM schema_migrations")
+
+			Expect(m.Down(ctx)).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should undo the only migration", func() {
+			givenApplied(1)
+			expectApply(1, "DROP TABLE a", "DELETE FROM schema_migrations")
+
+			Expect(m.Down(ctx)).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should do nothing when nothing is applied", func() {
+			givenApplied()
+
+			Expect(m.Down(ctx)).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Migrating to a version", func() {
+		It("should undo newer migrations newest first", func() {
+			givenApplied(1, 2, 3)
+			expectApply(3, "DROP TABLE c", "DELETE FROM schema_migrations")
+			expectApply(2, "DROP TABLE b", "DELETE FROM schema_migrations")
+
+			Expect(m.To(ctx, 1)).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should apply older migrations up to the version", func() {
+			givenApplied(1)
+			expectApply(2, "CREATE TABLE b", "INSERT INTO schema_migrations")
+
+			Expect(m.To(ctx, 2)).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should reject an unknown version", func() {
+			Expect(m.To(ctx, 7)).Should(Equal(&migration.UnknownVersionError{Version: 7}))
+		})
+
+		It("should not undo a version it does not know", func() {
+			givenApplied(1, 2, 3, 4)
+
+			Expect(m.To(ctx, 3)).Should(Equal(&migration.UnknownVersionError{Version: 4}))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Getting the status", func() {
+		It("should list applied, pending and unknown migrations", func() {
+			givenApplied(1, 4)
+
+			actual, err := m.Status(ctx)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).Should(HaveLen(4))
+			Expect(actual[0].Version).Should(Equal(1))
+			Expect(*actual[0].AppliedAt).Should(BeTemporally("==", now))
+			Expect(actual[1].Version).Should(Equal(2))
+			Expect(actual[1].AppliedAt).Should(BeNil())
+			Expect(actual[2].Version).Should(Equal(3))
+			Expect(actual[2].AppliedAt).Should(BeNil())
+			Expect(actual[3].Migration).Should(Equal(migration.Migration{Version: 4, Name: "unknown"}))
+			Expect(*actual[3].AppliedAt).Should(BeTemporally("==", now))
+		})
+	})
+})
@@ -0,0 +1,201 @@
+package migration
+
+// All is every migration of the payments schema, a new migration is added to
+// the end with the next version and never changed once released.
+var All = []Migration{
+	{
+		Version: 1,
+		Name:    "create payments",
+		Up: `CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS payments (
+ ID uuid DEFAULT uuid_generate_v4() PRIMARY KEY,
+ info json NOT NULL
+);`,
+		Down: `DROP TABLE IF EXISTS payments;`,
+	},
+	{
+		Version: 2,
+		Name:    "soft delete payments",
+		Up: `ALTER TABLE payments ADD COLUMN IF NOT EXISTS deleted_at timestamptz NULL;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS deleted_reason text NULL;`,
+		Down: `ALTER TABLE payments DROP COLUMN IF EXISTS deleted_reason;
+ALTER TABLE payments DROP COLUMN IF EXISTS deleted_at;`,
+	},
+	{
+		Version: 3,
+		Name:    "jsonb payments with query columns",
+		Up: `ALTER TABLE payments ALTER COLUMN info TYPE jsonb USING info::jsonb;
+
+ALTER TABLE payments
+ ADD COLUMN organisation_id text NULL,
+ ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+ ADD COLUMN processing_date date NULL,
+ ADD COLUMN currency text NULL,
+ ADD COLUMN amount numeric NULL,
+ ADD COLUMN status text NULL;
+
+-- Rows saved before validation may hold anything, values that cannot be
+-- read are left NULL rather than failing the migration.
+CREATE FUNCTION pg_temp.date_or_null(v text) RETURNS date AS $$
+BEGIN
+ RETURN v::date;
+EXCEPTION WHEN others THEN
+ RETURN NULL;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+UPDATE payments SET
+ organisation_id = info ->> 'organisation_id',
+ processing_date = pg_temp.date_or_null(info -> 'attributes' ->> 'processing_date'),
+ currency = NULLIF(info -> 'attributes' ->> 'currency', ''),
+ amount = CASE WHEN info -> 'attributes' ->> 'amount' ~ '^-?[0-9]+(\.[0-9]+)?$'
+  THEN (info -> 'attributes' ->> 'amount')::numeric END,
+ status = info ->> 'status';
+
+CREATE INDEX payments_organisation_id_idx ON payments (organisation_id, ID);
+CREATE INDEX payments_organisation_created_at_idx ON payments (organisation_id, created_at);
+CREATE INDEX payments_organisation_processing_date_idx ON payments (organisation_id, COALESCE(processing_date, '-infinity'::date), ID);
+CREATE INDEX payments_organisation_currency_idx ON payments (organisation_id, COALESCE(currency, ''), ID);
+CREATE INDEX payments_organisation_amount_idx ON payments (organisation_id, COALESCE(amount, 0), ID);
+CREATE INDEX payments_organisation_status_idx ON payments (organisation_id, status);
+CREATE INDEX payments_info_idx ON payments USING GIN (info jsonb_path_ops);`,
+		Down: `DROP INDEX IF EXISTS payments_info_idx;
+DROP INDEX IF EXISTS payments_organisation_status_idx;
+DROP INDEX IF EXISTS payments_organisation_amount_idx;
+DROP INDEX IF EXISTS payments_organisation_currency_idx;
+DROP INDEX IF EXISTS payments_organisation_processing_date_idx;
+DROP INDEX IF EXISTS payments_organisation_created_at_idx;
+DROP INDEX IF EXISTS payments_organisation_id_idx;
+
+ALTER TABLE payments
+ DROP COLUMN IF EXISTS status,
+ DROP COLUMN IF EXISTS amount,
+ DROP COLUMN IF EXISTS currency,
+ DROP COLUMN IF EXISTS processing_date,
+ DROP COLUMN IF EXISTS created_at,
+ DROP COLUMN IF EXISTS organisation_id;
+
+ALTER TABLE payments ALTER COLUMN info TYPE json USING info::json;`,
+	},
+	{
+		Version: 4,
+		Name:    "idempotency keys",
+		Up: `CREATE TABLE idempotency_keys (
+ scope text NOT NULL,
+ key text NOT NULL,
+ request_hash text NOT NULL,
+ status integer NULL,
+ location text NULL,
+ content_type text NULL,
+ body bytea NULL,
+ expires_at timestamptz NOT NULL,
+ PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);`,
+		Down: `DROP TABLE IF EXISTS idempotency_keys;`,
+	},
+	{
+		Version: 5,
+		Name:    "payment status",
+		Up:      `UPDATE payments SET info = jsonb_set(info, '{status}', '"created"'), status = 'created' WHERE status IS NULL;`,
+		Down: `UPDATE payments SET info = info - 'status', status = NULL
+ WHERE status = 'created' AND NOT info ? 'status_history';`,
+	},
+	{
+		Version: 6,
+		Name:    "payment history",
+		Up: `CREATE TABLE payment_history (
+ id bigserial PRIMARY KEY,
+ payment_id uuid NOT NULL,
+ action text NOT NULL,
+ actor text NULL,
+ request_id text NULL,
+ at timestamptz NOT NULL,
+ previous jsonb NULL,
+ current jsonb NOT NULL
+);
+
+CREATE INDEX payment_history_payment_id_idx ON payment_history (payment_id, id);
+
+-- The history is only ever added to.
+CREATE RULE payment_history_no_update AS ON UPDATE TO payment_history DO INSTEAD NOTHING;
+CREATE RULE payment_history_no_delete AS ON DELETE TO payment_history DO INSTEAD NOTHING;`,
+		Down: `DROP TABLE IF EXISTS payment_history;`,
+	},
+	{
+		Version: 7,
+		Name:    "outbox",
+		Up: `CREATE TABLE outbox (
+ sequence bigserial PRIMARY KEY,
+ type text NOT NULL,
+ subject text NOT NULL,
+ at timestamptz NOT NULL,
+ data jsonb NOT NULL
+);`,
+		Down: `DROP TABLE IF EXISTS outbox;`,
+	},
+	{
+		Version: 8,
+		Name:    "webhooks",
+		Up: `CREATE TABLE webhook_subscriptions (
+ id uuid PRIMARY KEY,
+ organisation_id text NOT NULL,
+ url text NOT NULL,
+ events text[] NOT NULL DEFAULT '{}',
+ secret text NOT NULL,
+ enabled boolean NOT NULL DEFAULT true,
+ failures integer NOT NULL DEFAULT 0,
+ disabled_at timestamptz NULL,
+ created_at timestamptz NOT NULL
+);
+
+CREATE INDEX webhook_subscriptions_organisation_id_idx ON webhook_subscriptions (organisation_id, created_at);
+
+CREATE TABLE webhook_deliveries (
+ id uuid PRIMARY KEY,
+ subscription_id uuid NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+ event_sequence bigint NOT NULL,
+ event jsonb NOT NULL,
+ status text NOT NULL,
+ attempts jsonb NOT NULL DEFAULT '[]',
+ next_attempt_at timestamptz NULL,
+ created_at timestamptz NOT NULL,
+ UNIQUE (subscription_id, event_sequence)
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, created_at);`,
+		Down: `DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;`,
+	},
+	{
+		Version: 9,
+		Name:    "payment history by organisation",
+		Up:      `CREATE INDEX payment_history_organisation_id_idx ON payment_history ((current->>'organisation_id'), id);`,
+		Down:    `DROP INDEX IF EXISTS payment_history_organisation_id_idx;`,
+	},
+	{
+		Version: 10,
+		Name:    "api keys",
+		Up: `CREATE TABLE api_keys (
+ id uuid PRIMARY KEY,
+ name text NOT NULL,
+ prefix text NOT NULL,
+ hash text NOT NULL UNIQUE,
+ organisation_ids text[] NOT NULL,
+ created_at timestamptz NOT NULL,
+ revoked_at timestamptz NULL
+);`,
+		Down: `DROP TABLE IF EXISTS api_keys;`,
+	},
+	{
+		Version: 11,
+		Name:    "api key roles",
+		// Keys made before there were roles could do everything.
+		Up: `ALTER TABLE api_keys ADD COLUMN roles text[] NOT NULL DEFAULT '{admin}';
+ALTER TABLE api_keys ALTER COLUMN roles DROP DEFAULT;`,
+		Down: `ALTER TABLE api_keys DROP COLUMN IF EXISTS roles;`,
+	},
+}
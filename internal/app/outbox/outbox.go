@@ -0,0 +1,36 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Event is a change for other systems to react to. Events are written to the
+// Store in the same transaction as the change itself, so there is an event
+// for every change that was made and none for a change that was not.
+type Event struct {
+	// Sequence is given by the Store, consumers can use it to spot an event
+	// they have already been sent.
+	Sequence int64           `json:"sequence"`
+	Type     string          `json:"type"`
+	Subject  string          `json:"subject"`
+	At       time.Time       `json:"at"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Store holds the events waiting to be published.
+type Store interface {
+	// Pending returns up to limit events waiting to be published, oldest
+	// first.
+	Pending(ctx context.Context, limit int) (events []Event, err error)
+	// Published removes the events with these sequences, they will not be
+	// published again.
+	Published(ctx context.Context, sequences []int64) error
+}
+
+// Sink is somewhere events are published to. A batch either all makes it or
+// is sent again.
+type Sink interface {
+	Publish(ctx context.Context, events []Event) error
+}
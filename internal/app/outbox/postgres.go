@@ -0,0 +1,53 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+type Database interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// NewPostgresStore reads the events from the outbox table, they are written
+// there by the payment store.
+func NewPostgresStore(db Database) Store {
+	return &postgresStore{db: db}
+}
+
+type postgresStore struct {
+	db Database
+}
+
+func (s *postgresStore) Pending(ctx context.Context, limit int) (events []Event, err error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT sequence, type, subject, at, data FROM outbox ORDER BY sequence LIMIT $1;",
+		limit)
+	if err != nil {
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			e    Event
+			data []byte
+		)
+		if err = rows.Scan(&e.Sequence, &e.Type, &e.Subject, &e.At, &data); err != nil {
+			return events, err
+		}
+		e.Data = data
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Published deletes the events by their sequence rather than everything up to
+// the last of them, a transaction that took an earlier sequence may not have
+// committed yet.
+func (s *postgresStore) Published(ctx context.Context, sequences []int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM outbox WHERE sequence = ANY($1);", pq.Array(sequences))
+	return err
+}
@@ -0,0 +1,63 @@
+package outbox_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"time"
+)
+
+var _ = Describe("Postgres store", func() {
+
+	var (
+		ctx    context.Context
+		s      outbox.Store
+		dbMock sqlmock.Sqlmock
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		db, mock, err := sqlmock.New()
+		Expect(err).ShouldNot(HaveOccurred())
+		s = outbox.NewPostgresStore(db)
+		dbMock = mock
+	})
+
+	AfterEach(func() {
+		Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+	})
+
+	It("should return the events waiting oldest first", func() {
+		at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+		dbMock.ExpectQuery("SELECT sequence, type, subject, at, data FROM outbox ORDER BY sequence LIMIT \\$1;").
+			WithArgs(10).
+			WillReturnRows(sqlmock.NewRows([]string{"sequence", "type", "subject", "at", "data"}).
+				AddRow(3, "payment.created", "some id", at, []byte(`{"id":"some id"}`)).
+				AddRow(5, "payment.updated", "some id", at, []byte(`{"id":"some id","version":1}`)))
+
+		actual, err := s.Pending(ctx, 10)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(actual).To(HaveLen(2))
+		Expect(actual[0]).To(Equal(outbox.Event{Sequence: 3, Type: "payment.created", Subject: "some id", At: at, Data: []byte(`{"id":"some id"}`)}))
+		Expect(actual[1].Sequence).To(Equal(int64(5)))
+	})
+
+	It("should return the error when the events cannot be read", func() {
+		dbMock.ExpectQuery("SELECT sequence").WillReturnError(sql.ErrConnDone)
+
+		_, err := s.Pending(ctx, 10)
+		Expect(err).To(Equal(sql.ErrConnDone))
+	})
+
+	It("should delete the events published by their sequence", func() {
+		dbMock.ExpectExec("DELETE FROM outbox WHERE sequence = ANY\\(\\$1\\);").
+			WithArgs(pq.Array([]int64{3, 5})).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+
+		Expect(s.Published(ctx, []int64{3, 5})).To(Succeed())
+	})
+})
@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	batchSize = 100
+	// maxBackoff is how many intervals the relay waits at most after
+	// failing again and again.
+	maxBackoff = 60
+)
+
+// NewRelay publishes the events waiting in the store to every sink, checking
+// for new ones every interval.
+func NewRelay(store Store, sinks []Sink, interval time.Duration) *Relay {
+	return &Relay{store: store, sinks: sinks, interval: interval}
+}
+
+// Relay takes events from the Store to the sinks, oldest first. An event is
+// only removed from the store once every sink has it, when a sink fails the
+// same events are sent again after backing off so the sinks that did not fail
+// get them twice. Every event is delivered at least once.
+type Relay struct {
+	store    Store
+	sinks    []Sink
+	interval time.Duration
+}
+
+// Run publishes events until the context is done.
+func (r *Relay) Run(ctx context.Context) {
+	failures := uint(0)
+	for {
+		n, err := r.Publish(ctx)
+		wait := r.interval
+		switch {
+		case err != nil:
+			failures++
+			wait = r.backoff(failures)
+			log.Warnf("Failed to publish events, trying again in %s: %s", wait, err)
+		case n == batchSize:
+			// There may be more waiting.
+			failures, wait = 0, 0
+		default:
+			failures = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff doubles the wait with each failure in a row up to a limit.
+func (r *Relay) backoff(failures uint) time.Duration {
+	if failures > 6 {
+		return r.interval * maxBackoff
+	}
+	wait := r.interval << failures
+	if wait > r.interval*maxBackoff {
+		return r.interval * maxBackoff
+	}
+	return wait
+}
+
+// Publish sends one batch of the events waiting to every sink and returns how
+// many there were.
+func (r *Relay) Publish(ctx context.Context) (int, error) {
+	events, err := r.store.Pending(ctx, batchSize)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	for _, sink := range r.sinks {
+		if err = sink.Publish(ctx, events); err != nil {
+			return 0, err
+		}
+	}
+
+	sequences := make([]int64, len(events))
+	for i, e := range events {
+		sequences[i] = e.Sequence
+	}
+	if err = r.store.Published(ctx, sequences); err != nil {
+		return 0, err
+	}
+	log.Debugf("Published %d events", len(events))
+	return len(events), nil
+}
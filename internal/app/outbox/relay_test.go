@@ -0,0 +1,166 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Relay", func() {
+
+	var (
+		ctx   context.Context
+		store *memoryStore
+		sink  *recordingSink
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = &memoryStore{}
+		store.add("payment.created", "payment.updated")
+		sink = &recordingSink{}
+	})
+
+	Describe("publishing", func() {
+		It("should send the events to every sink oldest first and then remove them", func() {
+			other := &recordingSink{}
+			r := outbox.NewRelay(store, []outbox.Sink{sink, other}, time.Second)
+
+			Expect(r.Publish(ctx)).To(Equal(2))
+			Expect(sink.types()).To(Equal([]string{"payment.created", "payment.updated"}))
+			Expect(other.types()).To(Equal([]string{"payment.created", "payment.updated"}))
+			Expect(store.pending()).To(BeEmpty())
+		})
+
+		It("should keep the events when a sink fails and send them again", func() {
+			failing := &recordingSink{failures: 1}
+			r := outbox.NewRelay(store, []outbox.Sink{sink, failing}, time.Second)
+
+			_, err := r.Publish(ctx)
+			Expect(err).To(Equal(errSink))
+			Expect(store.pending()).To(HaveLen(2))
+
+			Expect(r.Publish(ctx)).To(Equal(2))
+			Expect(sink.types()).To(Equal([]string{"payment.created", "payment.updated", "payment.created", "payment.updated"}))
+			Expect(failing.types()).To(Equal([]string{"payment.created", "payment.updated"}))
+			Expect(store.pending()).To(BeEmpty())
+		})
+
+		It("should drop the events when there are no sinks", func() {
+			r := outbox.NewRelay(store, nil, time.Second)
+
+			Expect(r.Publish(ctx)).To(Equal(2))
+			Expect(store.pending()).To(BeEmpty())
+		})
+
+		It("should do nothing when no events are waiting", func() {
+			r := outbox.NewRelay(&memoryStore{}, []outbox.Sink{sink}, time.Second)
+
+			Expect(r.Publish(ctx)).To(BeZero())
+			Expect(sink.types()).To(BeEmpty())
+		})
+	})
+
+	Describe("running", func() {
+		It("should publish new events, retrying after failures, until stopped", func() {
+			sink.failures = 2
+			r := outbox.NewRelay(store, []outbox.Sink{sink}, time.Millisecond)
+			ctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				r.Run(ctx)
+				close(done)
+			}()
+
+			Eventually(store.pending).Should(BeEmpty())
+			store.add("payment.status_changed")
+			Eventually(store.pending).Should(BeEmpty())
+			Expect(sink.types()).To(Equal([]string{"payment.created", "payment.updated", "payment.status_changed"}))
+
+			cancel()
+			Eventually(done).Should(BeClosed())
+		})
+	})
+})
+
+var errSink = errors.New("sink failed")
+
+// memoryStore holds events for the relay to publish.
+type memoryStore struct {
+	mu       sync.Mutex
+	events   []outbox.Event
+	sequence int64
+}
+
+func (s *memoryStore) add(types ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range types {
+		s.sequence++
+		s.events = append(s.events, outbox.Event{Sequence: s.sequence, Type: t, Subject: "some id"})
+	}
+}
+
+func (s *memoryStore) pending() []outbox.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]outbox.Event{}, s.events...)
+}
+
+func (s *memoryStore) Pending(ctx context.Context, limit int) ([]outbox.Event, error) {
+	events := s.pending()
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (s *memoryStore) Published(ctx context.Context, sequences []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	published := make(map[int64]bool)
+	for _, seq := range sequences {
+		published[seq] = true
+	}
+	pending := s.events[:0]
+	for _, e := range s.events {
+		if !published[e.Sequence] {
+			pending = append(pending, e)
+		}
+	}
+	s.events = pending
+	return nil
+}
+
+// recordingSink keeps every event it is given, failing the first few
+// batches.
+type recordingSink struct {
+	mu       sync.Mutex
+	failures int
+	events   []outbox.Event
+}
+
+func (s *recordingSink) Publish(ctx context.Context, events []outbox.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errSink
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *recordingSink) types() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	types := make([]string, 0, len(s.events))
+	for _, e := range s.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
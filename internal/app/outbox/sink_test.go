@@ -0,0 +1,131 @@
+package outbox_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Sinks", func() {
+
+	var (
+		ctx    context.Context
+		events []outbox.Event
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+		events = []outbox.Event{
+			{Sequence: 1, Type: "payment.created", Subject: "some id", At: at, Data: json.RawMessage(`{"id":"some id"}`)},
+			{Sequence: 2, Type: "payment.updated", Subject: "some id", At: at, Data: json.RawMessage(`{"id":"some id","version":1}`)},
+		}
+	})
+
+	Describe("Webhook sink", func() {
+		var (
+			server   *httptest.Server
+			mu       sync.Mutex
+			received []outbox.Event
+			status   int
+		)
+
+		BeforeEach(func() {
+			received, status = nil, http.StatusNoContent
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Method).To(Equal(http.MethodPost))
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				var e outbox.Event
+				Expect(json.NewDecoder(r.Body).Decode(&e)).To(Succeed())
+				mu.Lock()
+				received = append(received, e)
+				mu.Unlock()
+				w.WriteHeader(status)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should post each event as JSON", func() {
+			s := outbox.NewWebhookSink(server.URL, server.Client())
+			Expect(s.Publish(ctx, events)).To(Succeed())
+			Expect(received).To(Equal(events))
+		})
+
+		It("should fail on a response other than 2xx", func() {
+			status = http.StatusServiceUnavailable
+			s := outbox.NewWebhookSink(server.URL, server.Client())
+			err := s.Publish(ctx, events)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("503"))
+			Expect(received).To(HaveLen(1))
+		})
+
+		It("should fail when the webhook cannot be reached", func() {
+			s := outbox.NewWebhookSink(server.URL, server.Client())
+			server.Close()
+			Expect(s.Publish(ctx, events)).ShouldNot(Succeed())
+		})
+	})
+
+	Describe("File sink", func() {
+		var dir string
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "outbox")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		readLines := func(name string) (events []outbox.Event) {
+			f, err := os.Open(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer f.Close()
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var e outbox.Event
+				Expect(json.Unmarshal(scanner.Bytes(), &e)).To(Succeed())
+				events = append(events, e)
+			}
+			Expect(scanner.Err()).ShouldNot(HaveOccurred())
+			return events
+		}
+
+		It("should append each event as a line of JSON", func() {
+			name := filepath.Join(dir, "events.ndjson")
+			s, err := outbox.NewFileSink(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(s.Publish(ctx, events[:1])).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+
+			s, err = outbox.NewFileSink(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(s.Publish(ctx, events[1:])).To(Succeed())
+			Expect(s.Close()).To(Succeed())
+
+			Expect(readLines(name)).To(Equal(events))
+		})
+
+		It("should fail to open a file in a directory that does not exist", func() {
+			_, err := outbox.NewFileSink(filepath.Join(dir, "missing", "events.ndjson"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Decision is what was decided about a payment waiting for approval.
+type Decision string
+
+const (
+	DecisionApproved Decision = "approved"
+	DecisionRejected Decision = "rejected"
+)
+
+// Approval is the decision made on a payment that was pending approval, it is
+// made by someone other than who created the payment.
+type Approval struct {
+	Decision Decision  `json:"decision"`
+	By       string    `json:"by"`
+	At       time.Time `json:"at"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Thresholds are the amounts above which payments have to be approved before
+// they can be submitted, by organisation id and then currency.
+type Thresholds map[string]map[string]Decimal
+
+// ReadThresholds reads the thresholds from a JSON file such as
+// {"743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb": {"GBP": "10000.00"}}.
+func ReadThresholds(name string) (Thresholds, error) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var t Thresholds
+	if err = json.Unmarshal(bs, &t); err != nil {
+		return nil, err
+	}
+	for organisationId, currencies := range t {
+		for currency, threshold := range currencies {
+			if _, ok := MinorUnits(currency); !ok || threshold.Empty() || threshold.Sign() < 0 {
+				return nil, fmt.Errorf("payment: the threshold of '%s' in '%s' must be an amount in an ISO 4217 currency", organisationId, currency)
+			}
+		}
+	}
+	return t, nil
+}
+
+// Exceeded is true when the payment is for more than the threshold of its
+// organisation in its currency, there is no limit without one.
+func (t Thresholds) Exceeded(p Payment) bool {
+	threshold, ok := t[p.OrganisationId][p.Attributes.Currency]
+	return ok && p.Attributes.Amount.Cmp(threshold) > 0
+}
+
+// creator is who created the payment, a payment saved before there was a
+// lifecycle has no one.
+func creator(p Payment) string {
+	if len(p.StatusHistory) == 0 {
+		return ""
+	}
+	return p.StatusHistory[0].Actor
+}
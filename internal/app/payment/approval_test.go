@@ -0,0 +1,63 @@
+package payment_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Approval thresholds", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		d, err := ioutil.TempDir("", "thresholds")
+		Expect(err).ShouldNot(HaveOccurred())
+		dir = d
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	givenThresholdsFile := func(content string) string {
+		name := filepath.Join(dir, "thresholds.json")
+		Expect(ioutil.WriteFile(name, []byte(content), 0600)).To(Succeed())
+		return name
+	}
+
+	It("should read the thresholds by organisation and currency", func() {
+		t, err := payment.ReadThresholds(givenThresholdsFile(`{"org": {"GBP": "10000.00", "JPY": "1000000"}}`))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(t).To(Equal(payment.Thresholds{
+			"org": {"GBP": payment.MustParseDecimal("10000.00"), "JPY": payment.MustParseDecimal("1000000")},
+		}))
+
+		p := givenValidPayment()
+		p.OrganisationId = "org"
+		p.Attributes.Amount = payment.MustParseDecimal("10000.00")
+		Expect(t.Exceeded(p)).To(BeFalse())
+		p.Attributes.Amount = payment.MustParseDecimal("10000.01")
+		Expect(t.Exceeded(p)).To(BeTrue())
+		p.OrganisationId = "other"
+		Expect(t.Exceeded(p)).To(BeFalse())
+	})
+
+	It("should refuse an unknown currency", func() {
+		_, err := payment.ReadThresholds(givenThresholdsFile(`{"org": {"XYZ": "10.00"}}`))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should refuse a negative threshold", func() {
+		_, err := payment.ReadThresholds(givenThresholdsFile(`{"org": {"GBP": "-1.00"}}`))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should refuse a file that is not json", func() {
+		_, err := payment.ReadThresholds(givenThresholdsFile(`not json`))
+		Expect(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,28 @@
+package payment
+
+// Error is a failure the caller can do something about. The code identifies
+// the error and never changes, the message is for people.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "payment: " + e.Message
+}
+
+var (
+	ErrNotFound        = &Error{Code: "not_found", Message: "not found"}
+	ErrVersionConflict = &Error{Code: "version_conflict", Message: "version conflict"}
+	ErrInvalidCursor   = &Error{Code: "invalid_cursor", Message: "invalid page cursor"}
+	ErrInvalidSort     = &Error{Code: "invalid_sort", Message: "invalid sort"}
+
+	ErrCurrencyMismatch = &Error{Code: "currency_mismatch", Message: "amounts are in different currencies"}
+	ErrUnknownCurrency  = &Error{Code: "unknown_currency", Message: "not an ISO 4217 currency"}
+
+	ErrApprovalRequired        = &Error{Code: "approval_required", Message: "payment has to be approved before it is submitted"}
+	ErrNotPendingApproval      = &Error{Code: "not_pending_approval", Message: "payment is not pending approval"}
+	ErrSelfApproval            = &Error{Code: "self_approval", Message: "payment cannot be approved or rejected by who created it"}
+	ErrUnknownApprover         = &Error{Code: "unknown_approver", Message: "who is approving or rejecting is not known"}
+	ErrUnauthenticatedApprover = &Error{Code: "unauthenticated_approver", Message: "payment can only be approved or rejected by an authenticated caller"}
+)
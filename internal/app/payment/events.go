@@ -0,0 +1,24 @@
+package payment
+
+import "github.com/carlosroman/payments-api/internal/app/outbox"
+
+// The types of event published for a change, the data of each is the payment
+// after the change.
+const (
+	EventCreated       = "payment.created"
+	EventUpdated       = "payment.updated"
+	EventStatusChanged = "payment.status_changed"
+)
+
+// newEvent is the event published for a change made to a payment, the store
+// gives it a sequence when it is written with the change.
+func newEvent(change Change, paymentId string, doc []byte) outbox.Event {
+	eventType := EventUpdated
+	switch change.Action {
+	case ActionCreate:
+		eventType = EventCreated
+	case ActionTransition, ActionApprove, ActionReject:
+		eventType = EventStatusChanged
+	}
+	return outbox.Event{Type: eventType, Subject: paymentId, At: change.At, Data: doc}
+}
@@ -0,0 +1,35 @@
+package payment
+
+import "errors"
+
+// FailNextWrite makes the next write to the log of a file repository write
+// only half the record and fail, the log then cannot be cut back either when
+// cannotCut is set.
+func FailNextWrite(r Repository, cannotCut bool) {
+	f := r.(*fileRepository)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.log = &failingJournal{journal: f.log, cannotCut: cannotCut}
+}
+
+type failingJournal struct {
+	journal
+	failed    bool
+	cannotCut bool
+}
+
+func (j *failingJournal) Write(p []byte) (int, error) {
+	if j.failed {
+		return j.journal.Write(p)
+	}
+	j.failed = true
+	n, _ := j.journal.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (j *failingJournal) Truncate(size int64) error {
+	if j.cannotCut {
+		return errors.New("input/output error")
+	}
+	return j.journal.Truncate(size)
+}
@@ -0,0 +1,421 @@
+package payment
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	logFile      = "payments.log"
+	snapshotFile = "payments.snapshot"
+	positionFile = "outbox.position"
+)
+
+// NewFileRepository keeps payments in memory and makes every change durable
+// in an append-only log in the directory before it is made. Once the log
+// holds snapshotEvery changes all the payments, with their history, are
+// written to a snapshot and the log is started again. On opening the snapshot
+// and then the log are replayed, a record left half written by a crash is
+// dropped so the payments before it are kept.
+//
+// The events of each change are written in the same record as its revisions.
+// The sequence of the last event published is kept in a file of its own so
+// they are not published again.
+func NewFileRepository(dir string, snapshotEvery int) (Repository, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	r := &fileRepository{dir: dir, snapshotEvery: snapshotEvery}
+	r.memoryRepository = newMemoryRepository(r.append, r.acknowledge)
+
+	position, err := readPosition(filepath.Join(dir, positionFile))
+	if err != nil {
+		return nil, err
+	}
+	r.sequence, r.position = position, position
+	if err := r.replay(filepath.Join(dir, snapshotFile), false); err != nil {
+		return nil, err
+	}
+	if err := r.replay(filepath.Join(dir, logFile), true); err != nil {
+		return nil, err
+	}
+	// The snapshot holds the payments in no order.
+	for _, changes := range r.changes {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].sequence < changes[j].sequence })
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r.log = f
+	log.Infof("Loaded %d payments and %d events to publish from '%s'", len(r.payments), len(r.events), dir)
+	return r, nil
+}
+
+type fileRepository struct {
+	*memoryRepository
+	dir           string
+	log           journal
+	records       int
+	snapshotEvery int
+	// position is the sequence of the last event published.
+	position int64
+	// broken is why the log cannot be written to any more, a write failed
+	// and what it left could not be cut off.
+	broken error
+}
+
+// journal is the log file, tests swap it for one that fails.
+type journal interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// A record is a line holding the CRC-32 of its documents in hex followed by
+// the documents as a JSON array, all of them are applied or none are. The
+// documents are revisions and events, or payments for records written before
+// there was a history.
+func encodeRecord(docs [][]byte) []byte {
+	body := append([]byte{'['}, bytes.Join(docs, []byte{','})...)
+	body = append(body, ']')
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(body), body))
+}
+
+func decodeRecord(line []byte) (docs []json.RawMessage, ok bool) {
+	if len(line) < 10 || line[8] != ' ' || line[len(line)-1] != '\n' {
+		return nil, false
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	body := line[9 : len(line)-1]
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(body) {
+		return nil, false
+	}
+	if err = json.Unmarshal(body, &docs); err != nil {
+		return nil, false
+	}
+	return docs, true
+}
+
+// replay applies every record of the file. A bad record in the log can only
+// be the last write torn by a crash so the log is cut short there, the
+// snapshot is only ever renamed into place once complete so it has none.
+func (r *fileRepository) replay(name string, isLog bool) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		reader = bufio.NewReader(f)
+		offset int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		docs, ok := decodeRecord(line)
+		if !ok {
+			if !isLog {
+				return fmt.Errorf("payment: '%s' is corrupt at offset %d", name, offset)
+			}
+			log.Warnf("Dropping the torn end of '%s' from offset %d", name, offset)
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+
+		for _, doc := range docs {
+			if err = r.apply(doc); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+		if isLog {
+			r.records++
+		}
+	}
+}
+
+// apply puts a document read back from a file into memory. A revision
+// already in the history or an event already seen is skipped, it is in the
+// snapshot as well as the log when a crash stopped the log being emptied. An
+// event already published is skipped too.
+func (r *fileRepository) apply(doc json.RawMessage) error {
+	var revision struct {
+		Current  *json.RawMessage `json:"current"`
+		Sequence *int64           `json:"sequence"`
+	}
+	if err := json.Unmarshal(doc, &revision); err != nil {
+		return err
+	}
+	if revision.Current == nil && revision.Sequence != nil {
+		var e outbox.Event
+		if err := json.Unmarshal(doc, &e); err != nil {
+			return err
+		}
+		if e.Sequence > r.sequence {
+			r.enqueue(e)
+		}
+		return nil
+	}
+	payment, history, sequence := doc, []byte(doc), int64(0)
+	if revision.Current != nil {
+		payment = *revision.Current
+		if revision.Sequence != nil {
+			sequence = *revision.Sequence
+		}
+	} else {
+		history = nil
+	}
+
+	var p struct {
+		Id             string `json:"id"`
+		OrganisationId string `json:"organisation_id"`
+	}
+	if err := json.Unmarshal(payment, &p); err != nil {
+		return err
+	}
+	for _, seen := range r.payments[p.Id].history {
+		if history != nil && bytes.Equal(seen, history) {
+			return nil
+		}
+	}
+	r.put(p.Id, p.OrganisationId, payment, history, sequence)
+	return nil
+}
+
+// append is the journal of the memory repository so it is called with its
+// lock held, nothing else can change the payments while it runs.
+// A write that fails is cut off the log, the replay stops at the first bad
+// record so one left there would lose every record written after it. When it
+// cannot be cut off the log takes no more writes.
+func (r *fileRepository) append(docs [][]byte) error {
+	if r.broken != nil {
+		return r.broken
+	}
+	info, err := r.log.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.log.Write(encodeRecord(docs))
+	if err == nil {
+		err = r.log.Sync()
+	}
+	if err != nil {
+		if cutErr := r.cut(info.Size()); cutErr != nil {
+			r.broken = fmt.Errorf("payment: the log in '%s' takes no more writes, a failed write could not be cut off: %s", r.dir, cutErr)
+			log.Error(r.broken)
+		}
+		return err
+	}
+	r.records++
+	return nil
+}
+
+func (r *fileRepository) cut(size int64) error {
+	if err := r.log.Truncate(size); err != nil {
+		return err
+	}
+	return r.log.Sync()
+}
+
+func (r *fileRepository) Insert(ctx context.Context, payment Payment, change Change) error {
+	return r.compact(r.memoryRepository.Insert(ctx, payment, change))
+}
+
+func (r *fileRepository) InsertAll(ctx context.Context, payments []Payment, change Change) error {
+	return r.compact(r.memoryRepository.InsertAll(ctx, payments, change))
+}
+
+func (r *fileRepository) Update(ctx context.Context, payment Payment, expectedVersion int32, change Change) error {
+	return r.compact(r.memoryRepository.Update(ctx, payment, expectedVersion, change))
+}
+
+// compact takes a snapshot once the log holds snapshotEvery records. The
+// change is already safe in the log by then so a failed snapshot is only
+// logged, the next change will try again.
+func (r *fileRepository) compact(err error) error {
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snapshotEvery > 0 && r.records >= r.snapshotEvery {
+		if err := r.snapshot(); err != nil {
+			log.Errorf("Failed to snapshot '%s': %s", r.dir, err)
+		}
+	}
+	return nil
+}
+
+// snapshot writes every payment to a new file that replaces the old snapshot
+// in one rename, each payment is a record of its whole history and the events
+// still to be published are a record after them. Only then is the log
+// emptied, a crash in between replays the log over the new snapshot which
+// only repeats revisions and events already in it. The lock must be held.
+func (r *fileRepository) snapshot() error {
+	tmp := filepath.Join(r.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, stored := range r.payments {
+		docs := stored.history
+		if len(docs) == 0 {
+			docs = [][]byte{stored.doc}
+		}
+		if _, err = w.Write(encodeRecord(docs)); err != nil {
+			break
+		}
+	}
+	if err == nil && len(r.events) > 0 {
+		docs := make([][]byte, len(r.events))
+		for i, e := range r.events {
+			if docs[i], err = json.Marshal(e); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = w.Write(encodeRecord(docs))
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(r.dir, snapshotFile)); err != nil {
+		return err
+	}
+	if err = syncDir(r.dir); err != nil {
+		return err
+	}
+	if err = r.log.Truncate(0); err != nil {
+		return err
+	}
+	r.records = 0
+	return r.log.Sync()
+}
+
+// acknowledge keeps the sequence of the last event published, it is written
+// to a new file renamed into place so a crash leaves the old one or the new.
+// It is called with the lock of the memory repository held.
+func (r *fileRepository) acknowledge(through int64) error {
+	if through == r.position {
+		return nil
+	}
+
+	tmp := filepath.Join(r.dir, positionFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatInt(through, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(r.dir, positionFile)); err != nil {
+		return err
+	}
+	if err = syncDir(r.dir); err != nil {
+		return err
+	}
+	r.position = through
+	return nil
+}
+
+func readPosition(name string) (int64, error) {
+	bs, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	position, err := strconv.ParseInt(string(bs), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("payment: '%s' is corrupt: %s", name, err)
+	}
+	return position, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Ping checks the log can still be written to and that files can still be
+// made in the directory, which snapshots need.
+func (r *fileRepository) Ping(ctx context.Context) error {
+	r.mu.RLock()
+	broken := r.broken
+	r.mu.RUnlock()
+	if broken != nil {
+		return broken
+	}
+	if _, err := r.log.Stat(); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(r.dir, "ping")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (r *fileRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.log.Close()
+}
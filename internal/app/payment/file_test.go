@@ -0,0 +1,319 @@
+package payment_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/satori/go.uuid"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("File repository", func() {
+
+	var (
+		dir string
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		d, err := ioutil.TempDir("", "payments")
+		Expect(err).ShouldNot(HaveOccurred())
+		dir = d
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// A small snapshot interval makes the suite go through snapshots too.
+	behavesLikeARepository(func() payment.Repository {
+		r, err := payment.NewFileRepository(dir, 3)
+		Expect(err).ShouldNot(HaveOccurred())
+		return r
+	}, outboxOf)
+
+	Describe("reopening the directory", func() {
+		var r payment.Repository
+
+		open := func(snapshotEvery int) payment.Repository {
+			r, err := payment.NewFileRepository(dir, snapshotEvery)
+			Expect(err).ShouldNot(HaveOccurred())
+			return r
+		}
+
+		reopen := func(snapshotEvery int) payment.Repository {
+			Expect(r.(io.Closer).Close()).To(Succeed())
+			return open(snapshotEvery)
+		}
+
+		givenStored := func() payment.Payment {
+			p := givenExamplePayment()
+			p.Id = uuid.NewV4().String()
+			Expect(r.Insert(ctx, p, givenChange(payment.ActionCreate))).To(Succeed())
+			return p
+		}
+
+		logSize := func() int64 {
+			info, err := os.Stat(filepath.Join(dir, "payments.log"))
+			Expect(err).ShouldNot(HaveOccurred())
+			return info.Size()
+		}
+
+		AfterEach(func() {
+			Expect(r.(io.Closer).Close()).To(Succeed())
+		})
+
+		It("should load the payments from the log", func() {
+			r = open(0)
+			p := givenStored()
+			updated := p
+			updated.Version = 1
+			updated.Deleted = &payment.Deletion{At: time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC), Reason: "duplicate"}
+			Expect(r.Update(ctx, updated, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+			r = reopen(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(updated))
+			actual, err := r.Search(ctx, payment.Query{
+				Filter: payment.SearchOptions{OrganisationId: p.OrganisationId, IncludeDeleted: true},
+				Sort:   "id",
+				Limit:  10,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(Equal([]payment.Payment{updated}))
+		})
+
+		It("should load the payments from the snapshot and the log after it", func() {
+			r = open(2)
+			first, second, third := givenStored(), givenStored(), givenStored()
+			Expect(logSize()).ToNot(BeZero())
+
+			r = reopen(2)
+			Expect(r.Get(ctx, first.Id)).To(Equal(first))
+			Expect(r.Get(ctx, second.Id)).To(Equal(second))
+			Expect(r.Get(ctx, third.Id)).To(Equal(third))
+		})
+
+		It("should empty the log once it is in a snapshot", func() {
+			r = open(2)
+			givenStored()
+			Expect(logSize()).ToNot(BeZero())
+			givenStored()
+			Expect(logSize()).To(BeZero())
+		})
+
+		givenUpdated := func(p payment.Payment) payment.Payment {
+			updated := p
+			updated.Version++
+			updated.Attributes.Reference = fmt.Sprintf("ref %d", updated.Version)
+			Expect(r.Update(ctx, updated, p.Version, givenChange(payment.ActionUpdate))).To(Succeed())
+			return updated
+		}
+
+		It("should keep the history through the snapshot and the log", func() {
+			r = open(2)
+			p := givenStored()
+			givenUpdated(givenUpdated(p))
+			expected, err := r.History(ctx, p.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(expected).To(HaveLen(3))
+
+			r = reopen(2)
+			Expect(r.History(ctx, p.Id)).To(Equal(expected))
+		})
+
+		It("should not repeat history left in the log by a crash during a snapshot", func() {
+			r = open(0)
+			p := givenUpdated(givenStored())
+			logged, err := ioutil.ReadFile(filepath.Join(dir, "payments.log"))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			r = reopen(1)
+			givenUpdated(p)
+			Expect(logSize()).To(BeZero())
+			Expect(r.(io.Closer).Close()).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "payments.log"), logged, 0600)).To(Succeed())
+
+			r = open(0)
+			Expect(r.History(ctx, p.Id)).To(HaveLen(3))
+		})
+
+		It("should keep the changes in order through the snapshot and the log", func() {
+			r = open(2)
+			first := givenStored()
+			givenStored()
+			givenUpdated(first)
+			givenStored()
+			expected, err := r.Changes(ctx, first.OrganisationId, 0, 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(expected).To(HaveLen(4))
+
+			r = reopen(2)
+			Expect(r.Changes(ctx, first.OrganisationId, 0, 10)).To(Equal(expected))
+			givenStored()
+			Expect(r.LastSequence(ctx, first.OrganisationId)).To(BeNumerically(">", expected[3].Sequence))
+		})
+
+		pending := func() []outbox.Event {
+			events, err := r.(outbox.Store).Pending(ctx, 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			return events
+		}
+
+		It("should keep the events to publish through the snapshot and the log", func() {
+			r = open(2)
+			givenUpdated(givenStored())
+			givenStored()
+			expected := pending()
+			Expect(expected).To(HaveLen(3))
+
+			r = reopen(2)
+			Expect(pending()).To(Equal(expected))
+		})
+
+		It("should not publish an event again once reopened", func() {
+			r = open(2)
+			p := givenStored()
+			first := pending()
+			Expect(r.(outbox.Store).Published(ctx, []int64{first[0].Sequence})).To(Succeed())
+			givenUpdated(p)
+			next := pending()
+			Expect(next).To(HaveLen(1))
+
+			r = reopen(2)
+			Expect(pending()).To(Equal(next))
+			Expect(r.(outbox.Store).Published(ctx, []int64{next[0].Sequence})).To(Succeed())
+
+			r = reopen(0)
+			Expect(pending()).To(BeEmpty())
+			givenUpdated(givenStored())
+			Expect(pending()[0].Sequence).To(BeNumerically(">", next[0].Sequence))
+		})
+
+		It("should load payments logged before there was a history", func() {
+			p := givenExamplePayment()
+			p.Id = uuid.NewV4().String()
+			doc, err := json.Marshal([]payment.Payment{p})
+			Expect(err).ShouldNot(HaveOccurred())
+			record := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(doc), doc)
+			Expect(ioutil.WriteFile(filepath.Join(dir, "payments.log"), []byte(record), 0600)).To(Succeed())
+
+			r = open(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+			Expect(r.History(ctx, p.Id)).To(BeEmpty())
+
+			updated := givenUpdated(p)
+			r = reopen(1)
+			Expect(r.Get(ctx, p.Id)).To(Equal(updated))
+			history, err := r.History(ctx, p.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(history).To(HaveLen(1))
+			Expect(history[0].Previous).To(Equal(&p))
+		})
+
+		It("should drop a record torn by a crash and keep the ones before it", func() {
+			r = open(0)
+			p := givenStored()
+			size := logSize()
+			Expect(r.(io.Closer).Close()).To(Succeed())
+
+			f, err := os.OpenFile(filepath.Join(dir, "payments.log"), os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = f.WriteString(`0badf00d [{"id":"half written`)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			r = open(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+			Expect(logSize()).To(Equal(size))
+
+			next := givenStored()
+			r = reopen(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+			Expect(r.Get(ctx, next.Id)).To(Equal(next))
+		})
+
+		It("should drop a record that fails its checksum", func() {
+			r = open(0)
+			p := givenStored()
+			Expect(r.(io.Closer).Close()).To(Succeed())
+
+			f, err := os.OpenFile(filepath.Join(dir, "payments.log"), os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = f.WriteString("00000000 [{\"id\":\"other\"}]\n")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			r = open(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+			_, err = r.Get(ctx, "other")
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should refuse a corrupt snapshot", func() {
+			r = open(0)
+			Expect(ioutil.WriteFile(filepath.Join(dir, "payments.snapshot"), []byte("rubbish\n"), 0600)).To(Succeed())
+
+			_, err := payment.NewFileRepository(dir, 0)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should cut a failed write off the log and keep the writes after it", func() {
+			r = open(0)
+			p := givenStored()
+			size := logSize()
+
+			payment.FailNextWrite(r, false)
+			failed := givenExamplePayment()
+			failed.Id = uuid.NewV4().String()
+			Expect(r.Insert(ctx, failed, givenChange(payment.ActionCreate))).ShouldNot(Succeed())
+			Expect(logSize()).To(Equal(size))
+			Expect(r.Ping(ctx)).To(Succeed())
+
+			next := givenStored()
+			r = reopen(0)
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+			Expect(r.Get(ctx, next.Id)).To(Equal(next))
+			_, err := r.Get(ctx, failed.Id)
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should take no more writes when a failed write cannot be cut off", func() {
+			r = open(0)
+			p := givenStored()
+
+			payment.FailNextWrite(r, true)
+			failed := givenExamplePayment()
+			failed.Id = uuid.NewV4().String()
+			Expect(r.Insert(ctx, failed, givenChange(payment.ActionCreate))).ShouldNot(Succeed())
+			Expect(r.Ping(ctx)).ShouldNot(Succeed())
+
+			next := givenExamplePayment()
+			next.Id = uuid.NewV4().String()
+			Expect(r.Insert(ctx, next, givenChange(payment.ActionCreate))).ShouldNot(Succeed())
+			Expect(r.Get(ctx, p.Id)).To(Equal(p))
+		})
+
+		It("should be unhealthy once the directory is gone", func() {
+			r = open(0)
+			Expect(os.RemoveAll(dir)).To(Succeed())
+			Expect(r.Ping(ctx)).ShouldNot(Succeed())
+		})
+
+		It("should be unhealthy once closed", func() {
+			r = open(0)
+			Expect(r.(io.Closer).Close()).To(Succeed())
+			Expect(r.Ping(ctx)).ShouldNot(Succeed())
+			r = open(0)
+		})
+	})
+})
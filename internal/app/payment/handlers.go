@@ -1,51 +1,208 @@
 package payment
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/idempotency"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/carlosroman/payments-api/internal/app/requestid"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func GetHandlers(s Service) *mux.Router {
-	h := handlers{s: s}
+// HandlerOption changes how the routes are handled.
+type HandlerOption func(h *handlers)
+
+// WithIdempotency lets clients retry POST /payment with an Idempotency-Key
+// without saving the payment twice, keys are scoped to the organisation of
+// the payment and kept for ttl.
+func WithIdempotency(store idempotency.Store, ttl time.Duration) HandlerOption {
+	return func(h *handlers) {
+		h.idempotent = idempotency.Middleware(store, ttl, organisationScope)
+	}
+}
+
+func organisationScope(r *http.Request, body []byte) string {
+	var p struct {
+		OrganisationId string `json:"organisation_id"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return ""
+	}
+	// A caller naming an organisation it does not act for is kept apart from
+	// it so nothing of the organisation is replayed, the payment is then
+	// refused as not found.
+	if id, ok := auth.FromContext(r.Context()); ok && !id.ActsFor(p.OrganisationId) {
+		return id.Subject + "/" + p.OrganisationId
+	}
+	return p.OrganisationId
+}
+
+// WithAuthentication only lets through the requests the middleware
+// authenticates, the health check and any other route named PublicRoute are
+// left open.
+func WithAuthentication(authenticate func(http.Handler) http.Handler) HandlerOption {
+	return func(h *handlers) {
+		h.authenticate = authenticate
+	}
+}
+
+// WithRateLimit limits the requests of each caller with the middleware, it
+// runs after authentication so callers can be told apart. Routes named
+// PublicRoute are not limited.
+func WithRateLimit(limit func(http.Handler) http.Handler) HandlerOption {
+	return func(h *handlers) {
+		h.limit = limit
+	}
+}
+
+// Owner is the organisation of the payment a /payment/{id} route is for, so
+// that limiting by organisation counts the requests about a payment against
+// its organisation. It is "" for other routes and for a payment the caller
+// cannot see.
+func Owner(s Service) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			return ""
+		}
+		if template, err := route.GetPathTemplate(); err != nil || !strings.HasPrefix(template, "/payment/{id") {
+			return ""
+		}
+		payment, err := s.Get(r.Context(), mux.Vars(r)["id"], GetOptions{IncludeDeleted: true})
+		if err != nil {
+			return ""
+		}
+		return payment.OrganisationId
+	}
+}
+
+// PublicRoute is the name of the routes anyone can use when requests are
+// authenticated.
+const PublicRoute = "public"
+
+// unlessPublic only runs the middleware for routes that are not public.
+func unlessPublic(mw func(http.Handler) http.Handler) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() == PublicRoute {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+func GetHandlers(s Service, opts ...HandlerOption) *mux.Router {
+	h := &handlers{
+		s:              s,
+		streamInterval: time.Second,
+		idempotent: func(next http.Handler) http.Handler {
+			return next
+		},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
 	r := mux.NewRouter()
+	r.Use(requestid.Middleware)
+	if h.authenticate != nil {
+		r.Use(unlessPublic(h.authenticate))
+	}
+	if h.limit != nil {
+		r.Use(unlessPublic(h.limit))
+	}
+	r.Use(actorMiddleware)
+	r.NotFoundHandler = problem.Handler(http.StatusNotFound, "route_not_found", "no such resource")
+	r.MethodNotAllowedHandler = problem.Handler(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed on this resource")
+
+	r.Handle("/payment", h.idempotent(http.HandlerFunc(h.savePaymentHandler))).
+		Methods("POST")
+
+	r.HandleFunc("/payment/validate", h.validatePaymentHandler).
+		Methods("POST")
 
-	r.HandleFunc("/payment", h.savePaymentHandler).
+	r.HandleFunc("/payments", h.savePaymentsHandler).
 		Methods("POST")
 
 	r.HandleFunc("/payment/search", h.searchForPayments).
 		Methods("GET")
 
+	r.HandleFunc(StreamPath, h.streamPaymentsHandler).
+		Methods("GET")
+
+	r.HandleFunc("/approvals", h.approvalsHandler).
+		Methods("GET")
+
 	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.getPaymentHandler).
 		Methods("GET")
 
-	r.HandleFunc("/__health", h.healthCheckHandler).
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.updatePaymentHandler).
+		Methods("PUT")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.patchPaymentHandler).
+		Methods("PATCH")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.deletePaymentHandler).
+		Methods("DELETE")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/restore", h.restorePaymentHandler).
+		Methods("POST")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/transitions", h.transitionPaymentHandler).
+		Methods("POST")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/approve", h.decisionHandler(h.s.Approve)).
+		Methods("POST")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/reject", h.decisionHandler(h.s.Reject)).
+		Methods("POST")
+
+	r.HandleFunc("/payment/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/history", h.paymentHistoryHandler).
 		Methods("GET")
 
+	r.HandleFunc("/__health", h.healthCheckHandler).
+		Methods("GET").
+		Name(PublicRoute)
+
 	return r
 }
 
 type handlers struct {
-	s Service
+	s              Service
+	idempotent     func(http.Handler) http.Handler
+	authenticate   func(http.Handler) http.Handler
+	limit          func(http.Handler) http.Handler
+	streamInterval time.Duration
 }
 
 func (h *handlers) getPaymentHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
+	opts, err := getOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, "invalid_query", err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	p, err := h.s.Get(r.Context(), id)
+	p, err := h.s.Get(r.Context(), id, opts)
 	if err != nil {
-		switch err {
-		case ErrNotFound:
-			w.WriteHeader(http.StatusNotFound)
-			return
-		default:
-			log.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		writeError(w, r, err)
+		return
 	}
 
 	if err := json.NewEncoder(w).Encode(p); err != nil {
@@ -56,38 +213,131 @@ func (h *handlers) getPaymentHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handlers) searchForPayments(w http.ResponseWriter, r *http.Request) {
-	vars := r.URL.Query()
-	id := vars["organisation_id"]
+	opts, err := searchOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, "invalid_query", err)
+		return
+	}
+	h.search(w, r, opts)
+}
+
+// approvalsHandler is the queue of payments of an organisation waiting for
+// approval, it takes the same query as the search other than the status.
+func (h *handlers) approvalsHandler(w http.ResponseWriter, r *http.Request) {
+	opts, err := searchOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, "invalid_query", err)
+		return
+	}
+	opts.Status = StatusPendingApproval
+	h.search(w, r, opts)
+}
+
+func (h *handlers) search(w http.ResponseWriter, r *http.Request, opts SearchOptions) {
 	w.Header().Set("Content-Type", "application/json")
-	ps, err := h.s.SearchByOrganisationId(r.Context(), id[0])
+	result, err := h.s.Search(r.Context(), opts)
 	if err != nil {
-		log.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(Payments{Payments: ps}); err != nil {
+	links := &Links{
+		Self: r.URL.RequestURI(),
+		Next: pageLink(r, "page[after]", result.Next),
+		Prev: pageLink(r, "page[before]", result.Prev),
+	}
+	if err := json.NewEncoder(w).Encode(Payments{Payments: result.Payments, Links: links}); err != nil {
 		log.Error(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+var amountPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+func searchOptions(r *http.Request) (opts SearchOptions, err error) {
+	q := r.URL.Query()
+	opts = SearchOptions{
+		OrganisationId:           q.Get("organisation_id"),
+		Currency:                 q.Get("filter[currency]"),
+		PaymentType:              q.Get("filter[payment_type]"),
+		PaymentScheme:            PaymentScheme(q.Get("filter[payment_scheme]")),
+		ProcessingDateFrom:       q.Get("filter[processing_date_from]"),
+		ProcessingDateTo:         q.Get("filter[processing_date_to]"),
+		AmountMin:                q.Get("filter[amount_min]"),
+		AmountMax:                q.Get("filter[amount_max]"),
+		BeneficiaryAccountNumber: q.Get("filter[beneficiary_account_number]"),
+		DebtorAccountNumber:      q.Get("filter[debtor_account_number]"),
+		Status:                   Status(q.Get("filter[status]")),
+		Sort:                     q.Get("sort"),
+		After:                    q.Get("page[after]"),
+		Before:                   q.Get("page[before]"),
+	}
+
+	var errs []FieldError
+	if opts.OrganisationId == "" {
+		errs = append(errs, FieldError{Field: "organisation_id", Message: "is required"})
+	}
+	if opts.After != "" && opts.Before != "" {
+		errs = append(errs, FieldError{Field: "page[before]", Message: "cannot be used with page[after]"})
+	}
+	for field, amount := range map[string]string{"filter[amount_min]": opts.AmountMin, "filter[amount_max]": opts.AmountMax} {
+		if amount != "" && !amountPattern.MatchString(amount) {
+			errs = append(errs, FieldError{Field: field, Message: "must be a decimal"})
+		}
+	}
+	for field, date := range map[string]string{"filter[processing_date_from]": opts.ProcessingDateFrom, "filter[processing_date_to]": opts.ProcessingDateTo} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			errs = append(errs, FieldError{Field: field, Message: "must be a date as YYYY-MM-DD"})
+		}
+	}
+	if opts.Status != "" && !opts.Status.Known() {
+		errs = append(errs, FieldError{Field: "filter[status]", Message: "must be a known status"})
+	}
+	if size := q.Get("page[size]"); size != "" {
+		if opts.Size, err = strconv.Atoi(size); err != nil || opts.Size < 1 || opts.Size > MaxPageSize {
+			errs = append(errs, FieldError{Field: "page[size]", Message: fmt.Sprintf("must be between 1 and %d", MaxPageSize)})
+		}
+	}
+	if opts.IncludeDeleted, err = includeDeleted(r); err != nil {
+		errs = append(errs, err.(*ValidationError).Errors...)
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return opts, &ValidationError{Errors: errs}
+	}
+	return opts, nil
+}
+
+// pageLink is the current request with the page cursor swapped for the one
+// given, an empty cursor means there is no page to link to.
+func pageLink(r *http.Request, param string, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	q := r.URL.Query()
+	q.Del("page[after]")
+	q.Del("page[before]")
+	q.Set(param, cursor)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
 func (h *handlers) savePaymentHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	defer r.Body.Close()
 	var p Payment
 
 	if err := decoder.Decode(&p); err != nil {
-		log.Warn(err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, r, "malformed_body", err)
 		return
 	}
 
 	id, err := h.s.Save(r.Context(), p)
 	if err != nil {
-		log.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -96,6 +346,280 @@ func (h *handlers) savePaymentHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// validatePaymentHandler checks a payment without saving it, a valid payment
+// gets no content back and an invalid one the same problem Save would return.
+func (h *handlers) validatePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var p Payment
+
+	if err := decoder.Decode(&p); err != nil {
+		writeBadRequest(w, r, "malformed_body", err)
+		return
+	}
+
+	if err := Validate(p); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type batchResults struct {
+	Results []BatchResult `json:"data"`
+}
+
+func (h *handlers) savePaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var ps Payments
+
+	if err := decoder.Decode(&ps); err != nil {
+		writeBadRequest(w, r, "malformed_body", err)
+		return
+	}
+
+	atomic := true
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			writeBadRequest(w, r, "invalid_query", &ValidationError{Errors: []FieldError{{Field: "atomic", Message: "must be true or false"}}})
+			return
+		}
+	}
+
+	results, err := h.s.SaveAll(r.Context(), ps.Payments, atomic)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := http.StatusCreated
+	for _, result := range results {
+		if result.Status == BatchInvalid {
+			status = http.StatusMultiStatus
+			if atomic {
+				status = http.StatusUnprocessableEntity
+			}
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(batchResults{Results: results}); err != nil {
+		log.Error(err)
+		return
+	}
+}
+
+func (h *handlers) updatePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var p Payment
+
+	if err := decoder.Decode(&p); err != nil {
+		writeBadRequest(w, r, "malformed_body", err)
+		return
+	}
+
+	if p.Id != "" && p.Id != id {
+		writeBadRequest(w, r, "id_mismatch", fmt.Errorf("payment id '%s' does not match the path", p.Id))
+		return
+	}
+	p.Id = id
+
+	w.Header().Set("Content-Type", "application/json")
+	updated, err := h.s.Update(r.Context(), p)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *handlers) patchPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	defer r.Body.Close()
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/merge-patch+json" && mediaType != "application/json-patch+json") {
+		w.Header().Set("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+		problem.New(http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"patch must be application/merge-patch+json or application/json-patch+json").Write(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeBadRequest(w, r, "malformed_body", err)
+		return
+	}
+	if !json.Valid(body) {
+		writeBadRequest(w, r, "malformed_body", fmt.Errorf("patch is not valid JSON"))
+		return
+	}
+
+	var patch Patch = MergePatch(body)
+	if mediaType == "application/json-patch+json" {
+		patch = JSONPatch(body)
+	}
+
+	updated, err := h.s.Patch(r.Context(), id, patch)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *handlers) deletePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	reason := r.URL.Query().Get("reason")
+
+	if err := h.s.Delete(r.Context(), id, reason); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) restorePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	w.Header().Set("Content-Type", "application/json")
+	p, err := h.s.Restore(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *handlers) transitionPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var t Transition
+
+	if err := decoder.Decode(&t); err != nil {
+		writeBadRequest(w, r, "malformed_body", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	p, err := h.s.Transition(r.Context(), id, t)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// decisionHandler approves or rejects a payment pending approval, the body
+// with the reason for it is optional.
+func (h *handlers) decisionHandler(decide func(ctx context.Context, paymentId string, reason string) (Payment, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		var body struct {
+			Reason string `json:"reason"`
+		}
+
+		if err := decoder.Decode(&body); err != nil && err != io.EOF {
+			writeBadRequest(w, r, "malformed_body", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		p, err := decide(r.Context(), id, body.Reason)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (h *handlers) paymentHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	w.Header().Set("Content-Type", "application/json")
+	revisions, err := h.s.History(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(History{Revisions: revisions}); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+const ActorHeader = "X-Actor"
+
+var validActor = regexp.MustCompile(`^[^\x00-\x1f\x7f]{1,128}$`)
+
+// actorMiddleware puts who is making the request into its context so it can
+// be recorded against the changes they make.
+func actorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An authenticated caller is who made the request whatever it says.
+		if id, ok := auth.FromContext(r.Context()); ok {
+			next.ServeHTTP(w, r.WithContext(NewActorContext(r.Context(), id.Subject)))
+			return
+		}
+		actor := r.Header.Get(ActorHeader)
+		if actor == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validActor.MatchString(actor) {
+			problem.New(http.StatusBadRequest, "invalid_actor", "X-Actor must be at most 128 printable characters").Write(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewActorContext(r.Context(), actor)))
+	})
+}
+
 func (h *handlers) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	hc := h.s.HealthCheck(r.Context())
@@ -110,3 +634,106 @@ func (h *handlers) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// getOptions reads which version of the payment is wanted from the query.
+func getOptions(r *http.Request) (opts GetOptions, err error) {
+	var errs []FieldError
+	if opts.IncludeDeleted, err = includeDeleted(r); err != nil {
+		errs = append(errs, err.(*ValidationError).Errors...)
+	}
+	if v := r.URL.Query().Get("as_of"); v != "" {
+		if opts.AsOf, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			errs = append(errs, FieldError{Field: "as_of", Message: "must be a timestamp as RFC 3339"})
+		}
+	}
+	if len(errs) > 0 {
+		return opts, &ValidationError{Errors: errs}
+	}
+	return opts, nil
+}
+
+func includeDeleted(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("include_deleted")
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return b, &ValidationError{Errors: []FieldError{{Field: "include_deleted", Message: "must be true or false"}}}
+	}
+	return b, nil
+}
+
+// errorStatus is the HTTP status for each of the errors the service returns.
+var errorStatus = map[*Error]int{
+	ErrNotFound:        http.StatusNotFound,
+	ErrVersionConflict: http.StatusConflict,
+	ErrInvalidCursor:   http.StatusBadRequest,
+	ErrInvalidSort:     http.StatusBadRequest,
+
+	ErrCurrencyMismatch: http.StatusUnprocessableEntity,
+	ErrUnknownCurrency:  http.StatusUnprocessableEntity,
+
+	ErrApprovalRequired:        http.StatusConflict,
+	ErrNotPendingApproval:      http.StatusConflict,
+	ErrSelfApproval:            http.StatusForbidden,
+	ErrUnknownApprover:         http.StatusBadRequest,
+	ErrUnauthenticatedApprover: http.StatusForbidden,
+}
+
+// writeError maps an error from the service to a problem response, anything
+// we don't recognise is logged and hidden from the caller.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var p *problem.Problem
+	switch e := err.(type) {
+	case *Error:
+		status, ok := errorStatus[e]
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		p = problem.New(status, e.Code, e.Error())
+	case *ValidationError:
+		p = problem.New(http.StatusUnprocessableEntity, "validation_failed", "payment is not valid")
+		p.Errors = problemErrors(e.Errors)
+	case *PatchError:
+		p = problem.New(http.StatusUnprocessableEntity, "invalid_patch", e.Error())
+	case *TransitionError:
+		p = problem.New(http.StatusConflict, "illegal_transition", e.Error())
+		p.Extensions = map[string]interface{}{
+			"current_status":      e.From,
+			"allowed_transitions": e.Allowed,
+		}
+	case *ImmutableFieldError:
+		p = problem.New(http.StatusUnprocessableEntity, "immutable_field", e.Error())
+		p.Errors = []problem.FieldError{{Field: e.Field, Message: "cannot be changed"}}
+	case *auth.ForbiddenError:
+		p = problem.New(http.StatusForbidden, "forbidden", fmt.Sprintf("missing permission %s", e.Permission))
+		p.Extensions = map[string]interface{}{"missing_permission": e.Permission}
+	default:
+		log.Error(err)
+		problem.New(http.StatusInternalServerError, "internal_error", "something went wrong").Write(w, r)
+		return
+	}
+	log.Warn(err)
+	p.Write(w, r)
+}
+
+// writeBadRequest is for requests we could not make sense of before they got
+// anywhere near the service.
+func writeBadRequest(w http.ResponseWriter, r *http.Request, code string, err error) {
+	log.Warn(err)
+	p := problem.New(http.StatusBadRequest, code, err.Error())
+	if ve, ok := err.(*ValidationError); ok {
+		p.Detail = "request is not valid"
+		p.Errors = problemErrors(ve.Errors)
+	}
+	p.Write(w, r)
+}
+
+func problemErrors(errs []FieldError) []problem.FieldError {
+	pes := make([]problem.FieldError, len(errs))
+	for i, fe := range errs {
+		pes[i] = problem.FieldError{Field: fe.Field, Message: fe.Message}
+	}
+	return pes
+}
@@ -1,14 +1,20 @@
 package payment_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/idempotency"
 	"github.com/carlosroman/payments-api/internal/app/payment"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/carlosroman/payments-api/internal/app/ratelimit"
 	"github.com/gorilla/mux"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
@@ -17,6 +23,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -104,6 +111,718 @@ var _ = Describe("Handlers", func() {
 		})
 	})
 
+	Describe("Validating a payment", func() {
+		Context("that is valid", func() {
+			It("should return no content without saving", func() {
+				resp, err := http.DefaultClient.Do(givenValidateRequest(ts.URL, givenExamplePayment()))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+				ms.AssertNotCalled(GinkgoT(), "Save", mock.Anything, mock.Anything)
+			})
+		})
+
+		Context("that is invalid", func() {
+			It("should return every violation", func() {
+				p := givenExamplePayment()
+				p.OrganisationId = "not a uuid"
+				p.Attributes.Amount = payment.MustParseDecimal("-1")
+				p.Attributes.Currency = "GBX"
+
+				resp, err := http.DefaultClient.Do(givenValidateRequest(ts.URL, p))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				actual := thenProblem(resp, http.StatusUnprocessableEntity, "validation_failed")
+				Expect(actual.Errors).Should(Equal([]problem.FieldError{
+					{Field: "organisation_id", Message: "must be a UUID"},
+					{Field: "attributes.amount", Message: "must be greater than zero"},
+					{Field: "attributes.currency", Message: "is not an ISO 4217 currency"},
+				}))
+			})
+		})
+
+		Context("that is not json", func() {
+			It("should return bad request", func() {
+				req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/validate", ts.URL), strings.NewReader("not json"))
+				Expect(err).ShouldNot(HaveOccurred())
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusBadRequest, "malformed_body")
+			})
+		})
+	})
+
+	Describe("Saving a batch of payments", func() {
+		Context("that are all valid", func() {
+			It("should return created with the ids", func() {
+				req := givenBatchPaymentRequest(ts.URL, "", 2)
+				expected := []payment.BatchResult{
+					{Index: 0, Id: "id-1", Status: payment.BatchCreated},
+					{Index: 1, Id: "id-2", Status: payment.BatchCreated},
+				}
+				ms.On("SaveAll", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("[]payment.Payment"), true).
+					Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(body).Should(MatchJSON(`{"data":[{"index":0,"id":"id-1","status":"created"},{"index":1,"id":"id-2","status":"created"}]}`))
+			})
+		})
+
+		Context("that are atomic with an invalid payment", func() {
+			It("should return unprocessable entity", func() {
+				req := givenBatchPaymentRequest(ts.URL, "", 2)
+				ms.On("SaveAll", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("[]payment.Payment"), true).
+					Return([]payment.BatchResult{
+						{Index: 0, Status: payment.BatchSkipped},
+						{Index: 1, Status: payment.BatchInvalid, Errors: []payment.FieldError{{Field: "organisation_id", Message: "is required"}}},
+					}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			})
+		})
+
+		Context("that are not atomic with an invalid payment", func() {
+			It("should return multi status", func() {
+				req := givenBatchPaymentRequest(ts.URL, "atomic=false", 2)
+				ms.On("SaveAll", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("[]payment.Payment"), false).
+					Return([]payment.BatchResult{
+						{Index: 0, Id: "id-1", Status: payment.BatchCreated},
+						{Index: 1, Status: payment.BatchInvalid, Errors: []payment.FieldError{{Field: "organisation_id", Message: "is required"}}},
+					}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusMultiStatus))
+			})
+		})
+
+		Context("when the back end fails", func() {
+			It("should return internal server error", func() {
+				req := givenBatchPaymentRequest(ts.URL, "", 1)
+				ms.On("SaveAll", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("[]payment.Payment"), true).
+					Return([]payment.BatchResult{}, errors.New("something went wrong"))
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			})
+		})
+	})
+
+	Describe("Updating a payment", func() {
+		Context("that is valid", func() {
+			It("should return the updated payment", func() {
+				id := uuid.NewV4().String()
+				req := givenUpdatePaymentRequest(ts.URL, id, payment.Payment{Version: 2})
+
+				expected := payment.Payment{Id: id, Version: 3}
+				ms.On("Update", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+					Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				var actual payment.Payment
+				err = json.NewDecoder(resp.Body).Decode(&actual)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).Should(Equal(expected))
+				ms.AssertCalled(GinkgoT(), "Update", mock.AnythingOfType("*context.valueCtx"), payment.Payment{Id: id, Version: 2})
+			})
+		})
+
+		Context("that has a stale version", func() {
+			It("should return conflict", func() {
+				id := uuid.NewV4().String()
+				req := givenUpdatePaymentRequest(ts.URL, id, payment.Payment{Version: 1})
+				ms.On("Update", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+					Return(payment.Payment{}, payment.ErrVersionConflict)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+			})
+		})
+
+		Context("that does not exist", func() {
+			It("should return not found", func() {
+				id := uuid.NewV4().String()
+				req := givenUpdatePaymentRequest(ts.URL, id, payment.Payment{})
+				ms.On("Update", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+					Return(payment.Payment{}, payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("that has a different id to the path", func() {
+			It("should return bad request", func() {
+				req := givenUpdatePaymentRequest(ts.URL, uuid.NewV4().String(), payment.Payment{Id: uuid.NewV4().String()})
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				ms.AssertNotCalled(GinkgoT(), "Update", mock.Anything, mock.Anything)
+			})
+		})
+	})
+
+	Describe("Patching a payment", func() {
+		Context("with a merge patch", func() {
+			It("should return the updated payment", func() {
+				id := uuid.NewV4().String()
+				req := givenPatchPaymentRequest(ts.URL, id, "application/merge-patch+json", `{"attributes":{"reference":"new"}}`)
+				expected := payment.Payment{Id: id, Version: 1, Attributes: payment.Attributes{Reference: "new"}}
+				ms.On("Patch", mock.AnythingOfType("*context.valueCtx"), id, payment.MergePatch(`{"attributes":{"reference":"new"}}`)).
+					Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var actual payment.Payment
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual).Should(Equal(expected))
+			})
+		})
+
+		Context("with a JSON patch", func() {
+			It("should pass the JSON patch on", func() {
+				id := uuid.NewV4().String()
+				body := `[{"op":"replace","path":"/attributes/reference","value":"new"}]`
+				req := givenPatchPaymentRequest(ts.URL, id, "application/json-patch+json", body)
+				ms.On("Patch", mock.AnythingOfType("*context.valueCtx"), id, payment.JSONPatch(body)).
+					Return(payment.Payment{Id: id}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				ms.AssertExpectations(GinkgoT())
+			})
+		})
+
+		Context("that changes an immutable field", func() {
+			It("should return unprocessable entity with the reason", func() {
+				id := uuid.NewV4().String()
+				req := givenPatchPaymentRequest(ts.URL, id, "application/merge-patch+json", `{"organisation_id":"other"}`)
+				ms.On("Patch", mock.AnythingOfType("*context.valueCtx"), id, mock.Anything).
+					Return(payment.Payment{}, &payment.ImmutableFieldError{Field: "organisation_id"})
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+				body, err := ioutil.ReadAll(resp.Body)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(body)).Should(ContainSubstring("organisation_id cannot be changed"))
+			})
+		})
+
+		Context("that has a stale version", func() {
+			It("should return conflict", func() {
+				id := uuid.NewV4().String()
+				req := givenPatchPaymentRequest(ts.URL, id, "application/merge-patch+json", `{"version":1}`)
+				ms.On("Patch", mock.AnythingOfType("*context.valueCtx"), id, mock.Anything).
+					Return(payment.Payment{}, payment.ErrVersionConflict)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+			})
+		})
+
+		Context("with an unsupported content type", func() {
+			It("should return unsupported media type", func() {
+				req := givenPatchPaymentRequest(ts.URL, uuid.NewV4().String(), "application/json", `{}`)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusUnsupportedMediaType))
+				Expect(resp.Header.Get("Accept-Patch")).Should(ContainSubstring("application/merge-patch+json"))
+			})
+		})
+
+		Context("with a body that is not json", func() {
+			It("should return bad request", func() {
+				req := givenPatchPaymentRequest(ts.URL, uuid.NewV4().String(), "application/merge-patch+json", `not json`)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Describe("Deleting a payment", func() {
+		Context("that exists in the db", func() {
+			It("should return no content", func() {
+				id := uuid.NewV4().String()
+				req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/payment/%s?reason=duplicate", ts.URL, id), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				ms.On("Delete", mock.AnythingOfType("*context.valueCtx"), id, "duplicate").Return(nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+				ms.AssertExpectations(GinkgoT())
+			})
+		})
+
+		Context("that does not exist in the db", func() {
+			It("should return not found", func() {
+				id := uuid.NewV4().String()
+				req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/payment/%s", ts.URL, id), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				ms.On("Delete", mock.AnythingOfType("*context.valueCtx"), id, "").Return(payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("without the permission to", func() {
+			It("should return forbidden naming the permission", func() {
+				id := uuid.NewV4().String()
+				req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/payment/%s", ts.URL, id), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				ms.On("Delete", mock.AnythingOfType("*context.valueCtx"), id, "").
+					Return(&auth.ForbiddenError{Permission: auth.PermissionDelete})
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				var actual struct {
+					Code              string `json:"code"`
+					Detail            string `json:"detail"`
+					MissingPermission string `json:"missing_permission"`
+				}
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual.Code).To(Equal("forbidden"))
+				Expect(actual.Detail).To(Equal("missing permission payments:delete"))
+				Expect(actual.MissingPermission).To(Equal("payments:delete"))
+			})
+		})
+	})
+
+	Describe("Restoring a payment", func() {
+		Context("that has been deleted", func() {
+			It("should return the payment", func() {
+				id := uuid.NewV4().String()
+				req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/%s/restore", ts.URL, id), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				expected := payment.Payment{Id: id}
+				ms.On("Restore", mock.AnythingOfType("*context.valueCtx"), id).Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var actual payment.Payment
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual).Should(Equal(expected))
+			})
+		})
+
+		Context("that has not been deleted", func() {
+			It("should return not found", func() {
+				id := uuid.NewV4().String()
+				req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/%s/restore", ts.URL, id), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				ms.On("Restore", mock.AnythingOfType("*context.valueCtx"), id).Return(payment.Payment{}, payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("Moving a payment through its lifecycle", func() {
+		givenTransitionRequest := func(id string, body string) *http.Request {
+			req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/%s/transitions", ts.URL, id), strings.NewReader(body))
+			Expect(err).ShouldNot(HaveOccurred())
+			return req
+		}
+
+		Context("that is allowed", func() {
+			It("should return the payment with the actor in the context", func() {
+				id := uuid.NewV4().String()
+				req := givenTransitionRequest(id, `{"to":"submitted","reason":"sent to scheme"}`)
+				req.Header.Set(payment.ActorHeader, "alice")
+				expected := payment.Payment{Id: id, Status: payment.StatusSubmitted}
+				ms.On("Transition", mock.AnythingOfType("*context.valueCtx"), id, payment.Transition{To: payment.StatusSubmitted, Reason: "sent to scheme"}).
+					Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var actual payment.Payment
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual).Should(Equal(expected))
+
+				ctx := ms.Calls[0].Arguments.Get(0).(context.Context)
+				Expect(payment.ActorFromContext(ctx)).To(Equal("alice"))
+			})
+		})
+
+		Context("that is not allowed", func() {
+			It("should return conflict with the statuses it can move to", func() {
+				id := uuid.NewV4().String()
+				ms.On("Transition", mock.AnythingOfType("*context.valueCtx"), id, payment.Transition{To: payment.StatusSettled}).
+					Return(payment.Payment{}, &payment.TransitionError{
+						From:    payment.StatusCreated,
+						To:      payment.StatusSettled,
+						Allowed: []payment.Status{payment.StatusPendingApproval, payment.StatusSubmitted, payment.StatusCancelled},
+					})
+
+				resp, err := http.DefaultClient.Do(givenTransitionRequest(id, `{"to":"settled"}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+				var actual struct {
+					Code               string   `json:"code"`
+					CurrentStatus      string   `json:"current_status"`
+					AllowedTransitions []string `json:"allowed_transitions"`
+				}
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual.Code).To(Equal("illegal_transition"))
+				Expect(actual.CurrentStatus).To(Equal("created"))
+				Expect(actual.AllowedTransitions).To(Equal([]string{"pending_approval", "submitted", "cancelled"}))
+			})
+		})
+
+		Context("that does not exist", func() {
+			It("should return not found", func() {
+				id := uuid.NewV4().String()
+				ms.On("Transition", mock.AnythingOfType("*context.valueCtx"), id, payment.Transition{To: payment.StatusSubmitted}).
+					Return(payment.Payment{}, payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(givenTransitionRequest(id, `{"to":"submitted"}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusNotFound, "not_found")
+			})
+		})
+
+		Context("that is not json", func() {
+			It("should return bad request", func() {
+				resp, err := http.DefaultClient.Do(givenTransitionRequest(uuid.NewV4().String(), "not json"))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusBadRequest, "malformed_body")
+				ms.AssertNotCalled(GinkgoT(), "Transition", mock.Anything, mock.Anything, mock.Anything)
+			})
+		})
+
+		Context("with an invalid actor", func() {
+			It("should return bad request", func() {
+				req := givenTransitionRequest(uuid.NewV4().String(), `{"to":"submitted"}`)
+				req.Header.Set(payment.ActorHeader, strings.Repeat("a", 129))
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusBadRequest, "invalid_actor")
+				ms.AssertNotCalled(GinkgoT(), "Transition", mock.Anything, mock.Anything, mock.Anything)
+			})
+		})
+	})
+
+	Describe("Approving a payment", func() {
+		givenDecisionRequest := func(id string, decision string, body string) *http.Request {
+			req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/%s/%s", ts.URL, id, decision), strings.NewReader(body))
+			Expect(err).ShouldNot(HaveOccurred())
+			return req
+		}
+
+		Context("by someone other than who created it", func() {
+			It("should return the approved payment", func() {
+				id := uuid.NewV4().String()
+				expected := payment.Payment{Id: id, Status: payment.StatusSubmitted, Approval: &payment.Approval{Decision: payment.DecisionApproved, By: "bob"}}
+				ms.On("Approve", mock.AnythingOfType("*context.valueCtx"), id, "checked").
+					Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(givenDecisionRequest(id, "approve", `{"reason":"checked"}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var actual payment.Payment
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual).Should(Equal(expected))
+			})
+
+			It("should reject the payment without a body", func() {
+				id := uuid.NewV4().String()
+				ms.On("Reject", mock.AnythingOfType("*context.valueCtx"), id, "").
+					Return(payment.Payment{Id: id, Status: payment.StatusRejected}, nil)
+
+				resp, err := http.DefaultClient.Do(givenDecisionRequest(id, "reject", ""))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("by who created it", func() {
+			It("should return forbidden", func() {
+				id := uuid.NewV4().String()
+				ms.On("Approve", mock.AnythingOfType("*context.valueCtx"), id, "").
+					Return(payment.Payment{}, payment.ErrSelfApproval)
+
+				resp, err := http.DefaultClient.Do(givenDecisionRequest(id, "approve", ""))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusForbidden, "self_approval")
+			})
+		})
+
+		Context("by someone who is not authenticated", func() {
+			It("should return forbidden", func() {
+				id := uuid.NewV4().String()
+				ms.On("Approve", mock.AnythingOfType("*context.valueCtx"), id, "").
+					Return(payment.Payment{}, payment.ErrUnauthenticatedApprover)
+
+				req := givenDecisionRequest(id, "approve", "")
+				req.Header.Set(payment.ActorHeader, "bob")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusForbidden, "unauthenticated_approver")
+			})
+		})
+
+		Context("that is not pending approval", func() {
+			It("should return conflict", func() {
+				id := uuid.NewV4().String()
+				ms.On("Reject", mock.AnythingOfType("*context.valueCtx"), id, "").
+					Return(payment.Payment{}, payment.ErrNotPendingApproval)
+
+				resp, err := http.DefaultClient.Do(givenDecisionRequest(id, "reject", `{}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusConflict, "not_pending_approval")
+			})
+		})
+
+		Context("that is not json", func() {
+			It("should return bad request", func() {
+				resp, err := http.DefaultClient.Do(givenDecisionRequest(uuid.NewV4().String(), "approve", "not json"))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusBadRequest, "malformed_body")
+				ms.AssertNotCalled(GinkgoT(), "Approve", mock.Anything, mock.Anything, mock.Anything)
+			})
+		})
+	})
+
+	Describe("Getting the payments waiting for approval", func() {
+		It("should search for the payments pending approval", func() {
+			id := uuid.NewV4().String()
+			req, err := http.NewRequest("GET", fmt.Sprintf("%s/approvals?organisation_id=%s&filter[status]=created", ts.URL, id), nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			pending := []payment.Payment{{Id: "A", OrganisationId: id, Status: payment.StatusPendingApproval}}
+			ms.On("Search", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.SearchOptions")).
+				Return(payment.SearchResult{Payments: pending}, nil)
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var actual payment.Payments
+			Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+			Expect(actual.Payments).To(Equal(pending))
+			ms.AssertCalled(GinkgoT(), "Search", mock.AnythingOfType("*context.valueCtx"), payment.SearchOptions{
+				OrganisationId: id,
+				Status:         payment.StatusPendingApproval,
+			})
+		})
+
+		It("should need the organisation", func() {
+			resp, err := http.Get(ts.URL + "/approvals")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			thenProblem(resp, http.StatusBadRequest, "invalid_query")
+			ms.AssertNotCalled(GinkgoT(), "Search", mock.Anything, mock.Anything)
+		})
+	})
+
+	Describe("Getting the history of a payment", func() {
+		givenHistoryRequest := func(id string) *http.Request {
+			req, err := http.NewRequest("GET", fmt.Sprintf("%s/payment/%s/history", ts.URL, id), nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			return req
+		}
+
+		Context("that exists", func() {
+			It("should return every revision", func() {
+				id := uuid.NewV4().String()
+				created := payment.Payment{Id: id}
+				updated := payment.Payment{Id: id, Version: 1}
+				at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+				expected := []payment.Revision{
+					{Change: payment.Change{Action: payment.ActionCreate, Actor: "alice", RequestId: "some request", At: at}, Current: created},
+					{Change: payment.Change{Action: payment.ActionUpdate, At: at.Add(time.Hour)}, Previous: &created, Current: updated},
+				}
+				ms.On("History", mock.AnythingOfType("*context.valueCtx"), id).Return(expected, nil)
+
+				resp, err := http.DefaultClient.Do(givenHistoryRequest(id))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				var actual payment.History
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual.Revisions).Should(Equal(expected))
+			})
+		})
+
+		Context("that does not exist", func() {
+			It("should return not found", func() {
+				id := uuid.NewV4().String()
+				ms.On("History", mock.AnythingOfType("*context.valueCtx"), id).Return([]payment.Revision(nil), payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(givenHistoryRequest(id))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusNotFound, "not_found")
+			})
+		})
+	})
+
+	Describe("Streaming the changes to payments", func() {
+		var (
+			stream         *httptest.Server
+			organisationId string
+		)
+
+		BeforeEach(func() {
+			stream = httptest.NewServer(payment.GetHandlers(&ms, payment.WithStreamInterval(10*time.Millisecond)))
+			organisationId = uuid.NewV4().String()
+		})
+
+		AfterEach(func() {
+			stream.Close()
+		})
+
+		givenStreamRequest := func(query string, lastEventId string) *http.Request {
+			req, err := http.NewRequest("GET", fmt.Sprintf("%s/payment/stream?%s", stream.URL, query), nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			if lastEventId != "" {
+				req.Header.Set(payment.LastEventIdHeader, lastEventId)
+			}
+			return req
+		}
+
+		givenRevision := func(sequence int64, action payment.Action, p payment.Payment) payment.Revision {
+			return payment.Revision{Sequence: sequence, Change: payment.Change{Action: action, At: time.Now().UTC()}, Current: p}
+		}
+
+		// readEvent reads the fields of the next event, skipping comments.
+		readEvent := func(reader *bufio.Reader) map[string]string {
+			fields := make(map[string]string)
+			for {
+				line, err := reader.ReadString('\n')
+				Expect(err).ShouldNot(HaveOccurred())
+				line = strings.TrimSuffix(line, "\n")
+				if line == "" && len(fields) > 0 {
+					return fields
+				}
+				if line == "" || strings.HasPrefix(line, ":") {
+					continue
+				}
+				kv := strings.SplitN(line, ": ", 2)
+				Expect(kv).To(HaveLen(2))
+				fields[kv[0]] = kv[1]
+			}
+		}
+
+		It("should send the changes made after the last event", func() {
+			p := payment.Payment{Id: uuid.NewV4().String(), OrganisationId: organisationId}
+			moved := p
+			moved.Version, moved.Status = 1, payment.StatusSubmitted
+			ms.On("LastSequence", mock.Anything, organisationId).Return(int64(43), nil)
+			ms.On("Changes", mock.Anything, organisationId, int64(41), 100).
+				Return([]payment.Revision{givenRevision(42, payment.ActionCreate, p), givenRevision(43, payment.ActionTransition, moved)}, nil)
+			ms.On("Changes", mock.Anything, organisationId, int64(43), 100).
+				Return([]payment.Revision{}, nil)
+
+			resp, err := http.DefaultClient.Do(givenStreamRequest("organisation_id="+organisationId, "41"))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+			reader := bufio.NewReader(resp.Body)
+			first := readEvent(reader)
+			Expect(first["id"]).To(Equal("42"))
+			Expect(first["event"]).To(Equal(payment.EventCreated))
+			var actual payment.Payment
+			Expect(json.Unmarshal([]byte(first["data"]), &actual)).To(Succeed())
+			Expect(actual).To(Equal(p))
+
+			second := readEvent(reader)
+			Expect(second["id"]).To(Equal("43"))
+			Expect(second["event"]).To(Equal(payment.EventStatusChanged))
+			Expect(json.Unmarshal([]byte(second["data"]), &actual)).To(Succeed())
+			Expect(actual).To(Equal(moved))
+		})
+
+		It("should start with the next change when not resuming", func() {
+			p := payment.Payment{Id: uuid.NewV4().String(), OrganisationId: organisationId}
+			ms.On("LastSequence", mock.Anything, organisationId).Return(int64(7), nil)
+			ms.On("Changes", mock.Anything, organisationId, int64(7), 100).
+				Return([]payment.Revision{givenRevision(8, payment.ActionCreate, p)}, nil)
+			ms.On("Changes", mock.Anything, organisationId, int64(8), 100).
+				Return([]payment.Revision{}, nil)
+
+			resp, err := http.DefaultClient.Do(givenStreamRequest("organisation_id="+organisationId, ""))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(readEvent(bufio.NewReader(resp.Body))["id"]).To(Equal("8"))
+		})
+
+		It("should require the organisation", func() {
+			resp, err := http.DefaultClient.Do(givenStreamRequest("", ""))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			thenProblem(resp, http.StatusBadRequest, "invalid_query")
+		})
+
+		It("should refuse a last event id it did not send", func() {
+			resp, err := http.DefaultClient.Do(givenStreamRequest("organisation_id="+organisationId, "not a sequence"))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			thenProblem(resp, http.StatusBadRequest, "invalid_last_event_id")
+			ms.AssertNotCalled(GinkgoT(), "Changes", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	})
+
 	Describe("Searching for payments", func() {
 
 		Context("that exist in the db", func() {
@@ -122,8 +841,9 @@ var _ = Describe("Handlers", func() {
 						{Id: "C", OrganisationId: id},
 					},
 				}
-				ms.On("SearchByOrganisationId", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string")).
-					Return(expected.Payments, nil)
+				ms.On("Search", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.SearchOptions")).
+					Return(payment.SearchResult{Payments: expected.Payments}, nil)
+				expected.Links = &payment.Links{Self: req.URL.RequestURI()}
 
 				resp, err := http.DefaultClient.Do(req)
 				Expect(err).ShouldNot(HaveOccurred())
@@ -137,7 +857,414 @@ var _ = Describe("Handlers", func() {
 				err = json.Unmarshal(body, &actual)
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(actual).Should(Equal(expected))
-				ms.AssertCalled(GinkgoT(), "SearchByOrganisationId", mock.AnythingOfType("*context.valueCtx"), id)
+				ms.AssertCalled(GinkgoT(), "Search", mock.AnythingOfType("*context.valueCtx"), payment.SearchOptions{OrganisationId: id})
+			})
+
+			It("should pass on the filters, sort and page", func() {
+				id := uuid.NewV4().String()
+				req := givenPaymentSearchRequest(ts.URL)
+				req.URL.RawQuery = "organisation_id=" + id +
+					"&filter[currency]=GBP&filter[payment_type]=Credit&filter[payment_scheme]=FPS" +
+					"&filter[processing_date_from]=2017-01-01&filter[processing_date_to]=2017-01-31" +
+					"&filter[amount_min]=1.00&filter[amount_max]=200" +
+					"&filter[beneficiary_account_number]=123&filter[debtor_account_number]=456" +
+					"&sort=-amount&page[after]=cursor&page[size]=10&include_deleted=true"
+				ms.On("Search", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.SearchOptions")).
+					Return(payment.SearchResult{Payments: []payment.Payment{}}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+				ms.AssertCalled(GinkgoT(), "Search", mock.AnythingOfType("*context.valueCtx"), payment.SearchOptions{
+					OrganisationId:           id,
+					Currency:                 "GBP",
+					PaymentType:              "Credit",
+					PaymentScheme:            payment.SchemeFPS,
+					ProcessingDateFrom:       "2017-01-01",
+					ProcessingDateTo:         "2017-01-31",
+					AmountMin:                "1.00",
+					AmountMax:                "200",
+					BeneficiaryAccountNumber: "123",
+					DebtorAccountNumber:      "456",
+					IncludeDeleted:           true,
+					Sort:                     "-amount",
+					After:                    "cursor",
+					Size:                     10,
+				})
+			})
+
+			It("should link to the next and previous pages", func() {
+				id := uuid.NewV4().String()
+				req := givenPaymentSearchRequest(ts.URL)
+				req.URL.RawQuery = "organisation_id=" + id + "&page[after]=current"
+				ms.On("Search", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.SearchOptions")).
+					Return(payment.SearchResult{Payments: []payment.Payment{{Id: "A"}}, Next: "next", Prev: "prev"}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				var actual payment.Payments
+				Expect(json.NewDecoder(resp.Body).Decode(&actual)).ShouldNot(HaveOccurred())
+				Expect(actual.Links.Next).Should(Equal("/payment/search?organisation_id=" + id + "&page%5Bafter%5D=next"))
+				Expect(actual.Links.Prev).Should(Equal("/payment/search?organisation_id=" + id + "&page%5Bbefore%5D=prev"))
+			})
+		})
+
+		Context("that is invalid", func() {
+			DescribeTable("should return bad request",
+				func(query string) {
+					req := givenPaymentSearchRequest(ts.URL)
+					req.URL.RawQuery = query
+
+					resp, err := http.DefaultClient.Do(req)
+					Expect(err).ShouldNot(HaveOccurred())
+					defer resp.Body.Close()
+					Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+					ms.AssertNotCalled(GinkgoT(), "Search", mock.Anything, mock.Anything)
+				},
+				Entry("without an organisation id", ""),
+				Entry("with a non numeric amount", "organisation_id=a&filter[amount_min]=ten"),
+				Entry("with a bad date", "organisation_id=a&filter[processing_date_to]=31/01/2017"),
+				Entry("with a page size too big", "organisation_id=a&page[size]=1001"),
+				Entry("with both page cursors", "organisation_id=a&page[after]=a&page[before]=b"),
+				Entry("with an unknown status", "organisation_id=a&filter[status]=lost"),
+			)
+
+			It("should return bad request if the cursor is invalid", func() {
+				req := givenPaymentSearchRequest(ts.URL)
+				req.URL.RawQuery = "organisation_id=a&page[after]=rubbish"
+				ms.On("Search", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.SearchOptions")).
+					Return(payment.SearchResult{}, payment.ErrInvalidCursor)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Describe("Saving a new payment with an idempotency key", func() {
+		BeforeEach(func() {
+			ts.Close()
+			r = payment.GetHandlers(&ms, payment.WithIdempotency(idempotency.NewMemoryStore(), time.Hour))
+			ts = httptest.NewServer(r)
+		})
+
+		givenKeyedRequest := func(organisationId string) *http.Request {
+			req := givenValidPaymentRequest(ts.URL)
+			req.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"organisation_id":%q}`, organisationId)))
+			req.ContentLength = -1
+			req.Header.Set(idempotency.Header, "key-1")
+			return req
+		}
+
+		It("should only save the payment once for a retry", func() {
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("new-payment-id", nil).Once()
+
+			for i := 0; i < 2; i++ {
+				resp, err := http.DefaultClient.Do(givenKeyedRequest("org-1"))
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+				Expect(resp.Header.Get("Location")).To(Equal("/payment/new-payment-id"))
+			}
+			ms.AssertNumberOfCalls(GinkgoT(), "Save", 1)
+		})
+
+		It("should scope the key to the organisation of the payment", func() {
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("new-payment-id", nil)
+
+			for _, org := range []string{"org-1", "org-2"} {
+				resp, err := http.DefaultClient.Do(givenKeyedRequest(org))
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			}
+			ms.AssertNumberOfCalls(GinkgoT(), "Save", 2)
+		})
+	})
+
+	Describe("Authenticating requests", func() {
+		callers := stubAuthenticator{
+			"Bearer alice": {Subject: "apikey:alice", OrganisationIds: []string{"org-1"}},
+			"Bearer bob":   {Subject: "apikey:bob", OrganisationIds: []string{"org-2"}},
+		}
+
+		BeforeEach(func() {
+			ts.Close()
+			r = payment.GetHandlers(&ms,
+				payment.WithAuthentication(auth.Middleware(callers)),
+				payment.WithIdempotency(idempotency.NewMemoryStore(), time.Hour))
+			ts = httptest.NewServer(r)
+		})
+
+		givenCallerRequest := func(caller string) *http.Request {
+			req := givenValidPaymentRequest(ts.URL)
+			req.Body = ioutil.NopCloser(strings.NewReader(`{"organisation_id":"org-1"}`))
+			req.ContentLength = -1
+			req.Header.Set("Authorization", "Bearer "+caller)
+			return req
+		}
+
+		It("should refuse a request it cannot authenticate", func() {
+			resp, err := http.DefaultClient.Do(givenValidPaymentRequest(ts.URL))
+			Expect(err).ShouldNot(HaveOccurred())
+			defer resp.Body.Close()
+			thenProblem(resp, http.StatusUnauthorized, "unauthenticated")
+			ms.AssertNotCalled(GinkgoT(), "Save", mock.Anything, mock.Anything)
+		})
+
+		It("should leave the health check open", func() {
+			ms.On("HealthCheck", mock.AnythingOfType("*context.valueCtx")).
+				Return(payment.HealthCheckStatus{Healthy: true, Message: "okay"})
+
+			resp, err := http.Get(fmt.Sprintf("%s/__health", ts.URL))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should make the caller the actor whatever it says", func() {
+			ms.On("Save", mock.MatchedBy(func(ctx context.Context) bool {
+				return payment.ActorFromContext(ctx) == "apikey:alice"
+			}), mock.AnythingOfType("payment.Payment")).Return("new-payment-id", nil)
+
+			req := givenCallerRequest("alice")
+			req.Header.Set(payment.ActorHeader, "mallory")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			ms.AssertExpectations(GinkgoT())
+		})
+
+		It("should not replay the response for another organisation to the caller", func() {
+			ms.On("Save", mock.MatchedBy(func(ctx context.Context) bool {
+				return auth.Allowed(ctx, "org-1")
+			}), mock.AnythingOfType("payment.Payment")).Return("new-payment-id", nil)
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("", payment.ErrNotFound)
+
+			for _, call := range []struct {
+				caller string
+				status int
+			}{{"alice", http.StatusCreated}, {"bob", http.StatusNotFound}} {
+				req := givenCallerRequest(call.caller)
+				req.Header.Set(idempotency.Header, "key-1")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(call.status))
+				Expect(resp.Header.Get(idempotency.ReplayedHeader)).To(BeEmpty())
+			}
+		})
+	})
+
+	Describe("Saving with an idempotency key after being refused", func() {
+		BeforeEach(func() {
+			ts.Close()
+			r = payment.GetHandlers(&ms, payment.WithIdempotency(idempotency.NewMemoryStore(), time.Hour))
+			ts = httptest.NewServer(r)
+		})
+
+		It("should save the payment when retried once the caller is allowed to", func() {
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("", &auth.ForbiddenError{Permission: auth.PermissionCreate}).Once()
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("new-payment-id", nil).Once()
+
+			for _, status := range []int{http.StatusForbidden, http.StatusCreated} {
+				req := givenValidPaymentRequest(ts.URL)
+				req.Body = ioutil.NopCloser(strings.NewReader(`{"organisation_id":"org-1"}`))
+				req.ContentLength = -1
+				req.Header.Set(idempotency.Header, "key-1")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(status))
+				Expect(resp.Header.Get(idempotency.ReplayedHeader)).To(BeEmpty())
+			}
+			ms.AssertNumberOfCalls(GinkgoT(), "Save", 2)
+		})
+	})
+
+	Describe("Limiting requests", func() {
+		callers := stubAuthenticator{
+			"Bearer alice": {Subject: "apikey:alice", OrganisationIds: []string{"org-1"}},
+			"Bearer bob":   {Subject: "apikey:bob", OrganisationIds: []string{"org-1"}},
+		}
+
+		BeforeEach(func() {
+			ts.Close()
+			limiter := ratelimit.NewLimiter(ratelimit.Config{
+				By: ratelimit.ByKey,
+				Limits: map[ratelimit.Class]ratelimit.Limit{
+					ratelimit.ClassRead:  {Requests: 1, Per: ratelimit.Duration(time.Hour)},
+					ratelimit.ClassWrite: {Requests: 1, Per: ratelimit.Duration(time.Hour)},
+				},
+			})
+			r = payment.GetHandlers(&ms,
+				payment.WithAuthentication(auth.Middleware(callers)),
+				payment.WithRateLimit(ratelimit.Middleware(limiter, nil)))
+			ts = httptest.NewServer(r)
+		})
+
+		givenCallerRequest := func(caller string) *http.Request {
+			req := givenValidPaymentRequest(ts.URL)
+			req.Header.Set("Authorization", "Bearer "+caller)
+			return req
+		}
+
+		It("should refuse a caller over its limit", func() {
+			ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+				Return("new-payment-id", nil)
+
+			for _, call := range []struct {
+				caller string
+				status int
+			}{{"alice", http.StatusCreated}, {"alice", http.StatusTooManyRequests}, {"bob", http.StatusCreated}} {
+				resp, err := http.DefaultClient.Do(givenCallerRequest(call.caller))
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(call.status))
+				Expect(resp.Header.Get(ratelimit.LimitHeader)).To(Equal("1"))
+			}
+			ms.AssertNumberOfCalls(GinkgoT(), "Save", 2)
+		})
+
+		Context("by organisation", func() {
+			BeforeEach(func() {
+				ts.Close()
+				limiter := ratelimit.NewLimiter(ratelimit.Config{
+					By: ratelimit.ByOrganisation,
+					Limits: map[ratelimit.Class]ratelimit.Limit{
+						ratelimit.ClassWrite: {Requests: 1, Per: ratelimit.Duration(time.Hour)},
+					},
+				})
+				r = payment.GetHandlers(&ms,
+					payment.WithAuthentication(auth.Middleware(stubAuthenticator{
+						"Bearer carol": {Subject: "apikey:carol", OrganisationIds: []string{"org-1", "org-2"}},
+						"Bearer dave":  {Subject: "apikey:dave", OrganisationIds: []string{"org-1", "org-2"}},
+					})),
+					payment.WithRateLimit(ratelimit.Middleware(limiter, payment.Owner(&ms))))
+				ts = httptest.NewServer(r)
+			})
+
+			It("should limit callers acting for many organisations by the organisation of the payment patched", func() {
+				ids := map[string]string{"org-1": uuid.NewV4().String(), "org-2": uuid.NewV4().String()}
+				for organisationId, id := range ids {
+					ms.On("Get", mock.AnythingOfType("*context.valueCtx"), id, payment.GetOptions{IncludeDeleted: true}).
+						Return(payment.Payment{Id: id, OrganisationId: organisationId}, nil)
+					ms.On("Patch", mock.AnythingOfType("*context.valueCtx"), id, mock.Anything).
+						Return(payment.Payment{Id: id, OrganisationId: organisationId, Version: 1}, nil)
+				}
+
+				for _, call := range []struct {
+					caller         string
+					organisationId string
+					status         int
+				}{
+					{"carol", "org-1", http.StatusOK},
+					{"carol", "org-2", http.StatusOK},
+					{"dave", "org-1", http.StatusTooManyRequests},
+				} {
+					req := givenPatchPaymentRequest(ts.URL, ids[call.organisationId], "application/merge-patch+json", `{"attributes":{"reference":"new"}}`)
+					req.Header.Set("Authorization", "Bearer "+call.caller)
+					resp, err := http.DefaultClient.Do(req)
+					Expect(err).ShouldNot(HaveOccurred())
+					resp.Body.Close()
+					Expect(resp.StatusCode).To(Equal(call.status))
+				}
+				ms.AssertNumberOfCalls(GinkgoT(), "Patch", 2)
+			})
+		})
+
+		It("should not limit the health check", func() {
+			ms.On("HealthCheck", mock.AnythingOfType("*context.valueCtx")).
+				Return(payment.HealthCheckStatus{Healthy: true, Message: "okay"})
+
+			for i := 0; i < 2; i++ {
+				resp, err := http.Get(fmt.Sprintf("%s/__health", ts.URL))
+				Expect(err).ShouldNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get(ratelimit.LimitHeader)).To(BeEmpty())
+			}
+		})
+	})
+
+	Describe("Errors", func() {
+		Context("when the payment is not found", func() {
+			It("should return a problem with the code and request id", func() {
+				_, req := givenPaymentRequest(ts.URL)
+				req.Header.Set("X-Request-Id", "req-123")
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string"), payment.GetOptions{}).
+					Return(payment.Payment{}, payment.ErrNotFound)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				actual := thenProblem(resp, http.StatusNotFound, "not_found")
+				Expect(actual.RequestId).Should(Equal("req-123"))
+				Expect(actual.Instance).Should(Equal(req.URL.Path))
+				Expect(actual.Detail).Should(Equal("payment: not found"))
+			})
+		})
+
+		Context("when searching without an organisation id", func() {
+			It("should return the missing field", func() {
+				resp, err := http.DefaultClient.Do(givenPaymentSearchRequest(ts.URL))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				actual := thenProblem(resp, http.StatusBadRequest, "invalid_query")
+				Expect(actual.Errors).Should(Equal([]problem.FieldError{{Field: "organisation_id", Message: "is required"}}))
+			})
+		})
+
+		Context("when the payment is invalid", func() {
+			It("should return every field error", func() {
+				req := givenValidPaymentRequest(ts.URL)
+				ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+					Return("", &payment.ValidationError{Errors: []payment.FieldError{
+						{Field: "organisation_id", Message: "is required"},
+						{Field: "attributes.amount", Message: "is required"},
+					}})
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				actual := thenProblem(resp, http.StatusUnprocessableEntity, "validation_failed")
+				Expect(actual.Errors).Should(Equal([]problem.FieldError{
+					{Field: "organisation_id", Message: "is required"},
+					{Field: "attributes.amount", Message: "is required"},
+				}))
+			})
+		})
+
+		Context("when the back end fails", func() {
+			It("should not leak the error", func() {
+				req := givenValidPaymentRequest(ts.URL)
+				ms.On("Save", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("payment.Payment")).
+					Return("", errors.New("password=secret"))
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				actual := thenProblem(resp, http.StatusInternalServerError, "internal_error")
+				Expect(actual.Detail).ShouldNot(ContainSubstring("secret"))
+			})
+		})
+
+		Context("when the route does not exist", func() {
+			It("should return a problem", func() {
+				resp, err := http.Get(fmt.Sprintf("%s/nowhere", ts.URL))
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				thenProblem(resp, http.StatusNotFound, "route_not_found")
 			})
 		})
 	})
@@ -150,7 +1277,7 @@ var _ = Describe("Handlers", func() {
 				id, req := givenPaymentRequest(ts.URL)
 
 				expected := payment.Payment{Id: id, Attributes: payment.Attributes{Reference: "some ref"}}
-				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string")).
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string"), payment.GetOptions{}).
 					Return(expected, nil)
 
 				resp, err := http.DefaultClient.Do(req)
@@ -163,7 +1290,7 @@ var _ = Describe("Handlers", func() {
 				err = json.Unmarshal(body, &actual)
 				Expect(err).ShouldNot(HaveOccurred())
 				Expect(actual).Should(Equal(expected))
-				ms.AssertCalled(GinkgoT(), "Get", mock.AnythingOfType("*context.valueCtx"), id)
+				ms.AssertCalled(GinkgoT(), "Get", mock.AnythingOfType("*context.valueCtx"), id, payment.GetOptions{})
 			})
 
 			It("should return 200 status", func() {
@@ -171,7 +1298,7 @@ var _ = Describe("Handlers", func() {
 				id, req := givenPaymentRequest(ts.URL)
 
 				expected := payment.Payment{Id: id, Attributes: payment.Attributes{Reference: "some ref"}}
-				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string")).
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string"), payment.GetOptions{}).
 					Return(expected, nil)
 
 				resp, err := http.DefaultClient.Do(req)
@@ -181,10 +1308,67 @@ var _ = Describe("Handlers", func() {
 			})
 		})
 
+		Context("that has been deleted", func() {
+			It("should ask for deleted payments when include_deleted set", func() {
+				id, req := givenPaymentRequest(ts.URL)
+				q := req.URL.Query()
+				q.Add("include_deleted", "true")
+				req.URL.RawQuery = q.Encode()
+
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), id, payment.GetOptions{IncludeDeleted: true}).
+					Return(payment.Payment{Id: id, Deleted: &payment.Deletion{Reason: "duplicate"}}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+				ms.AssertExpectations(GinkgoT())
+			})
+
+			It("should return bad request if include_deleted is not a bool", func() {
+				_, req := givenPaymentRequest(ts.URL)
+				req.URL.RawQuery = "include_deleted=maybe"
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("as it was at a point in time", func() {
+			It("should ask for the payment as of the time given", func() {
+				id, req := givenPaymentRequest(ts.URL)
+				req.URL.RawQuery = "as_of=2018-10-01T13:00:00%2B01:00"
+				at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), id, mock.MatchedBy(func(opts payment.GetOptions) bool {
+					return opts.AsOf.Equal(at) && !opts.IncludeDeleted
+				})).Return(payment.Payment{Id: id}, nil)
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+				ms.AssertExpectations(GinkgoT())
+			})
+
+			It("should return bad request if as_of is not a timestamp", func() {
+				_, req := givenPaymentRequest(ts.URL)
+				req.URL.RawQuery = "as_of=yesterday"
+
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer resp.Body.Close()
+				p := thenProblem(resp, http.StatusBadRequest, "invalid_query")
+				Expect(p.Errors).To(Equal([]problem.FieldError{{Field: "as_of", Message: "must be a timestamp as RFC 3339"}}))
+				ms.AssertNotCalled(GinkgoT(), "Get", mock.Anything, mock.Anything, mock.Anything)
+			})
+		})
+
 		Context("that does not exists in the db", func() {
 			It("should return not found", func() {
 				_, req := givenPaymentRequest(ts.URL)
-				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string")).
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string"), payment.GetOptions{}).
 					Return(payment.Payment{}, payment.ErrNotFound)
 				resp, err := http.DefaultClient.Do(req)
 				Expect(err).ShouldNot(HaveOccurred())
@@ -196,7 +1380,7 @@ var _ = Describe("Handlers", func() {
 		Context("when the database errors", func() {
 			It("should return internal server error", func() {
 				_, req := givenPaymentRequest(ts.URL)
-				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string")).
+				ms.On("Get", mock.AnythingOfType("*context.valueCtx"), mock.AnythingOfType("string"), payment.GetOptions{}).
 					Return(payment.Payment{}, errors.New("some DB error"))
 				resp, err := http.DefaultClient.Do(req)
 				Expect(err).ShouldNot(HaveOccurred())
@@ -257,6 +1441,15 @@ var _ = Describe("Handlers", func() {
 	})
 })
 
+func thenProblem(resp *http.Response, status int, code string) (p problem.Problem) {
+	Expect(resp.StatusCode).Should(Equal(status))
+	Expect(resp.Header.Get("Content-Type")).Should(Equal(problem.ContentType))
+	Expect(json.NewDecoder(resp.Body).Decode(&p)).ShouldNot(HaveOccurred())
+	Expect(p.Status).Should(Equal(status))
+	Expect(p.Code).Should(Equal(code))
+	return p
+}
+
 func givenPaymentSearchRequest(url string) (req *http.Request) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/payment/search", url), nil)
 	Expect(err).ShouldNot(HaveOccurred())
@@ -281,6 +1474,41 @@ func givenValidPaymentRequest(url string) *http.Request {
 	return req
 }
 
+func givenValidateRequest(url string, p payment.Payment) *http.Request {
+	bs, err := json.Marshal(p)
+	Expect(err).ShouldNot(HaveOccurred())
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/payment/validate", url), bytes.NewReader(bs))
+	Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func givenUpdatePaymentRequest(url string, id string, p payment.Payment) *http.Request {
+	bs, err := json.Marshal(p)
+	Expect(err).ShouldNot(HaveOccurred())
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/payment/%s", url, id), bytes.NewReader(bs))
+	Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func givenPatchPaymentRequest(url string, id string, contentType string, body string) *http.Request {
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/payment/%s", url, id), strings.NewReader(body))
+	Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func givenBatchPaymentRequest(url string, query string, size int) *http.Request {
+	ps := payment.Payments{Payments: make([]payment.Payment, size)}
+	bs, err := json.Marshal(ps)
+	Expect(err).ShouldNot(HaveOccurred())
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/payments?%s", url, query), bytes.NewReader(bs))
+	Expect(err).ShouldNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
 type mockService struct {
 	mock.Mock
 }
@@ -290,14 +1518,80 @@ func (s *mockService) Save(ctx context.Context, payment payment.Payment) (id str
 	return args.String(0), args.Error(1)
 }
 
-func (s *mockService) Get(ctx context.Context, id string) (p payment.Payment, err error) {
+func (s *mockService) SaveAll(ctx context.Context, payments []payment.Payment, atomic bool) (results []payment.BatchResult, err error) {
+	args := s.Called(ctx, payments, atomic)
+	return args.Get(0).([]payment.BatchResult), args.Error(1)
+}
+
+func (s *mockService) Get(ctx context.Context, id string, opts payment.GetOptions) (p payment.Payment, err error) {
+	args := s.Called(ctx, id, opts)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) Update(ctx context.Context, p payment.Payment) (updated payment.Payment, err error) {
+	args := s.Called(ctx, p)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) Patch(ctx context.Context, id string, patch payment.Patch) (updated payment.Payment, err error) {
+	args := s.Called(ctx, id, patch)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) Delete(ctx context.Context, id string, reason string) error {
+	args := s.Called(ctx, id, reason)
+	return args.Error(0)
+}
+
+func (s *mockService) Restore(ctx context.Context, id string) (p payment.Payment, err error) {
 	args := s.Called(ctx, id)
 	return args.Get(0).(payment.Payment), args.Error(1)
 }
 
-func (s *mockService) SearchByOrganisationId(ctx context.Context, organisationId string) (payments []payment.Payment, err error) {
+func (s *mockService) Transition(ctx context.Context, id string, t payment.Transition) (p payment.Payment, err error) {
+	args := s.Called(ctx, id, t)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) Approve(ctx context.Context, id string, reason string) (p payment.Payment, err error) {
+	args := s.Called(ctx, id, reason)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) Reject(ctx context.Context, id string, reason string) (p payment.Payment, err error) {
+	args := s.Called(ctx, id, reason)
+	return args.Get(0).(payment.Payment), args.Error(1)
+}
+
+func (s *mockService) History(ctx context.Context, id string) (revisions []payment.Revision, err error) {
+	args := s.Called(ctx, id)
+	return args.Get(0).([]payment.Revision), args.Error(1)
+}
+
+func (s *mockService) Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []payment.Revision, err error) {
+	args := s.Called(ctx, organisationId, after, limit)
+	return args.Get(0).([]payment.Revision), args.Error(1)
+}
+
+func (s *mockService) LastSequence(ctx context.Context, organisationId string) (sequence int64, err error) {
 	args := s.Called(ctx, organisationId)
-	return args.Get(0).([]payment.Payment), args.Error(1)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (s *mockService) Search(ctx context.Context, opts payment.SearchOptions) (result payment.SearchResult, err error) {
+	args := s.Called(ctx, opts)
+	return args.Get(0).(payment.SearchResult), args.Error(1)
+}
+
+// stubAuthenticator knows callers by their whole Authorization header.
+type stubAuthenticator map[string]auth.Identity
+
+func (a stubAuthenticator) Authenticate(r *http.Request) (auth.Identity, error) {
+	id, ok := a[r.Header.Get("Authorization")]
+	if !ok {
+		return id, auth.ErrUnauthenticated
+	}
+	return id, nil
 }
 
 func (s *mockService) HealthCheck(ctx context.Context) payment.HealthCheckStatus {
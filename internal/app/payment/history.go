@@ -0,0 +1,57 @@
+package payment
+
+import "time"
+
+// Action is the kind of change made to a payment.
+type Action string
+
+const (
+	ActionCreate     Action = "create"
+	ActionUpdate     Action = "update"
+	ActionPatch      Action = "patch"
+	ActionDelete     Action = "delete"
+	ActionRestore    Action = "restore"
+	ActionTransition Action = "transition"
+	ActionApprove    Action = "approve"
+	ActionReject     Action = "reject"
+)
+
+// Change says what was done to a payment, by whom and when. The Repository is
+// given one with every write and keeps it in the history of the payment
+// together with the write.
+type Change struct {
+	Action    Action    `json:"action"`
+	Actor     string    `json:"actor,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+// Revision is one entry in the history of a payment, the change with the
+// payment as it was before and after it. There is nothing before the change
+// that created the payment.
+type Revision struct {
+	// Sequence orders the revisions of every payment of an organisation, a
+	// later revision always has a higher one. Revisions made before there
+	// was a sequence have none.
+	Sequence int64 `json:"sequence,omitempty"`
+	Change
+	Previous *Payment `json:"previous,omitempty"`
+	Current  Payment  `json:"current"`
+}
+
+// History is every change made to a payment, oldest first.
+type History struct {
+	Revisions []Revision `json:"data"`
+}
+
+// asOf finds the payment as it was at the time given, it did not exist yet
+// when no revision was made by then.
+func asOf(revisions []Revision, at time.Time) (payment Payment, ok bool) {
+	for _, r := range revisions {
+		if r.At.After(at) {
+			break
+		}
+		payment, ok = r.Current, true
+	}
+	return payment, ok
+}
@@ -0,0 +1,112 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Status is where a payment is in its lifecycle.
+type Status string
+
+const (
+	StatusCreated         Status = "created"
+	StatusPendingApproval Status = "pending_approval"
+	StatusSubmitted       Status = "submitted"
+	StatusSettled         Status = "settled"
+	StatusRejected        Status = "rejected"
+	StatusReturned        Status = "returned"
+	StatusCancelled       Status = "cancelled"
+)
+
+// transitions are the statuses a payment may move to from each status, a
+// status with none is final.
+var transitions = map[Status][]Status{
+	StatusCreated:         {StatusPendingApproval, StatusSubmitted, StatusCancelled},
+	StatusPendingApproval: {StatusSubmitted, StatusRejected, StatusCancelled},
+	StatusSubmitted:       {StatusSettled, StatusRejected},
+	StatusSettled:         {StatusReturned},
+	StatusRejected:        {},
+	StatusReturned:        {},
+	StatusCancelled:       {},
+}
+
+// Known is true for every status of the lifecycle.
+func (s Status) Known() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Next are the statuses a payment in this status may move to.
+func (s Status) Next() []Status {
+	next := make([]Status, len(transitions[s]))
+	copy(next, transitions[s])
+	return next
+}
+
+func (s Status) CanMoveTo(to Status) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusChange is one step of a payment through its lifecycle. The first
+// change of every payment has no From.
+type StatusChange struct {
+	From   Status    `json:"from,omitempty"`
+	To     Status    `json:"to"`
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Transition asks for a payment to be moved to another status.
+type Transition struct {
+	To     Status `json:"to"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// TransitionError is returned when a payment cannot move to the status asked
+// for from the one it is in.
+type TransitionError struct {
+	From    Status
+	To      Status
+	Allowed []Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("payment: cannot move from %s to %s", e.From, e.To)
+}
+
+type actorKey struct{}
+
+// NewActorContext records who is making the request, the actor is kept with
+// every status change made with the context.
+func NewActorContext(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns who is making the request, or empty if unknown.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// created starts the lifecycle of a new payment.
+func created(p Payment, at time.Time, actor string) Payment {
+	p.Status = StatusCreated
+	p.StatusHistory = []StatusChange{{To: StatusCreated, At: at, Actor: actor}}
+	return p
+}
+
+// currentStatus treats payments saved before there was a lifecycle as
+// created.
+func currentStatus(p Payment) Status {
+	if p.Status == "" {
+		return StatusCreated
+	}
+	return p.Status
+}
@@ -0,0 +1,390 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// NewMemoryRepository keeps payments in memory only, they are lost when the
+// server stops. It is meant for local development and tests. It is also the
+// outbox.Store of the events of its changes.
+func NewMemoryRepository() Repository {
+	return newMemoryRepository(nil, nil)
+}
+
+func newMemoryRepository(journal func(docs [][]byte) error, acknowledge func(through int64) error) *memoryRepository {
+	return &memoryRepository{
+		payments:       make(map[string]storedPayment),
+		byOrganisation: make(map[string]map[string]struct{}),
+		changes:        make(map[string][]sequenced),
+		journal:        journal,
+		acknowledge:    acknowledge,
+	}
+}
+
+// memoryRepository holds every payment and revision as JSON so that nothing
+// handed in or out shares memory with what is stored.
+type memoryRepository struct {
+	mu             sync.RWMutex
+	payments       map[string]storedPayment
+	byOrganisation map[string]map[string]struct{}
+	// changes are where the revisions of the payments of each organisation
+	// are in their history, in order of their sequence.
+	changes map[string][]sequenced
+	// events are waiting to be published oldest first, sequence is the last
+	// one given out.
+	events   []outbox.Event
+	sequence int64
+	// journal, when set, is given the revisions and events of every change
+	// before it is made while the lock is held, the change is dropped if it
+	// fails.
+	journal func(docs [][]byte) error
+	// acknowledge, when set, is told every event up to a sequence has been
+	// published before they are dropped while the lock is held, they are kept
+	// if it fails.
+	acknowledge func(through int64) error
+}
+
+type storedPayment struct {
+	organisationId string
+	doc            []byte
+	history        [][]byte
+}
+
+// sequenced is a revision found by its sequence, it is at the index of the
+// history of the payment.
+type sequenced struct {
+	sequence  int64
+	paymentId string
+	index     int
+}
+
+func (r *memoryRepository) Insert(ctx context.Context, payment Payment, change Change) error {
+	return r.InsertAll(ctx, []Payment{payment}, change)
+}
+
+func (r *memoryRepository) InsertAll(ctx context.Context, payments []Payment, change Change) error {
+	docs := make([][]byte, len(payments))
+	revisions := make([]Revision, len(payments))
+	events := make([]outbox.Event, len(payments))
+	for i, p := range payments {
+		p.Deleted = nil
+		bs, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		docs[i] = bs
+		revisions[i] = Revision{Change: change, Current: p}
+		events[i] = newEvent(change, p.Id, bs)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]struct{}, len(payments))
+	for _, p := range payments {
+		_, stored := r.payments[p.Id]
+		_, repeated := seen[p.Id]
+		if stored || repeated {
+			return fmt.Errorf("payment: duplicate id '%s'", p.Id)
+		}
+		seen[p.Id] = struct{}{}
+	}
+	written, err := r.write(revisions, events)
+	if err != nil {
+		return err
+	}
+	for i, p := range payments {
+		r.put(p.Id, p.OrganisationId, docs[i], written[i], revisions[i].Sequence)
+	}
+	return nil
+}
+
+// write numbers the revisions and the events that go with them after the
+// last sequence given out and passes them to the journal, the events are kept
+// to be published when it succeeds. It returns the revisions as they were
+// written. The lock must be held.
+func (r *memoryRepository) write(revisions []Revision, events []outbox.Event) ([][]byte, error) {
+	docs := make([][]byte, 0, len(revisions)+len(events))
+	for i := range revisions {
+		revisions[i].Sequence = r.sequence + int64(i) + 1
+		bs, err := json.Marshal(revisions[i])
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, bs)
+	}
+	for i := range events {
+		events[i].Sequence = r.sequence + int64(i) + 1
+		bs, err := json.Marshal(events[i])
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, bs)
+	}
+
+	if r.journal != nil {
+		if err := r.journal(docs); err != nil {
+			return nil, err
+		}
+	}
+	r.enqueue(events...)
+	return docs[:len(revisions)], nil
+}
+
+// enqueue keeps the events to be published. The lock must be held.
+func (r *memoryRepository) enqueue(events ...outbox.Event) {
+	if len(events) == 0 {
+		return
+	}
+	r.events = append(r.events, events...)
+	r.sequence = events[len(events)-1].Sequence
+}
+
+// put stores the document keeping the organisation index in step with it, the
+// revision, when there is one, is added to the history and to the changes of
+// the organisation when it has a sequence. The lock must be held.
+func (r *memoryRepository) put(id string, organisationId string, doc []byte, revision []byte, sequence int64) {
+	current, ok := r.payments[id]
+	if ok && current.organisationId != organisationId {
+		delete(r.byOrganisation[current.organisationId], id)
+	}
+	history := current.history
+	if revision != nil {
+		history = append(history, revision)
+	}
+	r.payments[id] = storedPayment{organisationId: organisationId, doc: doc, history: history}
+	ids, ok := r.byOrganisation[organisationId]
+	if !ok {
+		ids = make(map[string]struct{})
+		r.byOrganisation[organisationId] = ids
+	}
+	ids[id] = struct{}{}
+	if revision != nil && sequence > 0 {
+		r.changes[organisationId] = append(r.changes[organisationId], sequenced{sequence: sequence, paymentId: id, index: len(history) - 1})
+	}
+}
+
+func (r *memoryRepository) Get(ctx context.Context, paymentId string) (payment Payment, err error) {
+	r.mu.RLock()
+	stored, ok := r.payments[paymentId]
+	r.mu.RUnlock()
+	if !ok {
+		return payment, ErrNotFound
+	}
+	err = json.Unmarshal(stored.doc, &payment)
+	return payment, err
+}
+
+func (r *memoryRepository) Update(ctx context.Context, payment Payment, expectedVersion int32, change Change) error {
+	doc, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.payments[payment.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	var current Payment
+	if err = json.Unmarshal(stored.doc, &current); err != nil {
+		return err
+	}
+	if current.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	revisions := []Revision{{Change: change, Previous: &current, Current: payment}}
+	written, err := r.write(revisions, []outbox.Event{newEvent(change, payment.Id, doc)})
+	if err != nil {
+		return err
+	}
+	r.put(payment.Id, payment.OrganisationId, doc, written[0], revisions[0].Sequence)
+	return nil
+}
+
+func (r *memoryRepository) History(ctx context.Context, paymentId string) (revisions []Revision, err error) {
+	r.mu.RLock()
+	stored, ok := r.payments[paymentId]
+	r.mu.RUnlock()
+	if !ok {
+		return revisions, ErrNotFound
+	}
+
+	revisions = make([]Revision, len(stored.history))
+	for i, doc := range stored.history {
+		if err = json.Unmarshal(doc, &revisions[i]); err != nil {
+			return revisions, err
+		}
+	}
+	return revisions, nil
+}
+
+func (r *memoryRepository) Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	changes := r.changes[organisationId]
+	i := sort.Search(len(changes), func(i int) bool { return changes[i].sequence > after })
+	revisions = make([]Revision, 0)
+	for ; i < len(changes) && len(revisions) < limit; i++ {
+		var revision Revision
+		if err = json.Unmarshal(r.payments[changes[i].paymentId].history[changes[i].index], &revision); err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+func (r *memoryRepository) LastSequence(ctx context.Context, organisationId string) (sequence int64, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if changes := r.changes[organisationId]; len(changes) > 0 {
+		sequence = changes[len(changes)-1].sequence
+	}
+	return sequence, nil
+}
+
+func (r *memoryRepository) Pending(ctx context.Context, limit int) (events []outbox.Event, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if limit > len(r.events) {
+		limit = len(r.events)
+	}
+	events = make([]outbox.Event, limit)
+	copy(events, r.events)
+	return events, nil
+}
+
+func (r *memoryRepository) Published(ctx context.Context, sequences []int64) error {
+	published := make(map[int64]struct{}, len(sequences))
+	for _, s := range sequences {
+		published[s] = struct{}{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := make([]outbox.Event, 0, len(r.events))
+	for _, e := range r.events {
+		if _, ok := published[e.Sequence]; !ok {
+			pending = append(pending, e)
+		}
+	}
+
+	if r.acknowledge != nil {
+		// Everything before the oldest event still waiting has been published.
+		through := r.sequence
+		if len(pending) > 0 {
+			through = pending[0].Sequence - 1
+		}
+		if err := r.acknowledge(through); err != nil {
+			return err
+		}
+	}
+	r.events = pending
+	return nil
+}
+
+func (r *memoryRepository) Search(ctx context.Context, q Query) (payments []Payment, err error) {
+	field, ok := findSort(q.Sort)
+	if !ok {
+		return payments, ErrInvalidSort
+	}
+	match, err := newMatcher(q.Filter)
+	if err != nil {
+		return payments, err
+	}
+
+	r.mu.RLock()
+	payments = make([]Payment, 0, len(r.byOrganisation[q.Filter.OrganisationId]))
+	for id := range r.byOrganisation[q.Filter.OrganisationId] {
+		var p Payment
+		if err = json.Unmarshal(r.payments[id].doc, &p); err != nil {
+			r.mu.RUnlock()
+			return payments, err
+		}
+		if match(p) {
+			payments = append(payments, p)
+		}
+	}
+	r.mu.RUnlock()
+
+	// before is true when a comes before b in the order of the query.
+	before := func(aValue, aId, bValue, bId string) bool {
+		c := field.compare(aValue, bValue)
+		if c == 0 {
+			c = strings.Compare(aId, bId)
+		}
+		if q.Descending {
+			return c > 0
+		}
+		return c < 0
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return before(field.value(payments[i]), payments[i].Id, field.value(payments[j]), payments[j].Id)
+	})
+
+	page := payments[:0]
+	for _, p := range payments {
+		if q.AfterId != "" && !before(q.AfterValue, q.AfterId, field.value(p), p.Id) {
+			continue
+		}
+		if len(page) == q.Limit {
+			break
+		}
+		page = append(page, p)
+	}
+	return page, nil
+}
+
+func (r *memoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+// newMatcher turns the filters of the search into a test of a payment, a
+// filter on a field the payment does not have never matches just like NULL in
+// the database.
+func newMatcher(f SearchOptions) (func(p Payment) bool, error) {
+	min, err := optionalDecimal(f.AmountMin)
+	if err != nil {
+		return nil, err
+	}
+	max, err := optionalDecimal(f.AmountMax)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p Payment) bool {
+		a := p.Attributes
+		switch {
+		case !f.IncludeDeleted && p.Deleted != nil,
+			f.Currency != "" && a.Currency != f.Currency,
+			f.PaymentType != "" && a.PaymentType != f.PaymentType,
+			f.PaymentScheme != "" && a.PaymentScheme != f.PaymentScheme,
+			f.ProcessingDateFrom != "" && (a.ProcessingDate == "" || a.ProcessingDate < f.ProcessingDateFrom),
+			f.ProcessingDateTo != "" && (a.ProcessingDate == "" || a.ProcessingDate > f.ProcessingDateTo),
+			min != nil && (a.Amount.Empty() || a.Amount.Cmp(*min) < 0),
+			max != nil && (a.Amount.Empty() || a.Amount.Cmp(*max) > 0),
+			f.BeneficiaryAccountNumber != "" && (a.BeneficiaryParty == nil || a.BeneficiaryParty.AccountNumber != f.BeneficiaryAccountNumber),
+			f.DebtorAccountNumber != "" && (a.DebtorParty == nil || a.DebtorParty.AccountNumber != f.DebtorAccountNumber),
+			f.Status != "" && currentStatus(p) != f.Status:
+			return false
+		}
+		return true
+	}, nil
+}
+
+func optionalDecimal(s string) (*Decimal, error) {
+	if s == "" {
+		return nil, nil
+	}
+	d, err := ParseDecimal(s)
+	return &d, err
+}
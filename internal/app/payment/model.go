@@ -1,23 +1,128 @@
 package payment
 
+import "time"
+
+type PaymentScheme string
+
+const (
+	SchemeFPS        PaymentScheme = "FPS"
+	SchemeBacs       PaymentScheme = "Bacs"
+	SchemeChaps      PaymentScheme = "CHAPS"
+	SchemeSepaCredit PaymentScheme = "SEPACT"
+	SchemeSepaInst   PaymentScheme = "SEPAINSTANT"
+	SchemeSwift      PaymentScheme = "SWIFT"
+)
+
+type SchemePaymentType string
+
+const (
+	SchemePaymentTypeImmediatePayment      SchemePaymentType = "ImmediatePayment"
+	SchemePaymentTypeForwardDatedPayment   SchemePaymentType = "ForwardDatedPayment"
+	SchemePaymentTypeStandingOrder         SchemePaymentType = "StandingOrder"
+	SchemePaymentTypeDirectCredit          SchemePaymentType = "DirectCredit"
+	SchemePaymentTypeDirectDebit           SchemePaymentType = "DirectDebit"
+	SchemePaymentTypeSameDayPayment        SchemePaymentType = "SameDayPayment"
+	SchemePaymentTypeInternationalTransfer SchemePaymentType = "InternationalTransfer"
+)
+
+type SchemePaymentSubType string
+
+const (
+	SchemePaymentSubTypeInternetBanking   SchemePaymentSubType = "InternetBanking"
+	SchemePaymentSubTypeMobileBanking     SchemePaymentSubType = "MobileBanking"
+	SchemePaymentSubTypeTelephoneBanking  SchemePaymentSubType = "TelephoneBanking"
+	SchemePaymentSubTypeBranchInstruction SchemePaymentSubType = "BranchInstruction"
+)
+
 type Payment struct {
 	Id             string     `json:"id"`
 	Type           string     `json:"type"`
 	Version        int32      `json:"version"`
 	OrganisationId string     `json:"organisation_id"`
 	Attributes     Attributes `json:"attributes"`
+	// Status is only changed by a Transition, StatusHistory records every
+	// one of them starting with the payment being created.
+	Status        Status         `json:"status,omitempty"`
+	StatusHistory []StatusChange `json:"status_history,omitempty"`
+	// Approval is set once a payment pending approval has been approved or
+	// rejected.
+	Approval *Approval `json:"approval,omitempty"`
+	Deleted  *Deletion `json:"deleted,omitempty"`
+}
+
+// Deletion is only set on payments that have been soft deleted.
+type Deletion struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
 }
 
 type Attributes struct {
-	Amount            string `json:"amount"`
-	PaymentId         string `json:"payment_id"`
-	PaymentType       string `json:"payment_type"`
-	Currency          string `json:"currency"`
-	EndToEndReference string `json:"end_to_end_reference"`
-	NumericReference  string `json:"numeric_reference"`
-	Reference         string `json:"reference"`
+	Amount               Decimal              `json:"amount"`
+	PaymentId            string               `json:"payment_id"`
+	PaymentType          string               `json:"payment_type"`
+	Currency             string               `json:"currency"`
+	EndToEndReference    string               `json:"end_to_end_reference"`
+	NumericReference     string               `json:"numeric_reference"`
+	Reference            string               `json:"reference"`
+	PaymentPurpose       string               `json:"payment_purpose,omitempty"`
+	PaymentScheme        PaymentScheme        `json:"payment_scheme,omitempty"`
+	SchemePaymentType    SchemePaymentType    `json:"scheme_payment_type,omitempty"`
+	SchemePaymentSubType SchemePaymentSubType `json:"scheme_payment_sub_type,omitempty"`
+	ProcessingDate       string               `json:"processing_date,omitempty"`
+	BeneficiaryParty     *Party               `json:"beneficiary_party,omitempty"`
+	DebtorParty          *Party               `json:"debtor_party,omitempty"`
+	SponsorParty         *SponsorParty        `json:"sponsor_party,omitempty"`
+	ChargesInformation   *ChargesInformation  `json:"charges_information,omitempty"`
+	Fx                   *Fx                  `json:"fx,omitempty"`
+}
+
+// Party is either side of the payment, the beneficiary being paid or the debtor paying.
+type Party struct {
+	AccountName       string `json:"account_name,omitempty"`
+	AccountNumber     string `json:"account_number,omitempty"`
+	AccountNumberCode string `json:"account_number_code,omitempty"`
+	AccountType       *int   `json:"account_type,omitempty"`
+	Address           string `json:"address,omitempty"`
+	BankId            string `json:"bank_id,omitempty"`
+	BankIdCode        string `json:"bank_id_code,omitempty"`
+	Name              string `json:"name,omitempty"`
+}
+
+// SponsorParty is the bank sponsoring the payment into the scheme.
+type SponsorParty struct {
+	AccountNumber string `json:"account_number,omitempty"`
+	BankId        string `json:"bank_id,omitempty"`
+	BankIdCode    string `json:"bank_id_code,omitempty"`
+}
+
+type ChargesInformation struct {
+	BearerCode              string   `json:"bearer_code,omitempty"`
+	SenderCharges           []Charge `json:"sender_charges,omitempty"`
+	ReceiverChargesAmount   *Decimal `json:"receiver_charges_amount,omitempty"`
+	ReceiverChargesCurrency string   `json:"receiver_charges_currency,omitempty"`
+}
+
+type Charge struct {
+	Amount   Decimal `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// Fx holds the details of the foreign exchange when the payment was
+// originally made in another currency.
+type Fx struct {
+	ContractReference string   `json:"contract_reference,omitempty"`
+	ExchangeRate      *Decimal `json:"exchange_rate,omitempty"`
+	OriginalAmount    *Decimal `json:"original_amount,omitempty"`
+	OriginalCurrency  string   `json:"original_currency,omitempty"`
 }
 
 type Payments struct {
 	Payments []Payment `json:"data"`
+	Links    *Links    `json:"links,omitempty"`
+}
+
+type Links struct {
+	Self string `json:"self,omitempty"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
 }
@@ -0,0 +1,74 @@
+package payment_test
+
+import (
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+)
+
+var _ = Describe("Model", func() {
+
+	Describe("Marshalling the example payments", func() {
+		It("should not drop any attributes", func() {
+			expected, err := ioutil.ReadFile("../../../examples/example.json")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var ps payment.Payments
+			err = json.Unmarshal(expected, &ps)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(ps.Payments).Should(HaveLen(14))
+
+			actual, err := json.Marshal(ps)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).Should(MatchJSON(expected))
+		})
+
+		It("should read the typed attributes", func() {
+			p := givenExamplePayment()
+			Expect(p.Attributes.PaymentScheme).Should(Equal(payment.SchemeFPS))
+			Expect(p.Attributes.SchemePaymentType).Should(Equal(payment.SchemePaymentTypeImmediatePayment))
+			Expect(p.Attributes.SchemePaymentSubType).Should(Equal(payment.SchemePaymentSubTypeInternetBanking))
+			Expect(p.Attributes.BeneficiaryParty.AccountNumber).Should(Equal("31926819"))
+			Expect(*p.Attributes.BeneficiaryParty.AccountType).Should(Equal(0))
+			Expect(p.Attributes.DebtorParty.AccountType).Should(BeNil())
+			Expect(p.Attributes.SponsorParty.BankId).Should(Equal("123123"))
+			Expect(p.Attributes.ChargesInformation.SenderCharges).Should(Equal([]payment.Charge{
+				{Amount: payment.MustParseDecimal("5.00"), Currency: "GBP"},
+				{Amount: payment.MustParseDecimal("10.00"), Currency: "USD"},
+			}))
+			Expect(p.Attributes.Fx.ExchangeRate.String()).Should(Equal("2.00000"))
+			Expect(p.Attributes.ProcessingDate).Should(Equal("2017-01-18"))
+		})
+	})
+
+	Describe("Unmarshalling amounts", func() {
+		It("should reject an amount that is not a number", func() {
+			var p payment.Payment
+			err := json.Unmarshal([]byte(`{"attributes":{"amount":"ten"}}`), &p)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should reject an amount that is not a string", func() {
+			var p payment.Payment
+			err := json.Unmarshal([]byte(`{"attributes":{"amount":10.5}}`), &p)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should leave a missing amount empty", func() {
+			var p payment.Payment
+			Expect(json.Unmarshal([]byte(`{"attributes":{}}`), &p)).ShouldNot(HaveOccurred())
+			Expect(p.Attributes.Amount.Empty()).Should(BeTrue())
+			Expect(json.Marshal(p.Attributes.Amount)).Should(MatchJSON(`""`))
+		})
+	})
+})
+
+func givenExamplePayment() payment.Payment {
+	bs, err := ioutil.ReadFile("../../../examples/single_payment.json")
+	Expect(err).ShouldNot(HaveOccurred())
+	var p payment.Payment
+	Expect(json.Unmarshal(bs, &p)).ShouldNot(HaveOccurred())
+	return p
+}
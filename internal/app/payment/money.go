@@ -0,0 +1,261 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// RoundingMode decides which way a value is rounded when digits have to be
+// dropped from it.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds to the nearest value, halves away from zero.
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds to the nearest value, halves to the even digit.
+	RoundHalfEven
+	// RoundDown rounds towards zero.
+	RoundDown
+	// RoundUp rounds away from zero.
+	RoundUp
+	// RoundFloor rounds towards negative infinity.
+	RoundFloor
+	// RoundCeiling rounds towards positive infinity.
+	RoundCeiling
+)
+
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// Decimal is an exact fixed-point number held as an unscaled integer and the
+// number of digits after the decimal point. The scale is kept as it was
+// parsed so "2.00000" is written back as "2.00000". The zero value is empty,
+// it is written as "" and counts as zero in arithmetic.
+type Decimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+// ParseDecimal reads a plain decimal number such as "-100.21", exponents and
+// thousand separators are not accepted.
+func ParseDecimal(s string) (d Decimal, err error) {
+	if !decimalPattern.MatchString(s) {
+		return d, fmt.Errorf("payment: '%s' is not a decimal number", s)
+	}
+	digits := s
+	if i := strings.Index(s, "."); i >= 0 {
+		d.scale = len(s) - i - 1
+		digits = s[:i] + s[i+1:]
+	}
+	d.unscaled, _ = new(big.Int).SetString(digits, 10)
+	return d, nil
+}
+
+// MustParseDecimal is ParseDecimal for values known to be valid, it panics
+// otherwise.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) String() string {
+	if d.unscaled == nil {
+		return ""
+	}
+	digits := new(big.Int).Abs(d.unscaled).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+	if d.unscaled.Sign() < 0 {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Decimal) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return fmt.Errorf("payment: amounts must be strings, %s", err)
+	}
+	if s == "" {
+		*d = Decimal{}
+		return nil
+	}
+	parsed, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Empty is true when no value was ever given.
+func (d Decimal) Empty() bool {
+	return d.unscaled == nil
+}
+
+// Scale is the number of digits after the decimal point.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+func (d Decimal) Sign() int {
+	return d.int().Sign()
+}
+
+func (d Decimal) int() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return d.unscaled
+}
+
+// rescale returns the unscaled value at a larger scale, the value is unchanged.
+func (d Decimal) rescale(scale int) *big.Int {
+	return new(big.Int).Mul(d.int(), pow10(scale-d.scale))
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	scale := maxInt(d.scale, o.scale)
+	return Decimal{unscaled: new(big.Int).Add(d.rescale(scale), o.rescale(scale)), scale: scale}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	scale := maxInt(d.scale, o.scale)
+	return Decimal{unscaled: new(big.Int).Sub(d.rescale(scale), o.rescale(scale)), scale: scale}
+}
+
+// Mul is exact, the scale of the result is the sum of both scales.
+func (d Decimal) Mul(o Decimal) Decimal {
+	return Decimal{unscaled: new(big.Int).Mul(d.int(), o.int()), scale: d.scale + o.scale}
+}
+
+// Cmp returns -1, 0 or +1 as d is less than, equal to or greater than o, the
+// scale does not matter so "1.0" equals "1.00".
+func (d Decimal) Cmp(o Decimal) int {
+	scale := maxInt(d.scale, o.scale)
+	return d.rescale(scale).Cmp(o.rescale(scale))
+}
+
+// Round returns the value with the given number of digits after the decimal
+// point, digits are only dropped using the rounding mode.
+func (d Decimal) Round(scale int, mode RoundingMode) Decimal {
+	if scale >= d.scale {
+		return Decimal{unscaled: d.rescale(scale), scale: scale}
+	}
+
+	divisor := pow10(d.scale - scale)
+	q, r := new(big.Int).QuoRem(d.int(), divisor, new(big.Int))
+	if r.Sign() != 0 {
+		sign := d.Sign()
+		away := false
+		switch mode {
+		case RoundUp:
+			away = true
+		case RoundFloor:
+			away = sign < 0
+		case RoundCeiling:
+			away = sign > 0
+		case RoundHalfUp, RoundHalfEven:
+			half := new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(divisor)
+			away = half > 0 || (half == 0 && (mode == RoundHalfUp || q.Bit(0) == 1))
+		}
+		if away {
+			q.Add(q, big.NewInt(int64(sign)))
+		}
+	}
+	return Decimal{unscaled: q, scale: scale}
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Money is an amount in a currency, arithmetic is only allowed between
+// amounts in the same currency.
+type Money struct {
+	Amount   Decimal
+	Currency string
+}
+
+// MinorUnits is the number of decimal places used by the currency.
+func (m Money) MinorUnits() (units int, ok bool) {
+	return MinorUnits(m.Currency)
+}
+
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Amount, m.Currency)
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return m, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount.Add(o.Amount), Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return m, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount.Sub(o.Amount), Currency: m.Currency}, nil
+}
+
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	return m.Amount.Cmp(o.Amount), nil
+}
+
+// Round returns the amount with exactly the minor units of its currency.
+func (m Money) Round(mode RoundingMode) (Money, error) {
+	units, ok := m.MinorUnits()
+	if !ok {
+		return m, ErrUnknownCurrency
+	}
+	return Money{Amount: m.Amount.Round(units, mode), Currency: m.Currency}, nil
+}
+
+// Convert multiplies the amount by the exchange rate and rounds the result to
+// the minor units of the currency it is converted to.
+func (m Money) Convert(rate Decimal, currency string, mode RoundingMode) (Money, error) {
+	return Money{Amount: m.Amount.Mul(rate), Currency: currency}.Round(mode)
+}
+
+// Money is the amount of the payment in its currency.
+func (a Attributes) Money() Money {
+	return Money{Amount: a.Amount, Currency: a.Currency}
+}
+
+func (c Charge) Money() Money {
+	return Money{Amount: c.Amount, Currency: c.Currency}
+}
+
+// OriginalMoney is the amount before the exchange, empty if it is not known.
+func (fx Fx) OriginalMoney() Money {
+	m := Money{Currency: fx.OriginalCurrency}
+	if fx.OriginalAmount != nil {
+		m.Amount = *fx.OriginalAmount
+	}
+	return m
+}
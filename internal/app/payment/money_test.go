@@ -0,0 +1,125 @@
+package payment_test
+
+import (
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Money", func() {
+
+	Describe("Parsing a decimal", func() {
+		DescribeTable("should keep the value as written",
+			func(s string) {
+				d, err := payment.ParseDecimal(s)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(d.String()).Should(Equal(s))
+				bs, err := json.Marshal(d)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(bs).Should(MatchJSON(`"` + s + `"`))
+			},
+			Entry("a whole number", "100"),
+			Entry("minor units", "100.21"),
+			Entry("trailing zeros", "2.00000"),
+			Entry("less than one", "0.05"),
+			Entry("negative", "-0.50"),
+		)
+
+		DescribeTable("should reject anything else",
+			func(s string) {
+				_, err := payment.ParseDecimal(s)
+				Expect(err).Should(HaveOccurred())
+			},
+			Entry("empty", ""),
+			Entry("words", "ten"),
+			Entry("an exponent", "1e3"),
+			Entry("a trailing point", "10."),
+			Entry("a leading point", ".5"),
+			Entry("a separator", "1,000.00"),
+		)
+	})
+
+	Describe("Decimal arithmetic", func() {
+		It("should add and subtract exactly", func() {
+			a, b := payment.MustParseDecimal("0.1"), payment.MustParseDecimal("0.20")
+			Expect(a.Add(b).String()).Should(Equal("0.30"))
+			Expect(a.Sub(b).String()).Should(Equal("-0.10"))
+		})
+
+		It("should compare regardless of scale", func() {
+			Expect(payment.MustParseDecimal("1.0").Cmp(payment.MustParseDecimal("1.00"))).Should(Equal(0))
+			Expect(payment.MustParseDecimal("1.01").Cmp(payment.MustParseDecimal("1.1"))).Should(Equal(-1))
+			Expect(payment.MustParseDecimal("2").Cmp(payment.MustParseDecimal("-3"))).Should(Equal(1))
+		})
+
+		It("should treat an empty decimal as zero", func() {
+			Expect(payment.Decimal{}.Add(payment.MustParseDecimal("1.5")).String()).Should(Equal("1.5"))
+		})
+
+		DescribeTable("should round with the mode given",
+			func(value string, mode payment.RoundingMode, expected string) {
+				Expect(payment.MustParseDecimal(value).Round(2, mode).String()).Should(Equal(expected))
+			},
+			Entry("half up on a half", "1.005", payment.RoundHalfUp, "1.01"),
+			Entry("half up on a negative half", "-1.005", payment.RoundHalfUp, "-1.01"),
+			Entry("half even on a half to even", "1.005", payment.RoundHalfEven, "1.00"),
+			Entry("half even on a half to odd", "1.015", payment.RoundHalfEven, "1.02"),
+			Entry("half even above a half", "1.0051", payment.RoundHalfEven, "1.01"),
+			Entry("down", "1.009", payment.RoundDown, "1.00"),
+			Entry("down when negative", "-1.009", payment.RoundDown, "-1.00"),
+			Entry("up", "1.001", payment.RoundUp, "1.01"),
+			Entry("up when negative", "-1.001", payment.RoundUp, "-1.01"),
+			Entry("floor", "1.009", payment.RoundFloor, "1.00"),
+			Entry("floor when negative", "-1.001", payment.RoundFloor, "-1.01"),
+			Entry("ceiling", "1.001", payment.RoundCeiling, "1.01"),
+			Entry("ceiling when negative", "-1.009", payment.RoundCeiling, "-1.00"),
+			Entry("nothing to drop", "1.5", payment.RoundDown, "1.50"),
+		)
+	})
+
+	Describe("Money arithmetic", func() {
+		gbp := func(s string) payment.Money {
+			return payment.Money{Amount: payment.MustParseDecimal(s), Currency: "GBP"}
+		}
+
+		It("should add amounts in the same currency", func() {
+			actual, err := gbp("5.00").Add(gbp("10.25"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.String()).Should(Equal("15.25 GBP"))
+		})
+
+		It("should not mix currencies", func() {
+			usd := payment.Money{Amount: payment.MustParseDecimal("1.00"), Currency: "USD"}
+			_, err := gbp("5.00").Add(usd)
+			Expect(err).Should(Equal(payment.ErrCurrencyMismatch))
+			_, err = gbp("5.00").Sub(usd)
+			Expect(err).Should(Equal(payment.ErrCurrencyMismatch))
+			_, err = gbp("5.00").Cmp(usd)
+			Expect(err).Should(Equal(payment.ErrCurrencyMismatch))
+		})
+
+		It("should round to the minor units of the currency", func() {
+			actual, err := payment.Money{Amount: payment.MustParseDecimal("1234.5"), Currency: "JPY"}.Round(payment.RoundHalfEven)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.Amount.String()).Should(Equal("1234"))
+
+			_, err = payment.Money{Amount: payment.MustParseDecimal("1"), Currency: "ABC"}.Round(payment.RoundHalfEven)
+			Expect(err).Should(Equal(payment.ErrUnknownCurrency))
+		})
+
+		It("should convert with the exchange rate of the example payment", func() {
+			p := givenExamplePayment()
+			actual, err := p.Attributes.Money().Convert(*p.Attributes.Fx.ExchangeRate, "USD", payment.RoundHalfUp)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.Cmp(p.Attributes.Fx.OriginalMoney())).Should(Equal(0))
+		})
+
+		It("should round the converted amount", func() {
+			actual, err := gbp("10.00").Convert(payment.MustParseDecimal("0.333333"), "BHD", payment.RoundDown)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual.String()).Should(Equal("3.333 BHD"))
+		})
+	})
+})
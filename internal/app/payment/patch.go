@@ -0,0 +1,339 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch is a partial change to the JSON document of a payment.
+type Patch interface {
+	Apply(doc []byte) ([]byte, error)
+}
+
+// MergePatch is a JSON Merge Patch as described in RFC 7396.
+type MergePatch []byte
+
+// JSONPatch is a list of JSON Patch operations as described in RFC 6902.
+type JSONPatch []byte
+
+// PatchError is returned when a patch cannot be applied to a payment.
+type PatchError struct {
+	Reason string
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("payment: cannot apply patch, %s", e.Reason)
+}
+
+// ImmutableFieldError is returned when a change would modify a field that can
+// never change once the payment has been created.
+type ImmutableFieldError struct {
+	Field string
+}
+
+func (e *ImmutableFieldError) Error() string {
+	return fmt.Sprintf("payment: %s cannot be changed", e.Field)
+}
+
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	var patch interface{}
+	if err := json.Unmarshal(p, &patch); err != nil {
+		return nil, &PatchError{Reason: fmt.Sprintf("not a merge patch: %s", err)}
+	}
+
+	var target interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(target, patch))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (p JSONPatch) operations() (ops []jsonPatchOperation, err error) {
+	if err = json.Unmarshal(p, &ops); err != nil {
+		return ops, &PatchError{Reason: fmt.Sprintf("not a JSON patch: %s", err)}
+	}
+	return ops, err
+}
+
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	ops, err := p.operations()
+	if err != nil {
+		return nil, err
+	}
+
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if root, err = op.apply(root); err != nil {
+			return nil, &PatchError{Reason: fmt.Sprintf("operation %d (%s %s) %s", i, op.Op, op.Path, err)}
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+func (op jsonPatchOperation) value() (v interface{}, err error) {
+	if len(op.Value) == 0 {
+		return v, fmt.Errorf("is missing a value")
+	}
+	err = json.Unmarshal(op.Value, &v)
+	return v, err
+}
+
+func (op jsonPatchOperation) apply(root interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return root, err
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := op.value()
+		if err != nil {
+			return root, err
+		}
+		return pointerAdd(root, path, v)
+	case "remove":
+		root, _, err = pointerRemove(root, path)
+		return root, err
+	case "replace":
+		v, err := op.value()
+		if err != nil {
+			return root, err
+		}
+		return pointerReplace(root, path, v)
+	case "move":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return root, err
+		}
+		if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+			return root, fmt.Errorf("cannot move a value into one of its children")
+		}
+		var v interface{}
+		if root, v, err = pointerRemove(root, from); err != nil {
+			return root, err
+		}
+		return pointerAdd(root, path, v)
+	case "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return root, err
+		}
+		v, err := pointerGet(root, from)
+		if err != nil {
+			return root, err
+		}
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return root, err
+		}
+		var c interface{}
+		if err = json.Unmarshal(bs, &c); err != nil {
+			return root, err
+		}
+		return pointerAdd(root, path, c)
+	case "test":
+		expected, err := op.value()
+		if err != nil {
+			return root, err
+		}
+		actual, err := pointerGet(root, path)
+		if err != nil {
+			return root, err
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			return root, fmt.Errorf("failed, value does not match")
+		}
+		return root, nil
+	default:
+		return root, fmt.Errorf("is not a known operation")
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path '%s' must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= length || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("index '%s' is not in the array", token)
+	}
+	return i, nil
+}
+
+func pointerGet(node interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("'%s' does not exist", t)
+			}
+			node = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("'%s' does not exist", t)
+		}
+	}
+	return node, nil
+}
+
+// pointerUpdate walks to the parent of the last token of the path and lets fn
+// change it, fn returns the new parent so that arrays can grow and shrink.
+func pointerUpdate(node interface{}, path []string, fn func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+
+	child, err := pointerGet(node, path[:1])
+	if err != nil {
+		return node, err
+	}
+	child, err = pointerUpdate(child, path[1:], fn)
+	if err != nil {
+		return node, err
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		n[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(n))
+		n[i] = child
+	}
+	return node, nil
+}
+
+func pointerAdd(root interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return pointerUpdate(root, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = v
+			return p, nil
+		case []interface{}:
+			i := len(p)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(p)+1); err != nil {
+					return p, err
+				}
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = v
+			return p, nil
+		default:
+			return parent, fmt.Errorf("'%s' cannot be added to a value", token)
+		}
+	})
+}
+
+func pointerRemove(root interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return root, nil, fmt.Errorf("cannot remove the whole document")
+	}
+	var removed interface{}
+	root, err := pointerUpdate(root, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			v, ok := p[token]
+			if !ok {
+				return p, fmt.Errorf("'%s' does not exist", token)
+			}
+			removed = v
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(p))
+			if err != nil {
+				return p, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		default:
+			return parent, fmt.Errorf("'%s' does not exist", token)
+		}
+	})
+	return root, removed, err
+}
+
+func pointerReplace(root interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	return pointerUpdate(root, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok {
+				return p, fmt.Errorf("'%s' does not exist", token)
+			}
+			p[token] = v
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(p))
+			if err != nil {
+				return p, err
+			}
+			p[i] = v
+			return p, nil
+		default:
+			return parent, fmt.Errorf("'%s' does not exist", token)
+		}
+	})
+}
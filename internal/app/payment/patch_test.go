@@ -0,0 +1,71 @@
+package payment_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Patch", func() {
+
+	Describe("Applying a merge patch", func() {
+		DescribeTable("should follow RFC 7396",
+			func(doc string, patch string, expected string) {
+				actual, err := payment.MergePatch(patch).Apply([]byte(doc))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).Should(MatchJSON(expected))
+			},
+			Entry("replacing a value", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`),
+			Entry("adding a value", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`),
+			Entry("removing a value", `{"a":"b"}`, `{"a":null}`, `{}`),
+			Entry("replacing an array", `{"a":["b"]}`, `{"a":["c"]}`, `{"a":["c"]}`),
+			Entry("merging nested objects", `{"a":{"b":"c","d":"e"}}`, `{"a":{"b":"f","d":null}}`, `{"a":{"b":"f"}}`),
+			Entry("replacing a value with an object", `{"a":"b"}`, `{"a":{"c":"d"}}`, `{"a":{"c":"d"}}`),
+		)
+
+		It("should return a patch error if not json", func() {
+			_, err := payment.MergePatch("not json").Apply([]byte(`{}`))
+			Expect(err).Should(BeAssignableToTypeOf(&payment.PatchError{}))
+		})
+	})
+
+	Describe("Applying a JSON patch", func() {
+		DescribeTable("should follow RFC 6902",
+			func(doc string, patch string, expected string) {
+				actual, err := payment.JSONPatch(patch).Apply([]byte(doc))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).Should(MatchJSON(expected))
+			},
+			Entry("adding an object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`),
+			Entry("adding an array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`),
+			Entry("appending an array element", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`),
+			Entry("removing an object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`),
+			Entry("removing an array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`),
+			Entry("replacing a value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`),
+			Entry("moving a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`),
+			Entry("moving an array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`),
+			Entry("copying a value", `{"foo":{"bar":"baz"}}`, `[{"op":"copy","from":"/foo","path":"/qux"}]`, `{"foo":{"bar":"baz"},"qux":{"bar":"baz"}}`),
+			Entry("testing a value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`),
+			Entry("adding a null value", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":null}]`, `{"baz":null,"foo":"bar"}`),
+			Entry("escaping the path", `{"a/b":1,"m~n":2}`, `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`, `{"a/b":3}`),
+		)
+
+		DescribeTable("should return a patch error",
+			func(doc string, patch string) {
+				_, err := payment.JSONPatch(patch).Apply([]byte(doc))
+				Expect(err).Should(BeAssignableToTypeOf(&payment.PatchError{}))
+			},
+			Entry("when not a list of operations", `{}`, `{"op":"add"}`),
+			Entry("when the operation is unknown", `{}`, `[{"op":"frobnicate","path":"/a"}]`),
+			Entry("when adding to a missing parent", `{}`, `[{"op":"add","path":"/a/b","value":1}]`),
+			Entry("when removing a missing value", `{}`, `[{"op":"remove","path":"/a"}]`),
+			Entry("when replacing a missing value", `{}`, `[{"op":"replace","path":"/a","value":1}]`),
+			Entry("when the value is missing", `{}`, `[{"op":"add","path":"/a"}]`),
+			Entry("when the index is out of range", `{"a":[1]}`, `[{"op":"add","path":"/a/2","value":1}]`),
+			Entry("when a test fails", `{"a":"b"}`, `[{"op":"test","path":"/a","value":"c"}]`),
+			Entry("when moving into a child", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`),
+			Entry("when the path is not a pointer", `{"a":1}`, `[{"op":"remove","path":"a"}]`),
+		)
+	})
+})
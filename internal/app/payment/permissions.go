@@ -0,0 +1,121 @@
+package payment
+
+import (
+	"context"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+)
+
+// NewAuthorizedService only hands a call on to the service when the caller
+// has the permission it needs, so the roles are enforced however the call
+// was made. A call without the permission gets an *auth.ForbiddenError.
+func NewAuthorizedService(s Service) Service {
+	return &authorizedService{s: s}
+}
+
+type authorizedService struct {
+	s Service
+}
+
+func (a *authorizedService) Save(ctx context.Context, payment Payment) (id string, err error) {
+	if err = auth.Check(ctx, auth.PermissionCreate); err != nil {
+		return id, err
+	}
+	return a.s.Save(ctx, payment)
+}
+
+func (a *authorizedService) SaveAll(ctx context.Context, payments []Payment, atomic bool) (results []BatchResult, err error) {
+	if err = auth.Check(ctx, auth.PermissionCreate); err != nil {
+		return results, err
+	}
+	return a.s.SaveAll(ctx, payments, atomic)
+}
+
+func (a *authorizedService) Get(ctx context.Context, paymentId string, opts GetOptions) (payment Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionRead); err != nil {
+		return payment, err
+	}
+	return a.s.Get(ctx, paymentId, opts)
+}
+
+func (a *authorizedService) Update(ctx context.Context, payment Payment) (updated Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionUpdate); err != nil {
+		return updated, err
+	}
+	return a.s.Update(ctx, payment)
+}
+
+func (a *authorizedService) Patch(ctx context.Context, paymentId string, patch Patch) (updated Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionUpdate); err != nil {
+		return updated, err
+	}
+	return a.s.Patch(ctx, paymentId, patch)
+}
+
+func (a *authorizedService) Delete(ctx context.Context, paymentId string, reason string) error {
+	if err := auth.Check(ctx, auth.PermissionDelete); err != nil {
+		return err
+	}
+	return a.s.Delete(ctx, paymentId, reason)
+}
+
+// Restore undoes a delete so it needs the same permission.
+func (a *authorizedService) Restore(ctx context.Context, paymentId string) (payment Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionDelete); err != nil {
+		return payment, err
+	}
+	return a.s.Restore(ctx, paymentId)
+}
+
+func (a *authorizedService) Transition(ctx context.Context, paymentId string, transition Transition) (updated Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionTransition); err != nil {
+		return updated, err
+	}
+	return a.s.Transition(ctx, paymentId, transition)
+}
+
+func (a *authorizedService) Approve(ctx context.Context, paymentId string, reason string) (updated Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionApprove); err != nil {
+		return updated, err
+	}
+	return a.s.Approve(ctx, paymentId, reason)
+}
+
+func (a *authorizedService) Reject(ctx context.Context, paymentId string, reason string) (updated Payment, err error) {
+	if err = auth.Check(ctx, auth.PermissionApprove); err != nil {
+		return updated, err
+	}
+	return a.s.Reject(ctx, paymentId, reason)
+}
+
+func (a *authorizedService) History(ctx context.Context, paymentId string) (revisions []Revision, err error) {
+	if err = auth.Check(ctx, auth.PermissionRead); err != nil {
+		return revisions, err
+	}
+	return a.s.History(ctx, paymentId)
+}
+
+func (a *authorizedService) Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error) {
+	if err = auth.Check(ctx, auth.PermissionRead); err != nil {
+		return revisions, err
+	}
+	return a.s.Changes(ctx, organisationId, after, limit)
+}
+
+func (a *authorizedService) LastSequence(ctx context.Context, organisationId string) (sequence int64, err error) {
+	if err = auth.Check(ctx, auth.PermissionRead); err != nil {
+		return sequence, err
+	}
+	return a.s.LastSequence(ctx, organisationId)
+}
+
+func (a *authorizedService) Search(ctx context.Context, opts SearchOptions) (result SearchResult, err error) {
+	if err = auth.Check(ctx, auth.PermissionRead); err != nil {
+		return result, err
+	}
+	return a.s.Search(ctx, opts)
+}
+
+// HealthCheck is open to anyone.
+func (a *authorizedService) HealthCheck(ctx context.Context) HealthCheckStatus {
+	return a.s.HealthCheck(ctx)
+}
@@ -0,0 +1,114 @@
+package payment_test
+
+import (
+	"context"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Permissions", func() {
+
+	var (
+		s       payment.Service
+		ctx     context.Context
+		saved   payment.Payment
+		callers map[auth.Role]context.Context
+	)
+
+	BeforeEach(func() {
+		s = payment.NewAuthorizedService(payment.NewService(payment.NewMemoryRepository()))
+		ctx = context.Background()
+		id, err := s.Save(ctx, givenValidPayment())
+		Expect(err).ShouldNot(HaveOccurred())
+		saved, err = s.Get(ctx, id, payment.GetOptions{})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		callers = make(map[auth.Role]context.Context)
+		for _, role := range auth.Roles {
+			callers[role] = auth.NewContext(ctx, auth.Identity{
+				Subject:         string(role),
+				OrganisationIds: []string{saved.OrganisationId},
+				Roles:           []auth.Role{role},
+			})
+		}
+	})
+
+	thenForbidden := func(err error, p auth.Permission) {
+		Expect(err).To(Equal(&auth.ForbiddenError{Permission: p}))
+	}
+
+	It("should let every role read", func() {
+		for _, role := range auth.Roles {
+			_, err := s.Get(callers[role], saved.Id, payment.GetOptions{})
+			Expect(err).ShouldNot(HaveOccurred(), string(role))
+			_, err = s.Search(callers[role], payment.SearchOptions{OrganisationId: saved.OrganisationId})
+			Expect(err).ShouldNot(HaveOccurred(), string(role))
+			_, err = s.History(callers[role], saved.Id)
+			Expect(err).ShouldNot(HaveOccurred(), string(role))
+		}
+	})
+
+	It("should let nothing be done without a role", func() {
+		none := auth.NewContext(ctx, auth.Identity{Subject: "nobody", OrganisationIds: []string{saved.OrganisationId}})
+		_, err := s.Get(none, saved.Id, payment.GetOptions{})
+		thenForbidden(err, auth.PermissionRead)
+		_, err = s.LastSequence(none, saved.OrganisationId)
+		thenForbidden(err, auth.PermissionRead)
+	})
+
+	It("should only let submitters and admins save and change payments", func() {
+		_, err := s.Save(callers[auth.RoleViewer], givenValidPayment())
+		thenForbidden(err, auth.PermissionCreate)
+		_, err = s.SaveAll(callers[auth.RoleApprover], []payment.Payment{givenValidPayment()}, true)
+		thenForbidden(err, auth.PermissionCreate)
+		_, err = s.Update(callers[auth.RoleApprover], saved)
+		thenForbidden(err, auth.PermissionUpdate)
+
+		_, err = s.Save(callers[auth.RoleSubmitter], givenValidPayment())
+		Expect(err).ShouldNot(HaveOccurred())
+		updated, err := s.Update(callers[auth.RoleSubmitter], saved)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = s.Update(callers[auth.RoleAdmin], updated)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should only let approvers and admins move payments on", func() {
+		_, err := s.Transition(callers[auth.RoleSubmitter], saved.Id, payment.Transition{To: payment.StatusSubmitted})
+		thenForbidden(err, auth.PermissionTransition)
+		_, err = s.Transition(callers[auth.RoleApprover], saved.Id, payment.Transition{To: payment.StatusSubmitted})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = s.Transition(callers[auth.RoleAdmin], saved.Id, payment.Transition{To: payment.StatusSettled})
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should only let approvers and admins approve payments", func() {
+		for _, role := range []auth.Role{auth.RoleViewer, auth.RoleSubmitter} {
+			_, err := s.Approve(callers[role], saved.Id, "")
+			thenForbidden(err, auth.PermissionApprove)
+			_, err = s.Reject(callers[role], saved.Id, "")
+			thenForbidden(err, auth.PermissionApprove)
+		}
+		_, err := s.Approve(callers[auth.RoleApprover], saved.Id, "")
+		Expect(err).To(Equal(payment.ErrNotPendingApproval))
+	})
+
+	It("should only let admins delete and restore payments", func() {
+		for _, role := range []auth.Role{auth.RoleViewer, auth.RoleSubmitter, auth.RoleApprover} {
+			thenForbidden(s.Delete(callers[role], saved.Id, ""), auth.PermissionDelete)
+		}
+		Expect(s.Delete(callers[auth.RoleAdmin], saved.Id, "")).To(Succeed())
+		_, err := s.Restore(callers[auth.RoleSubmitter], saved.Id)
+		thenForbidden(err, auth.PermissionDelete)
+		_, err = s.Restore(callers[auth.RoleAdmin], saved.Id)
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("should check the permission before the organisation", func() {
+		other := auth.NewContext(ctx, auth.Identity{Subject: "other", OrganisationIds: []string{"other"}, Roles: []auth.Role{auth.RoleViewer}})
+		thenForbidden(s.Delete(other, saved.Id, ""), auth.PermissionDelete)
+		_, err := s.Get(other, saved.Id, payment.GetOptions{})
+		Expect(err).To(Equal(payment.ErrNotFound))
+	})
+})
@@ -0,0 +1,413 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+)
+
+type Database interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	PingContext(ctx context.Context) error
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func NewPostgresRepository(db Database) Repository {
+	return &postgresRepository{db: db}
+}
+
+type postgresRepository struct {
+	db Database
+}
+
+func (r *postgresRepository) Insert(ctx context.Context, payment Payment, change Change) error {
+	return r.InsertAll(ctx, []Payment{payment}, change)
+}
+
+func (r *postgresRepository) InsertAll(ctx context.Context, payments []Payment, change Change) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	organisationIds := make([]string, len(payments))
+	for i, p := range payments {
+		organisationIds[i] = p.OrganisationId
+	}
+	if err = lockOrganisations(ctx, tx, organisationIds...); err != nil {
+		return rollback(tx, err)
+	}
+	for _, p := range payments {
+		if err = insert(ctx, tx, p, change); err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// lockOrganisations holds the organisations until the transaction ends, so
+// the history of each is written by one transaction at a time. They are
+// locked in order so two transactions never wait on each other.
+func lockOrganisations(ctx context.Context, tx *sql.Tx, organisationIds ...string) error {
+	sort.Strings(organisationIds)
+	for i, id := range organisationIds {
+		if i > 0 && id == organisationIds[i-1] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert stores the document with the fields that are searched on copied
+// into their own columns.
+func insert(ctx context.Context, tx *sql.Tx, payment Payment, change Change) error {
+	payment.Deleted = nil
+	bs, err := json.Marshal(payment)
+	if err != nil {
+		return err
+	}
+
+	var id string
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO payments(ID, info, organisation_id, processing_date, currency, amount, status) VALUES($1, $2, $3, NULLIF($4, '')::date, NULLIF($5, ''), NULLIF($6, '')::numeric, $7) returning ID;",
+		payment.Id, string(bs), payment.OrganisationId, payment.Attributes.ProcessingDate, payment.Attributes.Currency, payment.Attributes.Amount.String(), currentStatus(payment)).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if err = record(ctx, tx, Revision{Change: change, Current: payment}); err != nil {
+		return err
+	}
+	return enqueue(ctx, tx, newEvent(change, payment.Id, bs))
+}
+
+// record adds the revision to the history, the table only allows rows to be
+// added.
+func record(ctx context.Context, tx *sql.Tx, revision Revision) error {
+	var previous sql.NullString
+	if revision.Previous != nil {
+		bs, err := json.Marshal(revision.Previous)
+		if err != nil {
+			return err
+		}
+		previous = sql.NullString{String: string(bs), Valid: true}
+	}
+	current, err := json.Marshal(revision.Current)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO payment_history(payment_id, action, actor, request_id, at, previous, current) VALUES($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7);",
+		revision.Current.Id, string(revision.Action), revision.Actor, revision.RequestId, revision.At, previous, string(current))
+	return err
+}
+
+// enqueue adds the event to the outbox to be published once the transaction
+// commits, outbox.NewPostgresStore reads them back.
+func enqueue(ctx context.Context, tx *sql.Tx, event outbox.Event) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO outbox(type, subject, at, data) VALUES($1, $2, $3, $4);",
+		event.Type, event.Subject, event.At, string(event.Data))
+	return err
+}
+
+func rollback(tx *sql.Tx, err error) error {
+	if rbErr := tx.Rollback(); rbErr != nil {
+		log.Error(rbErr)
+	}
+	return err
+}
+
+func (r *postgresRepository) Get(ctx context.Context, paymentId string) (payment Payment, err error) {
+	payment, err = scanPayment(r.db.QueryRowContext(ctx,
+		"SELECT info, deleted_at, deleted_reason FROM payments WHERE ID = $1;",
+		paymentId))
+	if err == sql.ErrNoRows {
+		return payment, ErrNotFound
+	}
+	return payment, err
+}
+
+// Update locks the row to check the version and keep the payment as it was in
+// the history, no other writer can change it until the update is committed.
+func (r *postgresRepository) Update(ctx context.Context, payment Payment, expectedVersion int32, change Change) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	previous, err := scanPayment(tx.QueryRowContext(ctx,
+		"SELECT info, deleted_at, deleted_reason FROM payments WHERE ID = $1 FOR UPDATE;",
+		payment.Id))
+	switch {
+	case err == sql.ErrNoRows:
+		return rollback(tx, ErrNotFound)
+	case err != nil:
+		return rollback(tx, err)
+	case previous.Version != expectedVersion:
+		return rollback(tx, ErrVersionConflict)
+	}
+
+	var (
+		deletedAt     pq.NullTime
+		deletedReason sql.NullString
+	)
+	if payment.Deleted != nil {
+		deletedAt = pq.NullTime{Time: payment.Deleted.At, Valid: true}
+		deletedReason = sql.NullString{String: payment.Deleted.Reason, Valid: true}
+	}
+	info := payment
+	info.Deleted = nil
+	bs, err := json.Marshal(info)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE payments SET info = $1, processing_date = NULLIF($3, '')::date, currency = NULLIF($4, ''), amount = NULLIF($5, '')::numeric, status = $8, deleted_at = $6, deleted_reason = $7 WHERE ID = $2;",
+		string(bs), payment.Id, payment.Attributes.ProcessingDate, payment.Attributes.Currency, payment.Attributes.Amount.String(), deletedAt, deletedReason, currentStatus(payment))
+	if err == nil {
+		err = lockOrganisations(ctx, tx, payment.OrganisationId)
+	}
+	if err == nil {
+		err = record(ctx, tx, Revision{Change: change, Previous: &previous, Current: payment})
+	}
+	if err == nil {
+		// The event carries the payment whole, deleted or not.
+		if bs, err = json.Marshal(payment); err == nil {
+			err = enqueue(ctx, tx, newEvent(change, payment.Id, bs))
+		}
+	}
+	if err != nil {
+		return rollback(tx, err)
+	}
+	return tx.Commit()
+}
+
+func (r *postgresRepository) History(ctx context.Context, paymentId string) (revisions []Revision, err error) {
+	revisions, err = r.queryRevisions(ctx,
+		"SELECT "+revisionColumns+" FROM payment_history WHERE payment_id = $1 ORDER BY id;",
+		paymentId)
+	if err != nil || len(revisions) > 0 {
+		return revisions, err
+	}
+
+	// Payments stored before there was a history have none.
+	var exists bool
+	if err = r.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM payments WHERE ID = $1);", paymentId).Scan(&exists); err != nil {
+		return revisions, err
+	}
+	if !exists {
+		return revisions, ErrNotFound
+	}
+	return revisions, nil
+}
+
+// The sequence of a revision is the id of its row in the history.
+const revisionColumns = "id, action, actor, request_id, at, previous, current"
+
+func (r *postgresRepository) queryRevisions(ctx context.Context, query string, args ...interface{}) (revisions []Revision, err error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return revisions, err
+	}
+	defer rows.Close()
+
+	revisions = []Revision{}
+	for rows.Next() {
+		var (
+			revision  Revision
+			action    string
+			actor     sql.NullString
+			requestId sql.NullString
+			previous  sql.NullString
+			current   string
+		)
+		if err = rows.Scan(&revision.Sequence, &action, &actor, &requestId, &revision.At, &previous, &current); err != nil {
+			return revisions, err
+		}
+		revision.Action, revision.Actor, revision.RequestId = Action(action), actor.String, requestId.String
+		if previous.Valid {
+			revision.Previous = &Payment{}
+			if err = json.Unmarshal([]byte(previous.String), revision.Previous); err != nil {
+				return revisions, err
+			}
+		}
+		if err = json.Unmarshal([]byte(current), &revision.Current); err != nil {
+			return revisions, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// Changes can rely on the ids of the history of an organisation only ever
+// growing, every write locks the organisations it changes until it commits
+// so none is given an id before another that commits after it.
+func (r *postgresRepository) Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error) {
+	return r.queryRevisions(ctx,
+		"SELECT "+revisionColumns+" FROM payment_history WHERE current->>'organisation_id' = $1 AND id > $2 ORDER BY id LIMIT $3;",
+		organisationId, after, limit)
+}
+
+func (r *postgresRepository) LastSequence(ctx context.Context, organisationId string) (sequence int64, err error) {
+	err = r.db.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(id), 0) FROM payment_history WHERE current->>'organisation_id' = $1;",
+		organisationId).Scan(&sequence)
+	return sequence, err
+}
+
+func (r *postgresRepository) Search(ctx context.Context, q Query) (payments []Payment, err error) {
+	field, ok := findSort(q.Sort)
+	if !ok {
+		return payments, ErrInvalidSort
+	}
+
+	// Fields copied into their own columns are filtered on those, the rest
+	// use containment so that the GIN index on the document is used.
+	f := q.Filter
+	b := &sqlBuilder{}
+	b.where("organisation_id = %s", f.OrganisationId)
+	if !f.IncludeDeleted {
+		b.where("deleted_at IS NULL")
+	}
+	if f.Currency != "" {
+		b.where("currency = %s", f.Currency)
+	}
+	if f.Status != "" {
+		b.where("status = %s", string(f.Status))
+	}
+	if f.PaymentType != "" {
+		b.where("info @> %s::jsonb", contains(f.PaymentType, "attributes", "payment_type"))
+	}
+	if f.PaymentScheme != "" {
+		b.where("info @> %s::jsonb", contains(string(f.PaymentScheme), "attributes", "payment_scheme"))
+	}
+	if f.ProcessingDateFrom != "" {
+		b.where("processing_date >= %s::date", f.ProcessingDateFrom)
+	}
+	if f.ProcessingDateTo != "" {
+		b.where("processing_date <= %s::date", f.ProcessingDateTo)
+	}
+	if f.AmountMin != "" {
+		b.where("amount >= %s::numeric", f.AmountMin)
+	}
+	if f.AmountMax != "" {
+		b.where("amount <= %s::numeric", f.AmountMax)
+	}
+	if f.BeneficiaryAccountNumber != "" {
+		b.where("info @> %s::jsonb", contains(f.BeneficiaryAccountNumber, "attributes", "beneficiary_party", "account_number"))
+	}
+	if f.DebtorAccountNumber != "" {
+		b.where("info @> %s::jsonb", contains(f.DebtorAccountNumber, "attributes", "debtor_party", "account_number"))
+	}
+
+	op, order := ">", "ASC"
+	if q.Descending {
+		op, order = "<", "DESC"
+	}
+
+	if q.AfterId != "" {
+		if field.name == "id" {
+			b.where("ID "+op+" %s::uuid", q.AfterId)
+		} else {
+			b.where(fmt.Sprintf("(%s, ID) %s (%s, %%s::uuid)", field.column, op, field.param), q.AfterValue, q.AfterId)
+		}
+	}
+
+	orderBy := fmt.Sprintf("%s %s, ID %s", field.column, order, order)
+	if field.name == "id" {
+		orderBy = fmt.Sprintf("ID %s", order)
+	}
+	query := fmt.Sprintf("SELECT info, deleted_at, deleted_reason FROM payments WHERE %s ORDER BY %s LIMIT %s;",
+		strings.Join(b.conditions, " AND "), orderBy, b.placeholder(q.Limit))
+
+	rows, err := r.db.QueryContext(ctx, query, b.args...)
+	if err != nil {
+		return payments, err
+	}
+	defer rows.Close()
+
+	payments = make([]Payment, 0)
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return payments, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+func (r *postgresRepository) Ping(ctx context.Context) error {
+	return r.db.PingContext(ctx)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPayment(row scanner) (payment Payment, err error) {
+	var (
+		info          string
+		deletedAt     pq.NullTime
+		deletedReason sql.NullString
+	)
+	if err = row.Scan(&info, &deletedAt, &deletedReason); err != nil {
+		return payment, err
+	}
+	if err = json.Unmarshal([]byte(info), &payment); err != nil {
+		return payment, err
+	}
+	if deletedAt.Valid {
+		payment.Deleted = &Deletion{
+			At:     deletedAt.Time,
+			Reason: deletedReason.String,
+		}
+	}
+	return payment, err
+}
+
+// sqlBuilder collects the conditions of a query numbering the placeholders of
+// the arguments as they are added.
+type sqlBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+// where adds a condition, every %s in it is replaced by the placeholder of the
+// matching argument.
+func (b *sqlBuilder) where(condition string, args ...interface{}) {
+	placeholders := make([]interface{}, len(args))
+	for i, arg := range args {
+		b.args = append(b.args, arg)
+		placeholders[i] = fmt.Sprintf("$%d", len(b.args))
+	}
+	b.conditions = append(b.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+// contains is a jsonb document holding only the value at the path, the
+// document of a payment contains it when the payment has that value.
+func contains(value string, path ...string) string {
+	var doc interface{} = value
+	for i := len(path) - 1; i >= 0; i-- {
+		doc = map[string]interface{}{path[i]: doc}
+	}
+	bs, _ := json.Marshal(doc)
+	return string(bs)
+}
+
+func (b *sqlBuilder) placeholder(arg interface{}) string {
+	b.args = append(b.args, arg)
+	return fmt.Sprintf("$%d", len(b.args))
+}
@@ -0,0 +1,560 @@
+package payment_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"time"
+)
+
+var _ = Describe("Postgres repository", func() {
+
+	var (
+		r      payment.Repository
+		dbMock sqlmock.Sqlmock
+		ctx    context.Context
+	)
+
+	BeforeEach(func() {
+		db, mock, err := sqlmock.New()
+		Expect(err).ShouldNot(HaveOccurred())
+		r = payment.NewPostgresRepository(db)
+		dbMock = mock
+		ctx = context.Background()
+	})
+
+	givenRows := func(ps ...payment.Payment) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"info", "deleted_at", "deleted_reason"})
+		for _, p := range ps {
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			rows.AddRow(string(bs), nil, nil)
+		}
+		return rows
+	}
+
+	expectLocked := func(organisationId string) {
+		dbMock.ExpectExec("SELECT pg_advisory_xact_lock\\(hashtext\\(\\$1\\)\\);").
+			WithArgs(organisationId).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	Describe("Inserting a payment", func() {
+		It("should store the document, the query columns, its history and event together", func() {
+			p := givenExamplePayment()
+			p.Id = "some id"
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(string(bs)).Should(ContainSubstring("beneficiary_party"))
+			change := givenChange(payment.ActionCreate)
+			dbMock.ExpectBegin()
+			expectLocked(p.OrganisationId)
+			dbMock.ExpectQuery("INSERT INTO payments\\(ID, info, organisation_id, processing_date, currency, amount, status\\)").
+				WithArgs(p.Id, string(bs), p.OrganisationId, "2017-01-18", "GBP", "100.21", "created").
+				WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(p.Id))
+			dbMock.ExpectExec("INSERT INTO payment_history\\(payment_id, action, actor, request_id, at, previous, current\\) VALUES\\(\\$1, \\$2, NULLIF\\(\\$3, ''\\), NULLIF\\(\\$4, ''\\), \\$5, \\$6, \\$7\\);").
+				WithArgs(p.Id, "create", "alice", "some request", change.At, nil, string(bs)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectExec("INSERT INTO outbox\\(type, subject, at, data\\) VALUES\\(\\$1, \\$2, \\$3, \\$4\\);").
+				WithArgs("payment.created", p.Id, change.At, string(bs)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectCommit()
+
+			Expect(r.Insert(ctx, p, change)).To(Succeed())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should never store a deletion", func() {
+			p := givenValidPayment()
+			p.Id = "some id"
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			dbMock.ExpectBegin()
+			expectLocked(p.OrganisationId)
+			dbMock.ExpectQuery("INSERT INTO payments").
+				WithArgs(p.Id, string(bs), p.OrganisationId, "", "GBP", "1.00", "created").
+				WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(p.Id))
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WithArgs(p.Id, "create", "alice", "some request", sqlmock.AnyArg(), nil, string(bs)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WithArgs("payment.created", p.Id, sqlmock.AnyArg(), string(bs)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectCommit()
+
+			p.Deleted = &payment.Deletion{Reason: "duplicate"}
+			Expect(r.Insert(ctx, p, givenChange(payment.ActionCreate))).To(Succeed())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should not store the payment without its history", func() {
+			dbMock.ExpectBegin()
+			expectLocked(givenValidPayment().OrganisationId)
+			dbMock.ExpectQuery("INSERT INTO payments").
+				WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("some id"))
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WillReturnError(sql.ErrConnDone)
+			dbMock.ExpectRollback()
+
+			p := givenValidPayment()
+			p.Id = "some id"
+			Expect(r.Insert(ctx, p, givenChange(payment.ActionCreate))).To(Equal(sql.ErrConnDone))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should not store the payment without its event", func() {
+			dbMock.ExpectBegin()
+			expectLocked(givenValidPayment().OrganisationId)
+			dbMock.ExpectQuery("INSERT INTO payments").
+				WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("some id"))
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WillReturnError(sql.ErrConnDone)
+			dbMock.ExpectRollback()
+
+			p := givenValidPayment()
+			p.Id = "some id"
+			Expect(r.Insert(ctx, p, givenChange(payment.ActionCreate))).To(Equal(sql.ErrConnDone))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Inserting a batch of payments", func() {
+		var first, second payment.Payment
+
+		BeforeEach(func() {
+			first, second = givenValidPayment(), givenValidPayment()
+			first.Id, second.Id = "id-1", "id-2"
+		})
+
+		It("should insert them all in one transaction", func() {
+			dbMock.ExpectBegin()
+			expectLocked(first.OrganisationId)
+			for _, id := range []string{"id-1", "id-2"} {
+				dbMock.ExpectQuery("INSERT INTO payments\\(ID, info, organisation_id, processing_date, currency, amount, status\\)").
+					WithArgs(id, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(id))
+				dbMock.ExpectExec("INSERT INTO payment_history").
+					WithArgs(id, "create", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				dbMock.ExpectExec("INSERT INTO outbox").
+					WithArgs("payment.created", id, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+			dbMock.ExpectCommit()
+
+			Expect(r.InsertAll(ctx, []payment.Payment{first, second}, givenChange(payment.ActionCreate))).To(Succeed())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should roll back and return the error when the database fails", func() {
+			dbMock.ExpectBegin()
+			expectLocked(first.OrganisationId)
+			dbMock.ExpectQuery("INSERT INTO payments").
+				WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow("id-1"))
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			dbMock.ExpectQuery("INSERT INTO payments").
+				WillReturnError(sql.ErrConnDone)
+			dbMock.ExpectRollback()
+
+			Expect(r.InsertAll(ctx, []payment.Payment{first, second}, givenChange(payment.ActionCreate))).To(Equal(sql.ErrConnDone))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Getting a payment", func() {
+		It("should return all the attributes", func() {
+			p := givenExamplePayment()
+			p.Id = "awesome id"
+			dbMock.ExpectQuery("SELECT info, deleted_at, deleted_reason FROM payments WHERE ID = \\$1;").
+				WithArgs(p.Id).
+				WillReturnRows(givenRows(p))
+
+			actual, err := r.Get(ctx, p.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(Equal(p))
+		})
+
+		It("should return the deletion from its columns", func() {
+			p := payment.Payment{Attributes: payment.Attributes{Reference: "some ref"}, Id: "awesome id"}
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			deletedAt := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			dbMock.ExpectQuery("SELECT info, deleted_at, deleted_reason FROM payments WHERE ID = \\$1;").
+				WithArgs(p.Id).
+				WillReturnRows(sqlmock.NewRows([]string{"info", "deleted_at", "deleted_reason"}).AddRow(string(bs), deletedAt, "duplicate"))
+
+			actual, err := r.Get(ctx, p.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			p.Deleted = &payment.Deletion{At: deletedAt, Reason: "duplicate"}
+			Expect(actual).To(Equal(p))
+		})
+
+		It("should return not found if no record", func() {
+			dbMock.ExpectQuery("SELECT info").
+				WithArgs("some id").
+				WillReturnError(sql.ErrNoRows)
+			_, err := r.Get(ctx, "some id")
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should return all other errors", func() {
+			dbMock.ExpectQuery("SELECT info").
+				WithArgs("some id").
+				WillReturnError(sql.ErrConnDone)
+			_, err := r.Get(ctx, "some id")
+			Expect(err).To(Equal(sql.ErrConnDone))
+		})
+	})
+
+	Describe("Updating a payment", func() {
+		var (
+			p        payment.Payment
+			previous payment.Payment
+		)
+
+		BeforeEach(func() {
+			p = givenValidPayment()
+			p.Id, p.Version = "some id", 4
+			previous = p
+			previous.Version = 3
+			previous.Attributes.Reference = "old ref"
+		})
+
+		givenLocked := func(stored payment.Payment) {
+			dbMock.ExpectBegin()
+			dbMock.ExpectQuery("SELECT info, deleted_at, deleted_reason FROM payments WHERE ID = \\$1 FOR UPDATE;").
+				WithArgs(p.Id).
+				WillReturnRows(givenRows(stored))
+		}
+
+		It("should replace the payment, keep what it was in the history and add an event", func() {
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			old, err := json.Marshal(previous)
+			Expect(err).ShouldNot(HaveOccurred())
+			change := givenChange(payment.ActionUpdate)
+			givenLocked(previous)
+			dbMock.ExpectExec("UPDATE payments SET info = \\$1, processing_date = NULLIF\\(\\$3, ''\\)::date, currency = NULLIF\\(\\$4, ''\\), amount = NULLIF\\(\\$5, ''\\)::numeric, status = \\$8, deleted_at = \\$6, deleted_reason = \\$7 WHERE ID = \\$2;").
+				WithArgs(string(bs), p.Id, "", "GBP", "1.00", nil, nil, "created").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectLocked(p.OrganisationId)
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WithArgs(p.Id, "update", "alice", "some request", change.At, string(old), string(bs)).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WithArgs("payment.updated", p.Id, change.At, string(bs)).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			dbMock.ExpectCommit()
+
+			Expect(r.Update(ctx, p, 3, change)).To(Succeed())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should write the deletion to its columns", func() {
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			deletedAt := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			givenLocked(previous)
+			dbMock.ExpectExec("UPDATE payments SET info").
+				WithArgs(string(bs), p.Id, "", "GBP", "1.00", deletedAt, "duplicate", "created").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			expectLocked(p.OrganisationId)
+			dbMock.ExpectExec("INSERT INTO payment_history").
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			dbMock.ExpectExec("INSERT INTO outbox").
+				WithArgs("payment.updated", p.Id, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(2, 1))
+			dbMock.ExpectCommit()
+
+			p.Deleted = &payment.Deletion{At: deletedAt, Reason: "duplicate"}
+			Expect(r.Update(ctx, p, 3, givenChange(payment.ActionDelete))).To(Succeed())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should return version conflict when the version does not match", func() {
+			givenLocked(previous)
+			dbMock.ExpectRollback()
+
+			Expect(r.Update(ctx, p, 2, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrVersionConflict))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should return not found if no record", func() {
+			dbMock.ExpectBegin()
+			dbMock.ExpectQuery("SELECT info").
+				WithArgs(p.Id).
+				WillReturnError(sql.ErrNoRows)
+			dbMock.ExpectRollback()
+
+			Expect(r.Update(ctx, p, 3, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrNotFound))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should roll back and return all other errors", func() {
+			givenLocked(previous)
+			dbMock.ExpectExec("UPDATE payments SET info").
+				WillReturnError(sql.ErrConnDone)
+			dbMock.ExpectRollback()
+
+			Expect(r.Update(ctx, p, 3, givenChange(payment.ActionUpdate))).To(Equal(sql.ErrConnDone))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Getting the history of a payment", func() {
+		It("should return the revisions oldest first", func() {
+			created, updated := givenValidPayment(), givenValidPayment()
+			created.Id, updated.Id, updated.Version = "some id", "some id", 1
+			first, err := json.Marshal(created)
+			Expect(err).ShouldNot(HaveOccurred())
+			second, err := json.Marshal(updated)
+			Expect(err).ShouldNot(HaveOccurred())
+			at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			dbMock.ExpectQuery("SELECT id, action, actor, request_id, at, previous, current FROM payment_history WHERE payment_id = \\$1 ORDER BY id;").
+				WithArgs("some id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "action", "actor", "request_id", "at", "previous", "current"}).
+					AddRow(1, "create", "alice", nil, at, nil, string(first)).
+					AddRow(5, "update", nil, "some request", at.Add(time.Hour), string(first), string(second)))
+
+			actual, err := r.History(ctx, "some id")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(Equal([]payment.Revision{
+				{Sequence: 1, Change: payment.Change{Action: payment.ActionCreate, Actor: "alice", At: at}, Current: created},
+				{Sequence: 5, Change: payment.Change{Action: payment.ActionUpdate, RequestId: "some request", At: at.Add(time.Hour)}, Previous: &created, Current: updated},
+			}))
+		})
+
+		It("should return an empty history for a payment stored before there was one", func() {
+			dbMock.ExpectQuery("SELECT id, action").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "action", "actor", "request_id", "at", "previous", "current"}))
+			dbMock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM payments WHERE ID = \\$1\\);").
+				WithArgs("some id").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+			actual, err := r.History(ctx, "some id")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).ShouldNot(BeNil())
+			Expect(actual).To(BeEmpty())
+		})
+
+		It("should return not found if no record", func() {
+			dbMock.ExpectQuery("SELECT id, action").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "action", "actor", "request_id", "at", "previous", "current"}))
+			dbMock.ExpectQuery("SELECT EXISTS").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+			_, err := r.History(ctx, "some id")
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+	})
+
+	Describe("Getting the changes of an organisation", func() {
+		It("should return the revisions after the sequence in order", func() {
+			p := givenValidPayment()
+			p.Id = "some id"
+			bs, err := json.Marshal(p)
+			Expect(err).ShouldNot(HaveOccurred())
+			at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			dbMock.ExpectQuery("SELECT id, action, actor, request_id, at, previous, current FROM payment_history WHERE current->>'organisation_id' = \\$1 AND id > \\$2 ORDER BY id LIMIT \\$3;").
+				WithArgs(p.OrganisationId, 41, 10).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "action", "actor", "request_id", "at", "previous", "current"}).
+					AddRow(42, "create", nil, nil, at, nil, string(bs)))
+
+			actual, err := r.Changes(ctx, p.OrganisationId, 41, 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(Equal([]payment.Revision{
+				{Sequence: 42, Change: payment.Change{Action: payment.ActionCreate, At: at}, Current: p},
+			}))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should return the sequence of the latest revision", func() {
+			dbMock.ExpectQuery("SELECT COALESCE\\(MAX\\(id\\), 0\\) FROM payment_history WHERE current->>'organisation_id' = \\$1;").
+				WithArgs("some organisation").
+				WillReturnRows(sqlmock.NewRows([]string{"coalesce"}).AddRow(42))
+
+			Expect(r.LastSequence(ctx, "some organisation")).To(Equal(int64(42)))
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("Searching for payments", func() {
+		It("should return all payments for the organisation", func() {
+			ps := []payment.Payment{
+				{Id: "A", OrganisationId: "OrgId"},
+				{Id: "B", OrganisationId: "OrgId"},
+			}
+			dbMock.ExpectQuery("SELECT info, deleted_at, deleted_reason FROM payments WHERE organisation_id = \\$1 AND deleted_at IS NULL ORDER BY ID ASC LIMIT \\$2;").
+				WithArgs("OrgId", 21).
+				WillReturnRows(givenRows(ps...))
+
+			actual, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: "OrgId"}, Sort: "id", Limit: 21})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).To(Equal(ps))
+		})
+
+		It("should include deleted payments when asked", func() {
+			dbMock.ExpectQuery("SELECT info, deleted_at, deleted_reason FROM payments WHERE organisation_id = \\$1 ORDER BY").
+				WithArgs("OrgId", 21).
+				WillReturnRows(givenRows())
+
+			_, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: "OrgId", IncludeDeleted: true}, Sort: "id", Limit: 21})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should apply all the filters", func() {
+			dbMock.ExpectQuery("WHERE organisation_id = \\$1 AND deleted_at IS NULL"+
+				" AND currency = \\$2"+
+				" AND status = \\$3"+
+				" AND info @> \\$4::jsonb"+
+				" AND info @> \\$5::jsonb"+
+				" AND processing_date >= \\$6::date"+
+				" AND processing_date <= \\$7::date"+
+				" AND amount >= \\$8::numeric"+
+				" AND amount <= \\$9::numeric"+
+				" AND info @> \\$10::jsonb"+
+				" AND info @> \\$11::jsonb"+
+				" ORDER BY").
+				WithArgs("OrgId", "GBP", "settled",
+					`{"attributes":{"payment_type":"Credit"}}`,
+					`{"attributes":{"payment_scheme":"FPS"}}`,
+					"2017-01-01", "2017-12-31", "10.00", "200",
+					`{"attributes":{"beneficiary_party":{"account_number":"31926819"}}}`,
+					`{"attributes":{"debtor_party":{"account_number":"GB29XABC10161234567801"}}}`,
+					11).
+				WillReturnRows(givenRows())
+
+			_, err := r.Search(ctx, payment.Query{
+				Filter: payment.SearchOptions{
+					OrganisationId:           "OrgId",
+					Currency:                 "GBP",
+					Status:                   payment.StatusSettled,
+					PaymentType:              "Credit",
+					PaymentScheme:            payment.SchemeFPS,
+					ProcessingDateFrom:       "2017-01-01",
+					ProcessingDateTo:         "2017-12-31",
+					AmountMin:                "10.00",
+					AmountMax:                "200",
+					BeneficiaryAccountNumber: "31926819",
+					DebtorAccountNumber:      "GB29XABC10161234567801",
+				},
+				Sort:  "id",
+				Limit: 11,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should sort descending", func() {
+			dbMock.ExpectQuery("ORDER BY COALESCE\\(amount, 0\\) DESC, ID DESC LIMIT \\$2;").
+				WithArgs("OrgId", 21).
+				WillReturnRows(givenRows())
+
+			_, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: "OrgId"}, Sort: "amount", Descending: true, Limit: 21})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should start after the key given", func() {
+			dbMock.ExpectQuery("AND \\(COALESCE\\(processing_date, '-infinity'::date\\), ID\\) > \\(COALESCE\\(NULLIF\\(\\$2, ''\\)::date, '-infinity'::date\\), \\$3::uuid\\) ORDER BY COALESCE\\(processing_date, '-infinity'::date\\) ASC, ID ASC LIMIT \\$4;").
+				WithArgs("OrgId", "2017-01-02", "B", 3).
+				WillReturnRows(givenRows())
+
+			_, err := r.Search(ctx, payment.Query{
+				Filter:     payment.SearchOptions{OrganisationId: "OrgId"},
+				Sort:       "processing_date",
+				AfterValue: "2017-01-02",
+				AfterId:    "B",
+				Limit:      3,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should start after the id when sorted by id", func() {
+			dbMock.ExpectQuery("AND ID < \\$2::uuid ORDER BY ID DESC LIMIT \\$3;").
+				WithArgs("OrgId", "B", 3).
+				WillReturnRows(givenRows())
+
+			_, err := r.Search(ctx, payment.Query{
+				Filter:     payment.SearchOptions{OrganisationId: "OrgId"},
+				Sort:       "id",
+				Descending: true,
+				AfterValue: "B",
+				AfterId:    "B",
+				Limit:      3,
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should return an empty slice", func() {
+			dbMock.ExpectQuery("SELECT info").
+				WillReturnRows(givenRows())
+
+			actual, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: "OrgId"}, Sort: "id", Limit: 21})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(actual).ShouldNot(BeNil())
+		})
+
+		It("should return db error back", func() {
+			dbMock.ExpectQuery("SELECT info").
+				WillReturnError(sql.ErrConnDone)
+
+			_, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: "OrgId"}, Sort: "id", Limit: 21})
+			Expect(err).To(Equal(sql.ErrConnDone))
+		})
+	})
+
+	Describe("Pinging the database", func() {
+		var mockDb mockDatabase
+
+		BeforeEach(func() {
+			mockDb = mockDatabase{}
+			r = payment.NewPostgresRepository(&mockDb)
+		})
+
+		It("should return the error from the database", func() {
+			mockDb.On("PingContext", mock.Anything).
+				Return(sql.ErrConnDone)
+
+			Expect(r.Ping(ctx)).To(Equal(sql.ErrConnDone))
+			mockDb.AssertCalled(GinkgoT(), "PingContext", ctx)
+		})
+	})
+})
+
+type mockDatabase struct {
+	mock.Mock
+}
+
+func (m *mockDatabase) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	arg := m.Called(ctx, query, args)
+	return arg.Get(0).(*sql.Row)
+}
+
+func (m *mockDatabase) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	arg := m.Called(ctx, query, args)
+	return arg.Get(0).(*sql.Rows), arg.Error(1)
+
+}
+func (m *mockDatabase) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	args := m.Called(ctx, opts)
+	return args.Get(0).(*sql.Tx), args.Error(1)
+}
+
+func (m *mockDatabase) PingContext(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
@@ -0,0 +1,47 @@
+package payment
+
+import "context"
+
+// Repository stores payments exactly as it is given them, every rule about
+// what may be stored is kept in the Service. Each write keeps the change it is
+// given in the history of the payment, the write and its history are made
+// together or not at all.
+type Repository interface {
+	// Insert stores a new payment, the id has already been set.
+	Insert(ctx context.Context, payment Payment, change Change) error
+	// InsertAll stores all of the payments or none of them.
+	InsertAll(ctx context.Context, payments []Payment, change Change) error
+	// Get returns the payment even if it has been deleted, or ErrNotFound.
+	Get(ctx context.Context, paymentId string) (payment Payment, err error)
+	// Update replaces the payment, including its deletion, as long as the
+	// stored version is still the one expected. It returns ErrNotFound or
+	// ErrVersionConflict otherwise.
+	Update(ctx context.Context, payment Payment, expectedVersion int32, change Change) error
+	// History returns every revision of the payment oldest first, or
+	// ErrNotFound. Payments stored before there was a history have none.
+	History(ctx context.Context, paymentId string) (revisions []Revision, err error)
+	// Changes returns up to limit revisions of the payments of the
+	// organisation with a sequence after the one given, oldest first.
+	Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error)
+	// LastSequence is the sequence of the latest revision of the payments of
+	// the organisation, or 0 when there is none.
+	LastSequence(ctx context.Context, organisationId string) (sequence int64, err error)
+	// Search returns the payments matching the query in its order.
+	Search(ctx context.Context, query Query) (payments []Payment, err error)
+	Ping(ctx context.Context) error
+}
+
+// Query asks a Repository for a page of payments. They are ordered by the
+// sort field and then the id, starting after the key given. Only the filters
+// of the SearchOptions are used.
+type Query struct {
+	Filter     SearchOptions
+	Sort       string
+	Descending bool
+	// AfterValue and AfterId are the sort value and id of the payment
+	// before the page, the page starts from the first payment when AfterId
+	// is empty.
+	AfterValue string
+	AfterId    string
+	Limit      int
+}
@@ -0,0 +1,499 @@
+package payment_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/migration"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	_ "github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/satori/go.uuid"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Memory repository", func() {
+	behavesLikeARepository(payment.NewMemoryRepository, outboxOf)
+})
+
+// The Postgres store only runs the suite when given a database to run it
+// against, the database is migrated once and emptied before each test.
+var _ = Describe("Postgres repository against a database", func() {
+	behavesLikeARepository(func() payment.Repository {
+		dsn := os.Getenv("PAYMENTS_TEST_DSN")
+		if dsn == "" {
+			Skip("PAYMENTS_TEST_DSN is not set")
+		}
+		if testDb == nil {
+			db, err := sql.Open("postgres", dsn)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(migration.New(db).Up(context.Background())).To(Succeed())
+			testDb = db
+		}
+		_, err := testDb.Exec("TRUNCATE payments, payment_history, outbox;")
+		Expect(err).ShouldNot(HaveOccurred())
+		return payment.NewPostgresRepository(testDb)
+	}, func(payment.Repository) outbox.Store {
+		return outbox.NewPostgresStore(testDb)
+	})
+})
+
+var testDb *sql.DB
+
+// outboxOf is the outbox of the stores that keep their events themselves.
+func outboxOf(r payment.Repository) outbox.Store {
+	return r.(outbox.Store)
+}
+
+// givenChange is what the service hands a repository with each write.
+func givenChange(action payment.Action) payment.Change {
+	return payment.Change{
+		Action:    action,
+		Actor:     "alice",
+		RequestId: "some request",
+		At:        time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// behavesLikeARepository is the behaviour every Repository has to share, the
+// Service relies on nothing else. The outbox is where the repository writes
+// the events of its changes. Repositories that can be closed are closed after
+// each test.
+func behavesLikeARepository(newRepository func() payment.Repository, outboxOf func(payment.Repository) outbox.Store) {
+	Describe("conformance", func() {
+
+		var (
+			r      payment.Repository
+			events outbox.Store
+			ctx    context.Context
+		)
+
+		BeforeEach(func() {
+			r = newRepository()
+			events = outboxOf(r)
+			ctx = context.Background()
+		})
+
+		AfterEach(func() {
+			if c, ok := r.(io.Closer); ok {
+				Expect(c.Close()).To(Succeed())
+			}
+		})
+
+		givenStored := func(p payment.Payment) payment.Payment {
+			p.Id = uuid.NewV4().String()
+			Expect(r.Insert(ctx, p, givenChange(payment.ActionCreate))).To(Succeed())
+			return p
+		}
+
+		Describe("Inserting and getting", func() {
+			It("should return the payment as it was inserted", func() {
+				p := givenStored(givenExamplePayment())
+				actual, err := r.Get(ctx, p.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(Equal(p))
+			})
+
+			It("should return not found for an unknown id", func() {
+				_, err := r.Get(ctx, uuid.NewV4().String())
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should insert all of a batch or none of it", func() {
+				p := givenValidPayment()
+				p.Id = uuid.NewV4().String()
+				other := givenValidPayment()
+				other.Id = uuid.NewV4().String()
+
+				Expect(r.InsertAll(ctx, []payment.Payment{other, p, p}, givenChange(payment.ActionCreate))).ShouldNot(Succeed())
+				_, err := r.Get(ctx, other.Id)
+				Expect(err).To(Equal(payment.ErrNotFound))
+
+				Expect(r.InsertAll(ctx, []payment.Payment{other, p}, givenChange(payment.ActionCreate))).To(Succeed())
+				_, err = r.Get(ctx, other.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Describe("Updating", func() {
+			var stored payment.Payment
+
+			BeforeEach(func() {
+				stored = givenStored(givenValidPayment())
+			})
+
+			It("should replace the payment when the version matches", func() {
+				p := stored
+				p.Version, p.Attributes.Reference = 1, "new ref"
+				Expect(r.Update(ctx, p, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+				actual, err := r.Get(ctx, p.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(Equal(p))
+			})
+
+			It("should return version conflict when the version does not match", func() {
+				p := stored
+				p.Version = 3
+				Expect(r.Update(ctx, p, 2, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrVersionConflict))
+			})
+
+			It("should return not found for an unknown id", func() {
+				p := stored
+				p.Id = uuid.NewV4().String()
+				Expect(r.Update(ctx, p, 0, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should store and clear the deletion", func() {
+				at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+				p := stored
+				p.Deleted = &payment.Deletion{At: at, Reason: "duplicate"}
+				Expect(r.Update(ctx, p, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+				actual, err := r.Get(ctx, p.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Deleted).ShouldNot(BeNil())
+				Expect(actual.Deleted.At).To(BeTemporally("==", at))
+				Expect(actual.Deleted.Reason).To(Equal("duplicate"))
+
+				p.Deleted = nil
+				Expect(r.Update(ctx, p, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+				actual, err = r.Get(ctx, p.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Deleted).To(BeNil())
+			})
+
+			It("should keep the payment in its organisation through the service", func() {
+				s := payment.NewService(r)
+				moved := stored
+				moved.OrganisationId = uuid.NewV4().String()
+				_, err := s.Update(ctx, moved)
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "organisation_id"}))
+
+				for organisationId, expected := range map[string][]payment.Payment{stored.OrganisationId: {stored}, moved.OrganisationId: {}} {
+					found, err := r.Search(ctx, payment.Query{Filter: payment.SearchOptions{OrganisationId: organisationId}, Sort: "id", Limit: 10})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(found).To(Equal(expected))
+				}
+			})
+
+			It("should let only one writer of a version win", func() {
+				var (
+					wg        sync.WaitGroup
+					conflicts = make(chan error, 10)
+				)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						p := stored
+						p.Version = 1
+						if err := r.Update(ctx, p, 0, givenChange(payment.ActionUpdate)); err != nil {
+							conflicts <- err
+						}
+					}()
+				}
+				wg.Wait()
+				close(conflicts)
+
+				Expect(conflicts).To(HaveLen(9))
+				for err := range conflicts {
+					Expect(err).To(Equal(payment.ErrVersionConflict))
+				}
+			})
+		})
+
+		Describe("History", func() {
+			var stored payment.Payment
+
+			BeforeEach(func() {
+				stored = givenStored(givenValidPayment())
+			})
+
+			thenRevision := func(actual payment.Revision, change payment.Change, previous *payment.Payment, current payment.Payment) {
+				Expect(actual.Action).To(Equal(change.Action))
+				Expect(actual.Actor).To(Equal(change.Actor))
+				Expect(actual.RequestId).To(Equal(change.RequestId))
+				Expect(actual.At).To(BeTemporally("==", change.At))
+				Expect(actual.Previous).To(Equal(previous))
+				Expect(actual.Current).To(Equal(current))
+			}
+
+			It("should start with the payment as it was inserted", func() {
+				actual, err := r.History(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(1))
+				thenRevision(actual[0], givenChange(payment.ActionCreate), nil, stored)
+			})
+
+			It("should add every update with what it replaced", func() {
+				updated := stored
+				updated.Version, updated.Attributes.Reference = 1, "new ref"
+				update := givenChange(payment.ActionUpdate)
+				update.At = update.At.Add(time.Hour)
+				Expect(r.Update(ctx, updated, 0, update)).To(Succeed())
+
+				deleted := updated
+				deleted.Deleted = &payment.Deletion{At: time.Date(2018, 10, 1, 14, 0, 0, 0, time.UTC), Reason: "duplicate"}
+				Expect(r.Update(ctx, deleted, 1, givenChange(payment.ActionDelete))).To(Succeed())
+
+				actual, err := r.History(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(3))
+				thenRevision(actual[1], update, &stored, updated)
+				Expect(actual[2].Action).To(Equal(payment.ActionDelete))
+				Expect(actual[2].Previous).To(Equal(&updated))
+				Expect(actual[2].Current.Deleted).ShouldNot(BeNil())
+				Expect(actual[2].Current.Deleted.Reason).To(Equal("duplicate"))
+			})
+
+			It("should not add a write that failed", func() {
+				p := stored
+				p.Version = 3
+				Expect(r.Update(ctx, p, 2, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrVersionConflict))
+
+				actual, err := r.History(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(1))
+			})
+
+			It("should return not found for an unknown id", func() {
+				_, err := r.History(ctx, uuid.NewV4().String())
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+
+		Describe("Changes", func() {
+			var organisationId string
+
+			givenInOrganisation := func() payment.Payment {
+				p := givenValidPayment()
+				p.OrganisationId = organisationId
+				return givenStored(p)
+			}
+
+			BeforeEach(func() {
+				organisationId = uuid.NewV4().String()
+			})
+
+			It("should return the revisions of the organisation in order", func() {
+				first := givenInOrganisation()
+				givenStored(givenValidPayment())
+				second := givenInOrganisation()
+				updated := first
+				updated.Version = 1
+				Expect(r.Update(ctx, updated, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+				actual, err := r.Changes(ctx, organisationId, 0, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(3))
+				Expect(actual[0].Current).To(Equal(first))
+				Expect(actual[1].Current).To(Equal(second))
+				Expect(actual[2].Action).To(Equal(payment.ActionUpdate))
+				Expect(actual[2].Previous).To(Equal(&first))
+				Expect(actual[2].Current).To(Equal(updated))
+				Expect(actual[0].Sequence).To(BeNumerically(">", 0))
+				Expect(actual[0].Sequence).To(BeNumerically("<", actual[1].Sequence))
+				Expect(actual[1].Sequence).To(BeNumerically("<", actual[2].Sequence))
+			})
+
+			It("should return no more than the limit after the sequence given", func() {
+				givenInOrganisation()
+				second := givenInOrganisation()
+				third := givenInOrganisation()
+
+				all, err := r.Changes(ctx, organisationId, 0, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				actual, err := r.Changes(ctx, organisationId, all[0].Sequence, 1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(1))
+				Expect(actual[0].Current).To(Equal(second))
+
+				actual, err = r.Changes(ctx, organisationId, all[2].Sequence, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(BeEmpty())
+				Expect(all[2].Current).To(Equal(third))
+			})
+
+			It("should give the sequence of the latest revision", func() {
+				Expect(r.LastSequence(ctx, organisationId)).To(BeZero())
+
+				givenInOrganisation()
+				givenStored(givenValidPayment())
+				all, err := r.Changes(ctx, organisationId, 0, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(r.LastSequence(ctx, organisationId)).To(Equal(all[0].Sequence))
+			})
+
+			It("should have the sequence in the history", func() {
+				p := givenInOrganisation()
+				changes, err := r.Changes(ctx, organisationId, 0, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				history, err := r.History(ctx, p.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(history[0].Sequence).To(Equal(changes[0].Sequence))
+			})
+		})
+
+		Describe("Events", func() {
+			var stored payment.Payment
+
+			BeforeEach(func() {
+				stored = givenStored(givenValidPayment())
+			})
+
+			thenEvent := func(actual outbox.Event, eventType string, p payment.Payment) {
+				Expect(actual.Type).To(Equal(eventType))
+				Expect(actual.Subject).To(Equal(p.Id))
+				Expect(actual.At).To(BeTemporally("==", givenChange(payment.ActionCreate).At))
+				var data payment.Payment
+				Expect(json.Unmarshal(actual.Data, &data)).To(Succeed())
+				Expect(data).To(Equal(p))
+			}
+
+			It("should add an event for every change in order", func() {
+				updated := stored
+				updated.Version, updated.Attributes.Reference = 1, "new ref"
+				Expect(r.Update(ctx, updated, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+				moved := updated
+				moved.Version, moved.Status = 2, payment.StatusSubmitted
+				Expect(r.Update(ctx, moved, 1, givenChange(payment.ActionTransition))).To(Succeed())
+
+				actual, err := events.Pending(ctx, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(3))
+				thenEvent(actual[0], payment.EventCreated, stored)
+				thenEvent(actual[1], payment.EventUpdated, updated)
+				thenEvent(actual[2], payment.EventStatusChanged, moved)
+				Expect(actual[0].Sequence).To(BeNumerically("<", actual[1].Sequence))
+				Expect(actual[1].Sequence).To(BeNumerically("<", actual[2].Sequence))
+			})
+
+			It("should not add an event for a write that failed", func() {
+				p := stored
+				p.Version = 3
+				Expect(r.Update(ctx, p, 2, givenChange(payment.ActionUpdate))).To(Equal(payment.ErrVersionConflict))
+
+				Expect(events.Pending(ctx, 10)).To(HaveLen(1))
+			})
+
+			It("should return no more than the limit, oldest first", func() {
+				other := givenStored(givenValidPayment())
+
+				actual, err := events.Pending(ctx, 1)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(1))
+				thenEvent(actual[0], payment.EventCreated, stored)
+
+				Expect(events.Published(ctx, []int64{actual[0].Sequence})).To(Succeed())
+				actual, err = events.Pending(ctx, 10)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(HaveLen(1))
+				thenEvent(actual[0], payment.EventCreated, other)
+			})
+		})
+
+		Describe("Searching", func() {
+			var (
+				organisationId string
+				a, b, c, other payment.Payment
+			)
+
+			givenPayment := func(date string, amount string, currency string) payment.Payment {
+				p := givenValidPayment()
+				p.OrganisationId = organisationId
+				p.Attributes.ProcessingDate = date
+				p.Attributes.Amount = payment.MustParseDecimal(amount)
+				p.Attributes.Currency = currency
+				return givenStored(p)
+			}
+
+			ids := func(ps []payment.Payment) []string {
+				ids := make([]string, len(ps))
+				for i, p := range ps {
+					ids[i] = p.Id
+				}
+				return ids
+			}
+
+			BeforeEach(func() {
+				organisationId = uuid.NewV4().String()
+				a = givenPayment("2017-01-03", "10.00", "GBP")
+				b = givenPayment("2017-01-01", "200.50", "EUR")
+				c = givenPayment("", "5", "GBP")
+				other = givenValidPayment()
+				other.OrganisationId = uuid.NewV4().String()
+				other = givenStored(other)
+			})
+
+			query := func(q payment.Query) []payment.Payment {
+				q.Filter.OrganisationId = organisationId
+				if q.Limit == 0 {
+					q.Limit = 10
+				}
+				ps, err := r.Search(ctx, q)
+				Expect(err).ShouldNot(HaveOccurred())
+				return ps
+			}
+
+			It("should only return payments of the organisation", func() {
+				Expect(ids(query(payment.Query{Sort: "id"}))).To(ConsistOf(a.Id, b.Id, c.Id))
+			})
+
+			It("should return an empty slice when nothing matches", func() {
+				actual := query(payment.Query{Sort: "id", Filter: payment.SearchOptions{Currency: "USD"}})
+				Expect(actual).ShouldNot(BeNil())
+				Expect(actual).To(BeEmpty())
+			})
+
+			It("should sort missing values first", func() {
+				Expect(ids(query(payment.Query{Sort: "processing_date"}))).To(Equal([]string{c.Id, b.Id, a.Id}))
+				Expect(ids(query(payment.Query{Sort: "processing_date", Descending: true}))).To(Equal([]string{a.Id, b.Id, c.Id}))
+			})
+
+			It("should sort amounts by value", func() {
+				Expect(ids(query(payment.Query{Sort: "amount"}))).To(Equal([]string{c.Id, a.Id, b.Id}))
+			})
+
+			It("should start after the key and stop at the limit", func() {
+				actual := query(payment.Query{Sort: "amount", AfterValue: "5", AfterId: c.Id, Limit: 1})
+				Expect(ids(actual)).To(Equal([]string{a.Id}))
+			})
+
+			It("should filter", func() {
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{Currency: "GBP"}}))).To(ConsistOf(a.Id, c.Id))
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{AmountMin: "6", AmountMax: "200.50"}}))).To(ConsistOf(a.Id, b.Id))
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{ProcessingDateFrom: "2017-01-02"}}))).To(ConsistOf(a.Id))
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{ProcessingDateTo: "2017-01-02"}}))).To(ConsistOf(b.Id))
+			})
+
+			It("should filter by status, treating payments without one as created", func() {
+				settled := b
+				settled.Status = payment.StatusSettled
+				Expect(r.Update(ctx, settled, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{Status: payment.StatusSettled}}))).To(ConsistOf(b.Id))
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{Status: payment.StatusCreated}}))).To(ConsistOf(a.Id, c.Id))
+			})
+
+			It("should only return deleted payments when asked", func() {
+				deleted := a
+				deleted.Deleted = &payment.Deletion{At: time.Now(), Reason: "duplicate"}
+				Expect(r.Update(ctx, deleted, 0, givenChange(payment.ActionUpdate))).To(Succeed())
+
+				Expect(ids(query(payment.Query{Sort: "id"}))).To(ConsistOf(b.Id, c.Id))
+				Expect(ids(query(payment.Query{Sort: "id", Filter: payment.SearchOptions{IncludeDeleted: true}}))).To(ConsistOf(a.Id, b.Id, c.Id))
+			})
+		})
+
+		It("should be healthy", func() {
+			Expect(r.Ping(ctx)).To(Succeed())
+		})
+	})
+}
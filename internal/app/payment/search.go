@@ -0,0 +1,158 @@
+package payment
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// SearchOptions changes which payments a search will return. Only the
+// organisation is required, any other filter left empty is not applied.
+type SearchOptions struct {
+	OrganisationId           string
+	Currency                 string
+	PaymentType              string
+	PaymentScheme            PaymentScheme
+	ProcessingDateFrom       string
+	ProcessingDateTo         string
+	AmountMin                string
+	AmountMax                string
+	BeneficiaryAccountNumber string
+	DebtorAccountNumber      string
+	Status                   Status
+	IncludeDeleted           bool
+
+	// Sort is the name of the field to sort by, prefixed with '-' to sort
+	// descending. Defaults to the id.
+	Sort string
+	// After and Before are cursors from a previous SearchResult, only one
+	// should be set.
+	After  string
+	Before string
+	Size   int
+}
+
+// SearchResult is a page of payments with the cursors needed to get the pages
+// either side of it, a cursor is empty when there is no page.
+type SearchResult struct {
+	Payments []Payment
+	Next     string
+	Prev     string
+}
+
+type sortField struct {
+	name string
+	// column is the SQL expression to sort by and param is how a value from
+	// a cursor is compared with it.
+	column string
+	param  string
+	value  func(p Payment) string
+	// compare orders two values the same way the column does and valid
+	// checks a value from a cursor can be compared at all.
+	compare func(a, b string) int
+	valid   func(v string) bool
+}
+
+var sortFields = []sortField{
+	{
+		name:    "id",
+		column:  "ID",
+		param:   "%s::uuid",
+		value:   func(p Payment) string { return p.Id },
+		compare: strings.Compare,
+		valid:   func(v string) bool { return true },
+	},
+	{
+		name:    "processing_date",
+		column:  "COALESCE(processing_date, '-infinity'::date)",
+		param:   "COALESCE(NULLIF(%s, '')::date, '-infinity'::date)",
+		value:   func(p Payment) string { return p.Attributes.ProcessingDate },
+		compare: strings.Compare,
+		valid: func(v string) bool {
+			_, err := time.Parse("2006-01-02", v)
+			return v == "" || err == nil
+		},
+	},
+	{
+		name:   "amount",
+		column: "COALESCE(amount, 0)",
+		param:  "%s::numeric",
+		value: func(p Payment) string {
+			if p.Attributes.Amount.Empty() {
+				return "0"
+			}
+			return p.Attributes.Amount.String()
+		},
+		compare: func(a, b string) int {
+			return MustParseDecimal(a).Cmp(MustParseDecimal(b))
+		},
+		valid: func(v string) bool {
+			_, err := ParseDecimal(v)
+			return err == nil
+		},
+	},
+	{
+		name:    "currency",
+		column:  "COALESCE(currency, '')",
+		param:   "%s",
+		value:   func(p Payment) string { return p.Attributes.Currency },
+		compare: strings.Compare,
+		valid:   func(v string) bool { return true },
+	},
+}
+
+func parseSort(sort string) (field sortField, desc bool, err error) {
+	if sort == "" {
+		sort = "id"
+	}
+	if strings.HasPrefix(sort, "-") {
+		desc = true
+		sort = sort[1:]
+	}
+	field, ok := findSort(sort)
+	if !ok {
+		return field, desc, ErrInvalidSort
+	}
+	return field, desc, nil
+}
+
+func findSort(name string) (field sortField, ok bool) {
+	for _, f := range sortFields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return field, false
+}
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Id    string `json:"id"`
+}
+
+func encodeCursor(field sortField, p Payment) string {
+	bs, _ := json.Marshal(cursor{Sort: field.name, Value: field.value(p), Id: p.Id})
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+func decodeCursor(field sortField, s string) (c cursor, err error) {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(bs, &c); err != nil || c.Sort != field.name || !field.valid(c.Value) {
+		return c, ErrInvalidCursor
+	}
+	if _, err = uuid.FromString(c.Id); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -1,12 +1,15 @@
 package payment
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/requestid"
 	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 type HealthCheckStatus struct {
@@ -14,103 +17,546 @@ type HealthCheckStatus struct {
 	Healthy bool   `json:"healthy"`
 }
 
+// GetOptions changes which payments Get will return.
+type GetOptions struct {
+	IncludeDeleted bool
+	// AsOf, when set, gets the payment as it was at that time from its
+	// history.
+	AsOf time.Time
+}
+
+// BatchStatus is what happened to a single payment in a batch.
+type BatchStatus string
+
+const (
+	BatchCreated BatchStatus = "created"
+	BatchInvalid BatchStatus = "invalid"
+	// BatchSkipped is a valid payment not saved because others in the
+	// atomic batch were invalid.
+	BatchSkipped BatchStatus = "skipped"
+)
+
+type BatchResult struct {
+	Index  int          `json:"index"`
+	Id     string       `json:"id,omitempty"`
+	Status BatchStatus  `json:"status"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
 type Service interface {
 	Save(ctx context.Context, payment Payment) (id string, err error)
-	Get(ctx context.Context, paymentId string) (payment Payment, err error)
-	SearchByOrganisationId(ctx context.Context, organisationId string) (payments []Payment, err error)
+	SaveAll(ctx context.Context, payments []Payment, atomic bool) (results []BatchResult, err error)
+	Get(ctx context.Context, paymentId string, opts GetOptions) (payment Payment, err error)
+	Update(ctx context.Context, payment Payment) (updated Payment, err error)
+	Patch(ctx context.Context, paymentId string, patch Patch) (updated Payment, err error)
+	Delete(ctx context.Context, paymentId string, reason string) error
+	Restore(ctx context.Context, paymentId string) (payment Payment, err error)
+	Transition(ctx context.Context, paymentId string, transition Transition) (updated Payment, err error)
+	Approve(ctx context.Context, paymentId string, reason string) (updated Payment, err error)
+	Reject(ctx context.Context, paymentId string, reason string) (updated Payment, err error)
+	History(ctx context.Context, paymentId string) (revisions []Revision, err error)
+	Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error)
+	LastSequence(ctx context.Context, organisationId string) (sequence int64, err error)
+	Search(ctx context.Context, opts SearchOptions) (result SearchResult, err error)
 	HealthCheck(ctx context.Context) HealthCheckStatus
 }
 
-var ErrNotFound = errors.New("payment: not found")
+// ServiceOption changes how the service handles payments.
+type ServiceOption func(s *service)
 
-type Database interface {
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
-	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-	PingContext(ctx context.Context) error
+// WithApprovalThresholds makes payments over the threshold of their
+// organisation wait for approval when they are created, none do when it is
+// not set.
+func WithApprovalThresholds(thresholds Thresholds) ServiceOption {
+	return func(s *service) {
+		s.thresholds = thresholds
+	}
 }
 
-func NewService(db Database) Service {
-	return NewServiceWithUuidGen(db, func() string {
+// WithUnauthenticatedApprovals lets payments be approved and rejected by the
+// actor a request names when it is not authenticated. Anyone can name any
+// actor so it is only for trying approvals out with authentication off.
+func WithUnauthenticatedApprovals() ServiceOption {
+	return func(s *service) {
+		s.unauthenticatedApprovals = true
+	}
+}
+
+func NewService(repo Repository, opts ...ServiceOption) Service {
+	return NewServiceWithUuidGen(repo, func() string {
 		return uuid.NewV4().String()
-	})
+	}, opts...)
 }
 
-func NewServiceWithUuidGen(db Database, newUuid func() string) Service {
-	return &service{
-		db:      db,
+func NewServiceWithUuidGen(repo Repository, newUuid func() string, opts ...ServiceOption) Service {
+	s := &service{
+		repo:    repo,
 		newUuid: newUuid,
+		now: func() time.Time {
+			return time.Now().UTC()
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 type service struct {
-	db      Database
-	newUuid func() string
+	repo       Repository
+	newUuid    func() string
+	now        func() time.Time
+	thresholds Thresholds
+	// unauthenticatedApprovals takes who approves from the actor of the
+	// context when it has no identity.
+	unauthenticatedApprovals bool
 }
 
 func (s *service) Save(ctx context.Context, payment Payment) (id string, err error) {
-	id = s.newUuid()
-	payment.Id = id
-	bs, err := json.Marshal(payment)
-	if err != nil {
+	if err = Validate(payment); err != nil {
 		return id, err
 	}
+	if !auth.Allowed(ctx, payment.OrganisationId) {
+		return id, ErrNotFound
+	}
 
-	err = s.db.QueryRowContext(ctx,
-		"INSERT INTO payments(ID, info) VALUES($1, $2) returning ID;",
-		id, string(bs)).Scan(&id)
-	if err != nil {
+	change := s.change(ctx, ActionCreate)
+	payment.Id = s.newUuid()
+	payment.Deleted = nil
+	payment = s.start(payment, change)
+	if err = s.repo.Insert(ctx, payment, change); err != nil {
 		return id, err
 	}
 
-	log.Infof("Inserted payment, id is '%s'", id)
-	return id, err
+	log.Infof("Inserted payment, id is '%s'", payment.Id)
+	return payment.Id, err
 }
 
-func (s *service) Get(ctx context.Context, paymentId string) (payment Payment, err error) {
-	var info string
-	err = s.db.QueryRowContext(ctx,
-		"SELECT info FROM payments WHERE ID = $1;",
-		paymentId).Scan(&info)
+// SaveAll inserts all the valid payments in one go. When atomic nothing is
+// saved unless every payment is valid, otherwise the valid payments are saved
+// and the invalid ones reported. A batch with a payment for an organisation
+// the caller does not act for is refused outright.
+func (s *service) SaveAll(ctx context.Context, payments []Payment, atomic bool) (results []BatchResult, err error) {
+	for _, p := range payments {
+		if !auth.Allowed(ctx, p.OrganisationId) {
+			return nil, ErrNotFound
+		}
+	}
+
+	results = make([]BatchResult, len(payments))
+	valid := make([]Payment, 0, len(payments))
+	change := s.change(ctx, ActionCreate)
+	for i, p := range payments {
+		results[i] = BatchResult{Index: i, Status: BatchSkipped}
+		if err := Validate(p); err != nil {
+			results[i].Status = BatchInvalid
+			results[i].Errors = err.(*ValidationError).Errors
+			continue
+		}
+		p.Id = s.newUuid()
+		p.Deleted = nil
+		p = s.start(p, change)
+		results[i].Id = p.Id
+		valid = append(valid, p)
+	}
+	if atomic && len(valid) < len(payments) {
+		for i := range results {
+			results[i].Id = ""
+		}
+		return results, nil
+	}
+
+	if err = s.repo.InsertAll(ctx, valid, change); err != nil {
+		return results, err
+	}
+
+	for i := range results {
+		if results[i].Status != BatchInvalid {
+			results[i].Status = BatchCreated
+		}
+	}
+	log.Infof("Inserted batch of %d payments", len(valid))
+	return results, err
+}
+
+// Get returns the payment as it is now, or as it was at the time asked for.
+// Either way a payment that is deleted is not found unless asked for, and
+// neither is one of an organisation the caller does not act for.
+func (s *service) Get(ctx context.Context, paymentId string, opts GetOptions) (payment Payment, err error) {
+	if opts.AsOf.IsZero() {
+		payment, err = s.repo.Get(ctx, paymentId)
+	} else {
+		payment, err = s.asOf(ctx, paymentId, opts.AsOf)
+	}
 	if err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			return payment, ErrNotFound
-		default:
-			return payment, err
+		return payment, err
+	}
+	if !auth.Allowed(ctx, payment.OrganisationId) {
+		return Payment{}, ErrNotFound
+	}
+	if payment.Deleted != nil && !opts.IncludeDeleted {
+		return Payment{}, ErrNotFound
+	}
+	return payment, err
+}
+
+// Update replaces the stored payment only if the version given matches the
+// one stored, the version is then bumped so that any other writer holding the
+// old version will get ErrVersionConflict. The status can only be changed by
+// a Transition, a payment without one keeps the status it has.
+func (s *service) Update(ctx context.Context, payment Payment) (updated Payment, err error) {
+	return s.update(ctx, payment, ActionUpdate)
+}
+
+func (s *service) update(ctx context.Context, payment Payment, action Action) (updated Payment, err error) {
+	if err = Validate(payment); err != nil {
+		return updated, err
+	}
+	if !auth.Allowed(ctx, payment.OrganisationId) {
+		return updated, ErrNotFound
+	}
+
+	// A deleted payment has to be restored before it can be changed.
+	current, err := s.Get(ctx, payment.Id, GetOptions{})
+	if err != nil {
+		return updated, err
+	}
+	// The stores index a payment by its organisation, it cannot be moved to
+	// another.
+	if payment.OrganisationId != current.OrganisationId {
+		return updated, &ImmutableFieldError{Field: "organisation_id"}
+	}
+	if payment.Status != "" && payment.Status != currentStatus(current) {
+		return updated, &ImmutableFieldError{Field: "status"}
+	}
+	// Once out of created the amount is what was approved or submitted, it
+	// cannot change behind the back of the approval thresholds.
+	if currentStatus(current) != StatusCreated {
+		switch {
+		case payment.Attributes.Amount.Cmp(current.Attributes.Amount) != 0:
+			return updated, &ImmutableFieldError{Field: "attributes.amount"}
+		case payment.Attributes.Currency != current.Attributes.Currency:
+			return updated, &ImmutableFieldError{Field: "attributes.currency"}
 		}
 	}
-	err = json.Unmarshal([]byte(info), &payment)
+	payment.Status, payment.StatusHistory, payment.Approval = current.Status, current.StatusHistory, current.Approval
+
+	expected := payment.Version
+	payment.Version = expected + 1
+	payment.Deleted = nil
+	if err = s.repo.Update(ctx, payment, expected, s.change(ctx, action)); err != nil {
+		return updated, err
+	}
+
+	log.Infof("Updated payment '%s' to version %d", payment.Id, payment.Version)
 	return payment, err
 }
 
-func (s *service) SearchByOrganisationId(ctx context.Context, organisationId string) (payments []Payment, err error) {
+// Patch applies the patch to the payment as it is currently stored and then
+// updates it, a version in the patch has to match the stored one just like
+// Update.
+func (s *service) Patch(ctx context.Context, paymentId string, patch Patch) (updated Payment, err error) {
+	current, err := s.Get(ctx, paymentId, GetOptions{})
+	if err != nil {
+		return updated, err
+	}
+
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return updated, err
+	}
+
+	doc, err = patch.Apply(doc)
+	if err != nil {
+		return updated, err
+	}
+
+	var payment Payment
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&payment); err != nil {
+		return updated, &PatchError{Reason: fmt.Sprintf("result is not a valid payment, %s", err)}
+	}
+
+	switch {
+	case payment.Id != current.Id:
+		return updated, &ImmutableFieldError{Field: "id"}
+	case payment.OrganisationId != current.OrganisationId:
+		return updated, &ImmutableFieldError{Field: "organisation_id"}
+	}
+
+	return s.update(ctx, payment, ActionPatch)
+}
+
+// Delete only marks the payment as deleted, it is kept so that it can still
+// be read with IncludeDeleted or brought back with Restore.
+func (s *service) Delete(ctx context.Context, paymentId string, reason string) error {
+	payment, err := s.Get(ctx, paymentId, GetOptions{})
+	if err != nil {
+		return err
+	}
 
-	rows, err := s.db.QueryContext(ctx,
-		"SELECT info FROM payments WHERE info ->> 'organisation_id' = $1;",
-		organisationId)
+	change := s.change(ctx, ActionDelete)
+	payment.Deleted = &Deletion{At: change.At, Reason: reason}
+	expected := payment.Version
+	payment.Version = expected + 1
+	if err = s.repo.Update(ctx, payment, expected, change); err != nil {
+		return err
+	}
+
+	log.Infof("Deleted payment '%s'", paymentId)
+	return nil
+}
 
+func (s *service) Restore(ctx context.Context, paymentId string) (payment Payment, err error) {
+	payment, err = s.repo.Get(ctx, paymentId)
 	if err != nil {
-		return payments, err
+		return payment, err
+	}
+	if payment.Deleted == nil || !auth.Allowed(ctx, payment.OrganisationId) {
+		return Payment{}, ErrNotFound
+	}
+
+	payment.Deleted = nil
+	expected := payment.Version
+	payment.Version = expected + 1
+	if err = s.repo.Update(ctx, payment, expected, s.change(ctx, ActionRestore)); err != nil {
+		return Payment{}, err
 	}
 
-	payments = make([]Payment, 0)
-	for rows.Next() {
-		var payment Payment
-		var info string
-		if err = rows.Scan(&info); err != nil {
-			return payments, err
+	log.Infof("Restored payment '%s'", paymentId)
+	return payment, err
+}
+
+// Transition moves the payment to another status of its lifecycle, who asked
+// for it and when is added to its history. A payment pending approval can
+// only be cancelled this way, and one over its threshold cannot be submitted
+// without being approved.
+func (s *service) Transition(ctx context.Context, paymentId string, transition Transition) (updated Payment, err error) {
+	if !transition.To.Known() {
+		return updated, &ValidationError{Errors: []FieldError{{Field: "to", Message: "must be a known status"}}}
+	}
+
+	payment, err := s.Get(ctx, paymentId, GetOptions{})
+	if err != nil {
+		return updated, err
+	}
+
+	from := currentStatus(payment)
+	if !from.CanMoveTo(transition.To) {
+		return updated, &TransitionError{From: from, To: transition.To, Allowed: from.Next()}
+	}
+	if (from == StatusPendingApproval && transition.To != StatusCancelled) ||
+		(transition.To == StatusSubmitted && s.thresholds.Exceeded(payment)) {
+		return updated, ErrApprovalRequired
+	}
+
+	return s.move(ctx, payment, transition.To, transition.Reason, s.change(ctx, ActionTransition))
+}
+
+// Approve submits a payment pending approval. It has to be approved by
+// someone other than who created it.
+func (s *service) Approve(ctx context.Context, paymentId string, reason string) (updated Payment, err error) {
+	return s.decide(ctx, paymentId, DecisionApproved, reason)
+}
+
+// Reject rejects a payment pending approval, like Approve it has to be done
+// by someone other than who created it.
+func (s *service) Reject(ctx context.Context, paymentId string, reason string) (updated Payment, err error) {
+	return s.decide(ctx, paymentId, DecisionRejected, reason)
+}
+
+func (s *service) decide(ctx context.Context, paymentId string, decision Decision, reason string) (updated Payment, err error) {
+	payment, err := s.Get(ctx, paymentId, GetOptions{})
+	if err != nil {
+		return updated, err
+	}
+	if currentStatus(payment) != StatusPendingApproval {
+		return updated, ErrNotPendingApproval
+	}
+
+	to, action := StatusSubmitted, ActionApprove
+	if decision == DecisionRejected {
+		to, action = StatusRejected, ActionReject
+	}
+	// Without an identity the actor is whatever the request said, so anyone
+	// could approve their own payment by naming someone else.
+	if _, ok := auth.FromContext(ctx); !ok && !s.unauthenticatedApprovals {
+		return updated, ErrUnauthenticatedApprover
+	}
+	change := s.change(ctx, action)
+	switch {
+	case change.Actor == "":
+		return updated, ErrUnknownApprover
+	case change.Actor == creator(payment):
+		return updated, ErrSelfApproval
+	}
+
+	payment.Approval = &Approval{Decision: decision, By: change.Actor, At: change.At, Reason: reason}
+	return s.move(ctx, payment, to, reason, change)
+}
+
+// move puts the payment in the status, who moved it and when is added to its
+// history.
+func (s *service) move(ctx context.Context, payment Payment, to Status, reason string, change Change) (updated Payment, err error) {
+	from := currentStatus(payment)
+	payment.Status = to
+	payment.StatusHistory = append(payment.StatusHistory, StatusChange{
+		From:   from,
+		To:     to,
+		At:     change.At,
+		Actor:  change.Actor,
+		Reason: reason,
+	})
+	expected := payment.Version
+	payment.Version = expected + 1
+	if err = s.repo.Update(ctx, payment, expected, change); err != nil {
+		return updated, err
+	}
+
+	log.Infof("Moved payment '%s' from %s to %s", payment.Id, from, to)
+	return payment, err
+}
+
+// start begins the lifecycle of a new payment, one over the threshold of its
+// organisation starts pending approval.
+func (s *service) start(payment Payment, change Change) Payment {
+	payment = created(payment, change.At, change.Actor)
+	payment.Approval = nil
+	if s.thresholds.Exceeded(payment) {
+		payment.Status = StatusPendingApproval
+		payment.StatusHistory[0].To = StatusPendingApproval
+	}
+	return payment
+}
+
+// History returns every change made to the payment, deleting a payment keeps
+// its history.
+func (s *service) History(ctx context.Context, paymentId string) (revisions []Revision, err error) {
+	revisions, err = s.repo.History(ctx, paymentId)
+	if err != nil {
+		return revisions, err
+	}
+	if n := len(revisions); n > 0 && !auth.Allowed(ctx, revisions[n-1].Current.OrganisationId) {
+		return nil, ErrNotFound
+	}
+	return revisions, err
+}
+
+// Changes returns the revisions of the payments of the organisation after
+// the sequence given, it is how the changes are streamed.
+func (s *service) Changes(ctx context.Context, organisationId string, after int64, limit int) (revisions []Revision, err error) {
+	if !auth.Allowed(ctx, organisationId) {
+		return nil, ErrNotFound
+	}
+	return s.repo.Changes(ctx, organisationId, after, limit)
+}
+
+// LastSequence is where a stream of the changes to the payments of the
+// organisation starts when it is not resuming.
+func (s *service) LastSequence(ctx context.Context, organisationId string) (sequence int64, err error) {
+	if !auth.Allowed(ctx, organisationId) {
+		return sequence, ErrNotFound
+	}
+	return s.repo.LastSequence(ctx, organisationId)
+}
+
+func (s *service) asOf(ctx context.Context, paymentId string, at time.Time) (payment Payment, err error) {
+	revisions, err := s.repo.History(ctx, paymentId)
+	if err != nil {
+		return payment, err
+	}
+	payment, ok := asOf(revisions, at)
+	if !ok {
+		return payment, ErrNotFound
+	}
+	return payment, nil
+}
+
+// change describes what is being done to a payment for its history, who is
+// doing it comes from the context.
+func (s *service) change(ctx context.Context, action Action) Change {
+	return Change{
+		Action:    action,
+		Actor:     ActorFromContext(ctx),
+		RequestId: requestid.FromContext(ctx),
+		At:        s.now(),
+	}
+}
+
+// Search returns a page of payments using keyset pagination, the cursors
+// hold the sort value and id of the payment either end of the page so the
+// next query carries on from there.
+func (s *service) Search(ctx context.Context, opts SearchOptions) (result SearchResult, err error) {
+	if !auth.Allowed(ctx, opts.OrganisationId) {
+		return result, ErrNotFound
+	}
+	field, desc, err := parseSort(opts.Sort)
+	if err != nil {
+		return result, err
+	}
+
+	size := opts.Size
+	if size <= 0 || size > MaxPageSize {
+		size = DefaultPageSize
+	}
+
+	// Going backwards from a cursor is the same query in the other direction
+	// with the rows then put back in order.
+	forward := opts.Before == ""
+	q := Query{
+		Filter:     opts,
+		Sort:       field.name,
+		Descending: desc == forward,
+		Limit:      size + 1,
+	}
+	if c := opts.After + opts.Before; c != "" {
+		after, err := decodeCursor(field, c)
+		if err != nil {
+			return result, err
 		}
-		if err = json.Unmarshal([]byte(info), &payment); err != nil {
-			return payments, err
+		q.AfterValue, q.AfterId = after.Value, after.Id
+	}
+
+	payments, err := s.repo.Search(ctx, q)
+	if err != nil {
+		return result, err
+	}
+
+	more := len(payments) > size
+	if more {
+		payments = payments[:size]
+	}
+	if !forward {
+		for i, j := 0, len(payments)-1; i < j; i, j = i+1, j-1 {
+			payments[i], payments[j] = payments[j], payments[i]
 		}
-		payments = append(payments, payment)
 	}
 
-	return payments, err
+	result.Payments = payments
+	if len(payments) == 0 {
+		return result, err
+	}
+	first, last := encodeCursor(field, payments[0]), encodeCursor(field, payments[len(payments)-1])
+	switch {
+	case forward:
+		if more {
+			result.Next = last
+		}
+		if opts.After != "" {
+			result.Prev = first
+		}
+	default:
+		if more {
+			result.Prev = first
+		}
+		result.Next = last
+	}
+	return result, err
 }
 
 func (s *service) HealthCheck(ctx context.Context) HealthCheckStatus {
-	if err := s.db.PingContext(ctx); err != nil {
+	if err := s.repo.Ping(ctx); err != nil {
 		return HealthCheckStatus{
 			Message: err.Error(),
 			Healthy: false,
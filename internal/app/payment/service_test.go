@@ -2,209 +2,1032 @@ package payment_test
 
 import (
 	"context"
-	"database/sql"
-	"encoding/json"
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/auth"
 	"github.com/carlosroman/payments-api/internal/app/payment"
+	"github.com/carlosroman/payments-api/internal/app/requestid"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/stretchr/testify/mock"
-	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"github.com/satori/go.uuid"
+	"time"
 )
 
 var _ = Describe("Service", func() {
 
 	var (
-		s      payment.Service
-		db     *sql.DB
-		dbMock sqlmock.Sqlmock
-		ctx    context.Context
+		s    payment.Service
+		repo payment.Repository
+		ctx  context.Context
 	)
 
 	BeforeEach(func() {
-		d, mock, err := sqlmock.New()
-		Expect(err).ShouldNot(HaveOccurred())
-		db = d
-		s = payment.NewService(db)
-		dbMock = mock
+		repo = payment.NewMemoryRepository()
+		s = payment.NewService(repo)
 		ctx = context.Background()
 	})
 
+	givenSaved := func(p payment.Payment) payment.Payment {
+		id, err := s.Save(ctx, p)
+		Expect(err).ShouldNot(HaveOccurred())
+		stored, err := repo.Get(ctx, id)
+		Expect(err).ShouldNot(HaveOccurred())
+		return stored
+	}
+
 	Describe("Saving a new payment", func() {
 		Context("when successful", func() {
-			It("should return id from DB", func() {
-				expectedId := "expectedId"
-				rows := sqlmock.NewRows([]string{"ID"}).AddRow(expectedId)
-				dbMock.ExpectQuery("INSERT INTO payments\\(ID, info\\)").
-					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
-					WillReturnRows(rows)
-
-				p := payment.Payment{Attributes: payment.Attributes{Reference: "some ref"}}
-				id, err := s.Save(ctx, p)
+			It("should return a new id", func() {
+				id, err := s.Save(ctx, givenValidPayment())
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = uuid.FromString(id)
 				Expect(err).ShouldNot(HaveOccurred())
-				Expect(id).Should(Equal(expectedId))
 			})
 
-			It("should save correct object", func() {
+			It("should save all the attributes under the id", func() {
 				expectedId := "Some Id"
-				s = payment.NewServiceWithUuidGen(db, func() string {
+				s = payment.NewServiceWithUuidGen(repo, func() string {
 					return expectedId
 				})
-				p := payment.Payment{Attributes: payment.Attributes{Reference: "some ref"}, Id: expectedId}
-				bs, err := json.Marshal(p)
+				p := givenExamplePayment()
+				id, err := s.Save(ctx, p)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(id).To(Equal(expectedId))
+
+				actual, err := repo.Get(ctx, expectedId)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusCreated))
+				Expect(actual.StatusHistory).To(HaveLen(1))
+				Expect(actual.StatusHistory[0].To).To(Equal(payment.StatusCreated))
+				Expect(actual.StatusHistory[0].At).ToNot(BeZero())
+
+				p.Id = expectedId
+				p.Status, p.StatusHistory = actual.Status, actual.StatusHistory
+				Expect(actual).To(Equal(p))
+			})
+
+			It("should start the lifecycle with the actor from the context", func() {
+				id, err := s.Save(payment.NewActorContext(ctx, "alice"), givenValidPayment())
+				Expect(err).ShouldNot(HaveOccurred())
+				actual, err := repo.Get(ctx, id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.StatusHistory[0].Actor).To(Equal("alice"))
+			})
+		})
+
+		Context("when the payment is invalid", func() {
+			It("should return the validation error without saving", func() {
+				s = payment.NewServiceWithUuidGen(repo, func() string {
+					return "some id"
+				})
+				_, err := s.Save(ctx, payment.Payment{})
+				Expect(err).Should(BeAssignableToTypeOf(&payment.ValidationError{}))
+				_, err = repo.Get(ctx, "some id")
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+	})
+
+	Describe("Saving a batch of payments", func() {
+		var valid, invalid payment.Payment
+
+		BeforeEach(func() {
+			valid = givenValidPayment()
+			invalid = payment.Payment{OrganisationId: valid.OrganisationId}
+			ids := []string{"id-1", "id-2"}
+			s = payment.NewServiceWithUuidGen(repo, func() string {
+				id := ids[0]
+				ids = ids[1:]
+				return id
+			})
+		})
+
+		Context("when all the payments are valid", func() {
+			It("should save them all", func() {
+				actual, err := s.SaveAll(ctx, []payment.Payment{valid, valid}, true)
 				Expect(err).ShouldNot(HaveOccurred())
-				rows := sqlmock.NewRows([]string{"ID"}).AddRow("some id")
-				dbMock.ExpectQuery("INSERT INTO payments\\(ID, info\\)").
-					WithArgs(sqlmock.AnyArg(), string(bs)).
-					WillReturnRows(rows)
-				_, err = s.Save(ctx, payment.Payment{Attributes: payment.Attributes{Reference: "some ref"}})
+				Expect(actual).To(Equal([]payment.BatchResult{
+					{Index: 0, Id: "id-1", Status: payment.BatchCreated},
+					{Index: 1, Id: "id-2", Status: payment.BatchCreated},
+				}))
+				Expect(repo.Get(ctx, "id-1")).ShouldNot(BeZero())
+				Expect(repo.Get(ctx, "id-2")).ShouldNot(BeZero())
+			})
+		})
+
+		Context("when atomic and a payment is invalid", func() {
+			It("should not save any of them", func() {
+				actual, err := s.SaveAll(ctx, []payment.Payment{valid, invalid}, true)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual[0]).To(Equal(payment.BatchResult{Index: 0, Status: payment.BatchSkipped}))
+				Expect(actual[1].Status).To(Equal(payment.BatchInvalid))
+				Expect(actual[1].Errors).To(ConsistOf(
+					payment.FieldError{Field: "attributes.amount", Message: "is required"},
+					payment.FieldError{Field: "attributes.currency", Message: "is required"},
+				))
+				_, err = repo.Get(ctx, "id-1")
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+
+		Context("when not atomic and a payment is invalid", func() {
+			It("should save the valid ones", func() {
+				actual, err := s.SaveAll(ctx, []payment.Payment{invalid, valid}, false)
 				Expect(err).ShouldNot(HaveOccurred())
-				Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+				Expect(actual[0].Status).To(Equal(payment.BatchInvalid))
+				Expect(actual[1]).To(Equal(payment.BatchResult{Index: 1, Id: "id-1", Status: payment.BatchCreated}))
+				Expect(repo.Get(ctx, "id-1")).ShouldNot(BeZero())
+			})
+		})
+
+		Context("when the store fails", func() {
+			It("should return the error", func() {
+				s = payment.NewService(&failingRepository{Repository: repo})
+				_, err := s.SaveAll(ctx, []payment.Payment{valid}, true)
+				Expect(err).To(Equal(errStore))
 			})
 		})
 	})
 
 	Describe("Getting a payment", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			stored = givenSaved(givenExamplePayment())
+		})
+
 		Context("when successful", func() {
-			It("should return payment from DB", func() {
-				p := payment.Payment{Attributes: payment.Attributes{Reference: "some ref"}, Id: "awesome id"}
-				bs, err := json.Marshal(p)
+			It("should return all the attributes", func() {
+				actual, err := s.Get(ctx, stored.Id, payment.GetOptions{})
 				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(Equal(stored))
+			})
+		})
 
-				rows := sqlmock.NewRows([]string{"info"}).AddRow(string(bs))
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE ID = ?").
-					WithArgs(p.Id).
-					WillReturnRows(rows)
+		Context("when the payment has been deleted", func() {
+			BeforeEach(func() {
+				Expect(s.Delete(ctx, stored.Id, "duplicate")).To(Succeed())
+			})
 
-				actual, err := s.Get(ctx, p.Id)
+			It("should return not found", func() {
+				_, err := s.Get(ctx, stored.Id, payment.GetOptions{})
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should return the deletion when asked to include deleted", func() {
+				actual, err := s.Get(ctx, stored.Id, payment.GetOptions{IncludeDeleted: true})
 				Expect(err).ShouldNot(HaveOccurred())
-				Expect(actual).To(Equal(p))
+				Expect(actual.Deleted).ShouldNot(BeNil())
+				Expect(actual.Deleted.Reason).To(Equal("duplicate"))
 			})
 		})
+
 		Context("when not successful", func() {
 			It("should return not found if no record", func() {
-
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE ID = ?").
-					WithArgs("some id").
-					WillReturnError(sql.ErrNoRows)
-				_, err := s.Get(ctx, "some id")
-				Expect(err).Should(HaveOccurred())
+				_, err := s.Get(ctx, "some id", payment.GetOptions{})
 				Expect(err).To(Equal(payment.ErrNotFound))
 			})
+
 			It("should return all other errors", func() {
+				s = payment.NewService(&failingRepository{Repository: repo})
+				_, err := s.Get(ctx, stored.Id, payment.GetOptions{})
+				Expect(err).To(Equal(errStore))
+			})
+		})
+	})
+
+	Describe("Updating a payment", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			stored = givenSaved(givenValidPayment())
+		})
+
+		Context("when the version matches", func() {
+			It("should save with the version bumped", func() {
+				p := stored
+				p.Attributes.Reference = "new ref"
+				expected := p
+				expected.Version = 1
+
+				actual, err := s.Update(ctx, p)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(Equal(expected))
+				Expect(repo.Get(ctx, p.Id)).To(Equal(expected))
+			})
+		})
+
+		Context("when the version is stale", func() {
+			It("should return version conflict", func() {
+				_, err := s.Update(ctx, stored)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err = s.Update(ctx, stored)
+				Expect(err).To(Equal(payment.ErrVersionConflict))
+			})
+		})
+
+		Context("when the payment is invalid", func() {
+			It("should return the validation error without updating", func() {
+				_, err := s.Update(ctx, payment.Payment{Id: stored.Id})
+				Expect(err).Should(BeAssignableToTypeOf(&payment.ValidationError{}))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(stored))
+			})
+		})
+
+		Context("when not successful", func() {
+			It("should return not found if no record", func() {
+				p := givenValidPayment()
+				p.Id = "some id"
+				_, err := s.Update(ctx, p)
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should return not found if deleted", func() {
+				Expect(s.Delete(ctx, stored.Id, "")).To(Succeed())
+				_, err := s.Update(ctx, stored)
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should reject changing the status", func() {
+				p := stored
+				p.Status = payment.StatusSettled
+				_, err := s.Update(ctx, p)
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "status"}))
+			})
+
+			It("should not move the payment to another organisation", func() {
+				moved := stored
+				moved.OrganisationId = "4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43"
+				_, err := s.Update(ctx, moved)
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "organisation_id"}))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(stored))
+			})
+		})
 
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE ID = ?").
-					WithArgs("some id").
-					WillReturnError(sql.ErrConnDone)
-				_, err := s.Get(ctx, "some id")
-				Expect(err).Should(HaveOccurred())
-				Expect(err).To(Equal(sql.ErrConnDone))
+		Context("when the status is left out", func() {
+			It("should keep the status and its history", func() {
+				p := stored
+				p.Status, p.StatusHistory = "", nil
+				actual, err := s.Update(ctx, p)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusCreated))
+				Expect(actual.StatusHistory).To(Equal(stored.StatusHistory))
 			})
 		})
 	})
 
-	Describe("Search By Organisation Id", func() {
+	Describe("Patching a payment", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			p := givenValidPayment()
+			p.Attributes.Reference = "old ref"
+			stored = givenSaved(p)
+		})
+
 		Context("when successful", func() {
-			It("should return all payments for given Organisation Id", func() {
-				ps := []payment.Payment{
-					{Id: "A", OrganisationId: "OrgId"},
-					{Id: "B", OrganisationId: "OrgId"},
-					{Id: "C", OrganisationId: "OrgId"},
+			It("should update the stored payment with the patch applied", func() {
+				expected := stored
+				expected.Version = 1
+				expected.Attributes.Reference = "new ref"
+
+				actual, err := s.Patch(ctx, stored.Id, payment.MergePatch(`{"attributes":{"reference":"new ref"}}`))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual).To(Equal(expected))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(expected))
+			})
+
+			It("should check the version from the patch", func() {
+				_, err := s.Patch(ctx, stored.Id, payment.JSONPatch(`[{"op":"replace","path":"/version","value":1}]`))
+				Expect(err).To(Equal(payment.ErrVersionConflict))
+			})
+		})
+
+		Context("when not successful", func() {
+			It("should reject changing the organisation id", func() {
+				_, err := s.Patch(ctx, stored.Id, payment.MergePatch(`{"organisation_id":"other"}`))
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "organisation_id"}))
+			})
+
+			It("should reject changing the id", func() {
+				_, err := s.Patch(ctx, stored.Id, payment.JSONPatch(`[{"op":"replace","path":"/id","value":"other"}]`))
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "id"}))
+			})
+
+			It("should reject a result that is not a payment", func() {
+				_, err := s.Patch(ctx, stored.Id, payment.MergePatch(`{"unknown":"field"}`))
+				Expect(err).Should(BeAssignableToTypeOf(&payment.PatchError{}))
+			})
+		})
+	})
+
+	Describe("Deleting a payment", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			stored = givenSaved(givenValidPayment())
+		})
+
+		Context("when successful", func() {
+			It("should mark the payment as deleted with the reason", func() {
+				Expect(s.Delete(ctx, stored.Id, "duplicate")).To(Succeed())
+
+				actual, err := repo.Get(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Deleted).ShouldNot(BeNil())
+				Expect(actual.Deleted.At).ShouldNot(BeZero())
+				Expect(actual.Deleted.Reason).To(Equal("duplicate"))
+				Expect(actual.Version).To(Equal(stored.Version + 1))
+			})
+		})
+
+		Context("when not successful", func() {
+			It("should return not found if no record", func() {
+				Expect(s.Delete(ctx, "some id", "")).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should return not found if already deleted", func() {
+				Expect(s.Delete(ctx, stored.Id, "")).To(Succeed())
+				Expect(s.Delete(ctx, stored.Id, "")).To(Equal(payment.ErrNotFound))
+			})
+		})
+	})
+
+	Describe("Restoring a payment", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			stored = givenSaved(givenValidPayment())
+		})
+
+		Context("when successful", func() {
+			It("should return the restored payment", func() {
+				Expect(s.Delete(ctx, stored.Id, "duplicate")).To(Succeed())
+
+				actual, err := s.Restore(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				expected := stored
+				expected.Version = stored.Version + 2
+				Expect(actual).To(Equal(expected))
+				Expect(s.Get(ctx, stored.Id, payment.GetOptions{})).To(Equal(expected))
+			})
+
+			It("should refuse an update with the version from before the delete", func() {
+				Expect(s.Delete(ctx, stored.Id, "duplicate")).To(Succeed())
+				_, err := s.Restore(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+
+				stale := stored
+				stale.Attributes.Reference = "stale ref"
+				_, err = s.Update(ctx, stale)
+				Expect(err).To(Equal(payment.ErrVersionConflict))
+			})
+		})
+
+		Context("when not successful", func() {
+			It("should return not found if not deleted", func() {
+				_, err := s.Restore(ctx, stored.Id)
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should return not found if no record", func() {
+				_, err := s.Restore(ctx, "some id")
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+	})
+
+	Describe("Moving a payment through its lifecycle", func() {
+		var stored payment.Payment
+
+		BeforeEach(func() {
+			stored = givenSaved(givenValidPayment())
+		})
+
+		Context("when the move is allowed", func() {
+			It("should add the change to the history", func() {
+				actual, err := s.Transition(payment.NewActorContext(ctx, "bob"), stored.Id, payment.Transition{To: payment.StatusSubmitted, Reason: "sent to scheme"})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusSubmitted))
+				Expect(actual.Version).To(Equal(stored.Version + 1))
+				Expect(actual.StatusHistory).To(HaveLen(2))
+
+				change := actual.StatusHistory[1]
+				Expect(change.From).To(Equal(payment.StatusCreated))
+				Expect(change.To).To(Equal(payment.StatusSubmitted))
+				Expect(change.Actor).To(Equal("bob"))
+				Expect(change.Reason).To(Equal("sent to scheme"))
+				Expect(change.At).ToNot(BeZero())
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(actual))
+			})
+
+			It("should follow the lifecycle to the end", func() {
+				for _, to := range []payment.Status{payment.StatusSubmitted, payment.StatusSettled, payment.StatusReturned} {
+					_, err := s.Transition(ctx, stored.Id, payment.Transition{To: to})
+					Expect(err).ShouldNot(HaveOccurred())
 				}
+				actual, err := repo.Get(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusReturned))
+				Expect(actual.StatusHistory).To(HaveLen(4))
+			})
+		})
+
+		Context("when the move is not allowed", func() {
+			It("should return the statuses it can move to", func() {
+				_, err := s.Transition(ctx, stored.Id, payment.Transition{To: payment.StatusSettled})
+				Expect(err).To(Equal(&payment.TransitionError{
+					From:    payment.StatusCreated,
+					To:      payment.StatusSettled,
+					Allowed: []payment.Status{payment.StatusPendingApproval, payment.StatusSubmitted, payment.StatusCancelled},
+				}))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(stored))
+			})
+
+			It("should not move a payment out of a final status", func() {
+				_, err := s.Transition(ctx, stored.Id, payment.Transition{To: payment.StatusCancelled})
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = s.Transition(ctx, stored.Id, payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).To(Equal(&payment.TransitionError{
+					From:    payment.StatusCancelled,
+					To:      payment.StatusSubmitted,
+					Allowed: []payment.Status{},
+				}))
+			})
+		})
+
+		Context("when not successful", func() {
+			It("should reject an unknown status", func() {
+				_, err := s.Transition(ctx, stored.Id, payment.Transition{To: "lost"})
+				Expect(err).Should(BeAssignableToTypeOf(&payment.ValidationError{}))
+			})
+
+			It("should return not found if deleted", func() {
+				Expect(s.Delete(ctx, stored.Id, "")).To(Succeed())
+				_, err := s.Transition(ctx, stored.Id, payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+
+			It("should return not found if no record", func() {
+				_, err := s.Transition(ctx, "some id", payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+	})
+
+	Describe("Approving high-value payments", func() {
+		var (
+			alice context.Context
+			bob   context.Context
+		)
+
+		BeforeEach(func() {
+			s = payment.NewService(repo, payment.WithApprovalThresholds(payment.Thresholds{
+				"743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb": {"GBP": payment.MustParseDecimal("1000.00")},
+			}))
+			alice = signedIn(ctx, "alice")
+			bob = signedIn(ctx, "bob")
+		})
+
+		givenHighValue := func() payment.Payment {
+			p := givenValidPayment()
+			p.Attributes.Amount = payment.MustParseDecimal("1000.01")
+			id, err := s.Save(alice, p)
+			Expect(err).ShouldNot(HaveOccurred())
+			stored, err := repo.Get(ctx, id)
+			Expect(err).ShouldNot(HaveOccurred())
+			return stored
+		}
+
+		Context("when saving", func() {
+			It("should leave a payment over the threshold pending approval", func() {
+				stored := givenHighValue()
+				Expect(stored.Status).To(Equal(payment.StatusPendingApproval))
+				Expect(stored.StatusHistory).To(HaveLen(1))
+				Expect(stored.StatusHistory[0].To).To(Equal(payment.StatusPendingApproval))
+				Expect(stored.StatusHistory[0].Actor).To(Equal("alice"))
+			})
 
-				rows := sqlmock.NewRows([]string{"info"})
+			It("should create a payment at the threshold", func() {
+				p := givenValidPayment()
+				p.Attributes.Amount = payment.MustParseDecimal("1000.00")
+				Expect(givenSaved(p).Status).To(Equal(payment.StatusCreated))
+			})
+
+			It("should create a payment in a currency without a threshold", func() {
+				p := givenValidPayment()
+				p.Attributes.Amount = payment.MustParseDecimal("5000.00")
+				p.Attributes.Currency = "EUR"
+				Expect(givenSaved(p).Status).To(Equal(payment.StatusCreated))
+			})
 
-				for _, p := range ps {
-					bs, err := json.Marshal(p)
+			It("should leave payments of a batch over the threshold pending approval", func() {
+				high := givenValidPayment()
+				high.Attributes.Amount = payment.MustParseDecimal("2000.00")
+				results, err := s.SaveAll(alice, []payment.Payment{givenValidPayment(), high}, true)
+				Expect(err).ShouldNot(HaveOccurred())
+				for i, status := range []payment.Status{payment.StatusCreated, payment.StatusPendingApproval} {
+					stored, err := repo.Get(ctx, results[i].Id)
 					Expect(err).ShouldNot(HaveOccurred())
-					rows.AddRow(string(bs))
+					Expect(stored.Status).To(Equal(status))
 				}
+			})
+		})
+
+		Context("when approved by someone else", func() {
+			It("should submit the payment", func() {
+				stored := givenHighValue()
+				actual, err := s.Approve(bob, stored.Id, "checked")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusSubmitted))
+				Expect(actual.Version).To(Equal(stored.Version + 1))
+				Expect(actual.Approval).To(Equal(&payment.Approval{
+					Decision: payment.DecisionApproved,
+					By:       "bob",
+					At:       actual.StatusHistory[1].At,
+					Reason:   "checked",
+				}))
+				Expect(actual.StatusHistory[1].From).To(Equal(payment.StatusPendingApproval))
+				Expect(actual.StatusHistory[1].To).To(Equal(payment.StatusSubmitted))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(actual))
+
+				revisions, err := s.History(ctx, stored.Id)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(revisions[len(revisions)-1].Action).To(Equal(payment.ActionApprove))
+			})
+
+			It("should keep the approval when the payment is updated", func() {
+				approved, err := s.Approve(bob, givenHighValue().Id, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				approved.Approval = nil
+				approved.Attributes.Reference = "new ref"
+				actual, err := s.Update(alice, approved)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Approval.By).To(Equal("bob"))
+			})
+		})
+
+		Context("when unauthenticated approvals are allowed", func() {
+			BeforeEach(func() {
+				s = payment.NewService(repo, payment.WithUnauthenticatedApprovals(), payment.WithApprovalThresholds(payment.Thresholds{
+					"743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb": {"GBP": payment.MustParseDecimal("1000.00")},
+				}))
+				alice = payment.NewActorContext(ctx, "alice")
+				bob = payment.NewActorContext(ctx, "bob")
+			})
+
+			It("should take who approves from the actor", func() {
+				actual, err := s.Approve(bob, givenHighValue().Id, "")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Approval.By).To(Equal("bob"))
+			})
+
+			It("should still refuse approval by who created the payment", func() {
+				_, err := s.Approve(alice, givenHighValue().Id, "")
+				Expect(err).To(Equal(payment.ErrSelfApproval))
+			})
+
+			It("should refuse approval by no one", func() {
+				_, err := s.Approve(ctx, givenHighValue().Id, "")
+				Expect(err).To(Equal(payment.ErrUnknownApprover))
+			})
+		})
+
+		Context("when rejected by someone else", func() {
+			It("should reject the payment", func() {
+				actual, err := s.Reject(bob, givenHighValue().Id, "unknown beneficiary")
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusRejected))
+				Expect(actual.Approval.Decision).To(Equal(payment.DecisionRejected))
+				Expect(actual.StatusHistory[1].Reason).To(Equal("unknown beneficiary"))
+			})
+		})
+
+		Context("when not allowed", func() {
+			It("should refuse approval by who created the payment", func() {
+				stored := givenHighValue()
+				_, err := s.Approve(alice, stored.Id, "")
+				Expect(err).To(Equal(payment.ErrSelfApproval))
+				_, err = s.Reject(alice, stored.Id, "")
+				Expect(err).To(Equal(payment.ErrSelfApproval))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(stored))
+			})
+
+			It("should refuse approval by someone who is not authenticated", func() {
+				stored := givenHighValue()
+				_, err := s.Approve(payment.NewActorContext(ctx, "bob"), stored.Id, "")
+				Expect(err).To(Equal(payment.ErrUnauthenticatedApprover))
+				_, err = s.Reject(payment.NewActorContext(ctx, "bob"), stored.Id, "")
+				Expect(err).To(Equal(payment.ErrUnauthenticatedApprover))
+				Expect(repo.Get(ctx, stored.Id)).To(Equal(stored))
+			})
+
+			It("should refuse approval by no one", func() {
+				_, err := s.Approve(ctx, givenHighValue().Id, "")
+				Expect(err).To(Equal(payment.ErrUnauthenticatedApprover))
+			})
+
+			It("should refuse approval of a payment not pending approval", func() {
+				stored := givenSaved(givenValidPayment())
+				_, err := s.Approve(bob, stored.Id, "")
+				Expect(err).To(Equal(payment.ErrNotPendingApproval))
+			})
+
+			It("should not submit a payment without approval", func() {
+				stored := givenHighValue()
+				_, err := s.Transition(bob, stored.Id, payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).To(Equal(payment.ErrApprovalRequired))
+				_, err = s.Transition(bob, stored.Id, payment.Transition{To: payment.StatusRejected})
+				Expect(err).To(Equal(payment.ErrApprovalRequired))
+			})
+
+			It("should not submit a payment raised over the threshold without approval", func() {
+				stored := givenSaved(givenValidPayment())
+				stored.Attributes.Amount = payment.MustParseDecimal("1500.00")
+				_, err := s.Update(alice, stored)
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = s.Transition(alice, stored.Id, payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).To(Equal(payment.ErrApprovalRequired))
+			})
+
+			It("should not change the amount or currency of an approved payment", func() {
+				approved, err := s.Approve(bob, givenHighValue().Id, "checked")
+				Expect(err).ShouldNot(HaveOccurred())
+
+				raised := approved
+				raised.Attributes.Amount = payment.MustParseDecimal("900000.00")
+				_, err = s.Update(alice, raised)
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "attributes.amount"}))
+				_, err = s.Patch(alice, approved.Id, payment.MergePatch(`{"attributes":{"amount":"900000.00"}}`))
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "attributes.amount"}))
+				_, err = s.Patch(alice, approved.Id, payment.MergePatch(`{"attributes":{"currency":"USD"}}`))
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "attributes.currency"}))
+				Expect(repo.Get(ctx, approved.Id)).To(Equal(approved))
+			})
+
+			It("should not change the amount of a payment pending approval", func() {
+				stored := givenHighValue()
+				stored.Attributes.Amount = payment.MustParseDecimal("1.00")
+				_, err := s.Update(alice, stored)
+				Expect(err).To(Equal(&payment.ImmutableFieldError{Field: "attributes.amount"}))
+			})
+
+			It("should still let the payment be cancelled", func() {
+				actual, err := s.Transition(alice, givenHighValue().Id, payment.Transition{To: payment.StatusCancelled})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Status).To(Equal(payment.StatusCancelled))
+			})
+
+			It("should return not found if no record", func() {
+				_, err := s.Approve(bob, "some id", "")
+				Expect(err).To(Equal(payment.ErrNotFound))
+			})
+		})
+	})
+
+	Describe("Getting the history of a payment", func() {
+		It("should record every change with who made it", func() {
+			ctx = requestid.NewContext(payment.NewActorContext(ctx, "alice"), "some request")
+			stored := givenSaved(givenValidPayment())
+			updated := stored
+			updated.Attributes.Reference = "new ref"
+			updated, err := s.Update(ctx, updated)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = s.Patch(ctx, stored.Id, payment.MergePatch(`{"attributes":{"reference":"patched ref"}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = s.Transition(ctx, stored.Id, payment.Transition{To: payment.StatusSubmitted})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(s.Delete(ctx, stored.Id, "duplicate")).To(Succeed())
+			_, err = s.Restore(ctx, stored.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			actual, err := s.History(ctx, stored.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			actions := make([]payment.Action, len(actual))
+			for i, revision := range actual {
+				actions[i] = revision.Action
+				Expect(revision.Actor).To(Equal("alice"))
+				Expect(revision.RequestId).To(Equal("some request"))
+				Expect(revision.At).ToNot(BeZero())
+			}
+			Expect(actions).To(Equal([]payment.Action{
+				payment.ActionCreate,
+				payment.ActionUpdate,
+				payment.ActionPatch,
+				payment.ActionTransition,
+				payment.ActionDelete,
+				payment.ActionRestore,
+			}))
+			Expect(actual[0].Previous).To(BeNil())
+			Expect(actual[0].Current).To(Equal(stored))
+			Expect(actual[1].Previous).To(Equal(&stored))
+			Expect(actual[1].Current).To(Equal(updated))
+		})
+
+		It("should keep the history of a deleted payment", func() {
+			stored := givenSaved(givenValidPayment())
+			Expect(s.Delete(ctx, stored.Id, "")).To(Succeed())
+			Expect(s.History(ctx, stored.Id)).To(HaveLen(2))
+		})
 
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE info ->> 'organisation_id' = ?").
-					WithArgs("OrgId").
-					WillReturnRows(rows)
+		It("should return not found if no record", func() {
+			_, err := s.History(ctx, "some id")
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+	})
+
+	Describe("Getting a payment as it was", func() {
+		var (
+			created, updated payment.Payment
+			at               time.Time
+		)
+
+		// The revisions are written straight to the store to control when
+		// they were made.
+		BeforeEach(func() {
+			at = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			created = givenValidPayment()
+			created.Id = "some id"
+			Expect(repo.Insert(ctx, created, payment.Change{Action: payment.ActionCreate, At: at})).To(Succeed())
+			updated = created
+			updated.Version, updated.Attributes.Reference = 1, "new ref"
+			Expect(repo.Update(ctx, updated, 0, payment.Change{Action: payment.ActionUpdate, At: at.Add(time.Hour)})).To(Succeed())
+		})
+
+		It("should return the payment as it was at the time", func() {
+			Expect(s.Get(ctx, created.Id, payment.GetOptions{AsOf: at})).To(Equal(created))
+			Expect(s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(time.Minute)})).To(Equal(created))
+			Expect(s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(time.Hour)})).To(Equal(updated))
+		})
+
+		It("should return not found before it was created", func() {
+			_, err := s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(-time.Second)})
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should only return it while deleted when asked to include deleted", func() {
+			deleted := updated
+			deleted.Deleted = &payment.Deletion{At: at.Add(2 * time.Hour), Reason: "duplicate"}
+			Expect(repo.Update(ctx, deleted, 1, payment.Change{Action: payment.ActionDelete, At: at.Add(2 * time.Hour)})).To(Succeed())
+
+			_, err := s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(3 * time.Hour)})
+			Expect(err).To(Equal(payment.ErrNotFound))
+			Expect(s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(3 * time.Hour), IncludeDeleted: true})).To(Equal(deleted))
+			Expect(s.Get(ctx, created.Id, payment.GetOptions{AsOf: at.Add(time.Hour)})).To(Equal(updated))
+		})
+	})
+
+	Describe("Searching for payments", func() {
+		var organisationId string
+
+		givenPayments := func(dates ...string) []payment.Payment {
+			ps := make([]payment.Payment, len(dates))
+			for i, date := range dates {
+				p := givenValidPayment()
+				p.OrganisationId = organisationId
+				p.Attributes.ProcessingDate = date
+				ps[i] = givenSaved(p)
+			}
+			return ps
+		}
+
+		BeforeEach(func() {
+			organisationId = uuid.NewV4().String()
+		})
+
+		Context("when successful", func() {
+			It("should return all payments for given Organisation Id", func() {
+				ps := givenPayments("2017-01-01", "2017-01-02")
+				other := givenValidPayment()
+				other.OrganisationId = uuid.NewV4().String()
+				givenSaved(other)
+
+				actual, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Payments).To(ConsistOf(ps))
+				Expect(actual.Next).To(BeEmpty())
+				Expect(actual.Prev).To(BeEmpty())
+			})
+
+			It("should include deleted payments when asked", func() {
+				ps := givenPayments("2017-01-01")
+				Expect(s.Delete(ctx, ps[0].Id, "")).To(Succeed())
+
+				actual, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Payments).To(BeEmpty())
+
+				actual, err = s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, IncludeDeleted: true})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Payments).To(HaveLen(1))
+			})
+
+			It("should filter by status", func() {
+				ps := givenPayments("2017-01-01", "2017-01-02")
+				_, err := s.Transition(ctx, ps[1].Id, payment.Transition{To: payment.StatusSubmitted})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				actual, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Status: payment.StatusCreated})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Payments).To(Equal(ps[:1]))
+			})
+
+			It("should sort descending", func() {
+				ps := givenPayments("2017-01-01", "2017-01-03", "2017-01-02")
+
+				actual, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Sort: "-processing_date"})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(actual.Payments).To(Equal([]payment.Payment{ps[1], ps[2], ps[0]}))
+			})
+
+			It("should page through the payments", func() {
+				ps := givenPayments("2017-01-01", "2017-01-02", "2017-01-03")
+
+				first, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Sort: "processing_date", Size: 2})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(first.Payments).To(Equal(ps[:2]))
+				Expect(first.Next).ToNot(BeEmpty())
+				Expect(first.Prev).To(BeEmpty())
+
+				second, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Sort: "processing_date", Size: 2, After: first.Next})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(second.Payments).To(Equal(ps[2:]))
+				Expect(second.Next).To(BeEmpty())
+				Expect(second.Prev).ToNot(BeEmpty())
 
-				actual, err := s.SearchByOrganisationId(ctx, "OrgId")
+				back, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Sort: "processing_date", Size: 2, Before: second.Prev})
 				Expect(err).ShouldNot(HaveOccurred())
-				Expect(actual).To(Equal(ps))
+				Expect(back.Payments).To(Equal(ps[:2]))
+				Expect(back.Prev).To(BeEmpty())
+				Expect(back.Next).ToNot(BeEmpty())
 			})
 
 			It("should return empty slice", func() {
-				rows := sqlmock.NewRows([]string{"info"})
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE info ->> 'organisation_id' = ?").
-					WithArgs("OrgId").
-					WillReturnRows(rows)
-				actual, err := s.SearchByOrganisationId(ctx, "OrgId")
+				actual, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId})
 				Expect(err).ShouldNot(HaveOccurred())
-				Expect(actual).ShouldNot(BeNil())
+				Expect(actual.Payments).ShouldNot(BeNil())
 			})
 		})
 
 		Context("when not successful", func() {
-			It("should return db error back", func() {
-				dbMock.ExpectQuery("SELECT info FROM payments WHERE info ->> 'organisation_id' = ?").
-					WithArgs("OrgId").
-					WillReturnError(sql.ErrConnDone)
-				_, err := s.SearchByOrganisationId(ctx, "OrgId")
-				Expect(err).Should(HaveOccurred())
-				Expect(err).To(Equal(sql.ErrConnDone))
+			It("should return store error back", func() {
+				s = payment.NewService(&failingRepository{Repository: repo})
+				_, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId})
+				Expect(err).To(Equal(errStore))
+			})
+
+			It("should reject an unknown sort", func() {
+				_, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, Sort: "colour"})
+				Expect(err).To(Equal(payment.ErrInvalidSort))
+			})
+
+			It("should reject a cursor that is not one of ours", func() {
+				_, err := s.Search(ctx, payment.SearchOptions{OrganisationId: organisationId, After: "rubbish"})
+				Expect(err).To(Equal(payment.ErrInvalidCursor))
 			})
 		})
 	})
 
-	Describe("when HealthCheck called", func() {
-		var mockDb mockDatabase
+	Describe("Acting for organisations", func() {
+		var (
+			own     payment.Payment
+			foreign payment.Payment
+			caller  context.Context
+		)
+
 		BeforeEach(func() {
-			mockDb = mockDatabase{}
-			s = payment.NewService(&mockDb)
+			own = givenSaved(givenValidPayment())
+			other := givenValidPayment()
+			other.OrganisationId = "d0f5bb47-a5b8-4a10-a1d9-3c9e2a5e8fcd"
+			foreign = givenSaved(other)
+			caller = auth.NewContext(ctx, auth.Identity{Subject: "apikey:some-key", OrganisationIds: []string{own.OrganisationId}})
+		})
+
+		It("should save and get the payments of its organisation", func() {
+			id, err := s.Save(caller, givenValidPayment())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(s.Get(caller, id, payment.GetOptions{})).ToNot(BeZero())
+			Expect(s.Get(caller, own.Id, payment.GetOptions{})).To(Equal(own))
+		})
+
+		It("should not save a payment for another organisation", func() {
+			_, err := s.Save(caller, foreign)
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should not save a batch with a payment for another organisation", func() {
+			results, err := s.SaveAll(caller, []payment.Payment{givenValidPayment(), foreign}, false)
+			Expect(err).To(Equal(payment.ErrNotFound))
+			Expect(results).To(BeNil())
+			Expect(s.Search(ctx, payment.SearchOptions{OrganisationId: own.OrganisationId})).To(
+				WithTransform(func(r payment.SearchResult) int { return len(r.Payments) }, Equal(1)))
+		})
+
+		It("should not find the payments of another organisation", func() {
+			_, err := s.Get(caller, foreign.Id, payment.GetOptions{})
+			Expect(err).To(Equal(payment.ErrNotFound))
+			_, err = s.History(caller, foreign.Id)
+			Expect(err).To(Equal(payment.ErrNotFound))
+			_, err = s.Search(caller, payment.SearchOptions{OrganisationId: foreign.OrganisationId})
+			Expect(err).To(Equal(payment.ErrNotFound))
+			_, err = s.Changes(caller, foreign.OrganisationId, 0, 10)
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should not change the payments of another organisation", func() {
+			_, err := s.Update(caller, foreign)
+			Expect(err).To(Equal(payment.ErrNotFound))
+			Expect(s.Delete(caller, foreign.Id, "")).To(Equal(payment.ErrNotFound))
+			_, err = s.Transition(caller, foreign.Id, payment.Transition{To: payment.StatusSubmitted})
+			Expect(err).To(Equal(payment.ErrNotFound))
+		})
+
+		It("should not move a payment to another organisation", func() {
+			own.OrganisationId = foreign.OrganisationId
+			_, err := s.Update(caller, own)
+			Expect(err).To(Equal(payment.ErrNotFound))
 		})
+	})
 
+	Describe("when HealthCheck called", func() {
 		Context("when healthy", func() {
 			It("should return healthy status", func() {
-				mockDb.On("PingContext", mock.Anything).
-					Return(nil)
-
 				actual := s.HealthCheck(ctx)
 				expected := payment.HealthCheckStatus{
 					Healthy: true,
 					Message: "okay",
 				}
 				Expect(actual).Should(Equal(expected))
-				mockDb.AssertCalled(GinkgoT(), "PingContext", ctx)
 			})
 		})
 
 		Context("when unhealthy", func() {
 			It("should return unhealthy status", func() {
-				mockDb.On("PingContext", mock.Anything).
-					Return(sql.ErrConnDone)
-
+				s = payment.NewService(&failingRepository{Repository: repo})
 				actual := s.HealthCheck(ctx)
 				expected := payment.HealthCheckStatus{
 					Healthy: false,
-					Message: "sql: connection is already closed",
+					Message: "store is unavailable",
 				}
 				Expect(actual).Should(Equal(expected))
-				mockDb.AssertCalled(GinkgoT(), "PingContext", ctx)
 			})
 		})
 	})
 })
 
-type mockDatabase struct {
-	mock.Mock
+var errStore = errors.New("store is unavailable")
+
+// failingRepository fails every call that reaches the store.
+type failingRepository struct {
+	payment.Repository
 }
 
-func (m *mockDatabase) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
-	arg := m.Called(ctx, query, args)
-	return arg.Get(0).(*sql.Row)
+func (r *failingRepository) Insert(ctx context.Context, p payment.Payment, c payment.Change) error {
+	return errStore
 }
 
-func (m *mockDatabase) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
-	arg := m.Called(ctx, query, args)
-	return arg.Get(0).(*sql.Rows), arg.Error(1)
+func (r *failingRepository) InsertAll(ctx context.Context, ps []payment.Payment, c payment.Change) error {
+	return errStore
+}
 
+func (r *failingRepository) Get(ctx context.Context, id string) (payment.Payment, error) {
+	return payment.Payment{}, errStore
 }
-func (m *mockDatabase) PingContext(ctx context.Context) error {
-	args := m.Called(ctx)
-	return args.Error(0)
+
+func (r *failingRepository) Update(ctx context.Context, p payment.Payment, expectedVersion int32, c payment.Change) error {
+	return errStore
+}
+
+func (r *failingRepository) History(ctx context.Context, id string) ([]payment.Revision, error) {
+	return nil, errStore
+}
+
+func (r *failingRepository) Changes(ctx context.Context, organisationId string, after int64, limit int) ([]payment.Revision, error) {
+	return nil, errStore
+}
+
+func (r *failingRepository) LastSequence(ctx context.Context, organisationId string) (int64, error) {
+	return 0, errStore
+}
+
+func (r *failingRepository) Search(ctx context.Context, q payment.Query) ([]payment.Payment, error) {
+	return nil, errStore
+}
+
+func (r *failingRepository) Ping(ctx context.Context) error {
+	return errStore
+}
+
+// signedIn is the context of a request authenticated as the actor, acting for
+// the organisation of the valid payment with every permission.
+func signedIn(ctx context.Context, actor string) context.Context {
+	id := auth.Identity{Subject: actor, OrganisationIds: []string{"743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb"}, Roles: []auth.Role{auth.RoleAdmin}}
+	return auth.NewContext(payment.NewActorContext(ctx, actor), id)
+}
+
+func givenValidPayment() payment.Payment {
+	return payment.Payment{
+		OrganisationId: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+		Attributes:     payment.Attributes{Amount: payment.MustParseDecimal("1.00"), Currency: "GBP", Reference: "some ref"},
+	}
 }
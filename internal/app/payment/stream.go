@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// StreamPath streams the changes to payments as they are made, responses to
+// it stay open so it cannot be given the write timeout of the other routes.
+const StreamPath = "/payment/stream"
+
+const (
+	// LastEventIdHeader is sent by a client reconnecting to a stream, it is
+	// the sequence of the last change it was sent.
+	LastEventIdHeader = "Last-Event-ID"
+
+	// streamBatch is how many changes are read at a time.
+	streamBatch = 100
+	// keepAlive is how long a stream goes without anything being sent before
+	// a comment is, so proxies do not close it and clients that have gone
+	// are noticed.
+	keepAlive = 15 * time.Second
+)
+
+// WithStreamInterval sets how often streams look for new changes, every
+// second when it is not set.
+func WithStreamInterval(interval time.Duration) HandlerOption {
+	return func(h *handlers) {
+		h.streamInterval = interval
+	}
+}
+
+// streamPaymentsHandler sends every change made to the payments of the
+// organisation as a Server-Sent Event, its id is the sequence of the change so
+// a client that reconnects with it is sent what it missed. A new stream starts
+// with the next change made.
+func (h *handlers) streamPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	organisationId := r.URL.Query().Get("organisation_id")
+	if organisationId == "" {
+		writeBadRequest(w, r, "invalid_query", &ValidationError{Errors: []FieldError{{Field: "organisation_id", Message: "is required"}}})
+		return
+	}
+	var (
+		after int64 = -1
+		err   error
+	)
+	if lastEventId := r.Header.Get(LastEventIdHeader); lastEventId != "" {
+		if after, err = strconv.ParseInt(lastEventId, 10, 64); err != nil || after < 0 {
+			writeBadRequest(w, r, "invalid_last_event_id", errors.New("Last-Event-ID must be the id of an event sent by the stream"))
+			return
+		}
+	}
+	// Asking for the last sequence even when resuming means a caller that
+	// cannot read the changes is told so before the stream starts.
+	last, err := h.s.LastSequence(r.Context(), organisationId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if after < 0 {
+		after = last
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("payment: response cannot be streamed"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	poll := time.NewTicker(h.streamInterval)
+	defer poll.Stop()
+	quiet := time.Now()
+	for {
+		revisions, err := h.s.Changes(r.Context(), organisationId, after, streamBatch)
+		if err != nil {
+			// The client reconnects and is sent the changes from where
+			// it got to.
+			if r.Context().Err() == nil {
+				log.Error(err)
+			}
+			return
+		}
+		for _, revision := range revisions {
+			if err = writeEvent(w, revision); err != nil {
+				return
+			}
+			after = revision.Sequence
+		}
+		if len(revisions) > 0 {
+			flusher.Flush()
+			quiet = time.Now()
+		}
+		if len(revisions) == streamBatch {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case now := <-poll.C:
+			if now.Sub(quiet) < keepAlive {
+				continue
+			}
+			if _, err = io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			quiet = now
+		}
+	}
+}
+
+// writeEvent sends the revision as an event of the type published for it
+// with the payment after the change as its data.
+func writeEvent(w io.Writer, revision Revision) error {
+	data, err := json.Marshal(revision.Current)
+	if err != nil {
+		return err
+	}
+	event := newEvent(revision.Change, revision.Current.Id, data)
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", revision.Sequence, event.Type, data)
+	return err
+}
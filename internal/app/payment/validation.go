@@ -0,0 +1,204 @@
+package payment
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+// FieldError is a problem with a single field of a payment, the field is the
+// dotted JSON path to it.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError holds every problem found with a payment, not just the first.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fmt.Sprintf("%s %s", fe.Field, fe.Message)
+	}
+	return fmt.Sprintf("payment: invalid, %s", strings.Join(msgs, ", "))
+}
+
+// schemeRule limits the scheme payment types and currency a payment scheme
+// accepts, an empty currency means any currency.
+type schemeRule struct {
+	currency string
+	types    []SchemePaymentType
+}
+
+var schemeRules = map[PaymentScheme]schemeRule{
+	SchemeFPS: {currency: "GBP", types: []SchemePaymentType{
+		SchemePaymentTypeImmediatePayment,
+		SchemePaymentTypeForwardDatedPayment,
+		SchemePaymentTypeStandingOrder,
+	}},
+	SchemeBacs: {currency: "GBP", types: []SchemePaymentType{
+		SchemePaymentTypeDirectCredit,
+		SchemePaymentTypeDirectDebit,
+		SchemePaymentTypeStandingOrder,
+	}},
+	SchemeChaps:      {currency: "GBP", types: []SchemePaymentType{SchemePaymentTypeSameDayPayment}},
+	SchemeSepaCredit: {currency: "EUR", types: []SchemePaymentType{SchemePaymentTypeDirectCredit}},
+	SchemeSepaInst:   {currency: "EUR", types: []SchemePaymentType{SchemePaymentTypeImmediatePayment}},
+	SchemeSwift:      {types: []SchemePaymentType{SchemePaymentTypeInternationalTransfer}},
+}
+
+var schemePaymentTypes = map[SchemePaymentType]bool{
+	SchemePaymentTypeImmediatePayment:      true,
+	SchemePaymentTypeForwardDatedPayment:   true,
+	SchemePaymentTypeStandingOrder:         true,
+	SchemePaymentTypeDirectCredit:          true,
+	SchemePaymentTypeDirectDebit:           true,
+	SchemePaymentTypeSameDayPayment:        true,
+	SchemePaymentTypeInternationalTransfer: true,
+}
+
+var schemePaymentSubTypes = map[SchemePaymentSubType]bool{
+	SchemePaymentSubTypeInternetBanking:   true,
+	SchemePaymentSubTypeMobileBanking:     true,
+	SchemePaymentSubTypeTelephoneBanking:  true,
+	SchemePaymentSubTypeBranchInstruction: true,
+}
+
+// validator collects the field errors found while checking a payment.
+type validator struct {
+	errs []FieldError
+}
+
+func (v *validator) add(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(field string, value string) bool {
+	if value == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) uuid(field string, value string) {
+	if _, err := uuid.FromString(value); err != nil {
+		v.add(field, "must be a UUID")
+	}
+}
+
+func (v *validator) currency(field string, value string) {
+	if _, ok := MinorUnits(value); !ok {
+		v.add(field, "is not an ISO 4217 currency")
+	}
+}
+
+// amount checks the value has no more decimal places than the currency
+// allows, zero is only accepted when positive is false.
+func (v *validator) amount(field string, value Decimal, currency string, positive bool) {
+	if value.Empty() {
+		v.add(field, "is required")
+		return
+	}
+	switch {
+	case positive && value.Sign() <= 0:
+		v.add(field, "must be greater than zero")
+	case value.Sign() < 0:
+		v.add(field, "must not be negative")
+	}
+	if units, ok := MinorUnits(currency); ok && value.Scale() > units {
+		v.add(field, "must have at most %d decimal places for %s", units, currency)
+	}
+}
+
+func (v *validator) date(field string, value string) {
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		v.add(field, "must be a date in the form YYYY-MM-DD")
+	}
+}
+
+func (v *validator) scheme(a Attributes) {
+	if a.SchemePaymentType != "" && !schemePaymentTypes[a.SchemePaymentType] {
+		v.add("attributes.scheme_payment_type", "is not a known scheme payment type")
+	}
+	if a.SchemePaymentSubType != "" && !schemePaymentSubTypes[a.SchemePaymentSubType] {
+		v.add("attributes.scheme_payment_sub_type", "is not a known scheme payment sub type")
+	}
+	if a.PaymentScheme == "" {
+		return
+	}
+
+	rule, ok := schemeRules[a.PaymentScheme]
+	if !ok {
+		v.add("attributes.payment_scheme", "is not a known payment scheme")
+		return
+	}
+	if _, known := MinorUnits(a.Currency); known && rule.currency != "" && a.Currency != rule.currency {
+		v.add("attributes.currency", "must be %s for payment scheme %s", rule.currency, a.PaymentScheme)
+	}
+	if a.SchemePaymentType != "" && schemePaymentTypes[a.SchemePaymentType] {
+		for _, t := range rule.types {
+			if t == a.SchemePaymentType {
+				return
+			}
+		}
+		v.add("attributes.scheme_payment_type", "is not allowed for payment scheme %s", a.PaymentScheme)
+	}
+}
+
+// Validate checks the payment has everything needed to be saved and that it
+// follows the rules of its payment scheme. Every problem found is returned in
+// the ValidationError, not just the first.
+func Validate(p Payment) error {
+	v := &validator{}
+	a := p.Attributes
+
+	if v.required("organisation_id", p.OrganisationId) {
+		v.uuid("organisation_id", p.OrganisationId)
+	}
+	v.amount("attributes.amount", a.Amount, a.Currency, true)
+	if v.required("attributes.currency", a.Currency) {
+		v.currency("attributes.currency", a.Currency)
+	}
+	if a.ProcessingDate != "" {
+		v.date("attributes.processing_date", a.ProcessingDate)
+	}
+	v.scheme(a)
+
+	if c := a.ChargesInformation; c != nil {
+		for i, charge := range c.SenderCharges {
+			field := fmt.Sprintf("attributes.charges_information.sender_charges[%d]", i)
+			if v.required(field+".currency", charge.Currency) {
+				v.currency(field+".currency", charge.Currency)
+			}
+			v.amount(field+".amount", charge.Amount, charge.Currency, false)
+		}
+		if c.ReceiverChargesCurrency != "" {
+			v.currency("attributes.charges_information.receiver_charges_currency", c.ReceiverChargesCurrency)
+		}
+		if c.ReceiverChargesAmount != nil {
+			v.amount("attributes.charges_information.receiver_charges_amount", *c.ReceiverChargesAmount, c.ReceiverChargesCurrency, false)
+		}
+	}
+
+	if fx := a.Fx; fx != nil {
+		if fx.OriginalCurrency != "" {
+			v.currency("attributes.fx.original_currency", fx.OriginalCurrency)
+		}
+		if fx.OriginalAmount != nil {
+			v.amount("attributes.fx.original_amount", *fx.OriginalAmount, fx.OriginalCurrency, true)
+		}
+		if fx.ExchangeRate != nil {
+			v.amount("attributes.fx.exchange_rate", *fx.ExchangeRate, "", true)
+		}
+	}
+
+	if len(v.errs) > 0 {
+		return &ValidationError{Errors: v.errs}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package payment_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/payment"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Validation", func() {
+
+	Context("when the payment is valid", func() {
+		It("should return no error", func() {
+			Expect(payment.Validate(givenExamplePayment())).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Context("when the payment is empty", func() {
+		It("should return every missing field", func() {
+			err := payment.Validate(payment.Payment{})
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(*payment.ValidationError).Errors).Should(Equal([]payment.FieldError{
+				{Field: "organisation_id", Message: "is required"},
+				{Field: "attributes.amount", Message: "is required"},
+				{Field: "attributes.currency", Message: "is required"},
+			}))
+		})
+	})
+
+	DescribeTable("when a rule is broken",
+		func(change func(p *payment.Payment), expected ...payment.FieldError) {
+			p := givenExamplePayment()
+			change(&p)
+			err := payment.Validate(p)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(*payment.ValidationError).Errors).Should(Equal(expected))
+		},
+		Entry("organisation id not a uuid",
+			func(p *payment.Payment) { p.OrganisationId = "OrgId" },
+			payment.FieldError{Field: "organisation_id", Message: "must be a UUID"}),
+		Entry("amount negative",
+			func(p *payment.Payment) { p.Attributes.Amount = payment.MustParseDecimal("-10.00") },
+			payment.FieldError{Field: "attributes.amount", Message: "must be greater than zero"}),
+		Entry("amount zero",
+			func(p *payment.Payment) { p.Attributes.Amount = payment.MustParseDecimal("0.00") },
+			payment.FieldError{Field: "attributes.amount", Message: "must be greater than zero"}),
+		Entry("amount with too many decimal places",
+			func(p *payment.Payment) { p.Attributes.Amount = payment.MustParseDecimal("10.001") },
+			payment.FieldError{Field: "attributes.amount", Message: "must have at most 2 decimal places for GBP"}),
+		Entry("amount with decimal places for a currency with none",
+			func(p *payment.Payment) {
+				p.Attributes.Amount, p.Attributes.Currency = payment.MustParseDecimal("100.5"), "JPY"
+				p.Attributes.PaymentScheme, p.Attributes.SchemePaymentType = payment.SchemeSwift, payment.SchemePaymentTypeInternationalTransfer
+			},
+			payment.FieldError{Field: "attributes.amount", Message: "must have at most 0 decimal places for JPY"}),
+		Entry("currency unknown",
+			func(p *payment.Payment) { p.Attributes.Currency = "ABC" },
+			payment.FieldError{Field: "attributes.currency", Message: "is not an ISO 4217 currency"}),
+		Entry("processing date not a date",
+			func(p *payment.Payment) { p.Attributes.ProcessingDate = "2017-02-30" },
+			payment.FieldError{Field: "attributes.processing_date", Message: "must be a date in the form YYYY-MM-DD"}),
+		Entry("scheme unknown",
+			func(p *payment.Payment) { p.Attributes.PaymentScheme = "Carrier Pigeon" },
+			payment.FieldError{Field: "attributes.payment_scheme", Message: "is not a known payment scheme"}),
+		Entry("scheme payment type not allowed by the scheme",
+			func(p *payment.Payment) { p.Attributes.SchemePaymentType = payment.SchemePaymentTypeDirectDebit },
+			payment.FieldError{Field: "attributes.scheme_payment_type", Message: "is not allowed for payment scheme FPS"}),
+		Entry("currency not allowed by the scheme",
+			func(p *payment.Payment) { p.Attributes.Currency = "EUR" },
+			payment.FieldError{Field: "attributes.currency", Message: "must be GBP for payment scheme FPS"}),
+		Entry("scheme payment sub type unknown",
+			func(p *payment.Payment) { p.Attributes.SchemePaymentSubType = "Fax" },
+			payment.FieldError{Field: "attributes.scheme_payment_sub_type", Message: "is not a known scheme payment sub type"}),
+		Entry("sender charge in an unknown currency",
+			func(p *payment.Payment) { p.Attributes.ChargesInformation.SenderCharges[1].Currency = "XYZ" },
+			payment.FieldError{Field: "attributes.charges_information.sender_charges[1].currency", Message: "is not an ISO 4217 currency"}),
+		Entry("sender charge negative",
+			func(p *payment.Payment) {
+				p.Attributes.ChargesInformation.SenderCharges[0].Amount = payment.MustParseDecimal("-5.00")
+			},
+			payment.FieldError{Field: "attributes.charges_information.sender_charges[0].amount", Message: "must not be negative"}),
+		Entry("fx original amount zero",
+			func(p *payment.Payment) {
+				zero := payment.MustParseDecimal("0")
+				p.Attributes.Fx.OriginalAmount = &zero
+			},
+			payment.FieldError{Field: "attributes.fx.original_amount", Message: "must be greater than zero"}),
+	)
+
+	Context("when many rules are broken", func() {
+		It("should return them all", func() {
+			p := givenExamplePayment()
+			p.OrganisationId = "OrgId"
+			p.Attributes.Amount = payment.MustParseDecimal("1.234")
+			p.Attributes.SchemePaymentType = payment.SchemePaymentTypeSameDayPayment
+			err := payment.Validate(p)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(*payment.ValidationError).Errors).Should(HaveLen(3))
+		})
+	})
+})
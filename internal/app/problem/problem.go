@@ -0,0 +1,80 @@
+package problem
+
+import (
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/requestid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// FieldError is a problem with a single field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 problem details body. Code is stable so that callers
+// can act on it, everything else is for people.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestId string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// Extensions are extra members specific to the type of problem, they
+	// are written alongside the standard ones and cannot replace them.
+	Extensions map[string]interface{} `json:"-"`
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type standard Problem
+	bs, err := json.Marshal(standard(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return bs, err
+	}
+
+	members := make(map[string]interface{})
+	if err = json.Unmarshal(bs, &members); err != nil {
+		return nil, err
+	}
+	for name, value := range p.Extensions {
+		if _, ok := members[name]; !ok {
+			members[name] = value
+		}
+	}
+	return json.Marshal(members)
+}
+
+func New(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "/problems/" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Write sends the problem as the response to the request.
+func (p *Problem) Write(w http.ResponseWriter, r *http.Request) {
+	p.Instance = r.URL.Path
+	p.RequestId = requestid.FromContext(r.Context())
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Error(err)
+	}
+}
+
+// Handler always responds with the problem, it is useful for routers that
+// need a handler for requests they cannot route.
+func Handler(status int, code string, detail string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		New(status, code, detail).Write(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package problem_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/carlosroman/payments-api/internal/app/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Problem", func() {
+
+	Describe("Writing a problem", func() {
+		It("should send the problem as json", func() {
+			req := httptest.NewRequest("GET", "/payment/abc?x=y", nil)
+			req = req.WithContext(requestid.NewContext(req.Context(), "req-1"))
+			w := httptest.NewRecorder()
+
+			p := problem.New(http.StatusUnprocessableEntity, "validation_failed", "payment is invalid")
+			p.Errors = []problem.FieldError{{Field: "attributes.amount", Message: "is required"}}
+			p.Write(w, req)
+
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(w.Header().Get("Content-Type")).To(Equal(problem.ContentType))
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"type": "/problems/validation_failed",
+				"title": "Unprocessable Entity",
+				"status": 422,
+				"detail": "payment is invalid",
+				"instance": "/payment/abc",
+				"code": "validation_failed",
+				"request_id": "req-1",
+				"errors": [{"field": "attributes.amount", "message": "is required"}]
+			}`))
+		})
+	})
+
+	Describe("Writing a problem with extensions", func() {
+		It("should add the extensions alongside the standard members", func() {
+			w := httptest.NewRecorder()
+			p := problem.New(http.StatusConflict, "illegal_transition", "")
+			p.Extensions = map[string]interface{}{
+				"allowed_transitions": []string{"submitted"},
+				"code":                "overridden",
+			}
+			p.Write(w, httptest.NewRequest("POST", "/payment/abc/transitions", nil))
+
+			Expect(w.Body.String()).To(MatchJSON(`{
+				"type": "/problems/illegal_transition",
+				"title": "Conflict",
+				"status": 409,
+				"instance": "/payment/abc/transitions",
+				"code": "illegal_transition",
+				"allowed_transitions": ["submitted"]
+			}`))
+		})
+	})
+
+	Describe("A problem handler", func() {
+		It("should always write the problem", func() {
+			w := httptest.NewRecorder()
+			problem.Handler(http.StatusNotFound, "route_not_found", "").ServeHTTP(w, httptest.NewRequest("GET", "/nowhere", nil))
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+			Expect(w.Body.String()).To(ContainSubstring(`"code":"route_not_found"`))
+		})
+	})
+})
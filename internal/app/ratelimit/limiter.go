@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+// Class is the kind of route a request is for, each has its own limit.
+type Class string
+
+const (
+	ClassRead  Class = "read"
+	ClassWrite Class = "write"
+)
+
+// By is who shares a bucket.
+type By string
+
+const (
+	// ByKey gives every API key or token subject its own bucket.
+	ByKey By = "key"
+	// ByOrganisation shares a bucket between everyone acting for the
+	// organisation a request is for.
+	ByOrganisation By = "organisation"
+)
+
+// Duration is a time.Duration written as "1m" or "1s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// Limit lets Requests through every Per, up to Burst of them at once. Burst
+// is Requests when it is left out.
+type Limit struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	Burst    int      `json:"burst,omitempty"`
+}
+
+func (l Limit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// rate is the number of requests let through a second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / time.Duration(l.Per).Seconds()
+}
+
+// Config is the limit of each class of route, a class without one is not
+// limited.
+type Config struct {
+	By     By              `json:"by"`
+	Limits map[Class]Limit `json:"limits"`
+}
+
+// ReadConfig reads the config from a JSON file such as
+// {"by": "organisation", "limits": {"read": {"requests": 600, "per": "1m"}, "write": {"requests": 60, "per": "1m", "burst": 10}}}.
+func ReadConfig(name string) (Config, error) {
+	var c Config
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(bs, &c); err != nil {
+		return c, err
+	}
+	if c.By == "" {
+		c.By = ByKey
+	}
+	if c.By != ByKey && c.By != ByOrganisation {
+		return c, fmt.Errorf("ratelimit: by must be %s or %s", ByKey, ByOrganisation)
+	}
+	for class, l := range c.Limits {
+		if class != ClassRead && class != ClassWrite {
+			return c, fmt.Errorf("ratelimit: there is no class of route '%s'", class)
+		}
+		if l.Requests < 1 || l.Per <= 0 || l.Burst < 0 {
+			return c, fmt.Errorf("ratelimit: the limit of '%s' needs a positive number of requests per a positive duration", class)
+		}
+	}
+	return c, nil
+}
+
+// Result is what taking a request from a bucket left.
+type Result struct {
+	Allowed bool
+	// Limit is the most requests the bucket lets through at once.
+	Limit int
+	// Remaining is the number of requests the bucket still lets through.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is let through, it is
+	// zero when one is let through now.
+	RetryAfter time.Duration
+}
+
+// Limiter keeps a token bucket for each caller and class of route.
+type Limiter struct {
+	mu      sync.Mutex
+	config  Config
+	buckets map[bucketKey]*bucket
+}
+
+type bucketKey struct {
+	class  Class
+	caller string
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func NewLimiter(c Config) *Limiter {
+	return &Limiter{config: c, buckets: make(map[bucketKey]*bucket)}
+}
+
+// Config is the config the limiter is using.
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Reload swaps the config, every bucket starts again full.
+func (l *Limiter) Reload(c Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = c
+	l.buckets = make(map[bucketKey]*bucket)
+}
+
+// Take takes a request from the bucket of the caller for the class, ok is
+// false when the class is not limited.
+func (l *Limiter) Take(caller string, class Class, now time.Time) (result Result, ok bool) {
+	return l.use(caller, class, now, true)
+}
+
+// Peek is what taking a request from the bucket would leave without taking
+// it.
+func (l *Limiter) Peek(caller string, class Class, now time.Time) (result Result, ok bool) {
+	return l.use(caller, class, now, false)
+}
+
+func (l *Limiter) use(caller string, class Class, now time.Time, take bool) (result Result, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, ok := l.config.Limits[class]
+	if !ok {
+		return result, false
+	}
+
+	key := bucketKey{class: class, caller: caller}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: limit.capacity(), at: now}
+		l.buckets[key] = b
+	}
+	b.fill(limit, now)
+
+	result.Allowed = b.tokens >= 1
+	if result.Allowed && take {
+		b.tokens--
+	} else if !result.Allowed {
+		result.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+	result.Limit = int(limit.capacity())
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((limit.capacity() - b.tokens) / limit.rate())
+	return result, true
+}
+
+// Purge forgets the buckets that have filled up again, a caller coming back
+// gets a full one anyway.
+func (l *Limiter) Purge(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		limit, ok := l.config.Limits[key.class]
+		if !ok {
+			delete(l.buckets, key)
+			continue
+		}
+		b.fill(limit, now)
+		if b.tokens >= limit.capacity() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// fill adds the tokens earned since the bucket was last filled.
+func (b *bucket) fill(limit Limit, now time.Time) {
+	if elapsed := now.Sub(b.at).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(limit.capacity(), b.tokens+elapsed*limit.rate())
+		b.at = now
+	}
+}
+
+// seconds rounds up to whole seconds, which is what the headers are in.
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
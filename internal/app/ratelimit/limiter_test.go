@@ -0,0 +1,137 @@
+package ratelimit_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Limiter", func() {
+
+	var (
+		l   *ratelimit.Limiter
+		now time.Time
+	)
+
+	BeforeEach(func() {
+		l = ratelimit.NewLimiter(ratelimit.Config{
+			By: ratelimit.ByKey,
+			Limits: map[ratelimit.Class]ratelimit.Limit{
+				ratelimit.ClassWrite: {Requests: 60, Per: ratelimit.Duration(time.Minute), Burst: 2},
+			},
+		})
+		now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	take := func(caller string, at time.Time) ratelimit.Result {
+		result, ok := l.Take(caller, ratelimit.ClassWrite, at)
+		Expect(ok).To(BeTrue())
+		return result
+	}
+
+	It("should let the burst through and then refuse", func() {
+		Expect(take("alice", now)).To(Equal(ratelimit.Result{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}))
+		Expect(take("alice", now)).To(Equal(ratelimit.Result{Allowed: true, Limit: 2, Remaining: 0, Reset: 2 * time.Second}))
+		Expect(take("alice", now)).To(Equal(ratelimit.Result{Allowed: false, Limit: 2, Remaining: 0, Reset: 2 * time.Second, RetryAfter: time.Second}))
+	})
+
+	It("should fill the bucket back up over time", func() {
+		take("alice", now)
+		take("alice", now)
+		Expect(take("alice", now.Add(500*time.Millisecond)).Allowed).To(BeFalse())
+		Expect(take("alice", now.Add(time.Second)).Allowed).To(BeTrue())
+		Expect(take("alice", now.Add(time.Hour)).Remaining).To(Equal(1))
+	})
+
+	It("should keep a bucket for each caller", func() {
+		take("alice", now)
+		take("alice", now)
+		Expect(take("bob", now).Allowed).To(BeTrue())
+	})
+
+	It("should peek at the bucket without taking from it", func() {
+		take("alice", now)
+		result, ok := l.Peek("alice", ratelimit.ClassWrite, now)
+		Expect(ok).To(BeTrue())
+		Expect(result).To(Equal(ratelimit.Result{Allowed: true, Limit: 2, Remaining: 1, Reset: time.Second}))
+		take("alice", now)
+		result, _ = l.Peek("alice", ratelimit.ClassWrite, now)
+		Expect(result.Allowed).To(BeFalse())
+		Expect(result.RetryAfter).To(Equal(time.Second))
+	})
+
+	It("should not limit a class without a limit", func() {
+		_, ok := l.Take("alice", ratelimit.ClassRead, now)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should start again full when reloaded", func() {
+		take("alice", now)
+		take("alice", now)
+		l.Reload(ratelimit.Config{Limits: map[ratelimit.Class]ratelimit.Limit{
+			ratelimit.ClassWrite: {Requests: 10, Per: ratelimit.Duration(time.Second)},
+		}})
+		Expect(take("alice", now)).To(Equal(ratelimit.Result{Allowed: true, Limit: 10, Remaining: 9, Reset: time.Second}))
+	})
+
+	It("should forget full buckets when purged", func() {
+		take("alice", now)
+		l.Purge(now.Add(time.Minute))
+		Expect(take("alice", now.Add(time.Minute)).Remaining).To(Equal(1))
+	})
+
+	Describe("Reading the config", func() {
+		var dir string
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "ratelimit")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		givenConfigFile := func(content string) string {
+			name := filepath.Join(dir, "rate-limits.json")
+			Expect(ioutil.WriteFile(name, []byte(content), 0600)).To(Succeed())
+			return name
+		}
+
+		It("should read the limit of each class", func() {
+			c, err := ratelimit.ReadConfig(givenConfigFile(`{"by": "organisation", "limits": {"read": {"requests": 600, "per": "1m"}, "write": {"requests": 60, "per": "1m", "burst": 10}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c).To(Equal(ratelimit.Config{
+				By: ratelimit.ByOrganisation,
+				Limits: map[ratelimit.Class]ratelimit.Limit{
+					ratelimit.ClassRead:  {Requests: 600, Per: ratelimit.Duration(time.Minute)},
+					ratelimit.ClassWrite: {Requests: 60, Per: ratelimit.Duration(time.Minute), Burst: 10},
+				},
+			}))
+		})
+
+		It("should limit by key when not told", func() {
+			c, err := ratelimit.ReadConfig(givenConfigFile(`{"limits": {}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(c.By).To(Equal(ratelimit.ByKey))
+		})
+
+		It("should refuse what it cannot limit", func() {
+			for _, content := range []string{
+				`{"by": "address"}`,
+				`{"limits": {"delete": {"requests": 1, "per": "1s"}}}`,
+				`{"limits": {"write": {"requests": 0, "per": "1s"}}}`,
+				`{"limits": {"write": {"requests": 1, "per": "soon"}}}`,
+				`not json`,
+			} {
+				_, err := ratelimit.ReadConfig(givenConfigFile(content))
+				Expect(err).Should(HaveOccurred(), content)
+			}
+		})
+	})
+})
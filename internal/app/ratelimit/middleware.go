@@ -0,0 +1,248 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	LimitHeader     = "RateLimit-Limit"
+	RemainingHeader = "RateLimit-Remaining"
+	ResetHeader     = "RateLimit-Reset"
+	RetryHeader     = "Retry-After"
+)
+
+// Owner is the organisation of what a request that names none is about, like
+// the payment of a route with its id, or "" when there is none.
+type Owner func(r *http.Request) string
+
+// Middleware lets a request through while the bucket of its caller for the
+// class of route has some left, and sends a 429 problem once it is empty.
+// The RateLimit headers say how much is left on every limited response. It
+// has to come after authentication to tell callers apart, unauthenticated
+// requests are told apart by address. A request for several organisations
+// is taken from the bucket of each, the owner, which can be nil, is only
+// asked when limiting by organisation.
+func Middleware(l *Limiter, owner Owner) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				class, now = ClassOf(r), time.Now()
+				tightest   *Result
+			)
+			for _, c := range callers(r, l.Config().By, owner) {
+				result, ok := l.Take(c, class, now)
+				if !ok {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if tightest == nil || tightest.Allowed && (!result.Allowed || result.Remaining < tightest.Remaining) {
+					tightest = &result
+				}
+			}
+			if !limited(w, r, *tightest) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// FailedAuthentication wraps the authentication middleware so that requests
+// failing it are limited by address, otherwise keys could be guessed as fast
+// as the server answers. Only requests authentication turns away are taken
+// from the bucket of their address, once it is empty authentication is not
+// tried until it fills again.
+func FailedAuthentication(l *Limiter, authenticate func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			address, class := "address:"+host(r), ClassOf(r)
+			if result, ok := l.Peek(address, class, time.Now()); ok && !result.Allowed {
+				limited(w, r, result)
+				return
+			}
+
+			authenticated := false
+			authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authenticated = true
+				next.ServeHTTP(w, r)
+			})).ServeHTTP(w, r)
+			if !authenticated {
+				l.Take(address, class, time.Now())
+			}
+		})
+	}
+}
+
+// limited sets the RateLimit headers, when the result is not allowed it also
+// sends a 429 problem and is true.
+func limited(w http.ResponseWriter, r *http.Request, result Result) bool {
+	w.Header().Set(LimitHeader, strconv.Itoa(result.Limit))
+	w.Header().Set(RemainingHeader, strconv.Itoa(result.Remaining))
+	w.Header().Set(ResetHeader, strconv.Itoa(int(result.Reset.Seconds())))
+	if result.Allowed {
+		return false
+	}
+	retry := int(result.RetryAfter.Seconds())
+	w.Header().Set(RetryHeader, strconv.Itoa(retry))
+	problem.New(http.StatusTooManyRequests, "rate_limited", fmt.Sprintf("too many requests, try again in %d seconds", retry)).Write(w, r)
+	return true
+}
+
+// ClassOf is the class of route of the request, anything that can change a
+// payment is a write.
+func ClassOf(r *http.Request) Class {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ClassRead
+	default:
+		return ClassWrite
+	}
+}
+
+// callers are the buckets the request is taken from, there is always one.
+func callers(r *http.Request, by By, owner Owner) []string {
+	id, ok := auth.FromContext(r.Context())
+	if !ok {
+		return []string{"address:" + host(r)}
+	}
+	if by == ByOrganisation {
+		if organisationIds, ok := organisations(r, id, owner); ok {
+			buckets := make([]string, len(organisationIds))
+			for i, organisationId := range organisationIds {
+				buckets[i] = "organisation:" + organisationId
+			}
+			return buckets
+		}
+	}
+	return []string{"key:" + id.Subject}
+}
+
+func host(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// organisations are the organisations the request is for, the
+// organisation_id of the query or else of the JSON body, or of every payment
+// in the data of a batch. A request that names none is for the organisation
+// of its owner, or else of an identity acting for just one. One naming an
+// organisation the identity does not act for is for none, it cannot use up
+// the limit of others, and so is one with a body too big to look into.
+func organisations(r *http.Request, id auth.Identity, owner Owner) ([]string, bool) {
+	var organisationIds []string
+	if organisationId := r.URL.Query().Get("organisation_id"); organisationId != "" {
+		organisationIds = []string{organisationId}
+	} else {
+		var ok bool
+		if organisationIds, ok = bodyOrganisations(r); !ok {
+			return nil, false
+		}
+	}
+	if len(organisationIds) == 0 && owner != nil {
+		if organisationId := owner(r); organisationId != "" {
+			organisationIds = []string{organisationId}
+		}
+	}
+	if len(organisationIds) == 0 && len(id.OrganisationIds) == 1 {
+		organisationIds = id.OrganisationIds
+	}
+	for _, organisationId := range organisationIds {
+		if !id.ActsFor(organisationId) {
+			return nil, false
+		}
+	}
+	return organisationIds, len(organisationIds) > 0
+}
+
+// maxPeek is how much of a body is read looking for its organisations.
+const maxPeek = 64 << 10
+
+// bodyOrganisations reads the organisation_id of a JSON object body, or of
+// every object in its data, reading no more of it than up to them. It is not
+// ok when they are not in the first maxPeek bytes of a body longer than that.
+// The body is left to be read again by the handler.
+func bodyOrganisations(r *http.Request) ([]string, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	var read bytes.Buffer
+	defer func(body io.ReadCloser) {
+		r.Body = replayedBody{Reader: io.MultiReader(&read, body), Closer: body}
+	}(r.Body)
+
+	decoder := json.NewDecoder(io.TeeReader(io.LimitReader(r.Body, maxPeek+1), &read))
+	organisationIds, err := findOrganisations(decoder)
+	if err != nil && read.Len() > maxPeek {
+		return nil, false
+	}
+	return organisationIds, true
+}
+
+// findOrganisations decodes the members of an object until it comes to
+// organisation_id or data.
+func findOrganisations(decoder *json.Decoder) ([]string, error) {
+	if t, err := decoder.Token(); err != nil || t != json.Delim('{') {
+		return nil, err
+	}
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case "organisation_id":
+			var organisationId string
+			if err = decoder.Decode(&organisationId); err != nil || organisationId == "" {
+				return nil, err
+			}
+			return []string{organisationId}, nil
+		case "data":
+			var data []organised
+			if err = decoder.Decode(&data); err != nil {
+				return nil, err
+			}
+			return distinct(data), nil
+		}
+		var skipped json.RawMessage
+		if err = decoder.Decode(&skipped); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// organised is anything with an organisation.
+type organised struct {
+	OrganisationId string `json:"organisation_id"`
+}
+
+// distinct are the organisations of the data, each once.
+func distinct(data []organised) []string {
+	var (
+		organisationIds []string
+		seen            = make(map[string]bool)
+	)
+	for _, d := range data {
+		if d.OrganisationId != "" && !seen[d.OrganisationId] {
+			seen[d.OrganisationId] = true
+			organisationIds = append(organisationIds, d.OrganisationId)
+		}
+	}
+	return organisationIds
+}
+
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
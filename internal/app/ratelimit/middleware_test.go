@@ -0,0 +1,254 @@
+package ratelimit_test
+
+import (
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/carlosroman/payments-api/internal/app/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+var _ = Describe("Middleware", func() {
+
+	var (
+		calls int
+		l     *ratelimit.Limiter
+		h     http.Handler
+	)
+
+	BeforeEach(func() {
+		calls = 0
+		l = ratelimit.NewLimiter(ratelimit.Config{
+			By: ratelimit.ByKey,
+			Limits: map[ratelimit.Class]ratelimit.Limit{
+				ratelimit.ClassWrite: {Requests: 1, Per: ratelimit.Duration(time.Hour)},
+			},
+		})
+		h = ratelimit.Middleware(l, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusCreated)
+		}))
+	})
+
+	sendTo := func(method string, target string, body string, id *auth.Identity) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if id != nil {
+			req = req.WithContext(auth.NewContext(req.Context(), *id))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	send := func(method string, id *auth.Identity) *httptest.ResponseRecorder {
+		return sendTo(method, "/payment", "", id)
+	}
+
+	It("should say what is left of the limit", func() {
+		w := send("POST", nil)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(w.Header().Get(ratelimit.LimitHeader)).To(Equal("1"))
+		Expect(w.Header().Get(ratelimit.RemainingHeader)).To(Equal("0"))
+		Expect(w.Header().Get(ratelimit.ResetHeader)).To(Equal("3600"))
+	})
+
+	It("should refuse requests over the limit with a problem", func() {
+		send("POST", nil)
+		w := send("POST", nil)
+		Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(w.Header().Get(ratelimit.RetryHeader)).To(Equal("3600"))
+		var p problem.Problem
+		Expect(json.NewDecoder(w.Body).Decode(&p)).To(Succeed())
+		Expect(p.Code).To(Equal("rate_limited"))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should not limit the routes without a limit", func() {
+		send("POST", nil)
+		w := send("GET", nil)
+		Expect(w.Code).To(Equal(http.StatusCreated))
+		Expect(w.Header().Get(ratelimit.LimitHeader)).To(BeEmpty())
+	})
+
+	It("should keep a bucket for each key", func() {
+		Expect(send("POST", &auth.Identity{Subject: "alice", OrganisationIds: []string{"org"}}).Code).To(Equal(http.StatusCreated))
+		Expect(send("POST", &auth.Identity{Subject: "bob", OrganisationIds: []string{"org"}}).Code).To(Equal(http.StatusCreated))
+		Expect(send("POST", &auth.Identity{Subject: "alice", OrganisationIds: []string{"org"}}).Code).To(Equal(http.StatusTooManyRequests))
+	})
+
+	Describe("limiting by organisation", func() {
+		var (
+			alice = &auth.Identity{Subject: "alice", OrganisationIds: []string{"a", "b"}}
+			bob   = &auth.Identity{Subject: "bob", OrganisationIds: []string{"b"}}
+		)
+
+		BeforeEach(func() {
+			config := l.Config()
+			config.By = ratelimit.ByOrganisation
+			l.Reload(config)
+		})
+
+		It("should share a bucket for the organisation in the query", func() {
+			Expect(sendTo("POST", "/payments?organisation_id=b", "", alice).Code).To(Equal(http.StatusCreated))
+			Expect(sendTo("POST", "/payments?organisation_id=a", "", alice).Code).To(Equal(http.StatusCreated))
+			Expect(sendTo("POST", "/payments?organisation_id=b", "", bob).Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should share a bucket for the organisation in the body and leave the body to be read", func() {
+			var body []byte
+			h = ratelimit.Middleware(l, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			Expect(sendTo("POST", "/payment", `{"organisation_id":"b"}`, alice).Code).To(Equal(http.StatusCreated))
+			Expect(string(body)).To(Equal(`{"organisation_id":"b"}`))
+			Expect(sendTo("POST", "/payment", `{"organisation_id":"a"}`, alice).Code).To(Equal(http.StatusCreated))
+			Expect(sendTo("POST", "/payment", `{"organisation_id":"b"}`, bob).Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		Describe("with a body too big to read all of", func() {
+			var (
+				body    []byte
+				padding = strings.Repeat("x", 1<<20)
+			)
+
+			BeforeEach(func() {
+				h = ratelimit.Middleware(l, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ = ioutil.ReadAll(r.Body)
+					w.WriteHeader(http.StatusCreated)
+				}))
+			})
+
+			It("should stop reading once it has the organisation", func() {
+				sent := `{"organisation_id":"b","padding":"` + padding + `"}`
+				counted := &countingReader{Reader: strings.NewReader(sent)}
+				var peeked int
+				h = ratelimit.Middleware(l, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					peeked = counted.n
+					body, _ = ioutil.ReadAll(r.Body)
+					w.WriteHeader(http.StatusCreated)
+				}))
+				req := httptest.NewRequest("POST", "/payment", counted)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req.WithContext(auth.NewContext(req.Context(), *alice)))
+
+				Expect(w.Code).To(Equal(http.StatusCreated))
+				Expect(peeked).To(BeNumerically("<=", 64<<10))
+				Expect(string(body)).To(Equal(sent))
+				Expect(sendTo("POST", "/payment", `{"organisation_id":"b"}`, bob).Code).To(Equal(http.StatusTooManyRequests))
+			})
+
+			It("should keep the caller to its own bucket when the organisation comes too late", func() {
+				sent := `{"padding":"` + padding + `","organisation_id":"b"}`
+				Expect(sendTo("POST", "/payment", sent, alice).Code).To(Equal(http.StatusCreated))
+				Expect(string(body)).To(Equal(sent))
+				Expect(sendTo("POST", "/payment", `{"organisation_id":"b"}`, bob).Code).To(Equal(http.StatusCreated))
+				Expect(sendTo("POST", "/payment", `{"organisation_id":"a"}`, alice).Code).To(Equal(http.StatusCreated))
+				Expect(sendTo("POST", "/payment", sent, alice).Code).To(Equal(http.StatusTooManyRequests))
+			})
+		})
+
+		It("should take a batch from the bucket of every organisation in its data", func() {
+			Expect(sendTo("POST", "/payments", `{"data":[{"organisation_id":"a"},{"organisation_id":"b"},{"organisation_id":"a"}]}`, alice).Code).To(Equal(http.StatusCreated))
+			Expect(sendTo("POST", "/payments", `{"data":[{"organisation_id":"b"}]}`, bob).Code).To(Equal(http.StatusTooManyRequests))
+			Expect(sendTo("POST", "/payments?organisation_id=a", "", alice).Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should take a request naming no organisation from the bucket of its owner", func() {
+			h = ratelimit.Middleware(l, func(r *http.Request) string {
+				return strings.TrimPrefix(r.URL.Path, "/payment/")
+			})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			Expect(sendTo("PATCH", "/payment/b", "", alice).Code).To(Equal(http.StatusOK))
+			Expect(sendTo("PATCH", "/payment/a", "", alice).Code).To(Equal(http.StatusOK))
+			Expect(sendTo("DELETE", "/payment/b", "", bob).Code).To(Equal(http.StatusTooManyRequests))
+			Expect(sendTo("PATCH", "/payment/m", "", alice).Code).To(Equal(http.StatusOK))
+			Expect(sendTo("PATCH", "/payment/m", "", alice).Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should take the organisation of a caller acting for one when the request names none", func() {
+			Expect(sendTo("POST", "/payment", `{"organisation_id":"b"}`, alice).Code).To(Equal(http.StatusCreated))
+			Expect(send("POST", bob).Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should not use up the limit of an organisation the caller does not act for", func() {
+			Expect(sendTo("POST", "/payments?organisation_id=b", "", &auth.Identity{Subject: "mallory", OrganisationIds: []string{"m"}}).Code).To(Equal(http.StatusCreated))
+			Expect(sendTo("POST", "/payments?organisation_id=b", "", bob).Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should keep a caller acting for many organisations to its own bucket when the request names none", func() {
+			Expect(send("POST", alice).Code).To(Equal(http.StatusCreated))
+			Expect(send("POST", bob).Code).To(Equal(http.StatusCreated))
+			Expect(send("POST", alice).Code).To(Equal(http.StatusTooManyRequests))
+		})
+	})
+
+	Describe("limiting failed authentication", func() {
+		var authenticated int
+
+		BeforeEach(func() {
+			authenticated = 0
+			authenticate := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Header.Get("Authorization") != "Bearer good" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					authenticated++
+					next.ServeHTTP(w, r)
+				})
+			}
+			h = ratelimit.FailedAuthentication(l, authenticate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(http.StatusCreated)
+			}))
+		})
+
+		sendWith := func(token string, address string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/payment", nil)
+			req.RemoteAddr = address + ":1234"
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			return w
+		}
+
+		It("should count failed requests by address and stop trying once over the limit", func() {
+			Expect(sendWith("bad", "10.0.0.1").Code).To(Equal(http.StatusUnauthorized))
+			w := sendWith("bad", "10.0.0.1")
+			Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(w.Header().Get(ratelimit.RetryHeader)).To(Equal("3600"))
+			Expect(sendWith("good", "10.0.0.1").Code).To(Equal(http.StatusTooManyRequests))
+			Expect(authenticated).To(BeZero())
+
+			Expect(sendWith("bad", "10.0.0.2").Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not count requests that are authenticated", func() {
+			Expect(sendWith("good", "10.0.0.1").Code).To(Equal(http.StatusCreated))
+			Expect(sendWith("good", "10.0.0.1").Code).To(Equal(http.StatusCreated))
+			Expect(sendWith("bad", "10.0.0.1").Code).To(Equal(http.StatusUnauthorized))
+			Expect(calls).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,38 @@
+package requestid
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"regexp"
+)
+
+const Header = "X-Request-Id"
+
+type contextKey struct{}
+
+// valid stops callers putting anything they like into our logs and responses.
+var valid = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Middleware gives every request an id, using the one sent by the caller when
+// there is one. The id is sent back in the response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the id of the request, or empty if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
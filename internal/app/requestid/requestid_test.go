@@ -0,0 +1,53 @@
+package requestid_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/requestid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Middleware", func() {
+
+	var (
+		actual string
+		h      http.Handler
+	)
+
+	BeforeEach(func() {
+		actual = ""
+		h = requestid.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actual = requestid.FromContext(r.Context())
+		}))
+	})
+
+	Context("when the caller sends an id", func() {
+		It("should use it", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(requestid.Header, "abc-123")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			Expect(actual).To(Equal("abc-123"))
+			Expect(w.Header().Get(requestid.Header)).To(Equal("abc-123"))
+		})
+
+		It("should replace it if it is not safe", func() {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(requestid.Header, "<script>")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			Expect(actual).ToNot(Equal("<script>"))
+			Expect(actual).ToNot(BeEmpty())
+		})
+	})
+
+	Context("when the caller does not send an id", func() {
+		It("should generate one", func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			Expect(actual).ToNot(BeEmpty())
+			Expect(w.Header().Get(requestid.Header)).To(Equal(actual))
+		})
+	})
+})
@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it fails for
+	// good.
+	MaxAttempts = 8
+	// FirstRetry is how long after the first failed attempt the delivery is
+	// tried again, the wait doubles with each attempt after it.
+	FirstRetry = 30 * time.Second
+
+	// claimFor is how long a delivery is held by the server sending it, it is
+	// tried again after that if the server stopped before it was done.
+	claimFor  = time.Minute
+	batchSize = 100
+	userAgent = "payments-api-webhooks"
+)
+
+// NewDispatcher sends the events of payments to the subscriptions of their
+// organisation. A subscription is disabled once disableAfter attempts in a
+// row have failed.
+func NewDispatcher(store Store, client *http.Client, disableAfter int) *Dispatcher {
+	return &Dispatcher{store: store, client: client, disableAfter: disableAfter}
+}
+
+// Dispatcher is the outbox.Sink of webhooks. Publishing an event only
+// enqueues its deliveries, Deliver sends them and retries the ones that fail
+// with exponential backoff.
+type Dispatcher struct {
+	store        Store
+	client       *http.Client
+	disableAfter int
+}
+
+// Publish adds a delivery of each event to every enabled subscription of the
+// organisation of its payment that wants events of its type.
+func (d *Dispatcher) Publish(ctx context.Context, events []outbox.Event) error {
+	now := time.Now().UTC()
+	subscriptions := make(map[string][]Subscription)
+	var deliveries []Delivery
+	for _, e := range events {
+		var payment struct {
+			OrganisationId string `json:"organisation_id"`
+		}
+		if err := json.Unmarshal(e.Data, &payment); err != nil {
+			return err
+		}
+
+		subs, ok := subscriptions[payment.OrganisationId]
+		if !ok {
+			var err error
+			if subs, err = d.store.List(ctx, payment.OrganisationId); err != nil {
+				return err
+			}
+			subscriptions[payment.OrganisationId] = subs
+		}
+
+		for _, s := range subs {
+			if !s.Enabled || !s.wants(e.Type) {
+				continue
+			}
+			next := now
+			deliveries = append(deliveries, Delivery{
+				Id:             uuid.NewV4().String(),
+				SubscriptionId: s.Id,
+				Event:          e,
+				Status:         DeliveryPending,
+				NextAttemptAt:  &next,
+				CreatedAt:      now,
+			})
+		}
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return d.store.Enqueue(ctx, deliveries)
+}
+
+// Run sends the deliveries that are due every interval until the context is
+// done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	for {
+		n, err := d.Deliver(ctx, time.Now().UTC())
+		wait := interval
+		if err != nil {
+			log.Errorf("Failed to send webhook deliveries: %s", err)
+		} else if n == batchSize {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Deliver makes an attempt at each delivery due by now and returns how many
+// it made.
+func (d *Dispatcher) Deliver(ctx context.Context, now time.Time) (int, error) {
+	deliveries, err := d.store.Claim(ctx, now, now.Add(claimFor), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	attempts := 0
+	subscriptions := make(map[string]Subscription)
+	for _, delivery := range deliveries {
+		s, ok := subscriptions[delivery.SubscriptionId]
+		if !ok {
+			if s, err = d.store.Get(ctx, delivery.SubscriptionId); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return attempts, err
+			}
+			subscriptions[s.Id] = s
+		}
+		if !s.Enabled {
+			// Disabled by an earlier delivery of the batch, the rest wait
+			// for it to be enabled again.
+			continue
+		}
+
+		result := d.attempt(ctx, s, delivery, now)
+		attempts++
+		if err = d.store.Attempted(ctx, delivery.Id, result, d.disableAfter); err != nil {
+			return attempts, err
+		}
+		if result.Status == DeliverySucceeded {
+			s.Failures = 0
+		} else {
+			log.Warnf("Webhook delivery '%s' to '%s' failed on attempt %d: status %d %s",
+				delivery.Id, s.URL, len(delivery.Attempts)+1, result.Attempt.StatusCode, result.Attempt.Error)
+			s.Failures++
+			if s.Failures >= d.disableAfter {
+				log.Warnf("Disabled webhook subscription '%s' after %d failures in a row", s.Id, s.Failures)
+				s.Enabled = false
+			}
+		}
+		subscriptions[s.Id] = s
+	}
+	return attempts, nil
+}
+
+// attempt posts the event signed with the secret of the subscription, any
+// response other than 2xx is a failure. The delivery is tried again after
+// backing off until it has had MaxAttempts.
+func (d *Dispatcher) attempt(ctx context.Context, s Subscription, delivery Delivery, now time.Time) Result {
+	result := Result{Attempt: Attempt{At: now}, Status: DeliverySucceeded}
+	status, err := d.post(ctx, s, delivery, now)
+	result.Attempt.StatusCode = status
+	if err == nil && (status < 200 || status > 299) {
+		err = errors.New(http.StatusText(status))
+	}
+	if err == nil {
+		return result
+	}
+
+	result.Attempt.Error = err.Error()
+	attempts := len(delivery.Attempts) + 1
+	if attempts >= MaxAttempts {
+		result.Status = DeliveryFailed
+		return result
+	}
+	next := now.Add(FirstRetry << uint(attempts-1))
+	result.Status, result.NextAttemptAt = DeliveryPending, &next
+	return result
+}
+
+func (d *Dispatcher) post(ctx context.Context, s Subscription, delivery Delivery, now time.Time) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(IdHeader, delivery.Id)
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(SignatureHeader, Sign(s.Secret, now, body))
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,189 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/carlosroman/payments-api/internal/app/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Dispatcher", func() {
+
+	var (
+		ctx      context.Context
+		store    webhook.Store
+		receiver *httptest.Server
+		mu       sync.Mutex
+		received []*http.Request
+		bodies   [][]byte
+		status   int
+		d        *webhook.Dispatcher
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		store = webhook.NewMemoryStore()
+		received, bodies, status = nil, nil, http.StatusNoContent
+		receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			mu.Lock()
+			defer mu.Unlock()
+			received, bodies = append(received, r), append(bodies, body)
+			w.WriteHeader(status)
+		}))
+		d = webhook.NewDispatcher(store, receiver.Client(), 3)
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	givenEvent := func(sequence int64, eventType string, organisationId string) outbox.Event {
+		return outbox.Event{
+			Sequence: sequence,
+			Type:     eventType,
+			Subject:  "some id",
+			At:       time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC),
+			Data:     json.RawMessage(`{"id":"some id","organisation_id":"` + organisationId + `"}`),
+		}
+	}
+
+	givenSubscribed := func(id string, organisationId string, events ...string) webhook.Subscription {
+		s := givenSubscription(id, organisationId, receiver.URL, time.Now().UTC())
+		s.Events = events
+		Expect(store.Create(ctx, s)).To(Succeed())
+		return s
+	}
+
+	deliveriesOf := func(id string) []webhook.Delivery {
+		deliveries, err := store.Deliveries(ctx, id, 100)
+		Expect(err).ShouldNot(HaveOccurred())
+		return deliveries
+	}
+
+	It("should only deliver to enabled subscriptions of the organisation that want the event", func() {
+		givenSubscribed("every-event", "org")
+		givenSubscribed("status-only", "org", "payment.status_changed")
+		givenSubscribed("other-org", "other org")
+		disabled := givenSubscribed("disabled", "org")
+		disabled.Enabled = false
+		Expect(store.Create(ctx, disabled)).To(Succeed())
+
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(1, "payment.created", "org"), givenEvent(2, "payment.status_changed", "org")})).To(Succeed())
+
+		Expect(deliveriesOf("every-event")).To(HaveLen(2))
+		Expect(deliveriesOf("status-only")).To(HaveLen(1))
+		Expect(deliveriesOf("status-only")[0].Event.Sequence).To(Equal(int64(2)))
+		Expect(deliveriesOf("other-org")).To(BeEmpty())
+		Expect(deliveriesOf("disabled")).To(BeEmpty())
+	})
+
+	It("should post the event signed with the secret of the subscription", func() {
+		givenSubscribed("sub-1", "org")
+		event := givenEvent(1, "payment.created", "org")
+		Expect(d.Publish(ctx, []outbox.Event{event})).To(Succeed())
+
+		now := time.Now().UTC()
+		Expect(d.Deliver(ctx, now)).To(Equal(1))
+
+		Expect(received).To(HaveLen(1))
+		r, body := received[0], bodies[0]
+		Expect(r.Method).To(Equal(http.MethodPost))
+		Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(r.Header.Get(webhook.EventHeader)).To(Equal("payment.created"))
+		Expect(webhook.Verify("secret", r.Header.Get(webhook.SignatureHeader), body, now, time.Minute)).To(Succeed())
+		var sent outbox.Event
+		Expect(json.Unmarshal(body, &sent)).To(Succeed())
+		Expect(sent).To(Equal(event))
+
+		deliveries := deliveriesOf("sub-1")
+		Expect(r.Header.Get(webhook.IdHeader)).To(Equal(deliveries[0].Id))
+		Expect(deliveries[0].Status).To(Equal(webhook.DeliverySucceeded))
+		Expect(deliveries[0].Attempts).To(Equal([]webhook.Attempt{{At: now, StatusCode: http.StatusNoContent}}))
+		Expect(d.Deliver(ctx, now.Add(time.Hour))).To(BeZero())
+	})
+
+	It("should retry a failed delivery with exponential backoff", func() {
+		givenSubscribed("sub-1", "org")
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(1, "payment.created", "org")})).To(Succeed())
+		status = http.StatusServiceUnavailable
+		now := time.Now().UTC()
+
+		Expect(d.Deliver(ctx, now)).To(Equal(1))
+		delivery := deliveriesOf("sub-1")[0]
+		Expect(delivery.Status).To(Equal(webhook.DeliveryPending))
+		Expect(delivery.Attempts[0].StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(delivery.Attempts[0].Error).To(Equal("Service Unavailable"))
+		Expect(*delivery.NextAttemptAt).To(Equal(now.Add(webhook.FirstRetry)))
+
+		Expect(d.Deliver(ctx, now.Add(webhook.FirstRetry-time.Second))).To(BeZero())
+		Expect(d.Deliver(ctx, now.Add(webhook.FirstRetry))).To(Equal(1))
+		Expect(*deliveriesOf("sub-1")[0].NextAttemptAt).To(Equal(now.Add(3 * webhook.FirstRetry)))
+
+		status = http.StatusOK
+		Expect(d.Deliver(ctx, now.Add(3*webhook.FirstRetry))).To(Equal(1))
+		delivery = deliveriesOf("sub-1")[0]
+		Expect(delivery.Status).To(Equal(webhook.DeliverySucceeded))
+		Expect(delivery.Attempts).To(HaveLen(3))
+		Expect(received).To(HaveLen(3))
+	})
+
+	It("should give up on a delivery after the last attempt", func() {
+		d = webhook.NewDispatcher(store, receiver.Client(), 100)
+		givenSubscribed("sub-1", "org")
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(1, "payment.created", "org")})).To(Succeed())
+		status = http.StatusInternalServerError
+
+		now := time.Now().UTC()
+		for i := 0; i < webhook.MaxAttempts; i++ {
+			Expect(d.Deliver(ctx, now)).To(Equal(1))
+			now = now.Add(24 * time.Hour)
+		}
+		Expect(d.Deliver(ctx, now)).To(BeZero())
+
+		delivery := deliveriesOf("sub-1")[0]
+		Expect(delivery.Status).To(Equal(webhook.DeliveryFailed))
+		Expect(delivery.Attempts).To(HaveLen(webhook.MaxAttempts))
+		Expect(delivery.NextAttemptAt).To(BeNil())
+	})
+
+	It("should disable a subscription after too many failures in a row", func() {
+		givenSubscribed("sub-1", "org")
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(1, "payment.created", "org"), givenEvent(2, "payment.updated", "org")})).To(Succeed())
+		status = http.StatusInternalServerError
+
+		now := time.Now().UTC()
+		Expect(d.Deliver(ctx, now)).To(Equal(2))
+		Expect(d.Deliver(ctx, now.Add(time.Hour))).To(Equal(1))
+
+		s, err := store.Get(ctx, "sub-1")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(s.Enabled).To(BeFalse())
+		Expect(s.Failures).To(Equal(3))
+		Expect(d.Deliver(ctx, now.Add(2*time.Hour))).To(BeZero())
+
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(3, "payment.updated", "org")})).To(Succeed())
+		Expect(deliveriesOf("sub-1")).To(HaveLen(2))
+	})
+
+	It("should keep trying when the receiver cannot be reached", func() {
+		givenSubscribed("sub-1", "org")
+		Expect(d.Publish(ctx, []outbox.Event{givenEvent(1, "payment.created", "org")})).To(Succeed())
+		receiver.Close()
+
+		Expect(d.Deliver(ctx, time.Now().UTC())).To(Equal(1))
+		delivery := deliveriesOf("sub-1")[0]
+		Expect(delivery.Status).To(Equal(webhook.DeliveryPending))
+		Expect(delivery.Attempts[0].StatusCode).To(BeZero())
+		Expect(delivery.Attempts[0].Error).ToNot(BeEmpty())
+	})
+})
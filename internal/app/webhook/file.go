@@ -0,0 +1,296 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NewFileStore keeps subscriptions and deliveries in memory and makes every
+// change durable in an append-only log first, so they outlive a restart of a
+// server without a database. On opening the log is replayed, a line left half
+// written by a crash is dropped. Claims are not logged, a delivery claimed
+// when the server stopped is due again once it starts. The log is written
+// again with only what is kept once most of it is of changes overtaken.
+func NewFileStore(name string) (Store, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), name: name}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.log = f
+	return s, nil
+}
+
+type fileStore struct {
+	*memoryStore
+	// mu keeps the log in the order the changes are made in memory.
+	mu   sync.Mutex
+	name string
+	log  *os.File
+	// entries is how many lines the log has.
+	entries int
+	// broken is why the log cannot be written to any more, a write failed
+	// and what it left could not be cut off.
+	broken error
+}
+
+// entry is a line of the log, a subscription created, enabled or deleted,
+// deliveries enqueued or an attempt at one.
+type entry struct {
+	Op           string        `json:"op"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+	// Pruned is the latest event of a delivery of the subscription dropped
+	// when the log was last written again.
+	Pruned        int64          `json:"pruned,omitempty"`
+	Id            string         `json:"id,omitempty"`
+	Deliveries    []Delivery     `json:"deliveries,omitempty"`
+	Attempt       *Attempt       `json:"attempt,omitempty"`
+	Status        DeliveryStatus `json:"status,omitempty"`
+	NextAttemptAt *time.Time     `json:"next_attempt_at,omitempty"`
+	DisableAfter  int            `json:"disable_after,omitempty"`
+}
+
+// minCompact is how many lines the log has before it is worth compacting.
+const minCompact = 1000
+
+const (
+	opCreate    = "create"
+	opEnable    = "enable"
+	opDelete    = "delete"
+	opEnqueue   = "enqueue"
+	opAttempted = "attempted"
+)
+
+func (s *fileStore) replay() error {
+	f, err := os.OpenFile(s.name, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		reader = bufio.NewReader(f)
+		offset int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var e entry
+		if line[len(line)-1] != '\n' || json.Unmarshal(line, &e) != nil {
+			log.Warnf("Dropping the torn end of '%s' from offset %d", s.name, offset)
+			if err = f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		s.apply(e)
+		offset += int64(len(line))
+		s.entries++
+	}
+}
+
+// apply makes the change of the entry in memory, the memory store skips one
+// of a subscription it does not have like it did when it was logged.
+func (s *fileStore) apply(e entry) {
+	ctx := context.Background()
+	switch e.Op {
+	case opCreate:
+		if e.Subscription == nil {
+			return
+		}
+		s.memoryStore.Create(ctx, *e.Subscription)
+		s.memoryStore.mu.Lock()
+		s.bySubscription[e.Subscription.Id].pruned = e.Pruned
+		s.memoryStore.mu.Unlock()
+	case opEnable:
+		s.memoryStore.Enable(ctx, e.Id)
+	case opDelete:
+		s.memoryStore.Delete(ctx, e.Id)
+	case opEnqueue:
+		s.memoryStore.Enqueue(ctx, e.Deliveries)
+	case opAttempted:
+		if e.Attempt == nil {
+			return
+		}
+		s.memoryStore.Attempted(ctx, e.Id, Result{Attempt: *e.Attempt, Status: e.Status, NextAttemptAt: e.NextAttemptAt}, e.DisableAfter)
+	}
+}
+
+// append writes the entries to the log and syncs it, the lock must be held.
+// A write that fails is cut off the log, the replay stops at the first bad
+// line so one left there would lose every line written after it. When it
+// cannot be cut off the log takes no more writes.
+func (s *fileStore) append(entries ...entry) error {
+	if s.broken != nil {
+		return s.broken
+	}
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.log.Write(buf)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		if cutErr := s.log.Truncate(info.Size()); cutErr != nil {
+			s.broken = fmt.Errorf("webhook: '%s' takes no more writes, a failed write could not be cut off: %s", s.name, cutErr)
+			log.Error(s.broken)
+		}
+		return err
+	}
+	s.entries += len(entries)
+	return nil
+}
+
+// write logs the entry and makes its change in memory, the lock must be
+// held. Once the log has more than four lines for everything kept it is
+// written again, a failure to is only logged as the change is already made.
+func (s *fileStore) write(e entry) error {
+	if err := s.append(e); err != nil {
+		return err
+	}
+	s.apply(e)
+
+	s.memoryStore.mu.Lock()
+	defer s.memoryStore.mu.Unlock()
+	if s.entries <= minCompact || s.entries <= 4*(len(s.subscriptions)+len(s.deliveries)) {
+		return nil
+	}
+	if err := s.compact(); err != nil {
+		log.Errorf("Could not compact '%s': %s", s.name, err)
+	}
+	return nil
+}
+
+func (s *fileStore) Create(ctx context.Context, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(entry{Op: opCreate, Subscription: &sub})
+}
+
+func (s *fileStore) Enable(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.memoryStore.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.write(entry{Op: opEnable, Id: id})
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.memoryStore.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.write(entry{Op: opDelete, Id: id})
+}
+
+func (s *fileStore) Enqueue(ctx context.Context, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(entry{Op: opEnqueue, Deliveries: deliveries})
+}
+
+func (s *fileStore) Attempted(ctx context.Context, deliveryId string, result Result, disableAfter int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(entry{
+		Op:            opAttempted,
+		Id:            deliveryId,
+		Attempt:       &result.Attempt,
+		Status:        result.Status,
+		NextAttemptAt: result.NextAttemptAt,
+		DisableAfter:  disableAfter,
+	})
+}
+
+// compact writes what is kept to a new log renamed into place, so a crash
+// leaves the old log or the new. Both locks must be held.
+func (s *fileStore) compact() error {
+	tmp := s.name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w, entries := bufio.NewWriter(f), 0
+	for id, sub := range s.subscriptions {
+		subDeliveries := s.bySubscription[id]
+		lines := []entry{{Op: opCreate, Subscription: &sub, Pruned: subDeliveries.pruned}}
+		if subDeliveries.enqueued.Len() > 0 {
+			deliveries := make([]Delivery, 0, subDeliveries.enqueued.Len())
+			for e := subDeliveries.enqueued.Front(); e != nil; e = e.Next() {
+				deliveries = append(deliveries, e.Value.(*queued).Delivery)
+			}
+			lines = append(lines, entry{Op: opEnqueue, Deliveries: deliveries})
+		}
+		for _, e := range lines {
+			line, err := json.Marshal(e)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(append(line, '\n'))
+			entries++
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.name)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(s.name)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	// The new log is written to from where it ends, it is the log from now.
+	s.log.Close()
+	s.log, s.entries = f, entries
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
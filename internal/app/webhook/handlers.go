@@ -0,0 +1,297 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxDeliveries is how many of the latest deliveries of a subscription are
+// listed.
+const maxDeliveries = 100
+
+// AddHandlers adds the routes organisations manage their subscriptions with
+// to the router, eventTypes are the types of event that can be subscribed to
+// and targets where they can be sent.
+func AddHandlers(r *mux.Router, store Store, targets Targets, eventTypes ...string) {
+	h := &handlers{store: store, targets: targets, eventTypes: eventTypes}
+
+	r.HandleFunc("/webhooks", h.createSubscriptionHandler).
+		Methods("POST")
+
+	r.HandleFunc("/webhooks", h.listSubscriptionsHandler).
+		Methods("GET")
+
+	r.HandleFunc("/webhooks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.getSubscriptionHandler).
+		Methods("GET")
+
+	r.HandleFunc("/webhooks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}", h.deleteSubscriptionHandler).
+		Methods("DELETE")
+
+	r.HandleFunc("/webhooks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/enable", h.enableSubscriptionHandler).
+		Methods("POST")
+
+	r.HandleFunc("/webhooks/{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}/deliveries", h.listDeliveriesHandler).
+		Methods("GET")
+}
+
+type handlers struct {
+	store      Store
+	targets    Targets
+	eventTypes []string
+}
+
+// Subscriptions is a page of subscriptions, their secrets are never listed.
+type Subscriptions struct {
+	Subscriptions []Subscription `json:"data"`
+}
+
+// Deliveries are the latest deliveries of a subscription, newest first.
+type Deliveries struct {
+	Deliveries []Delivery `json:"data"`
+}
+
+func (h *handlers) createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionManageWebhooks); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var s Subscription
+
+	if err := decoder.Decode(&s); err != nil {
+		log.Warn(err)
+		problem.New(http.StatusBadRequest, "malformed_body", err.Error()).Write(w, r)
+		return
+	}
+
+	if errs := h.validate(s); len(errs) > 0 {
+		writeInvalid(w, r, errs)
+		return
+	}
+	if !auth.Allowed(r.Context(), s.OrganisationId) {
+		writeOrganisationNotFound(w, r)
+		return
+	}
+	// The host is only resolved for a caller who may subscribe, anyone else
+	// could have the server look up any name they like.
+	if errs := h.checkTarget(r.Context(), s.URL); len(errs) > 0 {
+		writeInvalid(w, r, errs)
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s = Subscription{
+		Id:             uuid.NewV4().String(),
+		OrganisationId: s.OrganisationId,
+		URL:            s.URL,
+		Events:         s.Events,
+		Secret:         secret,
+		Enabled:        true,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := h.store.Create(r.Context(), s); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/webhooks/%s", s.Id))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Error(err)
+	}
+}
+
+func (h *handlers) validate(s Subscription) (errs []problem.FieldError) {
+	if s.OrganisationId == "" {
+		errs = append(errs, problem.FieldError{Field: "organisation_id", Message: "is required"})
+	}
+	if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, problem.FieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	}
+	for i, e := range s.Events {
+		if !h.known(e) {
+			errs = append(errs, problem.FieldError{Field: fmt.Sprintf("events[%d]", i), Message: "must be a known event type"})
+		}
+	}
+	return errs
+}
+
+// checkTarget resolves the host of the URL and refuses one inside the network
+// the server runs in.
+func (h *handlers) checkTarget(ctx context.Context, rawURL string) []problem.FieldError {
+	switch err := h.targets.Check(ctx, rawURL); {
+	case err == ErrInternalTarget:
+		return []problem.FieldError{{Field: "url", Message: "must not point at an internal address"}}
+	case err != nil:
+		return []problem.FieldError{{Field: "url", Message: "must have a host that resolves"}}
+	}
+	return nil
+}
+
+func (h *handlers) known(eventType string) bool {
+	for _, t := range h.eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handlers) listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionRead); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	organisationId := r.URL.Query().Get("organisation_id")
+	if organisationId == "" {
+		p := problem.New(http.StatusBadRequest, "invalid_query", "request is not valid")
+		p.Errors = []problem.FieldError{{Field: "organisation_id", Message: "is required"}}
+		p.Write(w, r)
+		return
+	}
+	if !auth.Allowed(r.Context(), organisationId) {
+		writeOrganisationNotFound(w, r)
+		return
+	}
+
+	subs, err := h.store.List(r.Context(), organisationId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	writeJSON(w, r, Subscriptions{Subscriptions: subs})
+}
+
+// find gets the subscription, a subscription of an organisation the caller
+// does not act for is not found.
+func (h *handlers) find(r *http.Request, id string) (Subscription, error) {
+	s, err := h.store.Get(r.Context(), id)
+	if err != nil {
+		return s, err
+	}
+	if !auth.Allowed(r.Context(), s.OrganisationId) {
+		return Subscription{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (h *handlers) getSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionRead); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s, err := h.find(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.Secret = ""
+	writeJSON(w, r, s)
+}
+
+func (h *handlers) deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionManageWebhooks); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := h.find(r, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.store.Delete(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// enableSubscriptionHandler turns a subscription disabled after failing back
+// on, its pending deliveries are sent again.
+func (h *handlers) enableSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionManageWebhooks); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := h.find(r, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h.store.Enable(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	h.getSubscriptionHandler(w, r)
+}
+
+func (h *handlers) listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := auth.Check(r.Context(), auth.PermissionRead); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if _, err := h.find(r, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	deliveries, err := h.store.Deliveries(r.Context(), id, maxDeliveries)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, Deliveries{Deliveries: deliveries})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
+
+func writeInvalid(w http.ResponseWriter, r *http.Request, errs []problem.FieldError) {
+	p := problem.New(http.StatusUnprocessableEntity, "validation_failed", "subscription is not valid")
+	p.Errors = errs
+	p.Write(w, r)
+}
+
+func writeOrganisationNotFound(w http.ResponseWriter, r *http.Request) {
+	problem.New(http.StatusNotFound, "organisation_not_found", "organisation not found").Write(w, r)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrNotFound {
+		log.Warn(err)
+		problem.New(http.StatusNotFound, "subscription_not_found", "subscription not found").Write(w, r)
+		return
+	}
+	if e, ok := err.(*auth.ForbiddenError); ok {
+		log.Warn(err)
+		p := problem.New(http.StatusForbidden, "forbidden", fmt.Sprintf("missing permission %s", e.Permission))
+		p.Extensions = map[string]interface{}{"missing_permission": e.Permission}
+		p.Write(w, r)
+		return
+	}
+	log.Error(err)
+	problem.New(http.StatusInternalServerError, "internal_error", "something went wrong").Write(w, r)
+}
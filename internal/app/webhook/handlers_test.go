@@ -0,0 +1,304 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/auth"
+	"github.com/carlosroman/payments-api/internal/app/problem"
+	"github.com/carlosroman/payments-api/internal/app/webhook"
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Handlers", func() {
+
+	var (
+		ctx   context.Context
+		store webhook.Store
+		ts    *httptest.Server
+		// looked are the hosts resolved.
+		looked []string
+		// targets resolves hosts without DNS, internal.example.com is
+		// inside the network.
+		targets = webhook.Targets{LookupIPAddr: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			looked = append(looked, host)
+			return lookup(map[string]string{
+				"example.com":          "93.184.216.34",
+				"internal.example.com": "10.0.0.7",
+			})(ctx, host)
+		}}
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		looked = nil
+		store = webhook.NewMemoryStore()
+		r := mux.NewRouter()
+		webhook.AddHandlers(r, store, targets, "payment.created", "payment.updated")
+		ts = httptest.NewServer(r)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	do := func(method string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		Expect(err).ShouldNot(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ShouldNot(HaveOccurred())
+		return resp
+	}
+
+	decode := func(resp *http.Response, v interface{}) {
+		defer resp.Body.Close()
+		Expect(json.NewDecoder(resp.Body).Decode(v)).To(Succeed())
+	}
+
+	givenStored := func() webhook.Subscription {
+		s := givenSubscription("6b1f1f8e-4f9f-4bd2-9d49-4a8fbd0b8a3e", "org", "https://example.com/hook", time.Now().UTC())
+		Expect(store.Create(ctx, s)).To(Succeed())
+		return s
+	}
+
+	Describe("Creating a subscription", func() {
+		It("should return it with its secret once", func() {
+			resp := do("POST", "/webhooks", `{"organisation_id":"org","url":"https://example.com/hook","events":["payment.created"]}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			var created webhook.Subscription
+			decode(resp, &created)
+
+			Expect(resp.Header.Get("Location")).To(Equal("/webhooks/" + created.Id))
+			Expect(created.OrganisationId).To(Equal("org"))
+			Expect(created.URL).To(Equal("https://example.com/hook"))
+			Expect(created.Events).To(Equal([]string{"payment.created"}))
+			Expect(created.Enabled).To(BeTrue())
+			Expect(created.Secret).To(HavePrefix("whsec_"))
+
+			stored, err := store.Get(ctx, created.Id)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(stored.Secret).To(Equal(created.Secret))
+
+			var got webhook.Subscription
+			decode(do("GET", resp.Header.Get("Location"), ""), &got)
+			Expect(got.Secret).To(BeEmpty())
+		})
+
+		It("should reject a subscription that is not valid", func() {
+			resp := do("POST", "/webhooks", `{"url":"ftp://example.com","events":["payment.deleted"]}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+			var p problem.Problem
+			decode(resp, &p)
+			Expect(p.Code).To(Equal("validation_failed"))
+			Expect(p.Errors).To(Equal([]problem.FieldError{
+				{Field: "organisation_id", Message: "is required"},
+				{Field: "url", Message: "must be an absolute http or https URL"},
+				{Field: "events[0]", Message: "must be a known event type"},
+			}))
+		})
+
+		DescribeTable("should reject a url that points inside the network",
+			func(url string, message string) {
+				resp := do("POST", "/webhooks", fmt.Sprintf(`{"organisation_id":"org","url":"%s","events":["payment.created"]}`, url))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnprocessableEntity))
+				var p problem.Problem
+				decode(resp, &p)
+				Expect(p.Errors).To(Equal([]problem.FieldError{{Field: "url", Message: message}}))
+			},
+			Entry("loopback", "http://127.0.0.1:8080/hook", "must not point at an internal address"),
+			Entry("loopback v6", "http://[::1]/hook", "must not point at an internal address"),
+			Entry("metadata service", "http://169.254.169.254/latest/meta-data", "must not point at an internal address"),
+			Entry("private", "https://192.168.1.10/hook", "must not point at an internal address"),
+			Entry("host resolving to a private address", "https://internal.example.com/hook", "must not point at an internal address"),
+			Entry("host that does not resolve", "https://nowhere.example.com/hook", "must have a host that resolves"),
+		)
+
+		It("should accept an internal url when internal targets are allowed", func() {
+			ts.Close()
+			r := mux.NewRouter()
+			webhook.AddHandlers(r, store, webhook.Targets{AllowInternal: true}, "payment.created")
+			ts = httptest.NewServer(r)
+
+			resp := do("POST", "/webhooks", `{"organisation_id":"org","url":"http://127.0.0.1:8080/hook","events":["payment.created"]}`)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+		})
+
+		It("should reject a body that is not json", func() {
+			resp := do("POST", "/webhooks", "not json")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Listing subscriptions", func() {
+		It("should list those of the organisation without their secrets", func() {
+			s := givenStored()
+			var subs webhook.Subscriptions
+			resp := do("GET", "/webhooks?organisation_id=org", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			decode(resp, &subs)
+			Expect(subs.Subscriptions).To(HaveLen(1))
+			Expect(subs.Subscriptions[0].Id).To(Equal(s.Id))
+			Expect(subs.Subscriptions[0].Secret).To(BeEmpty())
+		})
+
+		It("should require the organisation", func() {
+			resp := do("GET", "/webhooks", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			var p problem.Problem
+			decode(resp, &p)
+			Expect(p.Code).To(Equal("invalid_query"))
+		})
+	})
+
+	Describe("Deleting a subscription", func() {
+		It("should remove it", func() {
+			s := givenStored()
+			resp := do("DELETE", "/webhooks/"+s.Id, "")
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+			_, err := store.Get(ctx, s.Id)
+			Expect(err).To(Equal(webhook.ErrNotFound))
+		})
+	})
+
+	Describe("Enabling a subscription", func() {
+		It("should turn it back on", func() {
+			s := givenStored()
+			s.Enabled, s.Failures = false, 20
+			Expect(store.Create(ctx, s)).To(Succeed())
+
+			resp := do("POST", fmt.Sprintf("/webhooks/%s/enable", s.Id), "")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var enabled webhook.Subscription
+			decode(resp, &enabled)
+			Expect(enabled.Enabled).To(BeTrue())
+			Expect(enabled.Failures).To(BeZero())
+		})
+	})
+
+	Describe("Listing deliveries", func() {
+		It("should return the latest deliveries with their attempts", func() {
+			s := givenStored()
+			now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+			Expect(store.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", s.Id, 1, now)})).To(Succeed())
+			Expect(store.Attempted(ctx, "d-1", webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}, 20)).To(Succeed())
+
+			resp := do("GET", fmt.Sprintf("/webhooks/%s/deliveries", s.Id), "")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var deliveries webhook.Deliveries
+			decode(resp, &deliveries)
+			Expect(deliveries.Deliveries).To(HaveLen(1))
+			Expect(deliveries.Deliveries[0].Status).To(Equal(webhook.DeliverySucceeded))
+			Expect(deliveries.Deliveries[0].Attempts).To(Equal([]webhook.Attempt{{At: now, StatusCode: 200}}))
+		})
+	})
+
+	Describe("Errors", func() {
+		It("should return not found for an unknown subscription", func() {
+			for _, req := range [][]string{
+				{"GET", "/webhooks/6b1f1f8e-4f9f-4bd2-9d49-4a8fbd0b8a3e"},
+				{"DELETE", "/webhooks/6b1f1f8e-4f9f-4bd2-9d49-4a8fbd0b8a3e"},
+				{"POST", "/webhooks/6b1f1f8e-4f9f-4bd2-9d49-4a8fbd0b8a3e/enable"},
+				{"GET", "/webhooks/6b1f1f8e-4f9f-4bd2-9d49-4a8fbd0b8a3e/deliveries"},
+			} {
+				resp := do(req[0], req[1], "")
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound), req[1])
+				Expect(resp.Header.Get("Content-Type")).To(Equal(problem.ContentType))
+				var p problem.Problem
+				decode(resp, &p)
+				Expect(p.Code).To(Equal("subscription_not_found"))
+			}
+		})
+	})
+
+	// serveAs serves the routes to callers authenticated as the identity.
+	serveAs := func(id auth.Identity) {
+		ts.Close()
+		r := mux.NewRouter()
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), id)))
+			})
+		})
+		webhook.AddHandlers(r, store, targets, "payment.created", "payment.updated")
+		ts = httptest.NewServer(r)
+	}
+
+	Describe("Permissions", func() {
+		BeforeEach(func() {
+			serveAs(auth.Identity{Subject: "apikey:some-key", OrganisationIds: []string{"org"}, Roles: []auth.Role{auth.RoleViewer}})
+		})
+
+		It("should not let a caller without webhooks:manage change subscriptions", func() {
+			s := givenStored()
+			for _, req := range [][]string{
+				{"POST", "/webhooks", `{"organisation_id":"org","url":"https://example.com/hook"}`},
+				{"DELETE", "/webhooks/" + s.Id, ""},
+				{"POST", "/webhooks/" + s.Id + "/enable", ""},
+			} {
+				resp := do(req[0], req[1], req[2])
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden), req[1])
+				var actual struct {
+					Code              string `json:"code"`
+					MissingPermission string `json:"missing_permission"`
+				}
+				decode(resp, &actual)
+				Expect(actual.Code).To(Equal("forbidden"))
+				Expect(actual.MissingPermission).To(Equal("webhooks:manage"))
+			}
+			Expect(store.List(ctx, "org")).To(Equal([]webhook.Subscription{s}))
+		})
+
+		It("should let a caller with payments:read see subscriptions", func() {
+			s := givenStored()
+			for _, path := range []string{"/webhooks?organisation_id=org", "/webhooks/" + s.Id, "/webhooks/" + s.Id + "/deliveries"} {
+				resp := do("GET", path, "")
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK), path)
+			}
+		})
+	})
+
+	Describe("Acting for organisations", func() {
+		BeforeEach(func() {
+			serveAs(auth.Identity{Subject: "apikey:some-key", OrganisationIds: []string{"other"}, Roles: []auth.Role{auth.RoleAdmin}})
+		})
+
+		thenNotFound := func(resp *http.Response, code string) {
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			var p problem.Problem
+			decode(resp, &p)
+			Expect(p.Code).To(Equal(code))
+		}
+
+		It("should not subscribe to another organisation", func() {
+			thenNotFound(do("POST", "/webhooks", `{"organisation_id":"org","url":"https://example.com/hook"}`), "organisation_not_found")
+			thenNotFound(do("GET", "/webhooks?organisation_id=org", ""), "organisation_not_found")
+			Expect(store.List(ctx, "org")).To(BeEmpty())
+			Expect(looked).To(BeEmpty())
+		})
+
+		It("should not find the subscriptions of another organisation", func() {
+			s := givenStored()
+			for _, req := range [][]string{
+				{"GET", "/webhooks/" + s.Id},
+				{"DELETE", "/webhooks/" + s.Id},
+				{"POST", "/webhooks/" + s.Id + "/enable"},
+				{"GET", "/webhooks/" + s.Id + "/deliveries"},
+			} {
+				thenNotFound(do(req[0], req[1], ""), "subscription_not_found")
+			}
+			Expect(store.Get(ctx, s.Id)).To(Equal(s))
+		})
+	})
+})
@@ -0,0 +1,236 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type Database interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// NewPostgresStore keeps subscriptions in the webhook_subscriptions table and
+// their deliveries in webhook_deliveries, every server sharing the database
+// can send them.
+func NewPostgresStore(db Database) Store {
+	return &postgresStore{db: db}
+}
+
+type postgresStore struct {
+	db Database
+}
+
+const subscriptionColumns = "id, organisation_id, url, events, secret, enabled, failures, disabled_at, created_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSubscription(row scanner) (sub Subscription, err error) {
+	var disabledAt pq.NullTime
+	err = row.Scan(&sub.Id, &sub.OrganisationId, &sub.URL, pq.Array(&sub.Events), &sub.Secret, &sub.Enabled, &sub.Failures, &disabledAt, &sub.CreatedAt)
+	if disabledAt.Valid {
+		sub.DisabledAt = &disabledAt.Time
+	}
+	return sub, err
+}
+
+func (s *postgresStore) Create(ctx context.Context, sub Subscription) error {
+	events := sub.Events
+	if events == nil {
+		events = []string{}
+	}
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO webhook_subscriptions(id, organisation_id, url, events, secret, enabled, created_at) VALUES($1, $2, $3, $4, $5, $6, $7);",
+		sub.Id, sub.OrganisationId, sub.URL, pq.Array(events), sub.Secret, sub.Enabled, sub.CreatedAt)
+	return err
+}
+
+func (s *postgresStore) Get(ctx context.Context, id string) (Subscription, error) {
+	sub, err := scanSubscription(s.db.QueryRowContext(ctx,
+		"SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE id = $1;",
+		id))
+	if err == sql.ErrNoRows {
+		return sub, ErrNotFound
+	}
+	return sub, err
+}
+
+func (s *postgresStore) List(ctx context.Context, organisationId string) ([]Subscription, error) {
+	subs := make([]Subscription, 0)
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+subscriptionColumns+" FROM webhook_subscriptions WHERE organisation_id = $1 ORDER BY created_at, id;",
+		organisationId)
+	if err != nil {
+		return subs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return subs, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *postgresStore) Enable(ctx context.Context, id string) error {
+	return s.execOne(ctx,
+		"UPDATE webhook_subscriptions SET enabled = true, failures = 0, disabled_at = NULL WHERE id = $1;",
+		id)
+}
+
+// Delete takes the deliveries with the subscription, the table cascades.
+func (s *postgresStore) Delete(ctx context.Context, id string) error {
+	return s.execOne(ctx, "DELETE FROM webhook_subscriptions WHERE id = $1;", id)
+}
+
+// execOne runs a statement on a single subscription, it is not found when no
+// row was changed.
+func (s *postgresStore) execOne(ctx context.Context, query string, id string) error {
+	result, err := s.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *postgresStore) Enqueue(ctx context.Context, deliveries []Delivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		event, err := json.Marshal(d.Event)
+		if err != nil {
+			return rollback(tx, err)
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO webhook_deliveries(id, subscription_id, event_sequence, event, status, next_attempt_at, created_at) VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (subscription_id, event_sequence) DO NOTHING;",
+			d.Id, d.SubscriptionId, d.Event.Sequence, string(event), string(d.Status), nullTime(d.NextAttemptAt), d.CreatedAt)
+		if err != nil {
+			return rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func rollback(tx *sql.Tx, err error) error {
+	if rbErr := tx.Rollback(); rbErr != nil {
+		log.Error(rbErr)
+	}
+	return err
+}
+
+func nullTime(t *time.Time) pq.NullTime {
+	if t == nil {
+		return pq.NullTime{}
+	}
+	return pq.NullTime{Time: *t, Valid: true}
+}
+
+const deliveryColumns = "id, subscription_id, event, status, attempts, next_attempt_at, created_at"
+
+func scanDelivery(row scanner) (d Delivery, err error) {
+	var (
+		event, attempts []byte
+		nextAttemptAt   pq.NullTime
+	)
+	if err = row.Scan(&d.Id, &d.SubscriptionId, &event, &d.Status, &attempts, &nextAttemptAt, &d.CreatedAt); err != nil {
+		return d, err
+	}
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if err = json.Unmarshal(event, &d.Event); err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(attempts, &d.Attempts)
+	return d, err
+}
+
+func (s *postgresStore) queryDeliveries(ctx context.Context, query string, args ...interface{}) ([]Delivery, error) {
+	deliveries := make([]Delivery, 0)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Claim skips the deliveries another server has locked while claiming them,
+// so each is only taken by one.
+func (s *postgresStore) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]Delivery, error) {
+	return s.queryDeliveries(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = $2 WHERE id IN (
+ SELECT d.id FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id
+ WHERE d.status = 'pending' AND d.next_attempt_at <= $1 AND s.enabled
+ ORDER BY d.next_attempt_at LIMIT $3 FOR UPDATE OF d SKIP LOCKED
+) RETURNING `+deliveryColumns+`;`,
+		now, until, limit)
+}
+
+// Attempted changes the delivery and its subscription together. The columns
+// of the subscription are all set from the row as it was, so it is disabled
+// when the failure being counted is the one that reaches disableAfter.
+func (s *postgresStore) Attempted(ctx context.Context, deliveryId string, result Result, disableAfter int) error {
+	attempts, err := json.Marshal([]Attempt{result.Attempt})
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var subscriptionId string
+	err = tx.QueryRowContext(ctx,
+		"UPDATE webhook_deliveries SET status = $2, attempts = attempts || $3::jsonb, next_attempt_at = $4 WHERE id = $1 RETURNING subscription_id;",
+		deliveryId, string(result.Status), string(attempts), nullTime(result.NextAttemptAt)).Scan(&subscriptionId)
+	if err == sql.ErrNoRows {
+		// The subscription was deleted with its deliveries in between.
+		return rollback(tx, nil)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE webhook_subscriptions SET failures = CASE WHEN $2 THEN 0 ELSE failures + 1 END,
+ enabled = enabled AND ($2 OR failures + 1 < $3),
+ disabled_at = CASE WHEN enabled AND NOT $2 AND failures + 1 >= $3 THEN $4 ELSE disabled_at END
+ WHERE id = $1;`,
+			subscriptionId, result.Status == DeliverySucceeded, disableAfter, result.Attempt.At)
+	}
+	if err != nil {
+		return rollback(tx, err)
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Deliveries(ctx context.Context, subscriptionId string, limit int) ([]Delivery, error) {
+	return s.queryDeliveries(ctx,
+		"SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE subscription_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2;",
+		subscriptionId, limit)
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the time a delivery was sent and the signature
+	// of that time and the body as t=<unix seconds>,v1=<hex HMAC-SHA256>.
+	SignatureHeader = "Webhook-Signature"
+	// IdHeader is the id of the delivery, it is the same for every attempt.
+	IdHeader = "Webhook-Id"
+	// EventHeader is the type of the event delivered.
+	EventHeader = "Webhook-Event"
+)
+
+var ErrInvalidSignature = errors.New("webhook: invalid signature")
+
+// Sign is the signature header of a body sent at the time given. The time is
+// signed too so a delivery captured on the way cannot be replayed later.
+func Sign(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, signature(secret, t, body))
+}
+
+func signature(secret string, t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a delivery is of its body with the
+// secret and was sent no more than tolerance from now, it is how receivers
+// know the delivery came from us.
+func Verify(secret string, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidSignature
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return ErrInvalidSignature
+	}
+	if sent := time.Unix(unix, 0); sent.Before(now.Add(-tolerance)) || sent.After(now.Add(tolerance)) {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(v1), []byte(signature(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// newSecret is 32 random bytes, it is only ever shown to the organisation
+// when the subscription is created.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
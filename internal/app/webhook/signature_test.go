@@ -0,0 +1,48 @@
+package webhook_test
+
+import (
+	"github.com/carlosroman/payments-api/internal/app/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Signatures", func() {
+
+	var (
+		at   time.Time
+		body []byte
+	)
+
+	BeforeEach(func() {
+		at = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+		body = []byte(`{"type":"payment.created"}`)
+	})
+
+	It("should sign the time and body with HMAC-SHA256", func() {
+		Expect(webhook.Sign("secret", at, body)).To(Equal("t=1538395200,v1=8444a4a84423373f05b84a9895df6447f09f5f676643395ee583815873eafa1e"))
+		Expect(webhook.Sign("other", at, body)).ToNot(Equal(webhook.Sign("secret", at, body)))
+	})
+
+	It("should verify a signature made with the secret", func() {
+		header := webhook.Sign("secret", at, body)
+		Expect(webhook.Verify("secret", header, body, at.Add(time.Minute), 5*time.Minute)).To(Succeed())
+	})
+
+	It("should reject another secret or body", func() {
+		header := webhook.Sign("secret", at, body)
+		Expect(webhook.Verify("other", header, body, at, 5*time.Minute)).To(Equal(webhook.ErrInvalidSignature))
+		Expect(webhook.Verify("secret", header, []byte(`{}`), at, 5*time.Minute)).To(Equal(webhook.ErrInvalidSignature))
+	})
+
+	It("should reject a signature sent too long ago", func() {
+		header := webhook.Sign("secret", at, body)
+		Expect(webhook.Verify("secret", header, body, at.Add(time.Hour), 5*time.Minute)).To(Equal(webhook.ErrInvalidSignature))
+	})
+
+	It("should reject a header it cannot read", func() {
+		for _, header := range []string{"", "rubbish", "t=abc,v1=00", "t=1538395200"} {
+			Expect(webhook.Verify("secret", header, body, at, 5*time.Minute)).To(Equal(webhook.ErrInvalidSignature))
+		}
+	})
+})
@@ -0,0 +1,413 @@
+package webhook
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("webhook: subscription not found")
+
+// Subscription is an endpoint of an organisation that is sent the events of
+// its payments.
+type Subscription struct {
+	Id             string `json:"id"`
+	OrganisationId string `json:"organisation_id"`
+	URL            string `json:"url"`
+	// Events are the types of event sent, every type is sent when there are
+	// none.
+	Events []string `json:"events,omitempty"`
+	// Secret signs every delivery, it is only shown when the subscription is
+	// created.
+	Secret  string `json:"secret,omitempty"`
+	Enabled bool   `json:"enabled"`
+	// Failures is how many attempts in a row have failed, the subscription is
+	// disabled once there are too many.
+	Failures   int        `json:"consecutive_failures"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// wants is true when the subscription is sent events of the type.
+func (s Subscription) wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is an event to be sent to a subscription, with every attempt made
+// at sending it.
+type Delivery struct {
+	Id             string         `json:"id"`
+	SubscriptionId string         `json:"subscription_id"`
+	Event          outbox.Event   `json:"event"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       []Attempt      `json:"attempts"`
+	NextAttemptAt  *time.Time     `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// Attempt is one try at sending a delivery, it has the status of the response
+// or the error when there was none.
+type Attempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Result is what came of an attempt at a delivery, the delivery is tried
+// again at NextAttemptAt while it is still pending.
+type Result struct {
+	Attempt       Attempt
+	Status        DeliveryStatus
+	NextAttemptAt *time.Time
+}
+
+type Store interface {
+	Create(ctx context.Context, s Subscription) error
+	Get(ctx context.Context, id string) (Subscription, error)
+	// List returns the subscriptions of the organisation oldest first.
+	List(ctx context.Context, organisationId string) ([]Subscription, error)
+	// Enable lets a disabled subscription be sent events again, with no
+	// failures counted against it.
+	Enable(ctx context.Context, id string) error
+	// Delete removes the subscription and its deliveries.
+	Delete(ctx context.Context, id string) error
+	// Enqueue adds the deliveries, skipping any of an event the subscription
+	// already has a delivery of.
+	Enqueue(ctx context.Context, deliveries []Delivery) error
+	// Claim takes up to limit pending deliveries of enabled subscriptions
+	// due by now and puts their next attempt off until then, so no one else
+	// takes them meanwhile.
+	Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]Delivery, error)
+	// Attempted records the result of an attempt at the delivery. Its
+	// subscription counts the failure, and is disabled once disableAfter
+	// attempts in a row have failed, or starts counting again on success.
+	Attempted(ctx context.Context, deliveryId string, result Result, disableAfter int) error
+	// Deliveries returns up to limit deliveries of the subscription, newest
+	// first.
+	Deliveries(ctx context.Context, subscriptionId string, limit int) ([]Delivery, error)
+}
+
+// NewMemoryStore keeps subscriptions in memory, they are lost when the server
+// stops. Of the deliveries that are done with only as many as Deliveries
+// lists are kept for each subscription.
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		subscriptions:  make(map[string]Subscription),
+		deliveries:     make(map[string]*queued),
+		events:         make(map[event]*queued),
+		bySubscription: make(map[string]*subscriptionDeliveries),
+	}
+}
+
+type memoryStore struct {
+	mu            sync.Mutex
+	subscriptions map[string]Subscription
+	deliveries    map[string]*queued
+	// events are the deliveries by the event they send to a subscription.
+	events         map[event]*queued
+	bySubscription map[string]*subscriptionDeliveries
+	// due are the pending deliveries of enabled subscriptions, the one to
+	// be attempted soonest first. A subscription disabled meanwhile has its
+	// deliveries dropped as they come due and put back once it is enabled.
+	due dueQueue
+}
+
+// event is an event sent to a subscription.
+type event struct {
+	subscriptionId string
+	sequence       int64
+}
+
+// queued is a delivery kept by the store.
+type queued struct {
+	Delivery
+	// index is where the delivery is in the due queue, -1 when it is not.
+	index int
+	// enqueued and finished are where it is in the lists of its
+	// subscription, finished is nil while it is pending.
+	enqueued *list.Element
+	finished *list.Element
+}
+
+type subscriptionDeliveries struct {
+	// enqueued are the deliveries oldest first.
+	enqueued *list.List
+	// finished are those no longer pending, in the order they were done.
+	finished *list.List
+	// pruned is the latest event of a delivery dropped, the events are
+	// enqueued in order so any before it was already sent.
+	pruned int64
+}
+
+func (s *memoryStore) Create(ctx context.Context, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[sub.Id] = copySubscription(sub)
+	if _, ok := s.bySubscription[sub.Id]; !ok {
+		s.bySubscription[sub.Id] = &subscriptionDeliveries{enqueued: list.New(), finished: list.New()}
+	}
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return sub, ErrNotFound
+	}
+	return copySubscription(sub), nil
+}
+
+func (s *memoryStore) List(ctx context.Context, organisationId string) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]Subscription, 0)
+	for _, sub := range s.subscriptions {
+		if sub.OrganisationId == organisationId {
+			subs = append(subs, copySubscription(sub))
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].Id < subs[j].Id
+		}
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+	return subs, nil
+}
+
+func copySubscription(sub Subscription) Subscription {
+	sub.Events = append([]string(nil), sub.Events...)
+	if sub.DisabledAt != nil {
+		at := *sub.DisabledAt
+		sub.DisabledAt = &at
+	}
+	return sub
+}
+
+// Enable puts the pending deliveries of the subscription back in the due
+// queue, those that came due while it was disabled were dropped from it.
+func (s *memoryStore) Enable(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	sub.Enabled, sub.Failures, sub.DisabledAt = true, 0, nil
+	s.subscriptions[id] = sub
+	for e := s.bySubscription[id].enqueued.Front(); e != nil; e = e.Next() {
+		s.schedule(e.Value.(*queued))
+	}
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.subscriptions, id)
+	for e := s.bySubscription[id].enqueued.Front(); e != nil; e = e.Next() {
+		q := e.Value.(*queued)
+		if q.index >= 0 {
+			heap.Remove(&s.due, q.index)
+		}
+		delete(s.deliveries, q.Id)
+		delete(s.events, event{q.SubscriptionId, q.Event.Sequence})
+	}
+	delete(s.bySubscription, id)
+	return nil
+}
+
+// Enqueue skips deliveries to a subscription that is gone, its deliveries
+// went with it.
+func (s *memoryStore) Enqueue(ctx context.Context, deliveries []Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range deliveries {
+		subDeliveries, ok := s.bySubscription[d.SubscriptionId]
+		if !ok || d.Event.Sequence <= subDeliveries.pruned {
+			continue
+		}
+		if _, ok := s.events[event{d.SubscriptionId, d.Event.Sequence}]; ok {
+			continue
+		}
+		q := &queued{Delivery: copyDelivery(d), index: -1}
+		s.deliveries[d.Id] = q
+		s.events[event{d.SubscriptionId, d.Event.Sequence}] = q
+		q.enqueued = subDeliveries.enqueued.PushBack(q)
+		if q.Status == DeliveryPending {
+			s.schedule(q)
+		} else {
+			s.finish(q)
+		}
+	}
+	return nil
+}
+
+func copyDelivery(d Delivery) Delivery {
+	d.Attempts = append([]Attempt(nil), d.Attempts...)
+	if d.NextAttemptAt != nil {
+		at := *d.NextAttemptAt
+		d.NextAttemptAt = &at
+	}
+	return d
+}
+
+// schedule puts a pending delivery of an enabled subscription in the due
+// queue, or moves it to when it is next due when it is already there. Any
+// other delivery is taken out of it.
+func (s *memoryStore) schedule(q *queued) {
+	switch {
+	case q.Status != DeliveryPending || q.NextAttemptAt == nil || !s.subscriptions[q.SubscriptionId].Enabled:
+		if q.index >= 0 {
+			heap.Remove(&s.due, q.index)
+		}
+	case q.index >= 0:
+		heap.Fix(&s.due, q.index)
+	default:
+		heap.Push(&s.due, q)
+	}
+}
+
+// finish takes a delivery that is done with out of the due queue and drops
+// the oldest done with of its subscription that Deliveries no longer lists.
+func (s *memoryStore) finish(q *queued) {
+	if q.index >= 0 {
+		heap.Remove(&s.due, q.index)
+	}
+	subDeliveries := s.bySubscription[q.SubscriptionId]
+	q.finished = subDeliveries.finished.PushBack(q)
+	for subDeliveries.finished.Len() > maxDeliveries {
+		oldest := subDeliveries.finished.Remove(subDeliveries.finished.Front()).(*queued)
+		subDeliveries.enqueued.Remove(oldest.enqueued)
+		delete(s.deliveries, oldest.Id)
+		delete(s.events, event{oldest.SubscriptionId, oldest.Event.Sequence})
+		if oldest.Event.Sequence > subDeliveries.pruned {
+			subDeliveries.pruned = oldest.Event.Sequence
+		}
+	}
+}
+
+func (s *memoryStore) Claim(ctx context.Context, now time.Time, until time.Time, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	claimed := make([]Delivery, 0)
+	for len(claimed) < limit && s.due.Len() > 0 && !s.due[0].NextAttemptAt.After(now) {
+		q := s.due[0]
+		if !s.subscriptions[q.SubscriptionId].Enabled {
+			heap.Pop(&s.due)
+			continue
+		}
+		next := until
+		q.NextAttemptAt = &next
+		heap.Fix(&s.due, 0)
+		claimed = append(claimed, copyDelivery(q.Delivery))
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) Attempted(ctx context.Context, deliveryId string, result Result, disableAfter int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.deliveries[deliveryId]
+	if !ok {
+		return nil
+	}
+	q.Attempts = append(q.Attempts, result.Attempt)
+	q.Status, q.NextAttemptAt = result.Status, nil
+	if result.NextAttemptAt != nil {
+		at := *result.NextAttemptAt
+		q.NextAttemptAt = &at
+	}
+
+	sub, ok := s.subscriptions[q.SubscriptionId]
+	if ok {
+		if result.Status == DeliverySucceeded {
+			sub.Failures = 0
+		} else {
+			sub.Failures++
+			if sub.Enabled && sub.Failures >= disableAfter {
+				at := result.Attempt.At
+				sub.Enabled, sub.DisabledAt = false, &at
+			}
+		}
+		s.subscriptions[sub.Id] = sub
+	}
+
+	if q.Status == DeliveryPending {
+		s.schedule(q)
+	} else if q.finished == nil {
+		s.finish(q)
+	}
+	return nil
+}
+
+func (s *memoryStore) Deliveries(ctx context.Context, subscriptionId string, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := make([]Delivery, 0)
+	subDeliveries, ok := s.bySubscription[subscriptionId]
+	if !ok {
+		return deliveries, nil
+	}
+	for e := subDeliveries.enqueued.Back(); e != nil && len(deliveries) < limit; e = e.Prev() {
+		deliveries = append(deliveries, copyDelivery(e.Value.(*queued).Delivery))
+	}
+	return deliveries, nil
+}
+
+// dueQueue is a heap of deliveries by when they are next attempted.
+type dueQueue []*queued
+
+func (q dueQueue) Len() int { return len(q) }
+
+func (q dueQueue) Less(i, j int) bool { return q[i].NextAttemptAt.Before(*q[j].NextAttemptAt) }
+
+func (q dueQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *dueQueue) Push(x interface{}) {
+	d := x.(*queued)
+	d.index = len(*q)
+	*q = append(*q, d)
+}
+
+func (q *dueQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	d.index = -1
+	*q = old[:len(old)-1]
+	return d
+}
@@ -0,0 +1,434 @@
+package webhook_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/outbox"
+	"github.com/carlosroman/payments-api/internal/app/webhook"
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// givenSubscription is an enabled subscription of the organisation created at
+// the time given.
+func givenSubscription(id string, organisationId string, url string, createdAt time.Time) webhook.Subscription {
+	return webhook.Subscription{
+		Id:             id,
+		OrganisationId: organisationId,
+		URL:            url,
+		Secret:         "secret",
+		Enabled:        true,
+		CreatedAt:      createdAt,
+	}
+}
+
+func givenDelivery(id string, subscriptionId string, sequence int64, due time.Time) webhook.Delivery {
+	return webhook.Delivery{
+		Id:             id,
+		SubscriptionId: subscriptionId,
+		Event:          outbox.Event{Sequence: sequence, Type: "payment.created", Subject: "some id", At: due, Data: json.RawMessage(`{}`)},
+		Status:         webhook.DeliveryPending,
+		NextAttemptAt:  &due,
+		CreatedAt:      due,
+	}
+}
+
+var _ = Describe("Stores", func() {
+
+	var (
+		ctx context.Context
+		now time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	// behavesLikeAStore runs the cases every store that keeps deliveries
+	// itself has to pass.
+	behavesLikeAStore := func(newStore func() webhook.Store) {
+		var s webhook.Store
+
+		BeforeEach(func() {
+			s = newStore()
+			Expect(s.Create(ctx, givenSubscription("sub-2", "org", "http://b", now.Add(time.Minute)))).To(Succeed())
+			Expect(s.Create(ctx, givenSubscription("sub-1", "org", "http://a", now))).To(Succeed())
+			Expect(s.Create(ctx, givenSubscription("sub-3", "other org", "http://c", now))).To(Succeed())
+		})
+
+		It("should list the subscriptions of the organisation oldest first", func() {
+			subs, err := s.List(ctx, "org")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(subs).To(HaveLen(2))
+			Expect(subs[0].Id).To(Equal("sub-1"))
+			Expect(subs[1].Id).To(Equal("sub-2"))
+			Expect(s.List(ctx, "nobody")).To(BeEmpty())
+		})
+
+		It("should return not found for an unknown subscription", func() {
+			_, err := s.Get(ctx, "unknown")
+			Expect(err).To(Equal(webhook.ErrNotFound))
+			Expect(s.Enable(ctx, "unknown")).To(Equal(webhook.ErrNotFound))
+			Expect(s.Delete(ctx, "unknown")).To(Equal(webhook.ErrNotFound))
+		})
+
+		It("should only enqueue one delivery of an event to a subscription", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", "sub-1", 1, now)})).To(Succeed())
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-2", "sub-1", 1, now), givenDelivery("d-3", "sub-2", 1, now)})).To(Succeed())
+
+			Expect(s.Deliveries(ctx, "sub-1", 10)).To(HaveLen(1))
+			Expect(s.Deliveries(ctx, "sub-2", 10)).To(HaveLen(1))
+		})
+
+		It("should claim the deliveries due until the claim runs out", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{
+				givenDelivery("d-1", "sub-1", 1, now),
+				givenDelivery("d-2", "sub-1", 2, now.Add(time.Hour)),
+			})).To(Succeed())
+
+			claimed, err := s.Claim(ctx, now, now.Add(time.Minute), 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(claimed).To(HaveLen(1))
+			Expect(claimed[0].Id).To(Equal("d-1"))
+			Expect(s.Claim(ctx, now, now.Add(time.Minute), 10)).To(BeEmpty())
+			Expect(s.Claim(ctx, now.Add(time.Minute), now.Add(2*time.Minute), 10)).To(HaveLen(1))
+		})
+
+		It("should count failed attempts and disable the subscription once there are too many", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", "sub-1", 1, now)})).To(Succeed())
+			retry := now.Add(time.Minute)
+			failed := webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 500}, Status: webhook.DeliveryPending, NextAttemptAt: &retry}
+
+			Expect(s.Attempted(ctx, "d-1", failed, 2)).To(Succeed())
+			sub, err := s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sub.Enabled).To(BeTrue())
+			Expect(sub.Failures).To(Equal(1))
+
+			Expect(s.Attempted(ctx, "d-1", failed, 2)).To(Succeed())
+			sub, err = s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sub.Enabled).To(BeFalse())
+			Expect(sub.DisabledAt).To(Equal(&now))
+			Expect(s.Claim(ctx, retry, retry.Add(time.Minute), 10)).To(BeEmpty())
+
+			deliveries, err := s.Deliveries(ctx, "sub-1", 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deliveries[0].Attempts).To(HaveLen(2))
+			Expect(deliveries[0].NextAttemptAt).To(Equal(&retry))
+
+			Expect(s.Enable(ctx, "sub-1")).To(Succeed())
+			sub, err = s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sub.Enabled).To(BeTrue())
+			Expect(sub.Failures).To(BeZero())
+			Expect(sub.DisabledAt).To(BeNil())
+			Expect(s.Claim(ctx, retry, retry.Add(time.Minute), 10)).To(HaveLen(1))
+		})
+
+		It("should start counting again after a success", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", "sub-1", 1, now)})).To(Succeed())
+			Expect(s.Attempted(ctx, "d-1", webhook.Result{Attempt: webhook.Attempt{At: now}, Status: webhook.DeliveryPending, NextAttemptAt: &now}, 5)).To(Succeed())
+			Expect(s.Attempted(ctx, "d-1", webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}, 5)).To(Succeed())
+
+			sub, err := s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(sub.Failures).To(BeZero())
+			deliveries, err := s.Deliveries(ctx, "sub-1", 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deliveries[0].Status).To(Equal(webhook.DeliverySucceeded))
+			Expect(deliveries[0].NextAttemptAt).To(BeNil())
+		})
+
+		It("should list the latest deliveries newest first", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{
+				givenDelivery("d-1", "sub-1", 1, now),
+				givenDelivery("d-2", "sub-1", 2, now),
+				givenDelivery("d-3", "sub-1", 3, now),
+			})).To(Succeed())
+
+			deliveries, err := s.Deliveries(ctx, "sub-1", 2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deliveries).To(HaveLen(2))
+			Expect(deliveries[0].Id).To(Equal("d-3"))
+			Expect(deliveries[1].Id).To(Equal("d-2"))
+		})
+
+		It("should delete the deliveries with the subscription", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", "sub-1", 1, now)})).To(Succeed())
+			Expect(s.Delete(ctx, "sub-1")).To(Succeed())
+
+			_, err := s.Get(ctx, "sub-1")
+			Expect(err).To(Equal(webhook.ErrNotFound))
+			Expect(s.Deliveries(ctx, "sub-1", 10)).To(BeEmpty())
+			Expect(s.Claim(ctx, now, now.Add(time.Minute), 10)).To(BeEmpty())
+		})
+
+		It("should claim the deliveries due soonest first", func() {
+			Expect(s.Enqueue(ctx, []webhook.Delivery{
+				givenDelivery("d-1", "sub-1", 1, now.Add(-time.Second)),
+				givenDelivery("d-2", "sub-2", 1, now.Add(-time.Minute)),
+				givenDelivery("d-3", "sub-1", 2, now.Add(-time.Hour)),
+			})).To(Succeed())
+
+			claimed, err := s.Claim(ctx, now, now.Add(time.Minute), 2)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(claimed).To(HaveLen(2))
+			Expect(claimed[0].Id).To(Equal("d-3"))
+			Expect(claimed[1].Id).To(Equal("d-2"))
+		})
+
+		It("should only keep as many deliveries done with as are listed", func() {
+			var deliveries []webhook.Delivery
+			for i := 1; i <= 105; i++ {
+				deliveries = append(deliveries, givenDelivery(fmt.Sprintf("d-%d", i), "sub-1", int64(i), now))
+			}
+			Expect(s.Enqueue(ctx, append(deliveries, givenDelivery("pending", "sub-1", 106, now.Add(time.Hour))))).To(Succeed())
+			for _, d := range deliveries {
+				Expect(s.Attempted(ctx, d.Id, webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}, 5)).To(Succeed())
+			}
+
+			kept, err := s.Deliveries(ctx, "sub-1", 1000)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(kept).To(HaveLen(101))
+			Expect(kept[0].Id).To(Equal("pending"))
+			Expect(kept[1].Id).To(Equal("d-105"))
+			Expect(kept[100].Id).To(Equal("d-6"))
+
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("again", "sub-1", 3, now)})).To(Succeed())
+			Expect(s.Deliveries(ctx, "sub-1", 1000)).To(HaveLen(101))
+		})
+	}
+
+	Describe("Memory store", func() {
+		behavesLikeAStore(webhook.NewMemoryStore)
+	})
+
+	Describe("File store", func() {
+		var (
+			dir  string
+			name string
+		)
+
+		BeforeEach(func() {
+			d, err := ioutil.TempDir("", "webhook")
+			Expect(err).ShouldNot(HaveOccurred())
+			dir = d
+			name = filepath.Join(dir, "webhooks.log")
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		open := func() webhook.Store {
+			s, err := webhook.NewFileStore(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			return s
+		}
+
+		behavesLikeAStore(open)
+
+		reopen := func(s webhook.Store) webhook.Store {
+			Expect(s.(io.Closer).Close()).To(Succeed())
+			return open()
+		}
+
+		It("should keep subscriptions and deliveries once reopened", func() {
+			s := open()
+			Expect(s.Create(ctx, givenSubscription("sub-1", "org", "http://a", now))).To(Succeed())
+			Expect(s.Create(ctx, givenSubscription("sub-2", "org", "http://b", now))).To(Succeed())
+			Expect(s.Enqueue(ctx, []webhook.Delivery{
+				givenDelivery("d-1", "sub-1", 1, now),
+				givenDelivery("d-2", "sub-1", 2, now),
+				givenDelivery("d-3", "sub-2", 2, now),
+			})).To(Succeed())
+			retry := now.Add(time.Minute)
+			Expect(s.Attempted(ctx, "d-1", webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}, 1)).To(Succeed())
+			Expect(s.Attempted(ctx, "d-2", webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 500}, Status: webhook.DeliveryPending, NextAttemptAt: &retry}, 1)).To(Succeed())
+			Expect(s.Delete(ctx, "sub-2")).To(Succeed())
+			sub, err := s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			deliveries, err := s.Deliveries(ctx, "sub-1", 10)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			s = reopen(s)
+			Expect(s.Get(ctx, "sub-1")).To(Equal(sub))
+			Expect(sub.Enabled).To(BeFalse())
+			Expect(s.Deliveries(ctx, "sub-1", 10)).To(Equal(deliveries))
+			_, err = s.Get(ctx, "sub-2")
+			Expect(err).To(Equal(webhook.ErrNotFound))
+
+			Expect(s.Enable(ctx, "sub-1")).To(Succeed())
+			s = reopen(s)
+			claimed, err := s.Claim(ctx, retry, retry.Add(time.Minute), 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(claimed).To(HaveLen(1))
+			Expect(claimed[0].Id).To(Equal("d-2"))
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+
+		It("should drop a line torn by a crash and keep the ones before it", func() {
+			s := open()
+			Expect(s.Create(ctx, givenSubscription("sub-1", "org", "http://a", now))).To(Succeed())
+			Expect(s.(io.Closer).Close()).To(Succeed())
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0600)
+			Expect(err).ShouldNot(HaveOccurred())
+			_, err = f.WriteString(`{"op":"enq`)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			s = open()
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("d-1", "sub-1", 1, now)})).To(Succeed())
+			s = reopen(s)
+			Expect(s.Deliveries(ctx, "sub-1", 10)).To(HaveLen(1))
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+
+		It("should write the log again with only what is kept", func() {
+			s := open()
+			Expect(s.Create(ctx, givenSubscription("sub-1", "org", "http://a", now))).To(Succeed())
+			succeeded := webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}
+			for i := 1; i <= 1000; i++ {
+				id := fmt.Sprintf("d-%d", i)
+				Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery(id, "sub-1", int64(i), now)})).To(Succeed())
+				Expect(s.Attempted(ctx, id, succeeded, 5)).To(Succeed())
+			}
+			info, err := os.Stat(name)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<", 100*1000))
+
+			s = reopen(s)
+			deliveries, err := s.Deliveries(ctx, "sub-1", 1000)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(deliveries).To(HaveLen(100))
+			Expect(deliveries[0].Id).To(Equal("d-1000"))
+			Expect(s.Enqueue(ctx, []webhook.Delivery{givenDelivery("again", "sub-1", 3, now)})).To(Succeed())
+			Expect(s.Deliveries(ctx, "sub-1", 1000)).To(HaveLen(100))
+			Expect(s.(io.Closer).Close()).To(Succeed())
+		})
+	})
+
+	Describe("Postgres store", func() {
+		var (
+			s      webhook.Store
+			dbMock sqlmock.Sqlmock
+		)
+
+		BeforeEach(func() {
+			db, mock, err := sqlmock.New()
+			Expect(err).ShouldNot(HaveOccurred())
+			s = webhook.NewPostgresStore(db)
+			dbMock = mock
+		})
+
+		AfterEach(func() {
+			Expect(dbMock.ExpectationsWereMet()).ShouldNot(HaveOccurred())
+		})
+
+		It("should create a subscription", func() {
+			sub := givenSubscription("sub-1", "org", "http://a", now)
+			sub.Events = []string{"payment.created"}
+			dbMock.ExpectExec("INSERT INTO webhook_subscriptions\\(id, organisation_id, url, events, secret, enabled, created_at\\) VALUES\\(\\$1, \\$2, \\$3, \\$4, \\$5, \\$6, \\$7\\);").
+				WithArgs("sub-1", "org", "http://a", pq.Array([]string{"payment.created"}), "secret", true, now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			Expect(s.Create(ctx, sub)).To(Succeed())
+		})
+
+		It("should get a subscription", func() {
+			dbMock.ExpectQuery("SELECT id, organisation_id, url, events, secret, enabled, failures, disabled_at, created_at FROM webhook_subscriptions WHERE id = \\$1;").
+				WithArgs("sub-1").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "organisation_id", "url", "events", "secret", "enabled", "failures", "disabled_at", "created_at"}).
+					AddRow("sub-1", "org", "http://a", "{payment.created}", "secret", false, 3, now, now))
+
+			sub, err := s.Get(ctx, "sub-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			expected := givenSubscription("sub-1", "org", "http://a", now)
+			expected.Events, expected.Enabled, expected.Failures, expected.DisabledAt = []string{"payment.created"}, false, 3, &now
+			Expect(sub).To(Equal(expected))
+		})
+
+		It("should return not found for an unknown subscription", func() {
+			dbMock.ExpectQuery("SELECT id").WithArgs("sub-1").WillReturnError(sql.ErrNoRows)
+			dbMock.ExpectExec("UPDATE webhook_subscriptions SET enabled = true, failures = 0, disabled_at = NULL WHERE id = \\$1;").
+				WithArgs("sub-1").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			dbMock.ExpectExec("DELETE FROM webhook_subscriptions WHERE id = \\$1;").
+				WithArgs("sub-1").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			_, err := s.Get(ctx, "sub-1")
+			Expect(err).To(Equal(webhook.ErrNotFound))
+			Expect(s.Enable(ctx, "sub-1")).To(Equal(webhook.ErrNotFound))
+			Expect(s.Delete(ctx, "sub-1")).To(Equal(webhook.ErrNotFound))
+		})
+
+		It("should enqueue deliveries in one transaction skipping ones already there", func() {
+			d := givenDelivery("d-1", "sub-1", 7, now)
+			event, err := json.Marshal(d.Event)
+			Expect(err).ShouldNot(HaveOccurred())
+			dbMock.ExpectBegin()
+			dbMock.ExpectExec("INSERT INTO webhook_deliveries\\(id, subscription_id, event_sequence, event, status, next_attempt_at, created_at\\) VALUES\\(.*\\) ON CONFLICT \\(subscription_id, event_sequence\\) DO NOTHING;").
+				WithArgs("d-1", "sub-1", int64(7), string(event), "pending", pq.NullTime{Time: now, Valid: true}, now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			dbMock.ExpectCommit()
+
+			Expect(s.Enqueue(ctx, []webhook.Delivery{d})).To(Succeed())
+		})
+
+		It("should claim due deliveries others have not locked", func() {
+			event, err := json.Marshal(givenDelivery("d-1", "sub-1", 7, now).Event)
+			Expect(err).ShouldNot(HaveOccurred())
+			until := now.Add(time.Minute)
+			dbMock.ExpectQuery("UPDATE webhook_deliveries SET next_attempt_at = \\$2 WHERE id IN \\(.* FOR UPDATE OF d SKIP LOCKED \\) RETURNING id, subscription_id, event, status, attempts, next_attempt_at, created_at;").
+				WithArgs(now, until, 10).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "subscription_id", "event", "status", "attempts", "next_attempt_at", "created_at"}).
+					AddRow("d-1", "sub-1", event, "pending", []byte(`[{"at":"2018-10-01T11:00:00Z","status_code":500}]`), until, now))
+
+			claimed, err := s.Claim(ctx, now, until, 10)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(claimed).To(HaveLen(1))
+			Expect(claimed[0].Event.Sequence).To(Equal(int64(7)))
+			Expect(claimed[0].Attempts).To(Equal([]webhook.Attempt{{At: now.Add(-time.Hour), StatusCode: 500}}))
+			Expect(claimed[0].NextAttemptAt).To(Equal(&until))
+		})
+
+		It("should record an attempt with its subscription in one transaction", func() {
+			retry := now.Add(time.Minute)
+			dbMock.ExpectBegin()
+			dbMock.ExpectQuery("UPDATE webhook_deliveries SET status = \\$2, attempts = attempts \\|\\| \\$3::jsonb, next_attempt_at = \\$4 WHERE id = \\$1 RETURNING subscription_id;").
+				WithArgs("d-1", "pending", `[{"at":"2018-10-01T12:00:00Z","status_code":500}]`, pq.NullTime{Time: retry, Valid: true}).
+				WillReturnRows(sqlmock.NewRows([]string{"subscription_id"}).AddRow("sub-1"))
+			dbMock.ExpectExec("UPDATE webhook_subscriptions SET failures = CASE WHEN \\$2 THEN 0 ELSE failures \\+ 1 END").
+				WithArgs("sub-1", false, 20, now).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			dbMock.ExpectCommit()
+
+			result := webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 500}, Status: webhook.DeliveryPending, NextAttemptAt: &retry}
+			Expect(s.Attempted(ctx, "d-1", result, 20)).To(Succeed())
+		})
+
+		It("should roll back when the subscription cannot be updated", func() {
+			dbMock.ExpectBegin()
+			dbMock.ExpectQuery("UPDATE webhook_deliveries").
+				WillReturnRows(sqlmock.NewRows([]string{"subscription_id"}).AddRow("sub-1"))
+			dbMock.ExpectExec("UPDATE webhook_subscriptions").
+				WillReturnError(sql.ErrConnDone)
+			dbMock.ExpectRollback()
+
+			result := webhook.Result{Attempt: webhook.Attempt{At: now, StatusCode: 200}, Status: webhook.DeliverySucceeded}
+			Expect(s.Attempted(ctx, "d-1", result, 20)).To(Equal(sql.ErrConnDone))
+		})
+	})
+})
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrInternalTarget is returned for a subscription URL that resolves to an
+// address inside the network the server runs in.
+var ErrInternalTarget = errors.New("webhook: the url points at an internal address")
+
+var internalNetworks = parseNetworks(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata services live here
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// Internal is true for loopback, private, link-local and multicast
+// addresses.
+func Internal(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Targets decides where deliveries may be sent. Subscriptions have to point
+// outside the network the server runs in, otherwise anyone able to subscribe
+// could have the server post signed payments to services only it can reach.
+type Targets struct {
+	// AllowInternal lets subscriptions point at internal addresses, which is
+	// only safe when trying webhooks out locally.
+	AllowInternal bool
+	// LookupIPAddr resolves the host of a URL, net.DefaultResolver does when
+	// it is nil.
+	LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Check resolves the host of the URL and returns ErrInternalTarget when any
+// of its addresses is internal.
+func (t Targets) Check(ctx context.Context, rawURL string) error {
+	if t.AllowInternal {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	lookup := t.LookupIPAddr
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	addrs, err := lookup(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if Internal(addr.IP) {
+			return ErrInternalTarget
+		}
+	}
+	return nil
+}
+
+// Client is the client to send deliveries with. Unless internal targets are
+// allowed it refuses to connect to an internal address, whatever the host
+// resolves to by the time of the delivery and wherever it redirects. It never
+// goes through a proxy, the proxy would be the address checked and not the
+// target behind it.
+func (t Targets) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !t.AllowInternal {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || Internal(ip) {
+				return ErrInternalTarget
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
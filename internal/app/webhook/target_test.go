@@ -0,0 +1,85 @@
+package webhook_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/carlosroman/payments-api/internal/app/webhook"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// lookup resolves the hosts to the addresses given, like the resolver an IP
+// address resolves to itself.
+func lookup(hosts map[string]string) func(context.Context, string) ([]net.IPAddr, error) {
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		if addr, ok := hosts[host]; ok {
+			return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+}
+
+var _ = Describe("Targets", func() {
+
+	DescribeTable("should know the internal addresses",
+		func(addr string, internal bool) {
+			Expect(webhook.Internal(net.ParseIP(addr))).To(Equal(internal))
+		},
+		Entry("loopback", "127.0.0.1", true),
+		Entry("private", "10.1.2.3", true),
+		Entry("private", "172.16.0.1", true),
+		Entry("private", "192.168.0.1", true),
+		Entry("link-local", "169.254.169.254", true),
+		Entry("unspecified", "0.0.0.0", true),
+		Entry("loopback v6", "::1", true),
+		Entry("mapped loopback", "::ffff:127.0.0.1", true),
+		Entry("unique local v6", "fd00::1", true),
+		Entry("link-local v6", "fe80::1", true),
+		Entry("public", "93.184.216.34", false),
+		Entry("public next to a private range", "172.32.0.1", false),
+		Entry("public v6", "2606:2800:220:1:248:1893:25c8:1946", false),
+	)
+
+	Describe("delivering", func() {
+		var receiver *httptest.Server
+
+		BeforeEach(func() {
+			receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+		})
+
+		AfterEach(func() {
+			receiver.Close()
+		})
+
+		It("should refuse to connect to an internal address", func() {
+			client := webhook.Targets{}.Client(time.Second)
+			_, err := client.Post(receiver.URL, "application/json", strings.NewReader("{}"))
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(webhook.ErrInternalTarget.Error()))
+		})
+
+		It("should not go through a proxy, the proxy would be the address checked", func() {
+			client := webhook.Targets{}.Client(time.Second)
+			Expect(client.Transport.(*http.Transport).Proxy).To(BeNil())
+		})
+
+		It("should connect to an internal address when internal targets are allowed", func() {
+			client := webhook.Targets{AllowInternal: true}.Client(time.Second)
+			resp, err := client.Post(receiver.URL, "application/json", strings.NewReader("{}"))
+			Expect(err).ShouldNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		})
+	})
+})